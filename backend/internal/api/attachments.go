@@ -0,0 +1,760 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/imaging"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+	"github.com/jadefox10200/missiv/backend/internal/storage"
+)
+
+// defaultDeskQuota is how many bytes of attachments a desk may upload in total
+const defaultDeskQuota = 100 * 1024 * 1024 // 100MB
+
+// uploadType describes a content type uploads may declare
+type uploadType struct {
+	contentType string // Type the attachment is recorded as
+	sniffed     string // Type http.DetectContentType must find in the content
+}
+
+// uploadTypes are the content types uploads may declare
+var uploadTypes = map[string]uploadType{
+	"image/jpeg":      {"image/jpeg", "image/jpeg"},
+	"image/jpg":       {"image/jpeg", "image/jpeg"},
+	"image/png":       {"image/png", "image/png"},
+	"image/gif":       {"image/gif", "image/gif"},
+	"image/webp":      {"image/webp", "image/webp"},
+	"application/pdf": {"application/pdf", "application/pdf"},
+	"text/plain":      {"text/plain", "text/plain"},
+	"text/csv":        {"text/csv", "text/plain"},
+	"text/markdown":   {"text/markdown", "text/plain"},
+}
+
+// ParseDeskQuota parses a per-desk quota in megabytes, defaulting to
+// defaultDeskQuota
+func ParseDeskQuota(mb string) (int64, error) {
+	if mb == "" {
+		return defaultDeskQuota, nil
+	}
+	n, err := strconv.ParseInt(mb, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid desk quota: %q", mb)
+	}
+	return n * 1024 * 1024, nil
+}
+
+// SetDeskQuota changes how many bytes of attachments each desk may upload
+func (s *Server) SetDeskQuota(quota int64) {
+	s.deskQuota = quota
+}
+
+// downloadURLExpiry is how long a presigned download URL stays valid
+const downloadURLExpiry = 5 * time.Minute
+
+// SetBlobStore changes where attachment files are kept
+func (s *Server) SetBlobStore(blobs storage.BlobStore) {
+	s.blobs = blobs
+}
+
+// blobStore returns the store attachment files are kept in, by default
+// files in UPLOAD_DIR
+func (s *Server) blobStore() storage.BlobStore {
+	if s.blobs == nil {
+		return storage.NewFileBlobStore(os.Getenv("UPLOAD_DIR"))
+	}
+	return s.blobs
+}
+
+// fileKeySecretName is the server secret file keys are derived with when
+// none is configured
+const fileKeySecretName = "file-key"
+
+// ParseFileKeySecret validates the secret file keys are derived with. An
+// empty secret leaves the server to generate one and keep it in the store.
+func ParseFileKeySecret(secret string) ([]byte, error) {
+	if secret == "" {
+		return nil, nil
+	}
+	if len(secret) < crypto.MinFileKeySecretSize {
+		return nil, fmt.Errorf("file key secret must be at least %d bytes", crypto.MinFileKeySecretSize)
+	}
+	return []byte(secret), nil
+}
+
+// SetFileKeySecret sets the secret the keys of server-encrypted files are
+// derived with, so identical files share a blob and only servers with the
+// secret can derive their keys. Without one, a secret generated once and
+// kept in the store is used, which anyone who reads the store can use too.
+func (s *Server) SetFileKeySecret(secret []byte) {
+	s.fileKeySecret = secret
+}
+
+// serverURL returns the URL the server is reached at, for links in responses
+func serverURL(c *gin.Context) string {
+	// Note: For production deployments, SERVER_URL should be set to prevent
+	// Host header injection attacks. The Host header fallback is only for development.
+	if url := os.Getenv("SERVER_URL"); url != "" {
+		return url
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	host := c.Request.Host
+	if host == "" {
+		host = "localhost:8080"
+	}
+	return fmt.Sprintf("%s://%s", scheme, host)
+}
+
+// withURL returns a copy of an attachment with its download URL, and those
+// of its thumbnails, filled in
+func withURL(c *gin.Context, att *models.Attachment) *models.Attachment {
+	copied := *att
+	copied.URL = fmt.Sprintf("%s/api/attachments/%s/download", serverURL(c), att.ID)
+	copied.Thumbnails = make([]models.Thumbnail, len(att.Thumbnails))
+	for i, thumb := range att.Thumbnails {
+		thumb.URL = copied.URL + "?thumbnail=" + url.QueryEscape(thumb.Name)
+		copied.Thumbnails[i] = thumb
+	}
+	return &copied
+}
+
+// findThumbnail returns an attachment's thumbnail by name, or nil
+func findThumbnail(att *models.Attachment, name string) *models.Thumbnail {
+	for i := range att.Thumbnails {
+		if att.Thumbnails[i].Name == name {
+			return &att.Thumbnails[i]
+		}
+	}
+	return nil
+}
+
+// lookupUploadType returns the upload type of a declared content type.
+// Failures to report are statusErrors.
+func lookupUploadType(declared string) (uploadType, error) {
+	declared, _, _ = mime.ParseMediaType(declared)
+	kind, ok := uploadTypes[declared]
+	if !ok {
+		return uploadType{}, newStatusError(http.StatusBadRequest, "Invalid file type. Only images, PDF and plain text are allowed")
+	}
+	return kind, nil
+}
+
+// sniffUpload checks a plaintext file's declared content type against what
+// its first bytes show it to be. Failures to report are statusErrors.
+func sniffUpload(declared string, header []byte) (uploadType, error) {
+	kind, err := lookupUploadType(declared)
+	if err != nil {
+		return uploadType{}, err
+	}
+
+	// Note: This validates the file header but does not protect against polyglot files
+	// (files with valid headers but malicious payloads). uploadFile re-encodes
+	// JPEG, PNG and GIF images, which drops anything hidden in them; other
+	// files are only ever handed out encrypted, for the client to decrypt and
+	// check again.
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(header))
+	if sniffed != kind.sniffed {
+		log.Printf("Upload error: Content-Type mismatch - declared: %s, detected: %s", declared, sniffed)
+		return uploadType{}, newStatusError(http.StatusBadRequest, "File type mismatch. The file content does not match the declared type")
+	}
+	return kind, nil
+}
+
+// holdsDeskKey reports whether the server holds a desk's current private
+// key, and so may see the plaintext of what it sends
+func (s *Server) holdsDeskKey(desk *models.Desk) bool {
+	if s.clientKeysOnly() {
+		return false
+	}
+	_, err := s.storage.GetDeskPrivateKey(desk.ID, desk.KeyVersion)
+	return err == nil
+}
+
+// uploadFile stores an uploaded file as a pending attachment of the desk
+// named by desk_id (the active desk by default). Files are only ever stored
+// encrypted, in the layout of crypto.NewFileEncrypter:
+//
+//   - With the form field encrypted=true the upload is already encrypted by
+//     the client, which keeps the file key and declares the plaintext type in
+//     content_type. The server cannot check the content; that is up to the
+//     client.
+//   - Otherwise the upload is plaintext, which only desks whose keys the
+//     server holds may send. The server checks its type, encrypts it under a
+//     new file key and returns the key once in key, and in url's fragment,
+//     without keeping it. JPEG, PNG and GIF images are first re-encoded
+//     without their metadata, within the limits of the imaging package, and
+//     get thumbnails encrypted under the same key.
+//
+// The key travels to recipients inside the sealed miv body, typically as
+// the fragment of the download URL the editor embeds.
+func (s *Server) uploadFile(c *gin.Context) {
+	desk, ok := s.authorizeDesk(c, requestDeskID(c))
+	if !ok {
+		return
+	}
+
+	file, err := c.FormFile("upload")
+	if err != nil {
+		log.Printf("Upload error: No file in request - %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
+		return
+	}
+	clientEncrypted := c.PostForm("encrypted") == "true"
+	if !clientEncrypted && !s.holdsDeskKey(desk) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This desk holds its own keys; encrypt the file before uploading it with encrypted=true"})
+		return
+	}
+
+	stored := file.Size
+	if !clientEncrypted {
+		stored = crypto.EncryptedFileSize(file.Size)
+	}
+	if stored > crypto.EncryptedFileSize(maxFileSize) {
+		log.Printf("Upload error: File too large - %d bytes (max: %d)", file.Size, maxFileSize)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File too large. Maximum size is 10MB"})
+		return
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		log.Printf("Upload error: Failed to open file - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer src.Close()
+
+	// Read the first 512 bytes for content type validation
+	header := make([]byte, 512)
+	n, err := io.ReadFull(src, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		log.Printf("Upload error: Failed to read file header - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file header"})
+		return
+	}
+	header = header[:n]
+
+	var kind uploadType
+	if clientEncrypted {
+		kind, err = lookupUploadType(c.PostForm("content_type"))
+		if err == nil && crypto.ValidateEncryptedFile(header, file.Size) != nil {
+			err = newStatusError(http.StatusBadRequest, "File is not an encrypted attachment")
+		}
+	} else {
+		kind, err = sniffUpload(file.Header.Get("Content-Type"), header)
+	}
+	if err != nil {
+		respondError(c, err, "Failed to read file header")
+		return
+	}
+
+	var img *imaging.Result
+	if !clientEncrypted && imaging.Supported(kind.contentType) {
+		img, err = reencodeImage(io.MultiReader(bytes.NewReader(header), src), kind.contentType)
+		if err != nil {
+			respondError(c, err, "Failed to process image")
+			return
+		}
+		stored = crypto.EncryptedFileSize(int64(len(img.Data)))
+	}
+
+	// Thumbnails count against the quota along with the file
+	charged := stored
+	if img != nil {
+		for _, thumb := range img.Thumbnails {
+			charged += crypto.EncryptedFileSize(int64(len(thumb.Data)))
+		}
+	}
+	quotaExceeded := gin.H{"error": fmt.Sprintf("Desk attachment quota of %d bytes exceeded", s.deskQuota)}
+
+	// Turn away uploads that are already over before storing anything; the
+	// store checks again as it saves the attachment, which is what holds
+	// against concurrent uploads
+	used, err := s.storage.DeskAttachmentUsage(desk.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check attachment quota"})
+		return
+	}
+	if used+charged > s.deskQuota {
+		c.JSON(http.StatusRequestEntityTooLarge, quotaExceeded)
+		return
+	}
+
+	// Files are stored under the SHA-256 of their ciphertext, so the same
+	// file uploaded again shares its blob; the sanitized original name is
+	// only ever used in the download's Content-Disposition
+	att := &models.Attachment{
+		DeskID:      desk.ID,
+		Filename:    sanitizeFilename(file.Filename),
+		ContentType: kind.contentType,
+		Size:        stored,
+	}
+	var fileKey string
+	if clientEncrypted {
+		att.StorageKey, err = s.storeBlob(stored, func(w io.Writer) error {
+			if _, err := src.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			_, err := io.Copy(w, src)
+			return err
+		})
+	} else {
+		plaintext := io.ReadSeeker(src)
+		if img != nil {
+			plaintext = bytes.NewReader(img.Data)
+		}
+		var digest [sha256.Size]byte
+		var key [crypto.FileKeySize]byte
+		digest, err = readDigest(plaintext)
+		if err == nil {
+			key, err = s.fileKey(digest)
+		}
+		if err == nil {
+			fileKey = crypto.FileKeyToString(key)
+			att.StorageKey, err = s.storeEncrypted(plaintext, digest, key, stored)
+		}
+		if err == nil && img != nil {
+			att.Width, att.Height = img.Width, img.Height
+			for _, thumb := range img.Thumbnails {
+				saved := models.Thumbnail{
+					Name:        thumb.Name,
+					ContentType: thumb.ContentType,
+					Width:       thumb.Width,
+					Height:      thumb.Height,
+					Size:        crypto.EncryptedFileSize(int64(len(thumb.Data))),
+				}
+				// Thumbnails share the file's key, so only its holders can
+				// read them
+				saved.StorageKey, err = s.storeEncrypted(bytes.NewReader(thumb.Data), sha256.Sum256(thumb.Data), key, saved.Size)
+				if err != nil {
+					break
+				}
+				att.Thumbnails = append(att.Thumbnails, saved)
+			}
+		}
+	}
+	att.Checksum = att.StorageKey
+	if errors.Is(err, storage.ErrBlobBusy) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "The file is being cleaned up; please upload it again"})
+		return
+	}
+	if err != nil {
+		log.Printf("Upload error: Failed to save file - %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+
+	// Blobs left behind by a failure here are unreferenced, and the blob
+	// collector removes them once their grace period is over
+	if err := s.storage.CreateAttachment(att, s.deskQuota); err != nil {
+		if errors.Is(err, storage.ErrBlobBusy) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "The file is being cleaned up; please upload it again"})
+			return
+		}
+		if errors.Is(err, storage.ErrQuotaExceeded) {
+			c.JSON(http.StatusRequestEntityTooLarge, quotaExceeded)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save attachment"})
+		return
+	}
+
+	log.Printf("File uploaded successfully: %s (size: %d bytes, type: %s, thumbnails: %d)", att.StorageKey, stored, kind.contentType, len(att.Thumbnails))
+	response := withURL(c, att)
+	if fileKey != "" {
+		response.Key = fileKey
+		response.URL += "#key=" + fileKey
+		for i := range response.Thumbnails {
+			response.Thumbnails[i].URL += "#key=" + fileKey
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// reencodeImage reads a plaintext image and re-encodes it with its
+// thumbnails. Failures to report are statusErrors.
+func reencodeImage(r io.Reader, contentType string) (*imaging.Result, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	img, err := imaging.Process(data, contentType)
+	switch {
+	case errors.Is(err, imaging.ErrTooLarge):
+		return nil, newStatusError(http.StatusBadRequest, "Image too large. Images may be at most %d pixels on a side and %d megapixels in all",
+			imaging.MaxDimension, imaging.MaxPixels/1000000)
+	case errors.Is(err, imaging.ErrInvalid):
+		log.Printf("Upload error: Image does not decode - %v", err)
+		return nil, newStatusError(http.StatusBadRequest, "Image could not be read. The file may be damaged")
+	case err != nil:
+		return nil, err
+	}
+	return img, nil
+}
+
+// fileKey returns the key a plaintext with digest is encrypted under,
+// derived from it with the configured file key secret or, without one, the
+// one kept in the store, so identical files get the same key on every
+// server
+func (s *Server) fileKey(digest [sha256.Size]byte) ([crypto.FileKeySize]byte, error) {
+	secret := s.fileKeySecret
+	if len(secret) == 0 {
+		var err error
+		secret, err = s.storage.ServerSecret(fileKeySecretName, crypto.MinFileKeySecretSize)
+		if err != nil {
+			return [crypto.FileKeySize]byte{}, err
+		}
+	}
+	return crypto.ConvergentFileKey(secret, digest)
+}
+
+// storeEncrypted encrypts plaintext under key, with nonces derived from
+// its digest, into a content-addressed blob that takes size bytes, and
+// returns the blob's key
+func (s *Server) storeEncrypted(plaintext io.ReadSeeker, digest [sha256.Size]byte, key [crypto.FileKeySize]byte, size int64) (string, error) {
+	return s.storeBlob(size, func(w io.Writer) error {
+		if _, err := plaintext.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		enc, err := crypto.NewConvergentFileEncrypter(w, key, digest)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(enc, plaintext); err != nil {
+			return err
+		}
+		return enc.Close()
+	})
+}
+
+// readDigest returns the SHA-256 of everything r holds from its start
+func readDigest(r io.ReadSeeker) ([sha256.Size]byte, error) {
+	var digest [sha256.Size]byte
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return digest, err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return digest, err
+	}
+	copy(digest[:], hash.Sum(nil))
+	return digest, nil
+}
+
+// storeBlob stores the size bytes write produces under their hex SHA-256,
+// unless a blob already holds them, and returns that key. write is called
+// once to hash the bytes and again to store them, and must produce the
+// same bytes both times. The blob is held, not referenced: the attachment
+// that uses it adds the reference.
+func (s *Server) storeBlob(size int64, write func(w io.Writer) error) (string, error) {
+	hash := sha256.New()
+	if err := write(hash); err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(hash.Sum(nil))
+
+	stored, err := s.storage.HoldBlob(key, size)
+	if err != nil {
+		return "", err
+	}
+	if stored {
+		return key, nil
+	}
+	checksum, err := s.saveUpload(key, size, write)
+	if err != nil {
+		return "", err
+	}
+	if checksum != key {
+		return "", fmt.Errorf("blob %s changed while it was stored", key)
+	}
+	return key, s.storage.MarkBlobStored(key)
+}
+
+// saveUpload stores the size bytes write produces in the blob store under
+// storageKey and returns their hex SHA-256. The bytes are streamed to the
+// store as write produces them.
+func (s *Server) saveUpload(storageKey string, size int64, write func(w io.Writer) error) (string, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(write(pw))
+	}()
+
+	hash := sha256.New()
+	err := s.blobStore().Put(storageKey, io.TeeReader(pr, hash), size)
+	// Unblock write if the store gave up early
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// authorizeAttachment looks up the attachment named in the path and checks
+// that the requesting desk may see it: its uploader while it is pending,
+// and once it is sent the participants of its conversation and of any
+// conversation with a miv that links it. On failure it writes the error
+// response and returns ok=false.
+func (s *Server) authorizeAttachment(c *gin.Context) (*models.Attachment, *models.Desk, bool) {
+	att, err := s.storage.GetAttachment(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+		return nil, nil, false
+	}
+	desk, ok := s.authorizeDesk(c, requestDeskID(c))
+	if !ok {
+		return nil, nil, false
+	}
+
+	if att.MivID == "" {
+		if att.DeskID != desk.ID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Attachment belongs to another desk"})
+			return nil, nil, false
+		}
+		return att, desk, true
+	}
+	visible, err := s.attachmentVisible(att, desk)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check attachment access"})
+		return nil, nil, false
+	}
+	if !visible {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Desk is not a participant in a conversation with this attachment"})
+		return nil, nil, false
+	}
+	return att, desk, true
+}
+
+// attachmentVisible reports whether a desk takes part in the conversation
+// a sent attachment was sent in, or in one with a miv that links it
+func (s *Server) attachmentVisible(att *models.Attachment, desk *models.Desk) (bool, error) {
+	links, err := s.storage.ListAttachmentLinks(att.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, conversationID := range append([]string{att.ConversationID}, links...) {
+		conv, err := s.storage.GetConversation(conversationID)
+		if err != nil {
+			continue
+		}
+		mivs, err := s.storage.GetConversationMivs(conversationID)
+		if err != nil {
+			return false, err
+		}
+		if isConversationParticipant(conv, mivs, desk.ID) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// downloadLink matches the attachment download links a body embeds, such
+// as .../api/attachments/<id>/download#key=<file key>
+var downloadLink = regexp.MustCompile(`/api/attachments/([A-Za-z0-9-]+)/download`)
+
+// bodyLinks returns the attachments a plaintext body links, so a miv holds
+// every file it shows. The server cannot read a client-sealed body, whose
+// client must list its links itself.
+func bodyLinks(body string, clientSealed bool) []string {
+	if clientSealed {
+		return nil
+	}
+	var ids []string
+	for _, match := range downloadLink.FindAllStringSubmatch(body, -1) {
+		ids = append(ids, match[1])
+	}
+	return ids
+}
+
+// withLinks returns ids with each of links it does not list yet appended
+func withLinks(ids []string, links []string) []string {
+	listed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		listed[id] = true
+	}
+	for _, id := range links {
+		if !listed[id] {
+			listed[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// resolveAttachments looks up the attachments a desk sends with a miv:
+// its own pending attachments, which are sent with the miv, and attachments
+// already sent in a conversation the desk takes part in, which the miv
+// links. Failures to report are statusErrors.
+func (s *Server) resolveAttachments(desk *models.Desk, ids []string) ([]*models.Attachment, error) {
+	var attachments []*models.Attachment
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			return nil, newStatusError(http.StatusBadRequest, "Attachment '%s' is listed twice", id)
+		}
+		seen[id] = true
+
+		att, err := s.storage.GetAttachment(id)
+		if err != nil {
+			return nil, newStatusError(http.StatusNotFound, "Attachment '%s' not found", id)
+		}
+		if att.MivID != "" {
+			visible, err := s.attachmentVisible(att, desk)
+			if err != nil {
+				return nil, err
+			}
+			if !visible {
+				return nil, newStatusError(http.StatusForbidden, "Attachment '%s' was sent in a conversation this desk is not part of", id)
+			}
+		} else if att.DeskID != desk.ID {
+			return nil, newStatusError(http.StatusForbidden, "Attachment '%s' belongs to another desk", id)
+		}
+		attachments = append(attachments, att)
+	}
+	return attachments, nil
+}
+
+// listAttachments lists the attachments a desk uploaded, newest first, with
+// its quota
+func (s *Server) listAttachments(c *gin.Context) {
+	desk, ok := s.authorizeDesk(c, c.Param("desk_id"))
+	if !ok {
+		return
+	}
+
+	attachments, err := s.storage.ListAttachments(desk.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list attachments"})
+		return
+	}
+
+	used, err := s.storage.DeskAttachmentUsage(desk.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check attachment quota"})
+		return
+	}
+	listed := make([]*models.Attachment, 0, len(attachments))
+	for _, att := range attachments {
+		listed = append(listed, withURL(c, att))
+	}
+	c.JSON(http.StatusOK, models.ListAttachmentsResponse{
+		Attachments: listed,
+		Total:       len(listed),
+		Used:        used,
+		Quota:       s.deskQuota,
+	})
+}
+
+// getAttachment returns an attachment's details
+func (s *Server) getAttachment(c *gin.Context) {
+	att, _, ok := s.authorizeAttachment(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, withURL(c, att))
+}
+
+// downloadAttachment streams an attachment's encrypted file, or the
+// thumbnail named by the thumbnail query parameter, or redirects to a
+// short-lived presigned URL when the blob store hands them out. The client
+// decrypts the file with the file key from the miv body.
+func (s *Server) downloadAttachment(c *gin.Context) {
+	att, _, ok := s.authorizeAttachment(c)
+	if !ok {
+		return
+	}
+
+	storageKey, size, etag := att.StorageKey, att.Size, att.Checksum
+	if name := c.Query("thumbnail"); name != "" {
+		thumb := findThumbnail(att, name)
+		if thumb == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Thumbnail not found"})
+			return
+		}
+		storageKey, size, etag = thumb.StorageKey, thumb.Size, att.Checksum+"-"+thumb.Name
+	}
+
+	blobs := s.blobStore()
+	if url, err := blobs.DownloadURL(storageKey, downloadURLExpiry); err != nil {
+		log.Printf("Failed to presign attachment %s: %v", att.ID, err)
+	} else if url != "" {
+		c.Header("Cache-Control", "no-store")
+		c.Redirect(http.StatusFound, url)
+		return
+	}
+
+	file, err := blobs.Get(storageKey)
+	if err != nil {
+		log.Printf("Failed to open attachment %s: %v", att.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read attachment"})
+		return
+	}
+	defer file.Close()
+
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": att.Filename}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Cache-Control", "private")
+	c.Header("ETag", `"`+etag+`"`)
+	if seeker, ok := file.(io.ReadSeeker); ok {
+		http.ServeContent(c.Writer, c.Request, att.Filename, att.CreatedAt, seeker)
+		return
+	}
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
+	c.Status(http.StatusOK)
+	if _, err := io.Copy(c.Writer, file); err != nil {
+		log.Printf("Failed to stream attachment %s: %v", att.ID, err)
+	}
+}
+
+// deleteAttachment discards a pending attachment, giving its bytes back to
+// the desk's quota. Sent attachments stay with their miv, and ones a
+// scheduled miv lists stay until it is sent or discarded. The blob
+// collector removes the file once neither an attachment nor a miv link
+// references it.
+func (s *Server) deleteAttachment(c *gin.Context) {
+	att, desk, ok := s.authorizeAttachment(c)
+	if !ok {
+		return
+	}
+	if att.MivID != "" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Attachment has been sent and cannot be deleted"})
+		return
+	}
+	scheduled, err := s.storage.ListScheduledMivs(desk.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete attachment"})
+		return
+	}
+	for _, sched := range scheduled {
+		for _, id := range sched.AttachmentIDs {
+			if id == att.ID {
+				c.JSON(http.StatusConflict, gin.H{"error": "Attachment is listed by a scheduled miv"})
+				return
+			}
+		}
+	}
+
+	if err := s.storage.DeleteAttachment(att.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete attachment"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
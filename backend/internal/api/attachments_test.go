@@ -0,0 +1,484 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+	"github.com/jadefox10200/missiv/backend/internal/storage"
+)
+
+// uploadAttachment uploads a file as a pending attachment of a desk, with
+// any extra form fields
+func uploadAttachment(t *testing.T, server *Server, login models.LoginResponse, deskID, filename, contentType string, data []byte, fields ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for i := 0; i+1 < len(fields); i += 2 {
+		writer.WriteField(fields[i], fields[i+1])
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="upload"; filename="`+filename+`"`)
+	h.Set("Content-Type", contentType)
+	part, err := writer.CreatePart(h)
+	if err != nil {
+		t.Fatalf("Failed to create upload part: %v", err)
+	}
+	part.Write(data)
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/upload?desk_id="+deskID, body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAttachmentAccessControl(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+	carolDesk := f.carol.Account.ActiveDesk
+
+	pdf := []byte("%PDF-1.4\n1 0 obj\n<<>>\nendobj\ntrailer\n<<>>\n%%EOF\n")
+	w := uploadAttachment(t, f.server, f.alice, aliceDesk, "report.pdf", "application/pdf", pdf)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to upload PDF: %d %s", w.Code, w.Body.String())
+	}
+	var att models.Attachment
+	json.Unmarshal(w.Body.Bytes(), &att)
+	if att.ContentType != "application/pdf" || att.Size != crypto.EncryptedFileSize(int64(len(pdf))) || att.Checksum == "" {
+		t.Errorf("Expected the PDF's type, encrypted size and checksum to be recorded, got %+v", att)
+	}
+	if att.Key == "" || !strings.HasSuffix(att.URL, "#key="+att.Key) {
+		t.Fatalf("Expected the file key in the response and the URL fragment, got %+v", att)
+	}
+	key, err := crypto.FileKeyFromString(att.Key)
+	if err != nil {
+		t.Fatalf("Invalid file key: %v", err)
+	}
+	stored, _ := f.server.storage.GetAttachment(att.ID)
+	blob, err := f.server.blobStore().Get(stored.StorageKey)
+	if err != nil {
+		t.Fatalf("Failed to get stored file: %v", err)
+	}
+	raw, _ := io.ReadAll(blob)
+	blob.Close()
+	if bytes.Contains(raw, []byte("%PDF")) {
+		t.Errorf("Expected the file to be stored encrypted")
+	}
+	w = doRequest(t, f.server, http.MethodGet, "/api/attachments/"+att.ID+"?desk_id="+aliceDesk, f.alice.Token, nil)
+	if strings.Contains(w.Body.String(), att.Key) {
+		t.Errorf("Expected the file key not to be kept")
+	}
+
+	// A pending attachment is its uploader's alone
+	w = doRequest(t, f.server, http.MethodGet, "/api/attachments/"+att.ID+"/download?desk_id="+bobDesk, f.bob.Token, nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected a pending attachment to be hidden from other desks, got %d", w.Code)
+	}
+
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+aliceDesk, f.alice.Token,
+		models.ReplyToConversationRequest{Body: "The report", AttachmentIDs: []string{att.ID}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to reply with attachment: %d %s", w.Code, w.Body.String())
+	}
+	var miv models.ConversationMiv
+	json.Unmarshal(w.Body.Bytes(), &miv)
+	if len(miv.Attachments) != 1 || miv.Attachments[0].ID != att.ID {
+		t.Fatalf("Expected the reply to carry the attachment, got %+v", miv.Attachments)
+	}
+
+	// Once sent, participants may download it and nobody else
+	w = doRequest(t, f.server, http.MethodGet, "/api/attachments/"+att.ID+"/download?desk_id="+bobDesk, f.bob.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected a participant to download the attachment, got %d %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("Expected ciphertext to be served as octet-stream, got %q", got)
+	}
+	r, err := crypto.NewFileDecrypter(w.Body, key)
+	if err != nil {
+		t.Fatalf("Failed to open download: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, pdf) {
+		t.Errorf("Expected the download to decrypt to the upload, err %v", err)
+	}
+	w = doRequest(t, f.server, http.MethodGet, "/api/attachments/"+att.ID+"/download?desk_id="+carolDesk, f.carol.Token, nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected a non-participant to be forbidden, got %d", w.Code)
+	}
+
+	// A sent attachment cannot be deleted, and a later miv that shows it
+	// again links it; a plaintext body's links are picked up unlisted
+	w = doRequest(t, f.server, http.MethodDelete, "/api/attachments/"+att.ID+"?desk_id="+aliceDesk, f.alice.Token, nil)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected deleting a sent attachment to conflict, got %d", w.Code)
+	}
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+bobDesk, f.bob.Token,
+		models.ReplyToConversationRequest{Body: `Quoting <a href="/api/attachments/` + att.ID + `/download#key=` + att.Key + `">the report</a>`})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to reply linking the attachment: %d %s", w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &miv)
+	if len(miv.Attachments) != 1 || miv.Attachments[0].ID != att.ID {
+		t.Errorf("Expected the reply to link the attachment, got %+v", miv.Attachments)
+	}
+	stored, _ = f.server.storage.GetAttachment(att.ID)
+	if blob, _ := f.server.storage.GetBlob(stored.StorageKey); blob == nil || blob.Refs != 2 {
+		t.Errorf("Expected the link to reference the blob, got %+v", blob)
+	}
+
+	// Linking it into a conversation with carol lets her download it, but
+	// carol cannot link what she was never sent
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token,
+		models.CreateConversationRequest{To: carolDesk, Subject: "Forwarded", Body: "See attached", AttachmentIDs: []string{att.ID}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to forward the attachment: %d %s", w.Code, w.Body.String())
+	}
+	w = doRequest(t, f.server, http.MethodGet, "/api/attachments/"+att.ID+"/download?desk_id="+carolDesk, f.carol.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected a participant of a linking conversation to download the attachment, got %d", w.Code)
+	}
+	other := uploadAttachment(t, f.server, f.alice, aliceDesk, "other.pdf", "application/pdf", append(pdf, '\n'))
+	var otherAtt models.Attachment
+	json.Unmarshal(other.Body.Bytes(), &otherAtt)
+	doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+aliceDesk, f.alice.Token,
+		models.ReplyToConversationRequest{Body: "Another", AttachmentIDs: []string{otherAtt.ID}})
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations?desk_id="+carolDesk, f.carol.Token,
+		models.CreateConversationRequest{To: aliceDesk, Subject: "Mine now", Body: "Look", AttachmentIDs: []string{otherAtt.ID}})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected linking an attachment from another conversation to be forbidden, got %d", w.Code)
+	}
+}
+
+func TestAttachmentValidationAndQuota(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	f.server.SetDeskQuota(100)
+
+	w := uploadAttachment(t, f.server, f.alice, aliceDesk, "fake.pdf", "application/pdf", []byte("just some text"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a mismatched content type to be rejected, got %d", w.Code)
+	}
+	w = uploadAttachment(t, f.server, f.alice, aliceDesk, "page.html", "text/html", []byte("<html></html>"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unsupported content type to be rejected, got %d", w.Code)
+	}
+
+	note := bytes.Repeat([]byte("notes "), 8)
+	w = uploadAttachment(t, f.server, f.alice, aliceDesk, "notes.txt", "text/plain", note)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to upload text: %d %s", w.Code, w.Body.String())
+	}
+	var att models.Attachment
+	json.Unmarshal(w.Body.Bytes(), &att)
+
+	w = uploadAttachment(t, f.server, f.alice, aliceDesk, "more.txt", "text/plain", note)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected the quota to be enforced, got %d", w.Code)
+	}
+
+	// Deleting a pending attachment gives its bytes back
+	w = doRequest(t, f.server, http.MethodDelete, "/api/attachments/"+att.ID+"?desk_id="+aliceDesk, f.alice.Token, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Failed to delete attachment: %d %s", w.Code, w.Body.String())
+	}
+	w = uploadAttachment(t, f.server, f.alice, aliceDesk, "more.txt", "text/plain", note)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the freed quota to allow an upload, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestClientEncryptedAttachments(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	server := NewServer()
+	login, _ := registerClientKeyedAccount(t, server, "dana")
+	deskID := login.Account.ActiveDesk
+
+	// The server never sees the plaintext of a client-keyed desk
+	w := uploadAttachment(t, server, login, deskID, "notes.txt", "text/plain", []byte("plain notes"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a plaintext upload from a client-keyed desk to be rejected, got %d", w.Code)
+	}
+
+	key, _ := crypto.GenerateFileKey()
+	var sealed bytes.Buffer
+	enc, _ := crypto.NewFileEncrypter(&sealed, key)
+	enc.Write([]byte("plain notes"))
+	enc.Close()
+
+	w = uploadAttachment(t, server, login, deskID, "notes.txt", "application/octet-stream", []byte("not encrypted"),
+		"encrypted", "true", "content_type", "text/plain")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an upload that is not an encrypted file to be rejected, got %d", w.Code)
+	}
+	w = uploadAttachment(t, server, login, deskID, "notes.txt", "application/octet-stream", sealed.Bytes(),
+		"encrypted", "true", "content_type", "text/plain")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to upload encrypted file: %d %s", w.Code, w.Body.String())
+	}
+	var att models.Attachment
+	json.Unmarshal(w.Body.Bytes(), &att)
+	if att.Key != "" || att.ContentType != "text/plain" || att.Size != int64(sealed.Len()) {
+		t.Errorf("Expected the encrypted upload to be recorded as declared without a key, got %+v", att)
+	}
+
+	w = doRequest(t, server, http.MethodGet, "/api/attachments/"+att.ID+"/download?desk_id="+deskID, login.Token, nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), sealed.Bytes()) {
+		t.Errorf("Expected the ciphertext back as uploaded, got %d", w.Code)
+	}
+}
+
+// presigningBlobs is a file blob store that hands out download URLs, as an
+// S3 store with presigning does
+type presigningBlobs struct {
+	*storage.FileBlobStore
+}
+
+func (p presigningBlobs) DownloadURL(key string, expires time.Duration) (string, error) {
+	return "https://blobs.example.com/" + key + "?expires=" + expires.String(), nil
+}
+
+func TestAttachmentDownloadRedirectsToPresignedURL(t *testing.T) {
+	f := newPolicyFixture(t)
+	f.server.SetBlobStore(presigningBlobs{storage.NewFileBlobStore(t.TempDir())})
+	aliceDesk := f.alice.Account.ActiveDesk
+
+	w := uploadAttachment(t, f.server, f.alice, aliceDesk, "notes.txt", "text/plain", []byte("some notes"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to upload: %d %s", w.Code, w.Body.String())
+	}
+	var att models.Attachment
+	json.Unmarshal(w.Body.Bytes(), &att)
+
+	// Authorization still happens before the redirect
+	w = doRequest(t, f.server, http.MethodGet, "/api/attachments/"+att.ID+"/download?desk_id="+f.bob.Account.ActiveDesk, f.bob.Token, nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected another desk to be forbidden, got %d", w.Code)
+	}
+	w = doRequest(t, f.server, http.MethodGet, "/api/attachments/"+att.ID+"/download?desk_id="+aliceDesk, f.alice.Token, nil)
+	if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), "https://blobs.example.com/") {
+		t.Errorf("Expected a redirect to the presigned URL, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestIdenticalUploadsShareABlob(t *testing.T) {
+	f := newPolicyFixture(t)
+	blobs := storage.NewFileBlobStore(t.TempDir())
+	f.server.SetBlobStore(blobs)
+	f.server.SetBlobGC(BlobGCOn, time.Hour, false)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+	secret := []byte(strings.Repeat("k", crypto.MinFileKeySecretSize))
+
+	upload := func(login models.LoginResponse, deskID string, data []byte) models.Attachment {
+		t.Helper()
+		w := uploadAttachment(t, f.server, login, deskID, "notes.txt", "text/plain", data)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Failed to upload: %d %s", w.Code, w.Body.String())
+		}
+		var att models.Attachment
+		json.Unmarshal(w.Body.Bytes(), &att)
+		stored, _ := f.server.storage.GetAttachment(att.ID)
+		att.StorageKey = stored.StorageKey
+		return att
+	}
+	notes := []byte("Quarterly figures attached to every miv\n")
+
+	// Without a configured secret, the one kept in the store is used, so
+	// identical files are still shared
+	if a, b := upload(f.alice, aliceDesk, notes), upload(f.bob, bobDesk, notes); a.Key != b.Key || a.StorageKey != b.StorageKey {
+		t.Errorf("Expected identical files to share a blob without a configured secret")
+	}
+	if _, err := ParseFileKeySecret("short"); err == nil {
+		t.Errorf("Expected a short file key secret to be refused")
+	}
+
+	f.server.SetFileKeySecret(secret)
+	first := upload(f.alice, aliceDesk, notes)
+	second := upload(f.bob, bobDesk, notes)
+	other := upload(f.alice, aliceDesk, []byte("Something else entirely\n"))
+
+	if first.ID == second.ID || first.StorageKey != second.StorageKey || first.Key != second.Key {
+		t.Fatalf("Expected identical files to share a blob and key, got %+v and %+v", first, second)
+	}
+	if first.Checksum != first.StorageKey || other.StorageKey == first.StorageKey || other.Key == first.Key {
+		t.Errorf("Expected files to be stored under the hash of their contents")
+	}
+	if blob, err := f.server.storage.GetBlob(first.StorageKey); err != nil || blob.Refs != 2 || !blob.Stored {
+		t.Fatalf("Expected the blob to have two references, got %+v (err %v)", blob, err)
+	}
+
+	// Another secret gives other keys, so other servers cannot derive them
+	f.server.SetFileKeySecret([]byte(strings.Repeat("x", crypto.MinFileKeySecretSize)))
+	if third := upload(f.alice, aliceDesk, notes); third.Key == first.Key || third.StorageKey == first.StorageKey {
+		t.Errorf("Expected the file key secret to change the key")
+	}
+	f.server.SetFileKeySecret(secret)
+
+	// The blob outlives the first deletion and goes after the last
+	later := time.Now().Add(2 * time.Hour)
+	doRequest(t, f.server, http.MethodDelete, "/api/attachments/"+first.ID+"?desk_id="+aliceDesk, f.alice.Token, nil)
+	f.server.collectBlobs(later)
+	w := doRequest(t, f.server, http.MethodGet, "/api/attachments/"+second.ID+"/download?desk_id="+bobDesk, f.bob.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the shared blob to survive, got %d %s", w.Code, w.Body.String())
+	}
+	key, _ := crypto.FileKeyFromString(second.Key)
+	r, err := crypto.NewFileDecrypter(w.Body, key)
+	if err != nil {
+		t.Fatalf("Failed to open download: %v", err)
+	}
+	if plain, _ := io.ReadAll(r); !bytes.Equal(plain, notes) {
+		t.Errorf("Expected the download to decrypt to the upload, got %q", plain)
+	}
+
+	doRequest(t, f.server, http.MethodDelete, "/api/attachments/"+second.ID+"?desk_id="+bobDesk, f.bob.Token, nil)
+	f.server.SetBlobGC(BlobGCDryRun, time.Hour, false)
+	f.server.collectBlobs(later)
+	if _, err := blobs.Get(first.StorageKey); err != nil {
+		t.Errorf("Expected a dry run to keep the blob, got %v", err)
+	}
+	f.server.SetBlobGC(BlobGCOn, time.Hour, false)
+	f.server.collectBlobs(later)
+	if _, err := blobs.Get(first.StorageKey); !errors.Is(err, storage.ErrBlobNotFound) {
+		t.Errorf("Expected the unreferenced blob to be collected, got %v", err)
+	}
+	if _, err := blobs.Get(other.StorageKey); err != nil {
+		t.Errorf("Expected a referenced blob to be kept, got %v", err)
+	}
+
+	// The same file can be uploaded again once its blob is gone
+	if again := upload(f.alice, aliceDesk, notes); again.StorageKey != first.StorageKey {
+		t.Errorf("Expected the re-upload to be stored under the same key")
+	}
+	if _, err := blobs.Get(first.StorageKey); err != nil {
+		t.Errorf("Expected the blob to be stored again, got %v", err)
+	}
+}
+
+func TestImageUploadsAreReencodedWithThumbnails(t *testing.T) {
+	f := newPolicyFixture(t)
+	blobs := storage.NewFileBlobStore(t.TempDir())
+	f.server.SetBlobStore(blobs)
+	aliceDesk := f.alice.Account.ActiveDesk
+
+	// A photo with a comment standing in for its metadata
+	var photo bytes.Buffer
+	jpeg.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 1200, 900)), nil)
+	comment := []byte("GPS 51.5007N 0.1246W")
+	data := append([]byte{0xFF, 0xD8, 0xFF, 0xFE, 0, byte(len(comment) + 2)}, comment...)
+	data = append(data, photo.Bytes()[2:]...)
+
+	w := uploadAttachment(t, f.server, f.alice, aliceDesk, "photo.jpg", "image/jpeg", data)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to upload photo: %d %s", w.Code, w.Body.String())
+	}
+	var att models.Attachment
+	json.Unmarshal(w.Body.Bytes(), &att)
+	if att.Width != 1200 || att.Height != 900 || len(att.Thumbnails) != 3 {
+		t.Fatalf("Expected a 1200x900 image with three thumbnails, got %+v", att)
+	}
+	key, _ := crypto.FileKeyFromString(att.Key)
+
+	download := func(path string) []byte {
+		t.Helper()
+		w := doRequest(t, f.server, http.MethodGet, path, f.alice.Token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Failed to download %s: %d %s", path, w.Code, w.Body.String())
+		}
+		r, err := crypto.NewFileDecrypter(w.Body, key)
+		if err != nil {
+			t.Fatalf("Failed to open download: %v", err)
+		}
+		plain, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Failed to decrypt download: %v", err)
+		}
+		return plain
+	}
+
+	original := download("/api/attachments/" + att.ID + "/download?desk_id=" + aliceDesk)
+	if bytes.Contains(original, comment) {
+		t.Errorf("Expected the metadata to be stripped")
+	}
+	for _, thumb := range att.Thumbnails {
+		if !strings.Contains(thumb.URL, "?thumbnail="+thumb.Name+"#key="+att.Key) {
+			t.Errorf("Expected the thumbnail URL to carry its name and the file key, got %q", thumb.URL)
+		}
+		path := "/api/attachments/" + att.ID + "/download?thumbnail=" + thumb.Name + "&desk_id=" + aliceDesk
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(download(path)))
+		if err != nil || cfg.Width != thumb.Width || cfg.Height != thumb.Height {
+			t.Errorf("Expected thumbnail %s to be a %dx%d JPEG, got %+v %v", thumb.Name, thumb.Width, thumb.Height, cfg, err)
+		}
+	}
+	w = doRequest(t, f.server, http.MethodGet, "/api/attachments/"+att.ID+"/download?thumbnail=huge&desk_id="+aliceDesk, f.alice.Token, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown thumbnail to be missing, got %d", w.Code)
+	}
+
+	// Thumbnails count against the desk's quota with the image
+	charged := att.Size
+	for _, thumb := range att.Thumbnails {
+		charged += thumb.Size
+	}
+	w = doRequest(t, f.server, http.MethodGet, "/api/desks/"+aliceDesk+"/attachments", f.alice.Token, nil)
+	var listed models.ListAttachmentsResponse
+	json.Unmarshal(w.Body.Bytes(), &listed)
+	if listed.Used != charged || charged == att.Size {
+		t.Errorf("Expected %d bytes used with thumbnails, got %d", charged, listed.Used)
+	}
+	f.server.SetDeskQuota(charged + att.Size)
+	if w := uploadAttachment(t, f.server, f.alice, aliceDesk, "photo.jpg", "image/jpeg", data); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected the thumbnails of a new upload to count against the quota, got %d", w.Code)
+	}
+	f.server.SetDeskQuota(defaultDeskQuota)
+
+	// Deleting the attachment releases its thumbnails too, and the blob
+	// collector removes them after the grace period
+	stored, _ := f.server.storage.GetAttachment(att.ID)
+	w = doRequest(t, f.server, http.MethodDelete, "/api/attachments/"+att.ID+"?desk_id="+aliceDesk, f.alice.Token, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Failed to delete attachment: %d %s", w.Code, w.Body.String())
+	}
+	f.server.SetBlobGC(BlobGCOn, time.Hour, false)
+	f.server.collectBlobs(time.Now().Add(2 * time.Hour))
+	for _, thumb := range stored.Thumbnails {
+		if _, err := blobs.Get(thumb.StorageKey); !errors.Is(err, storage.ErrBlobNotFound) {
+			t.Errorf("Expected thumbnail %s to be removed, got %v", thumb.Name, err)
+		}
+	}
+
+	// A PNG header claiming 64 megapixels is rejected before decoding
+	ihdr := []byte("IHDR\x00\x00\x1f\x40\x00\x00\x1f\x40\x08\x02\x00\x00\x00")
+	bomb := append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d"), ihdr...)
+	bomb = binary.BigEndian.AppendUint32(bomb, crc32.ChecksumIEEE(ihdr))
+	w = uploadAttachment(t, f.server, f.alice, aliceDesk, "bomb.png", "image/png", bomb)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "too large") {
+		t.Errorf("Expected an oversized image to be rejected, got %d %s", w.Code, w.Body.String())
+	}
+	w = uploadAttachment(t, f.server, f.alice, aliceDesk, "broken.png", "image/png", bomb[:20])
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a damaged image to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// Session constants
+const (
+	sessionTTL = 24 * time.Hour // How long an issued token stays valid
+	ticketTTL  = time.Minute    // How long a ticket stays valid
+
+	accountContextKey = "account" // gin context key for the authenticated account
+	sessionContextKey = "session" // gin context key for the current session
+)
+
+// issueSession generates a token for the account and stores its hash in the
+// session store; the token itself is only ever handed to the client
+func (s *Server) issueSession(accountID string) (string, *models.Session, error) {
+	token, err := crypto.GenerateToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now()
+	session := &models.Session{
+		TokenHash: crypto.HashToken(token),
+		AccountID: accountID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(sessionTTL),
+	}
+
+	// Prune stale sessions so the store does not grow without bound
+	s.storage.DeleteExpiredSessions(now)
+
+	if err := s.storage.CreateSession(session); err != nil {
+		return "", nil, err
+	}
+
+	return token, session, nil
+}
+
+// requireAuth resolves the calling account from the "Authorization: Bearer" header.
+// Requests without a valid, unexpired session are rejected with 401.
+func (s *Server) requireAuth() gin.HandlerFunc {
+	return s.authenticate(false)
+}
+
+// requireAuthOrTicket is requireAuth that also accepts a ticket for the
+// requested path in the ticket query parameter, since browsers cannot set
+// headers on an EventSource or an image embedded in a miv. Session tokens
+// are never accepted in the URL, where logs and proxies would keep them.
+func (s *Server) requireAuthOrTicket() gin.HandlerFunc {
+	return s.authenticate(true)
+}
+
+// authenticate is requireAuth, optionally accepting tickets
+func (s *Server) authenticate(allowTicket bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := bearerToken(c.GetHeader("Authorization"))
+		fromTicket := false
+		if token == "" && allowTicket {
+			token, fromTicket = c.Query("ticket"), true
+		}
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid Authorization header"})
+			return
+		}
+
+		session, err := s.storage.GetSession(crypto.HashToken(token))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid session"})
+			return
+		}
+		// A ticket opens only the path it was issued for, and only as a ticket
+		if fromTicket != (session.Scope != "") || (fromTicket && session.Scope != c.Request.URL.Path) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid session"})
+			return
+		}
+
+		if time.Now().After(session.ExpiresAt) {
+			s.storage.DeleteSession(session.TokenHash)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Session expired"})
+			return
+		}
+
+		account, err := s.storage.GetAccountByID(session.AccountID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid session"})
+			return
+		}
+
+		c.Set(accountContextKey, account)
+		c.Set(sessionContextKey, session)
+		c.Next()
+	}
+}
+
+// ticketPath matches the paths tickets may be issued for: a desk's event
+// stream and an attachment's download
+var ticketPath = regexp.MustCompile(`^/api/(desks/[A-Za-z0-9-]+/events|attachments/[A-Za-z0-9-]+/download)$`)
+
+// issueTicket hands out a short-lived ticket that opens one event stream or
+// download through the ticket query parameter. Tickets are sessions scoped
+// to that path, so every replica accepts them; they never outlive the
+// session that asked for them.
+func (s *Server) issueTicket(c *gin.Context) {
+	var req models.TicketRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !ticketPath.MatchString(req.Path) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Tickets are only issued for desk event streams and attachment downloads"})
+		return
+	}
+
+	token, err := crypto.GenerateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue ticket"})
+		return
+	}
+	session := currentSession(c)
+	now := time.Now()
+	ticket := &models.Session{
+		TokenHash: crypto.HashToken(token),
+		AccountID: session.AccountID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ticketTTL),
+		Scope:     req.Path,
+	}
+	if ticket.ExpiresAt.After(session.ExpiresAt) {
+		ticket.ExpiresAt = session.ExpiresAt
+	}
+	if err := s.storage.CreateSession(ticket); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue ticket"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, models.TicketResponse{Ticket: token, Path: ticket.Scope, ExpiresAt: ticket.ExpiresAt})
+}
+
+// sensitiveQueryParams are query parameters that carry credentials
+var sensitiveQueryParams = []string{"ticket", "access_token"}
+
+// logFormatter is gin's default request log line without colors, with
+// credentials in the query string redacted
+func logFormatter(param gin.LogFormatterParams) string {
+	path := param.Path
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		query, err := url.ParseQuery(path[i+1:])
+		if err != nil {
+			path = path[:i]
+		} else {
+			for _, name := range sensitiveQueryParams {
+				if query.Has(name) {
+					query.Set(name, "REDACTED")
+				}
+			}
+			path = path[:i+1] + query.Encode()
+		}
+	}
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		path,
+		param.ErrorMessage,
+	)
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header value
+func bearerToken(header string) string {
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(prefix):])
+}
+
+// currentAccount returns the account resolved by requireAuth
+func currentAccount(c *gin.Context) *models.Account {
+	value, exists := c.Get(accountContextKey)
+	if !exists {
+		return nil
+	}
+	account, _ := value.(*models.Account)
+	return account
+}
+
+// currentSession returns the session resolved by requireAuth
+func currentSession(c *gin.Context) *models.Session {
+	value, exists := c.Get(sessionContextKey)
+	if !exists {
+		return nil
+	}
+	session, _ := value.(*models.Session)
+	return session
+}
+
+// requestDeskID returns the desk_id query parameter, falling back to the
+// authenticated account's active desk when it is omitted
+func requestDeskID(c *gin.Context) string {
+	if deskID := c.Query("desk_id"); deskID != "" {
+		return deskID
+	}
+	if account := currentAccount(c); account != nil {
+		return account.ActiveDesk
+	}
+	return ""
+}
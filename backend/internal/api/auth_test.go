@@ -0,0 +1,223 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+func TestRequireAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+	login := registerTestAccount(t, server, "alice")
+
+	// An expired session for the same account
+	expired := &models.Session{
+		TokenHash: crypto.HashToken("expired-token"),
+		AccountID: login.Account.ID,
+		ExpiresAt: time.Now().Add(-time.Minute),
+	}
+	server.storage.CreateSession(expired)
+
+	tests := []struct {
+		name     string
+		header   string
+		expected int
+	}{
+		{"missing header", "", http.StatusUnauthorized},
+		{"wrong scheme", "Basic " + login.Token, http.StatusUnauthorized},
+		{"unknown token", "Bearer not-a-token", http.StatusUnauthorized},
+		{"expired token", "Bearer expired-token", http.StatusUnauthorized},
+		{"valid token", "Bearer " + login.Token, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/desks", nil)
+			if test.header != "" {
+				req.Header.Set("Authorization", test.header)
+			}
+			w := httptest.NewRecorder()
+			server.router.ServeHTTP(w, req)
+
+			if w.Code != test.expected {
+				t.Errorf("Expected status %d, got %d: %s", test.expected, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestListDesksUsesSessionAccount(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+	alice := registerTestAccount(t, server, "alice")
+	bob := registerTestAccount(t, server, "bob")
+
+	// A client-supplied account_id must not override the session's account
+	req := httptest.NewRequest(http.MethodGet, "/api/desks?account_id="+bob.Account.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+alice.Token)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	var desks []*models.Desk
+	if err := json.Unmarshal(w.Body.Bytes(), &desks); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+
+	if len(desks) != 1 || desks[0].AccountID != alice.Account.ID {
+		t.Errorf("Expected only alice's desk, got %+v", desks)
+	}
+}
+
+func TestLogoutInvalidatesToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+	login := registerTestAccount(t, server, "alice")
+
+	req := httptest.NewRequest(http.MethodPost, "/api/accounts/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/desks", nil)
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d after logout, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestSessionsAreStoredHashed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+	login := registerTestAccount(t, server, "alice")
+
+	if _, err := server.storage.GetSession(login.Token); err == nil {
+		t.Errorf("Expected the token itself not to be stored")
+	}
+	if _, err := server.storage.GetSession(crypto.HashToken(login.Token)); err != nil {
+		t.Errorf("Expected the session to be stored under the token's hash: %v", err)
+	}
+}
+
+func TestRecoverPasswordRevokesSessions(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+	login := registerTestAccount(t, server, "alice")
+
+	w := doRequest(t, server, http.MethodPost, "/api/tickets", login.Token, models.TicketRequest{Path: "/api/desks/" + login.Account.ActiveDesk + "/events"})
+	var ticket models.TicketResponse
+	json.Unmarshal(w.Body.Bytes(), &ticket)
+
+	w = doRequest(t, server, http.MethodPost, "/api/accounts/recover-password", "", models.RecoverPasswordRequest{
+		Username:     "alice",
+		Birthday:     "2000-01-01",
+		FirstPetName: "Rex",
+		MotherMaiden: "Smith",
+		NewPassword:  "new-password456",
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to recover password: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := doRequest(t, server, http.MethodGet, "/api/desks", login.Token, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the old session to be revoked, got %d", w.Code)
+	}
+	if _, err := server.storage.GetSession(crypto.HashToken(ticket.Ticket)); err == nil {
+		t.Errorf("Expected the old session's ticket to be revoked")
+	}
+}
+
+func TestTickets(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	server := NewServer()
+	login := registerTestAccount(t, server, "alice")
+	deskID := login.Account.ActiveDesk
+
+	w := uploadAttachment(t, server, login, deskID, "notes.txt", "text/plain", []byte("Minutes of the meeting\n"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to upload: %d %s", w.Code, w.Body.String())
+	}
+	var att models.Attachment
+	json.Unmarshal(w.Body.Bytes(), &att)
+	download := "/api/attachments/" + att.ID + "/download"
+
+	w = doRequest(t, server, http.MethodPost, "/api/tickets", login.Token, models.TicketRequest{Path: download})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to issue ticket: %d %s", w.Code, w.Body.String())
+	}
+	var ticket models.TicketResponse
+	json.Unmarshal(w.Body.Bytes(), &ticket)
+	if ticket.Ticket == "" || ticket.Ticket == login.Token || time.Until(ticket.ExpiresAt) > ticketTTL {
+		t.Fatalf("Expected a short-lived ticket, got %+v", ticket)
+	}
+
+	cases := []struct {
+		name, path, token string
+		want              int
+	}{
+		{"ticket for its path", download + "?ticket=" + ticket.Ticket, "", http.StatusOK},
+		{"session token in the query", download + "?access_token=" + login.Token, "", http.StatusUnauthorized},
+		{"session token as a ticket", download + "?ticket=" + login.Token, "", http.StatusUnauthorized},
+		{"ticket for another path", "/api/desks/" + deskID + "/events?ticket=" + ticket.Ticket, "", http.StatusUnauthorized},
+		{"ticket as a bearer token", "/api/desks", ticket.Ticket, http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		if w := doRequest(t, server, http.MethodGet, tc.path, tc.token, nil); w.Code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, w.Code)
+		}
+	}
+
+	if w := doRequest(t, server, http.MethodPost, "/api/tickets", login.Token, models.TicketRequest{Path: "/api/desks"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected tickets for other routes to be refused, got %d", w.Code)
+	}
+
+	server.storage.CreateSession(&models.Session{TokenHash: crypto.HashToken("expired"), AccountID: login.Account.ID, ExpiresAt: time.Now().Add(-time.Second), Scope: download})
+	if w := doRequest(t, server, http.MethodGet, download+"?ticket=expired", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an expired ticket to be refused, got %d", w.Code)
+	}
+
+	line := logFormatter(gin.LogFormatterParams{Method: http.MethodGet, Path: download + "?desk_id=" + deskID + "&ticket=" + ticket.Ticket})
+	if strings.Contains(line, ticket.Ticket) || !strings.Contains(line, "desk_id="+deskID) {
+		t.Errorf("Expected the ticket to be redacted from %q", line)
+	}
+}
+
+func TestIdentityCannotBeReplaced(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+	alice := registerTestAccount(t, server, "alice")
+	bob := registerTestAccount(t, server, "bob")
+
+	w := doRequest(t, server, http.MethodPost, "/api/identity", alice.Token, map[string]string{"name": "Alice"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create identity: %d %s", w.Code, w.Body.String())
+	}
+	var identity models.Identity
+	json.Unmarshal(w.Body.Bytes(), &identity)
+
+	if w := doRequest(t, server, http.MethodPost, "/api/identity", bob.Token, map[string]string{"name": "Bob"}); w.Code != http.StatusConflict {
+		t.Errorf("Expected replacing the identity to be refused, got %d", w.Code)
+	}
+	if got, err := server.storage.GetIdentity(); err != nil || got.PublicKey != identity.PublicKey {
+		t.Errorf("Expected the first identity to stay, got %+v", got)
+	}
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// getBasket lists the conversation mivs in one of a desk's baskets (IN,
+// PENDING, SENT or ARCHIVED), opened for the desk
+func (s *Server) getBasket(c *gin.Context) {
+	desk, ok := s.authorizeDesk(c, c.Param("desk_id"))
+	if !ok {
+		return
+	}
+
+	basket := models.MivState(strings.ToUpper(c.Param("basket")))
+	switch basket {
+	case models.StateIN, models.StatePENDING, models.StateSENT, models.StateARCHIVED:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown basket; use IN, PENDING, SENT or ARCHIVED"})
+		return
+	}
+
+	mivs, err := s.storage.ListBasket(desk.ID, basket)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	opened := s.openMivs(desk, mivs)
+	for _, miv := range opened {
+		miv.State = basket
+	}
+
+	c.JSON(http.StatusOK, models.BasketResponse{
+		Basket: basket,
+		Mivs:   opened,
+		Total:  len(opened),
+	})
+}
+
+// mivBasket returns the basket a miv sits in for a desk, or its stored state
+// when the desk neither sent nor received it
+func mivBasket(miv *models.ConversationMiv, deskID string) models.MivState {
+	if r := mivRecipient(miv, deskID); r != nil {
+		return r.Basket
+	}
+	if crypto.NormalizeDeskID(miv.From) == crypto.NormalizeDeskID(deskID) {
+		return miv.SenderBasket
+	}
+	return miv.State
+}
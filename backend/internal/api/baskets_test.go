@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// getBasketMivs lists a desk's basket and returns the miv IDs in it
+func getBasketMivs(t *testing.T, f *policyFixture, login models.LoginResponse, basket string) []string {
+	t.Helper()
+	w := doRequest(t, f.server, http.MethodGet, "/api/desks/"+login.Account.ActiveDesk+"/baskets/"+basket, login.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to list %s: %d %s", basket, w.Code, w.Body.String())
+	}
+	var resp models.BasketResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	ids := make([]string, 0, len(resp.Mivs))
+	for _, miv := range resp.Mivs {
+		if string(miv.State) != basket {
+			t.Errorf("Expected %s in %s, got %s", miv.ID, basket, miv.State)
+		}
+		ids = append(ids, miv.ID)
+	}
+	return ids
+}
+
+func TestBaskets(t *testing.T) {
+	f := newPolicyFixture(t)
+	bobDesk := f.bob.Account.ActiveDesk
+
+	if ids := getBasketMivs(t, f, f.bob, "IN"); len(ids) != 1 || ids[0] != f.mivID {
+		t.Errorf("Expected the miv in bob's IN, got %v", ids)
+	}
+	if ids := getBasketMivs(t, f, f.alice, "SENT"); len(ids) != 1 || ids[0] != f.mivID {
+		t.Errorf("Expected the miv in alice's SENT, got %v", ids)
+	}
+
+	doRequest(t, f.server, http.MethodPost, "/api/mivs/"+f.mivID+"/read?desk_id="+bobDesk, f.bob.Token, nil)
+	if ids := getBasketMivs(t, f, f.bob, "in"); len(ids) != 0 {
+		t.Errorf("Expected bob's IN to be empty after reading, got %v", ids)
+	}
+	if ids := getBasketMivs(t, f, f.bob, "PENDING"); len(ids) != 1 || ids[0] != f.mivID {
+		t.Errorf("Expected the read miv in bob's PENDING, got %v", ids)
+	}
+
+	// Answering moves the miv out of PENDING and SENT
+	w := doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+bobDesk, f.bob.Token,
+		models.ReplyToConversationRequest{Body: "Hi Alice"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to reply: %d %s", w.Code, w.Body.String())
+	}
+	var reply models.ConversationMiv
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	if ids := getBasketMivs(t, f, f.bob, "PENDING"); len(ids) != 0 {
+		t.Errorf("Expected bob's PENDING to be empty after answering, got %v", ids)
+	}
+	if ids := getBasketMivs(t, f, f.alice, "SENT"); len(ids) != 0 {
+		t.Errorf("Expected alice's SENT to be empty once answered, got %v", ids)
+	}
+	if ids := getBasketMivs(t, f, f.alice, "IN"); len(ids) != 1 || ids[0] != reply.ID {
+		t.Errorf("Expected the reply in alice's IN, got %v", ids)
+	}
+
+	// The conversation view shows the same baskets
+	resp := getConversationState(t, f, f.bob)
+	if resp.Mivs[0].State != "" || resp.Mivs[1].State != models.StateSENT {
+		t.Errorf("Expected bob to see the answered miv out of every basket and the reply in SENT, got %s and %s", resp.Mivs[0].State, resp.Mivs[1].State)
+	}
+
+	w = doRequest(t, f.server, http.MethodGet, "/api/desks/"+bobDesk+"/baskets/OUT", f.bob.Token, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown basket to be rejected, got %d", w.Code)
+	}
+	w = doRequest(t, f.server, http.MethodGet, "/api/desks/"+bobDesk+"/baskets/IN", f.carol.Token, nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected another account's basket to be forbidden, got %d", w.Code)
+	}
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jadefox10200/missiv/backend/internal/storage"
+)
+
+// BlobGCMode selects what the blob collector does with blobs no attachment
+// references
+type BlobGCMode string
+
+const (
+	// BlobGCOn removes them once their grace period is over
+	BlobGCOn BlobGCMode = "on"
+	// BlobGCDryRun only logs what would be removed, so admins can check the
+	// collector against their blob store first
+	BlobGCDryRun BlobGCMode = "dry-run"
+	// BlobGCOff never collects them (default)
+	BlobGCOff BlobGCMode = "off"
+)
+
+const (
+	// blobGCInterval is how often the blob collector runs
+	blobGCInterval = time.Hour
+	// defaultBlobGCGrace is how long unreferenced blobs are kept by default
+	defaultBlobGCGrace = 7 * 24 * time.Hour
+	// minBlobGCGrace keeps uploads in progress, which hold their blobs
+	// without referencing them, well clear of the collector
+	minBlobGCGrace = time.Hour
+)
+
+// ParseBlobGCMode validates a blob collector mode, defaulting to BlobGCOff
+func ParseBlobGCMode(mode string) (BlobGCMode, error) {
+	switch BlobGCMode(mode) {
+	case "", BlobGCOff:
+		return BlobGCOff, nil
+	case BlobGCOn:
+		return BlobGCOn, nil
+	case BlobGCDryRun:
+		return BlobGCDryRun, nil
+	default:
+		return "", fmt.Errorf("unknown blob collector mode: %q", mode)
+	}
+}
+
+// ParseBlobGCGrace parses how long unreferenced blobs are kept, such as
+// "72h", defaulting to defaultBlobGCGrace
+func ParseBlobGCGrace(grace string) (time.Duration, error) {
+	if grace == "" {
+		return defaultBlobGCGrace, nil
+	}
+	d, err := time.ParseDuration(grace)
+	if err != nil || d < minBlobGCGrace {
+		return 0, fmt.Errorf("invalid blob grace period %q: must be a duration of at least %s", grace, minBlobGCGrace)
+	}
+	return d, nil
+}
+
+// SetBlobGC changes what the blob collector started by Run does, how long
+// unreferenced blobs are kept, and whether blobs the database has no record
+// of are removed too. Servers start with it off.
+func (s *Server) SetBlobGC(mode BlobGCMode, grace time.Duration, orphans bool) {
+	s.blobGC = mode
+	s.blobGCGrace = grace
+	s.blobGCOrphans = orphans
+}
+
+// runBlobCollector collects unreferenced blobs every interval
+func (s *Server) runBlobCollector(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.collectBlobs(time.Now())
+		<-ticker.C
+	}
+}
+
+// collectBlobs runs the blob collector once and logs its report. A dry run
+// logs every blob it would remove.
+func (s *Server) collectBlobs(now time.Time) {
+	dryRun := s.blobGC == BlobGCDryRun
+	report, err := storage.CollectBlobs(s.storage, s.blobStore(), storage.BlobCollection{
+		Grace:   s.blobGCGrace,
+		DryRun:  dryRun,
+		Orphans: s.blobGCOrphans,
+	}, now)
+	if err != nil {
+		log.Printf("Blob collection failed: %v", err)
+		if report == nil {
+			return
+		}
+	}
+	for _, err := range report.Errors {
+		log.Printf("Failed to collect blob: %v", err)
+	}
+	if dryRun {
+		for _, blob := range report.Released {
+			log.Printf("Blob collection dry run: would remove %s (%d bytes, unreferenced since %s)", blob.Key, blob.Size, blob.Modified.Format(time.RFC3339))
+		}
+		for _, blob := range report.Orphaned {
+			log.Printf("Blob collection dry run: would remove %s (%d bytes, no record, modified %s)", blob.Key, blob.Size, blob.Modified.Format(time.RFC3339))
+		}
+	}
+	if dryRun || len(report.Released)+len(report.Orphaned)+len(report.Errors) > 0 {
+		log.Printf("%s", report)
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+	"github.com/jadefox10200/missiv/backend/internal/storage"
+)
+
+// changeConversationStates applies change to each desk's own state and
+// returns the states by normalized desk ID, leaving out desks whose state
+// could not be changed
+func (s *Server) changeConversationStates(conversationID string, change storage.ConversationStateChange, deskIDs ...string) map[string]*models.ConversationState {
+	states := make(map[string]*models.ConversationState)
+	for _, deskID := range deskIDs {
+		state, _, err := s.storage.UpdateConversationState(conversationID, deskID, change)
+		if err != nil {
+			log.Printf("Failed to update state of conversation %s for desk %s: %v", conversationID, deskID, err)
+			continue
+		}
+		states[state.DeskID] = state
+	}
+	return states
+}
+
+// deskConversationState returns the desk's own state, or an empty one when
+// it cannot be read
+func (s *Server) deskConversationState(conversationID, deskID string) *models.ConversationState {
+	state, err := s.storage.GetConversationState(conversationID, deskID)
+	if err != nil {
+		return &models.ConversationState{ConversationID: conversationID, DeskID: crypto.NormalizeDeskID(deskID)}
+	}
+	return state
+}
+
+// deskConversation returns a copy of conv as the desk sees it
+func deskConversation(conv *models.Conversation, state *models.ConversationState) *models.Conversation {
+	copied := *conv
+	copied.IsArchived = state.IsArchived
+	return &copied
+}
+
+// updateConversationState archives, mutes or pins a conversation for the
+// requesting desk alone
+func (s *Server) updateConversationState(c *gin.Context) {
+	var req models.UpdateConversationStateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	desk, ok := s.authorizeDesk(c, requestDeskID(c))
+	if !ok {
+		return
+	}
+	conv, _, ok := s.authorizeConversation(c, c.Param("id"), desk)
+	if !ok {
+		return
+	}
+
+	state, _, err := s.storage.UpdateConversationState(conv.ID, desk.ID, storage.ConversationStateChange{
+		IsArchived: req.IsArchived,
+		IsMuted:    req.IsMuted,
+		IsPinned:   req.IsPinned,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update conversation state"})
+		return
+	}
+
+	c.JSON(http.StatusOK, state)
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// getConversationState fetches a conversation as a desk and returns its state
+func getConversationState(t *testing.T, f *policyFixture, login models.LoginResponse) *models.GetConversationResponse {
+	t.Helper()
+	w := doRequest(t, f.server, http.MethodGet, "/api/conversations/"+f.conversationID+"?desk_id="+login.Account.ActiveDesk, login.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to get conversation: %d %s", w.Code, w.Body.String())
+	}
+	var resp models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return &resp
+}
+
+func TestPerDeskConversationState(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+
+	if state := getConversationState(t, f, f.alice).State; state.Basket != models.StateSENT || state.LastReadSeq != 1 {
+		t.Errorf("Expected the sender's conversation in SENT, got %+v", state)
+	}
+	if state := getConversationState(t, f, f.bob).State; state.Basket != models.StateIN || state.LastReadSeq != 0 {
+		t.Errorf("Expected the recipient's conversation in IN, got %+v", state)
+	}
+
+	doRequest(t, f.server, http.MethodPost, "/api/mivs/"+f.mivID+"/read?desk_id="+bobDesk, f.bob.Token, nil)
+	if state := getConversationState(t, f, f.bob).State; state.Basket != models.StatePENDING || state.LastReadSeq != 1 {
+		t.Errorf("Expected a read conversation in PENDING, got %+v", state)
+	}
+
+	// An ACK archives the conversation for its sender only
+	w := doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+bobDesk, f.bob.Token,
+		models.ReplyToConversationRequest{Body: "Thanks", IsAck: true})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to ACK: %d %s", w.Code, w.Body.String())
+	}
+	if resp := getConversationState(t, f, f.bob); !resp.Conversation.IsArchived || resp.State.Basket != "" {
+		t.Errorf("Expected the ACK to archive bob's view, got %+v", resp.State)
+	}
+	if resp := getConversationState(t, f, f.alice); resp.Conversation.IsArchived || resp.State.Basket != models.StateIN {
+		t.Errorf("Expected alice's view to stay open with the ACK in IN, got %+v", resp.State)
+	}
+
+	// Archiving is per desk too
+	doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/archive?desk_id="+aliceDesk, f.alice.Token, nil)
+	if !getConversationState(t, f, f.alice).State.IsArchived {
+		t.Errorf("Expected alice's view to be archived")
+	}
+
+	// A muted desk is neither notified of replies nor brought back from the archive
+	muted := true
+	w = doRequest(t, f.server, http.MethodPut, "/api/conversations/"+f.conversationID+"/state?desk_id="+bobDesk, f.bob.Token,
+		models.UpdateConversationStateRequest{IsMuted: &muted})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to mute: %d %s", w.Code, w.Body.String())
+	}
+	before, _ := f.server.storage.ListNotificationsByDesk(bobDesk, false)
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+aliceDesk, f.alice.Token,
+		models.ReplyToConversationRequest{Body: "One more thing"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to reply: %d %s", w.Code, w.Body.String())
+	}
+	after, _ := f.server.storage.ListNotificationsByDesk(bobDesk, false)
+	if len(after) != len(before) {
+		t.Errorf("Expected no notification for a muted desk")
+	}
+	if resp := getConversationState(t, f, f.bob); !resp.State.IsArchived || resp.State.Basket != models.StateIN {
+		t.Errorf("Expected bob's muted view to stay archived with the reply in IN, got %+v", resp.State)
+	}
+	if getConversationState(t, f, f.alice).State.IsArchived {
+		t.Errorf("Expected replying to bring the conversation back for alice")
+	}
+
+	// Pinned conversations list first
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Subject: "Later", Body: "Newer"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create conversation: %d %s", w.Code, w.Body.String())
+	}
+	pinned := true
+	doRequest(t, f.server, http.MethodPut, "/api/conversations/"+f.conversationID+"/state?desk_id="+aliceDesk, f.alice.Token,
+		models.UpdateConversationStateRequest{IsPinned: &pinned})
+	w = doRequest(t, f.server, http.MethodGet, "/api/conversations?desk_id="+aliceDesk, f.alice.Token, nil)
+	var list models.ListConversationsResponse
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Conversations) != 2 || list.Conversations[0].Conversation.ID != f.conversationID || !list.Conversations[0].State.IsPinned {
+		t.Errorf("Expected the pinned conversation first, got %+v", list.Conversations)
+	}
+}
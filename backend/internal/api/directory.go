@@ -0,0 +1,160 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// Public key directory
+//
+// Any signed-in user can look up a desk's keys to seal and verify mivs.
+// Fingerprints let two people confirm out of band that the server handed out
+// the right keys; a contact can pin the fingerprint that was confirmed, and is
+// flagged once the desk's keys no longer match it.
+
+// deskFingerprint returns the fingerprint of a desk's current keys
+func deskFingerprint(desk *models.Desk) string {
+	return crypto.KeyFingerprint(desk.ID, desk.PublicKey, desk.SigningKey)
+}
+
+// getDeskPublicKey returns a desk's current keys, their fingerprint and the
+// desk's key history
+func (s *Server) getDeskPublicKey(c *gin.Context) {
+	desk, err := s.storage.GetDesk(c.Param("desk_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Desk not found"})
+		return
+	}
+
+	history, err := s.storage.ListDeskKeys(desk.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list desk keys"})
+		return
+	}
+
+	keys := make([]*models.DeskKey, 0, len(history))
+	for _, key := range history {
+		copied := *key
+		copied.Fingerprint = crypto.KeyFingerprint(key.DeskID, key.PublicKey, key.SigningKey)
+		keys = append(keys, &copied)
+	}
+
+	c.JSON(http.StatusOK, models.DeskPublicKeyResponse{
+		DeskID:      desk.ID,
+		PublicKey:   desk.PublicKey,
+		SigningKey:  desk.SigningKey,
+		KeyVersion:  desk.KeyVersion,
+		Fingerprint: deskFingerprint(desk),
+		Keys:        keys,
+	})
+}
+
+// getSafetyNumber returns the safety number between one of the caller's
+// desks and another desk. Both sides see the same number as long as neither
+// desk's keys have changed.
+func (s *Server) getSafetyNumber(c *gin.Context) {
+	desk, ok := s.authorizeDesk(c, c.Param("desk_id"))
+	if !ok {
+		return
+	}
+
+	other, err := s.storage.GetDesk(c.Param("other_desk_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Desk not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, models.SafetyNumberResponse{
+		DeskID:          desk.ID,
+		OtherDeskID:     other.ID,
+		SafetyNumber:    crypto.SafetyNumber(desk.ID, deskFingerprint(desk), other.ID, deskFingerprint(other)),
+		KeyVersion:      desk.KeyVersion,
+		OtherKeyVersion: other.KeyVersion,
+	})
+}
+
+// withKeyStatus returns a copy of the contact with the current fingerprint of
+// the desk it refers to, flagging a pinned fingerprint that no longer matches.
+// Fingerprints already computed are kept in fingerprints, keyed by desk ID.
+func (s *Server) withKeyStatus(contact *models.Contact, fingerprints map[string]string) *models.Contact {
+	copied := *contact
+
+	deskID := crypto.NormalizeDeskID(contact.DeskIDRef)
+	fingerprint, cached := fingerprints[deskID]
+	if !cached {
+		if desk, err := s.storage.GetDesk(deskID); err == nil {
+			fingerprint = deskFingerprint(desk)
+		}
+		fingerprints[deskID] = fingerprint
+	}
+
+	copied.CurrentFingerprint = fingerprint
+	copied.KeyChanged = contact.PinnedFingerprint != "" && contact.PinnedFingerprint != fingerprint
+	return &copied
+}
+
+// pinContactKey pins the fingerprint the user compared out of band. It must
+// match the contact desk's current keys, so a key swapped before the
+// comparison cannot be pinned.
+func (s *Server) pinContactKey(c *gin.Context) {
+	var req models.PinContactKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	contact, err := s.storage.GetContact(c.Param("contact_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Contact not found"})
+		return
+	}
+	if _, ok := s.authorizeDesk(c, contact.DeskID); !ok {
+		return
+	}
+
+	desk, err := s.storage.GetDesk(contact.DeskIDRef)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Contact desk does not exist"})
+		return
+	}
+	if req.Fingerprint != deskFingerprint(desk) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Fingerprint does not match the contact's current keys"})
+		return
+	}
+
+	now := time.Now()
+	contact.PinnedFingerprint = req.Fingerprint
+	contact.PinnedAt = &now
+	if err := s.storage.UpdateContact(contact); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update contact"})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.withKeyStatus(contact, map[string]string{}))
+}
+
+// unpinContactKey clears a contact's pinned fingerprint, e.g. to accept a
+// key change before comparing the new fingerprint
+func (s *Server) unpinContactKey(c *gin.Context) {
+	contact, err := s.storage.GetContact(c.Param("contact_id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Contact not found"})
+		return
+	}
+	if _, ok := s.authorizeDesk(c, contact.DeskID); !ok {
+		return
+	}
+
+	contact.PinnedFingerprint = ""
+	contact.PinnedAt = nil
+	if err := s.storage.UpdateContact(contact); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update contact"})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.withKeyStatus(contact, map[string]string{}))
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+func TestDeskPublicKeyDirectory(t *testing.T) {
+	f := newPolicyFixture(t)
+	bobDesk := f.bob.Account.ActiveDesk
+
+	doRequest(t, f.server, http.MethodPost, "/api/desks/"+bobDesk+"/rotate-key", f.bob.Token, nil)
+
+	w := doRequest(t, f.server, http.MethodGet, "/api/desks/"+bobDesk+"/publickey", f.carol.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var entry models.DeskPublicKeyResponse
+	json.Unmarshal(w.Body.Bytes(), &entry)
+
+	if entry.KeyVersion != 2 || entry.Fingerprint == "" || entry.SigningKey == "" {
+		t.Errorf("Expected current keys at version 2 with a fingerprint, got %+v", entry)
+	}
+	if len(entry.Keys) != 2 || entry.Keys[0].RetiredAt == nil || entry.Keys[1].Fingerprint != entry.Fingerprint {
+		t.Fatalf("Expected retired v1 and current v2 in the history, got %+v", entry.Keys)
+	}
+	if entry.Keys[0].Fingerprint == entry.Fingerprint {
+		t.Errorf("Expected the rotated key to have a new fingerprint")
+	}
+
+	if w := doRequest(t, f.server, http.MethodGet, "/api/desks/5550000000/publickey", f.carol.Token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown desk, got %d", w.Code)
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+
+	safetyNumber := func(login models.LoginResponse, desk, other string) string {
+		w := doRequest(t, f.server, http.MethodGet, "/api/desks/"+desk+"/safety-number/"+other, login.Token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp models.SafetyNumberResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.SafetyNumber
+	}
+
+	fromAlice := safetyNumber(f.alice, aliceDesk, bobDesk)
+	if fromAlice == "" || fromAlice != safetyNumber(f.bob, bobDesk, aliceDesk) {
+		t.Errorf("Expected alice and bob to see the same safety number")
+	}
+
+	if w := doRequest(t, f.server, http.MethodGet, "/api/desks/"+aliceDesk+"/safety-number/"+bobDesk, f.carol.Token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected safety number for a foreign desk to be forbidden, got %d", w.Code)
+	}
+
+	doRequest(t, f.server, http.MethodPost, "/api/desks/"+bobDesk+"/rotate-key", f.bob.Token, nil)
+	if safetyNumber(f.alice, aliceDesk, bobDesk) == fromAlice {
+		t.Errorf("Expected the safety number to change after bob rotates the desk key")
+	}
+}
+
+func TestPinnedContactKeyWarnsOnChange(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+	pinPath := "/api/contacts/" + f.contactID + "/pinned-key"
+
+	w := doRequest(t, f.server, http.MethodGet, "/api/desks/"+bobDesk+"/publickey", f.alice.Token, nil)
+	var entry models.DeskPublicKeyResponse
+	json.Unmarshal(w.Body.Bytes(), &entry)
+
+	if w := doRequest(t, f.server, http.MethodPut, pinPath, f.alice.Token, models.PinContactKeyRequest{Fingerprint: "00000 00000 00000 00000 00000 00000"}); w.Code != http.StatusConflict {
+		t.Errorf("Expected a mismatched fingerprint to conflict, got %d", w.Code)
+	}
+	if w := doRequest(t, f.server, http.MethodPut, pinPath, f.carol.Token, models.PinContactKeyRequest{Fingerprint: entry.Fingerprint}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected pinning a foreign contact to be forbidden, got %d", w.Code)
+	}
+
+	w = doRequest(t, f.server, http.MethodPut, pinPath, f.alice.Token, models.PinContactKeyRequest{Fingerprint: entry.Fingerprint})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected pin to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var contact models.Contact
+	json.Unmarshal(w.Body.Bytes(), &contact)
+	if contact.PinnedFingerprint != entry.Fingerprint || contact.PinnedAt == nil || contact.KeyChanged {
+		t.Errorf("Expected pinned contact without a warning, got %+v", contact)
+	}
+
+	// Bob's key changes; alice's contact list flags it
+	doRequest(t, f.server, http.MethodPost, "/api/desks/"+bobDesk+"/rotate-key", f.bob.Token, nil)
+	w = doRequest(t, f.server, http.MethodGet, "/api/desks/"+aliceDesk+"/contacts", f.alice.Token, nil)
+	var list models.ListContactsResponse
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Contacts) != 1 || !list.Contacts[0].KeyChanged || list.Contacts[0].CurrentFingerprint == entry.Fingerprint {
+		t.Fatalf("Expected the key change to be flagged, got %+v", list.Contacts)
+	}
+
+	// Unpinning accepts the change
+	w = doRequest(t, f.server, http.MethodDelete, pinPath, f.alice.Token, nil)
+	var unpinned models.Contact
+	json.Unmarshal(w.Body.Bytes(), &unpinned)
+	if w.Code != http.StatusOK || unpinned.PinnedFingerprint != "" || unpinned.KeyChanged {
+		t.Errorf("Expected unpinned contact without a warning, got %d %+v", w.Code, unpinned)
+	}
+}
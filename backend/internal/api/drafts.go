@@ -0,0 +1,263 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+	"github.com/jadefox10200/missiv/backend/internal/storage"
+)
+
+// sealDraftBody sets a draft's stored body. A client-sealed body must be a
+// NaCl box sealed to the desk's current key and is stored as received, the
+// way sealMivBody takes client-sealed mivs. A plaintext body is sealed to the
+// desk's own key here, which desks that hold their own keys refuse.
+// Failures to report are statusErrors.
+func (s *Server) sealDraftBody(desk *models.Desk, draft *models.Draft, body string, clientSealed bool, keyVersion int) error {
+	if clientSealed {
+		if keyVersion == 0 {
+			return newStatusError(http.StatusBadRequest, "Missing the key version the draft body is sealed to")
+		}
+		if keyVersion != desk.KeyVersion {
+			return newStatusError(http.StatusConflict, "Key of desk '%s' has been rotated; seal the draft to the current key", desk.ID)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil || len(decoded) < minSealedLength {
+			return newStatusError(http.StatusBadRequest, "Encrypted body must be a base64 NaCl box")
+		}
+		draft.Body = body
+		draft.IsEncrypted = true
+		draft.KeyVersion = keyVersion
+		return nil
+	}
+
+	sealed, keyVersion, err := s.sealForSelf(desk, body)
+	if errors.Is(err, errClientHeldKeys) {
+		return newStatusError(http.StatusBadRequest, "This desk holds its own keys; seal the draft body and set is_encrypted")
+	}
+	if err != nil {
+		return err
+	}
+	draft.Body = sealed
+	draft.KeyVersion = keyVersion
+	return nil
+}
+
+// openDraft returns a copy of a draft with its body as composed; a sealed
+// body that cannot be opened is left empty. Client-sealed drafts are
+// returned as stored for the client to open.
+func (s *Server) openDraft(draft *models.Draft) *models.Draft {
+	copied := *draft
+	if draft.IsEncrypted {
+		return &copied
+	}
+	copied.KeyVersion = 0
+	if draft.KeyVersion == 0 {
+		return &copied
+	}
+	copied.Body = ""
+	if body, err := s.openForSelf(draft.DeskID, draft.KeyVersion, draft.Body); err == nil {
+		copied.Body = body
+	}
+	return &copied
+}
+
+// authorizeDraft looks up the draft named in the path and checks that the
+// caller owns its desk. On failure it writes the error response and returns
+// ok=false.
+func (s *Server) authorizeDraft(c *gin.Context) (*models.Draft, *models.Desk, bool) {
+	draft, err := s.storage.GetDraft(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Draft not found"})
+		return nil, nil, false
+	}
+	desk, ok := s.authorizeDesk(c, draft.DeskID)
+	if !ok {
+		return nil, nil, false
+	}
+	return draft, desk, true
+}
+
+// draftToSend looks up the draft a new miv is sent from, which must belong
+// to the sending desk, answer the same conversation (empty for a new one)
+// and still be at the version the sender composed. It returns nil when no
+// draft is named. On failure it writes the error response and returns
+// ok=false.
+func (s *Server) draftToSend(c *gin.Context, desk *models.Desk, draftID string, draftVersion int, conversationID string) (*models.Draft, bool) {
+	if draftID == "" {
+		return nil, true
+	}
+	if draftVersion == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "draft_version is required with draft_id"})
+		return nil, false
+	}
+	draft, err := s.storage.GetDraft(draftID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Draft not found"})
+		return nil, false
+	}
+	if draft.DeskID != desk.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Draft belongs to another desk"})
+		return nil, false
+	}
+	if draft.ConversationID != conversationID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Draft belongs to another conversation"})
+		return nil, false
+	}
+	if draft.Version != draftVersion {
+		c.JSON(http.StatusConflict, gin.H{"error": "Draft has changed; fetch the current version and retry"})
+		return nil, false
+	}
+	return draft, true
+}
+
+// discardDraft deletes a draft once the miv composed in it is sent. A draft
+// saved again since it was checked is kept, as it holds newer work.
+func (s *Server) discardDraft(draft *models.Draft) {
+	if draft == nil {
+		return
+	}
+	err := s.storage.DeleteDraft(draft.ID, draft.Version)
+	if errors.Is(err, storage.ErrVersionConflict) {
+		log.Printf("Kept sent draft %s, saved again while sending", draft.ID)
+	} else if err != nil {
+		log.Printf("Failed to delete sent draft %s: %v", draft.ID, err)
+	}
+}
+
+// listDrafts lists a desk's drafts, most recently saved first
+func (s *Server) listDrafts(c *gin.Context) {
+	desk, ok := s.authorizeDesk(c, c.Param("desk_id"))
+	if !ok {
+		return
+	}
+
+	drafts, err := s.storage.ListDrafts(desk.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list drafts"})
+		return
+	}
+
+	opened := make([]*models.Draft, 0, len(drafts))
+	for _, draft := range drafts {
+		opened = append(opened, s.openDraft(draft))
+	}
+	c.JSON(http.StatusOK, models.ListDraftsResponse{
+		Drafts: opened,
+		Total:  len(opened),
+	})
+}
+
+// createDraft saves a new draft, for a reply when it names a conversation
+func (s *Server) createDraft(c *gin.Context) {
+	var req models.CreateDraftRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	desk, ok := s.authorizeDesk(c, c.Param("desk_id"))
+	if !ok {
+		return
+	}
+	if req.ConversationID != "" {
+		if _, _, ok := s.authorizeConversation(c, req.ConversationID, desk); !ok {
+			return
+		}
+		if req.To != "" || req.Cc != "" || req.Subject != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "A reply draft takes its recipients and subject from the conversation"})
+			return
+		}
+	}
+
+	draft := &models.Draft{
+		DeskID:         desk.ID,
+		ConversationID: req.ConversationID,
+		To:             req.To,
+		Cc:             req.Cc,
+		Subject:        req.Subject,
+		IsAck:          req.IsAck,
+		FontFamily:     req.FontFamily,
+		FontSize:       req.FontSize,
+	}
+	if err := s.sealDraftBody(desk, draft, req.Body, req.IsEncrypted, req.KeyVersion); err != nil {
+		respondError(c, err, "Failed to save draft")
+		return
+	}
+	if err := s.storage.CreateDraft(draft); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save draft"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, s.openDraft(draft))
+}
+
+// getDraft returns one draft
+func (s *Server) getDraft(c *gin.Context) {
+	draft, _, ok := s.authorizeDraft(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, s.openDraft(draft))
+}
+
+// updateDraft saves a draft over the version the editor started from
+func (s *Server) updateDraft(c *gin.Context) {
+	var req models.UpdateDraftRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	existing, desk, ok := s.authorizeDraft(c)
+	if !ok {
+		return
+	}
+	if existing.ConversationID != "" && (req.To != "" || req.Cc != "" || req.Subject != "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A reply draft takes its recipients and subject from the conversation"})
+		return
+	}
+
+	draft := &models.Draft{
+		ID:         existing.ID,
+		To:         req.To,
+		Cc:         req.Cc,
+		Subject:    req.Subject,
+		IsAck:      req.IsAck,
+		FontFamily: req.FontFamily,
+		FontSize:   req.FontSize,
+	}
+	if err := s.sealDraftBody(desk, draft, req.Body, req.IsEncrypted, req.KeyVersion); err != nil {
+		respondError(c, err, "Failed to save draft")
+		return
+	}
+	if err := s.storage.UpdateDraft(draft, req.Version); err != nil {
+		if errors.Is(err, storage.ErrVersionConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Draft has changed; fetch the current version and retry"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save draft"})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.openDraft(draft))
+}
+
+// deleteDraft discards a draft
+func (s *Server) deleteDraft(c *gin.Context) {
+	draft, _, ok := s.authorizeDraft(c)
+	if !ok {
+		return
+	}
+
+	if err := s.storage.DeleteDraft(draft.ID, 0); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete draft"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// saveDraft creates a draft on a desk and returns it
+func saveDraft(t *testing.T, f *policyFixture, login models.LoginResponse, req models.CreateDraftRequest) models.Draft {
+	t.Helper()
+	w := doRequest(t, f.server, http.MethodPost, "/api/desks/"+login.Account.ActiveDesk+"/drafts", login.Token, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create draft: %d %s", w.Code, w.Body.String())
+	}
+	var draft models.Draft
+	json.Unmarshal(w.Body.Bytes(), &draft)
+	return draft
+}
+
+func TestDraftAutosave(t *testing.T) {
+	f := newPolicyFixture(t)
+	carolDesk := f.carol.Account.ActiveDesk
+
+	draft := saveDraft(t, f, f.alice, models.CreateDraftRequest{To: carolDesk, Subject: "Plans", Body: "Half"})
+	if draft.Version != 1 || draft.Body != "Half" {
+		t.Fatalf("Expected version 1 with the body as composed, got %+v", draft)
+	}
+	if stored, _ := f.server.storage.GetDraft(draft.ID); stored.Body == "Half" {
+		t.Errorf("Expected the stored body to be sealed")
+	}
+
+	w := doRequest(t, f.server, http.MethodPut, "/api/drafts/"+draft.ID, f.alice.Token,
+		models.UpdateDraftRequest{Version: 1, To: carolDesk, Subject: "Plans", Body: "Whole"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to save draft: %d %s", w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &draft)
+	if draft.Version != 2 || draft.Body != "Whole" {
+		t.Errorf("Expected version 2, got %+v", draft)
+	}
+
+	// A second editor still on version 1 is turned away
+	w = doRequest(t, f.server, http.MethodPut, "/api/drafts/"+draft.ID, f.alice.Token,
+		models.UpdateDraftRequest{Version: 1, Body: "Stale"})
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected a stale save to conflict, got %d", w.Code)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		w = doRequest(t, f.server, method, "/api/drafts/"+draft.ID, f.carol.Token, models.UpdateDraftRequest{Version: 2})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected %s by another account to be forbidden, got %d", method, w.Code)
+		}
+	}
+
+	w = doRequest(t, f.server, http.MethodGet, "/api/desks/"+f.alice.Account.ActiveDesk+"/drafts", f.alice.Token, nil)
+	var list models.ListDraftsResponse
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if list.Total != 1 || list.Drafts[0].Body != "Whole" {
+		t.Errorf("Expected alice's draft in her list, got %+v", list)
+	}
+
+	w = doRequest(t, f.server, http.MethodDelete, "/api/drafts/"+draft.ID, f.alice.Token, nil)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Failed to delete draft: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestClientKeyedDraftsStaySealed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+	alice, keys := registerClientKeyedAccount(t, server, "alice")
+	drafts := "/api/desks/" + alice.Account.ActiveDesk + "/drafts"
+
+	// The server cannot seal for a desk whose keys it lacks, so plaintext
+	// is refused rather than kept readable
+	w := doRequest(t, server, http.MethodPost, drafts, alice.Token, models.CreateDraftRequest{Subject: "Plans", Body: "Half"})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a plaintext draft to be refused, got %d", w.Code)
+	}
+
+	box, _ := crypto.Encrypt([]byte("Half"), keys.PublicKey, keys.PrivateKey)
+	sealed := base64.StdEncoding.EncodeToString(box)
+	for _, req := range []models.CreateDraftRequest{
+		{Body: sealed, IsEncrypted: true},
+		{Body: "Half", IsEncrypted: true, KeyVersion: 1},
+	} {
+		w = doRequest(t, server, http.MethodPost, drafts, alice.Token, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %+v to be refused, got %d", req, w.Code)
+		}
+	}
+	w = doRequest(t, server, http.MethodPost, drafts, alice.Token,
+		models.CreateDraftRequest{Body: sealed, IsEncrypted: true, KeyVersion: 2})
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected a draft sealed to another key version to conflict, got %d", w.Code)
+	}
+
+	w = doRequest(t, server, http.MethodPost, drafts, alice.Token,
+		models.CreateDraftRequest{Subject: "Plans", Body: sealed, IsEncrypted: true, KeyVersion: 1})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create sealed draft: %d %s", w.Code, w.Body.String())
+	}
+	var draft models.Draft
+	json.Unmarshal(w.Body.Bytes(), &draft)
+	if !draft.IsEncrypted || draft.KeyVersion != 1 || draft.Body != sealed {
+		t.Errorf("Expected the draft back as sealed, got %+v", draft)
+	}
+
+	w = doRequest(t, server, http.MethodPut, "/api/drafts/"+draft.ID, alice.Token,
+		models.UpdateDraftRequest{Version: 1, Subject: "Plans", Body: "Whole"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a plaintext save to be refused, got %d", w.Code)
+	}
+	if stored, _ := server.storage.GetDraft(draft.ID); stored.Version != 1 || stored.Body != sealed {
+		t.Errorf("Expected the refused save to leave the draft alone, got %+v", stored)
+	}
+}
+
+func TestDraftPromotion(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+
+	// Reply drafts must be for a conversation the desk is in
+	w := doRequest(t, f.server, http.MethodPost, "/api/desks/"+f.carol.Account.ActiveDesk+"/drafts", f.carol.Token,
+		models.CreateDraftRequest{ConversationID: f.conversationID, Body: "Hi"})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected a reply draft outside the conversation to be forbidden, got %d", w.Code)
+	}
+	w = doRequest(t, f.server, http.MethodPost, "/api/desks/"+bobDesk+"/drafts", f.bob.Token,
+		models.CreateDraftRequest{ConversationID: f.conversationID, Subject: "Other", Body: "Hi"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a reply draft's subject to be rejected, got %d", w.Code)
+	}
+
+	newDraft := saveDraft(t, f, f.alice, models.CreateDraftRequest{To: bobDesk, Subject: "Again", Body: "Second"})
+	replyDraft := saveDraft(t, f, f.bob, models.CreateDraftRequest{ConversationID: f.conversationID, Body: "Hello back"})
+
+	// A draft only promotes into the conversation it was written for
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+aliceDesk, f.alice.Token,
+		models.ReplyToConversationRequest{Body: "Second", DraftID: newDraft.ID, DraftVersion: 1})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a new-conversation draft to be refused for a reply, got %d", w.Code)
+	}
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+aliceDesk, f.alice.Token,
+		models.ReplyToConversationRequest{Body: "Hello back", DraftID: replyDraft.ID, DraftVersion: 1})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected another desk's draft to be refused, got %d", w.Code)
+	}
+
+	// Sending names the version composed, so a stale tab cannot send a
+	// draft that was saved since
+	w = doRequest(t, f.server, http.MethodPut, "/api/drafts/"+newDraft.ID, f.alice.Token,
+		models.UpdateDraftRequest{Version: 1, To: bobDesk, Subject: "Again", Body: "Second, revised"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to save draft: %d %s", w.Code, w.Body.String())
+	}
+	for version, code := range map[int]int{0: http.StatusBadRequest, 1: http.StatusConflict} {
+		w = doRequest(t, f.server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token,
+			models.CreateConversationRequest{To: bobDesk, Subject: "Again", Body: "Second", DraftID: newDraft.ID, DraftVersion: version})
+		if w.Code != code {
+			t.Errorf("Expected sending draft version %d to get %d, got %d", version, code, w.Code)
+		}
+	}
+
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Subject: "Again", Body: "Second, revised", DraftID: newDraft.ID, DraftVersion: 2})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to send draft: %d %s", w.Code, w.Body.String())
+	}
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+bobDesk, f.bob.Token,
+		models.ReplyToConversationRequest{Body: "Hello back", DraftID: replyDraft.ID, DraftVersion: 1})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to send reply draft: %d %s", w.Code, w.Body.String())
+	}
+
+	for _, id := range []string{newDraft.ID, replyDraft.ID} {
+		if _, err := f.server.storage.GetDraft(id); err == nil {
+			t.Errorf("Expected draft %s to be deleted once sent", id)
+		}
+	}
+
+	// A draft saved again while its miv was being sent holds newer work
+	racing := saveDraft(t, f, f.alice, models.CreateDraftRequest{To: bobDesk, Subject: "Racing", Body: "First"})
+	w = doRequest(t, f.server, http.MethodPut, "/api/drafts/"+racing.ID, f.alice.Token,
+		models.UpdateDraftRequest{Version: 1, To: bobDesk, Subject: "Racing", Body: "Newer"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to save draft: %d %s", w.Code, w.Body.String())
+	}
+	f.server.discardDraft(&racing)
+	if _, err := f.server.storage.GetDraft(racing.ID); err != nil {
+		t.Errorf("Expected a draft saved after the send was checked to be kept")
+	}
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// statusError is a failure reported to the client with its own HTTP status.
+// Code that runs outside a request, like the scheduled send dispatcher,
+// keeps the message instead.
+type statusError struct {
+	status  int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// newStatusError returns a statusError with a formatted message
+func newStatusError(status int, format string, args ...interface{}) *statusError {
+	return &statusError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+// respondError writes err as the error response: a statusError with its
+// own status, anything else as 500 with fallback as the message
+func respondError(c *gin.Context, err error, fallback string) {
+	if statusErr, ok := err.(*statusError); ok {
+		c.JSON(statusErr.status, gin.H{"error": statusErr.message})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+}
@@ -0,0 +1,426 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+	"github.com/jadefox10200/missiv/backend/internal/storage"
+)
+
+// Event stream constants
+const (
+	eventSubscriberQueue = 64               // Events buffered per open stream before it is dropped
+	eventHeartbeat       = 25 * time.Second // Keeps idle streams open through proxies
+	eventPollInterval    = time.Second      // How often Run picks up the events of other servers
+	eventBatchSize       = 500              // Events read from the log at a time
+	eventRetention       = time.Hour        // How long events are kept for resuming clients
+	eventPruneInterval   = time.Minute      // How often Run drops events past their retention
+)
+
+// eventHub fans events out to the open streams of each desk. Events are
+// written to the event log in the store rather than handed over directly,
+// and every server reads the log back in order, so a stream gets the
+// events of every server sharing the store. An event's ID is its sequence
+// number in the log; a client resuming with an ID the log no longer holds
+// is told to reload instead of silently missing events.
+type eventHub struct {
+	store     storage.Store
+	mu        sync.Mutex
+	delivered int64 // Highest sequence number fanned out to the streams
+	desks     map[string]map[*eventSubscription]struct{}
+}
+
+// eventSubscription is one open stream. Its channel is closed when the
+// stream falls too far behind; the client then reconnects and resumes.
+type eventSubscription struct {
+	deskID string
+	events chan *models.Event
+}
+
+// newEventHub creates a hub on the store's event log. Streams get the
+// events logged from now on.
+func newEventHub(store storage.Store) *eventHub {
+	h := &eventHub{store: store, desks: make(map[string]map[*eventSubscription]struct{})}
+	if _, latest, err := store.EventSeqRange(); err != nil {
+		log.Printf("Failed to read the event log: %v", err)
+	} else {
+		h.delivered = latest
+	}
+	return h
+}
+
+// publish logs an event for each of the given desks and pushes the log to
+// the open streams. Desk IDs are normalized and deduplicated.
+func (h *eventHub) publish(eventType models.EventType, data interface{}, deskIDs ...string) {
+	var events []*models.Event
+	seen := make(map[string]bool, len(deskIDs))
+	for _, deskID := range deskIDs {
+		deskID = crypto.NormalizeDeskID(deskID)
+		if deskID == "" || seen[deskID] {
+			continue
+		}
+		seen[deskID] = true
+		events = append(events, &models.Event{Type: eventType, DeskID: deskID, Data: data})
+	}
+	if len(events) == 0 {
+		return
+	}
+
+	if err := h.store.AppendEvents(events); err != nil {
+		log.Printf("Failed to log %s events: %v", eventType, err)
+		return
+	}
+	h.deliver()
+}
+
+// deliver pushes the events logged since the last delivery, by any
+// server, to the open streams
+func (h *eventHub) deliver() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.deliverLocked(); err != nil {
+		log.Printf("Failed to read the event log: %v", err)
+	}
+}
+
+func (h *eventHub) deliverLocked() error {
+	for {
+		events, err := h.store.ListEvents(h.delivered, eventBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			h.delivered = event.Seq
+			event.ID = strconv.FormatInt(event.Seq, 10)
+			for sub := range h.desks[event.DeskID] {
+				select {
+				case sub.events <- event:
+				default:
+					h.dropLocked(sub)
+				}
+			}
+		}
+		if len(events) < eventBatchSize {
+			return nil
+		}
+	}
+}
+
+// subscribe opens a stream for the desk. When lastEventID is set, the events
+// the client missed since then are returned to be sent first; reset is true
+// when they can no longer be replayed.
+func (h *eventHub) subscribe(deskID, lastEventID string) (sub *eventSubscription, missed []*models.Event, reset bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Catch up first, so an ID another server issued a moment ago is known
+	if err := h.deliverLocked(); err != nil {
+		return nil, nil, false, err
+	}
+
+	deskID = crypto.NormalizeDeskID(deskID)
+	if lastEventID != "" {
+		seq, parseErr := strconv.ParseInt(lastEventID, 10, 64)
+		oldest, _, err := h.store.EventSeqRange()
+		if err != nil {
+			return nil, nil, false, err
+		}
+		switch {
+		case parseErr != nil || seq < 0 || seq > h.delivered:
+			reset = true // Not an ID from this log
+		case (oldest == 0 && seq < h.delivered) || (oldest != 0 && seq < oldest-1):
+			reset = true // Events after it have been dropped
+		default:
+			missed, err = h.store.ListDeskEvents(deskID, seq, h.delivered)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			for _, event := range missed {
+				event.ID = strconv.FormatInt(event.Seq, 10)
+			}
+		}
+	}
+
+	sub = &eventSubscription{deskID: deskID, events: make(chan *models.Event, eventSubscriberQueue)}
+	if h.desks[deskID] == nil {
+		h.desks[deskID] = make(map[*eventSubscription]struct{})
+	}
+	h.desks[deskID][sub] = struct{}{}
+	return sub, missed, reset, nil
+}
+
+// unsubscribe closes a stream opened by subscribe
+func (h *eventHub) unsubscribe(sub *eventSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, open := h.desks[sub.deskID][sub]; open {
+		h.dropLocked(sub)
+	}
+}
+
+func (h *eventHub) dropLocked(sub *eventSubscription) {
+	delete(h.desks[sub.deskID], sub)
+	if len(h.desks[sub.deskID]) == 0 {
+		delete(h.desks, sub.deskID)
+	}
+	close(sub.events)
+}
+
+// runEventRelay delivers the events other servers log every interval, and
+// drops events past their retention, until the process exits
+func (s *Server) runEventRelay(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastPrune := time.Time{}
+	for now := range ticker.C {
+		s.events.deliver()
+		if now.Sub(lastPrune) >= eventPruneInterval {
+			if err := s.events.store.DeleteEventsBefore(now.Add(-eventRetention)); err != nil {
+				log.Printf("Failed to drop old events: %v", err)
+			}
+			lastPrune = now
+		}
+	}
+}
+
+// eventStore publishes an event for every change a desk's stream reports,
+// after the wrapped store has accepted it. Handlers keep writing through
+// s.storage and get events for free.
+type eventStore struct {
+	storage.Store
+	hub *eventHub
+}
+
+// StartConversation publishes the new conversation and its notifications
+func (s *eventStore) StartConversation(conv *models.Conversation, miv *models.ConversationMiv, notifs []*models.Notification) error {
+	if err := s.Store.StartConversation(conv, miv, notifs); err != nil {
+		return err
+	}
+	s.publishMiv(models.ConversationActionMivCreated, miv)
+	for _, notif := range notifs {
+		s.publishNotification(models.EventTypeNotification, notif)
+	}
+	return nil
+}
+
+// CreateConversationMiv publishes the new miv to its sender and recipients
+func (s *eventStore) CreateConversationMiv(miv *models.ConversationMiv) error {
+	if err := s.Store.CreateConversationMiv(miv); err != nil {
+		return err
+	}
+	s.publishMiv(models.ConversationActionMivCreated, miv)
+	return nil
+}
+
+// UpdateConversationMiv publishes the miv's new state to its sender and recipients
+func (s *eventStore) UpdateConversationMiv(miv *models.ConversationMiv) error {
+	if err := s.Store.UpdateConversationMiv(miv); err != nil {
+		return err
+	}
+	s.publishMiv(models.ConversationActionMivUpdated, miv)
+	return nil
+}
+
+// UpdateConversation publishes the change to every participant
+func (s *eventStore) UpdateConversation(conv *models.Conversation) error {
+	if err := s.Store.UpdateConversation(conv); err != nil {
+		return err
+	}
+	s.hub.publish(models.EventTypeConversation, &models.ConversationEvent{
+		ConversationID: conv.ID,
+		Action:         models.ConversationActionUpdated,
+	}, s.participants(conv)...)
+	return nil
+}
+
+// UpdateConversationState publishes a change to its desk only, since the
+// state is that desk's own
+func (s *eventStore) UpdateConversationState(conversationID, deskID string, change storage.ConversationStateChange) (*models.ConversationState, bool, error) {
+	state, changed, err := s.Store.UpdateConversationState(conversationID, deskID, change)
+	if err != nil || !changed {
+		return state, changed, err
+	}
+	s.hub.publish(models.EventTypeConversation, &models.ConversationEvent{
+		ConversationID: state.ConversationID,
+		Action:         models.ConversationActionState,
+	}, state.DeskID)
+	return state, changed, nil
+}
+
+// MarkConversationMivAsRead publishes the read to the reader, and to the
+// sender unless the reader withheld its receipt
+func (s *eventStore) MarkConversationMivAsRead(mivID string, deskID string) error {
+	if err := s.Store.MarkConversationMivAsRead(mivID, deskID); err != nil {
+		return err
+	}
+	if miv, err := s.Store.GetConversationMiv(mivID); err == nil {
+		s.publishRead(miv, deskID)
+	}
+	return nil
+}
+
+// MarkConversationMivsAsRead publishes a read for each miv it marked
+func (s *eventStore) MarkConversationMivsAsRead(conversationID string, deskID string) error {
+	before, _ := s.Store.GetConversationMivs(conversationID)
+	unread := make(map[string]bool)
+	for _, miv := range before {
+		if r := mivRecipient(miv, deskID); r != nil && r.ReadAt == nil {
+			unread[miv.ID] = true
+		}
+	}
+
+	if err := s.Store.MarkConversationMivsAsRead(conversationID, deskID); err != nil {
+		return err
+	}
+
+	after, _ := s.Store.GetConversationMivs(conversationID)
+	for _, miv := range after {
+		if unread[miv.ID] {
+			s.publishRead(miv, deskID)
+		}
+	}
+	return nil
+}
+
+// CreateNotification publishes the notification to its desk
+func (s *eventStore) CreateNotification(notif *models.Notification) error {
+	if err := s.Store.CreateNotification(notif); err != nil {
+		return err
+	}
+	s.publishNotification(models.EventTypeNotification, notif)
+	return nil
+}
+
+// MarkNotificationAsRead publishes the read notification to its desk, so
+// every open client of the desk clears it
+func (s *eventStore) MarkNotificationAsRead(id string) error {
+	if err := s.Store.MarkNotificationAsRead(id); err != nil {
+		return err
+	}
+	if notif, err := s.Store.GetNotification(id); err == nil {
+		s.publishNotification(models.EventTypeNotificationRead, notif)
+	}
+	return nil
+}
+
+// publishNotification publishes a copy, since streams encode it later while
+// the store may still change the original
+func (s *eventStore) publishNotification(eventType models.EventType, notif *models.Notification) {
+	copied := *notif
+	s.hub.publish(eventType, &copied, notif.DeskID)
+}
+
+func (s *eventStore) publishMiv(action models.ConversationAction, miv *models.ConversationMiv) {
+	s.hub.publish(models.EventTypeConversation, &models.ConversationEvent{
+		ConversationID: miv.ConversationID,
+		Action:         action,
+		MivID:          miv.ID,
+		SeqNo:          miv.SeqNo,
+	}, append(recipientDeskIDs(miv), miv.From, miv.To)...)
+}
+
+// publishRead tells the reader, and the sender unless the reader withheld
+// its receipt, that the reader's copy of a miv has been read; other
+// recipients keep their own read state
+func (s *eventStore) publishRead(miv *models.ConversationMiv, deskID string) {
+	r := mivRecipient(miv, deskID)
+	if r == nil || r.ReadAt == nil {
+		return
+	}
+	deskIDs := []string{deskID}
+	if !r.ReceiptWithheld {
+		deskIDs = append(deskIDs, miv.From)
+	}
+	s.hub.publish(models.EventTypeMivRead, &models.MivReadEvent{
+		ConversationID: miv.ConversationID,
+		MivID:          miv.ID,
+		DeskID:         crypto.NormalizeDeskID(deskID),
+		ReadAt:         *r.ReadAt,
+	}, deskIDs...)
+}
+
+// participants returns every desk taking part in the conversation, as the
+// store now records them
+func (s *eventStore) participants(conv *models.Conversation) []string {
+	deskIDs := []string{conv.DeskID}
+	if stored, err := s.Store.GetConversation(conv.ID); err == nil {
+		conv = stored
+	}
+	for _, p := range conv.Participants {
+		deskIDs = append(deskIDs, p.DeskID)
+	}
+	return deskIDs
+}
+
+// streamDeskEvents serves a desk's events as Server-Sent Events. A reconnecting
+// client sends the last event ID it saw (the Last-Event-ID header, which
+// EventSource sets itself, or the last_event_id query parameter) and gets the
+// events it missed first. If those are gone, a reset event tells it to reload
+// through the REST endpoints.
+func (s *Server) streamDeskEvents(c *gin.Context) {
+	desk, ok := s.authorizeDesk(c, c.Param("desk_id"))
+	if !ok {
+		return
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+
+	sub, missed, reset, err := s.events.subscribe(desk.ID, lastEventID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open event stream"})
+		return
+	}
+	defer s.events.unsubscribe(sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // Stop nginx from buffering the stream
+	c.Status(http.StatusOK)
+
+	if reset {
+		c.Render(-1, sse.Event{Event: string(models.EventTypeReset), Data: gin.H{"desk_id": sub.deskID}})
+	}
+	for _, event := range missed {
+		writeEvent(c, event)
+	}
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, open := <-sub.events:
+			if !open {
+				// Fell too far behind; the client reconnects and resumes
+				return
+			}
+			writeEvent(c, event)
+			c.Writer.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(c.Writer, ": heartbeat\n\n")
+			c.Writer.Flush()
+		}
+	}
+}
+
+func writeEvent(c *gin.Context, event *models.Event) {
+	c.Render(-1, sse.Event{Id: event.ID, Event: string(event.Type), Data: event.Data})
+}
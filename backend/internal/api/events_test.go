@@ -0,0 +1,243 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jadefox10200/missiv/backend/internal/models"
+	"github.com/jadefox10200/missiv/backend/internal/storage"
+)
+
+// streamedEvent is one event read off an SSE stream
+type streamedEvent struct {
+	id, event, data string
+}
+
+// requestTicket asks a live test server for a ticket to open path
+func requestTicket(t *testing.T, baseURL, token, path string) string {
+	t.Helper()
+	body, _ := json.Marshal(models.TicketRequest{Path: path})
+	req, _ := http.NewRequest(http.MethodPost, baseURL+"/api/tickets", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to request ticket: %v", err)
+	}
+	defer resp.Body.Close()
+	var ticket models.TicketResponse
+	if resp.StatusCode != http.StatusCreated || json.NewDecoder(resp.Body).Decode(&ticket) != nil {
+		t.Fatalf("Failed to get a ticket for %s: %d", path, resp.StatusCode)
+	}
+	return ticket.Ticket
+}
+
+// openEventStream connects to a desk's event stream on a live test server
+// with a ticket
+func openEventStream(t *testing.T, ctx context.Context, baseURL, deskID, token, lastEventID string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	path := "/api/desks/" + deskID + "/events"
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+path+"?ticket="+requestTicket(t, baseURL, token, path), nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	return resp, bufio.NewReader(resp.Body)
+}
+
+// readEvent reads the next event, skipping heartbeat comments
+func readEvent(t *testing.T, r *bufio.Reader) streamedEvent {
+	t.Helper()
+	var e streamedEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && e.event != "":
+			return e
+		case strings.HasPrefix(line, "id:"):
+			e.id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "event:"):
+			e.event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			e.data = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+}
+
+func TestDeskEventStream(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+	ts := httptest.NewServer(f.server.router)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Only the desk's owner may listen
+	resp, _ := openEventStream(t, ctx, ts.URL, bobDesk, f.carol.Token, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a foreign desk's stream to be forbidden, got %d", resp.StatusCode)
+	}
+
+	streamCtx, closeStream := context.WithCancel(ctx)
+	resp, events := openEventStream(t, streamCtx, ts.URL, bobDesk, f.bob.Token, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+
+	w := doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+aliceDesk, f.alice.Token,
+		models.ReplyToConversationRequest{Body: "Still there?"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to reply: %d %s", w.Code, w.Body.String())
+	}
+
+	created := readEvent(t, events)
+	if created.event != string(models.EventTypeConversation) || !strings.Contains(created.data, `"miv_created"`) {
+		t.Errorf("Expected a conversation event for the reply, got %+v", created)
+	}
+	notified := readEvent(t, events)
+	if notified.event != string(models.EventTypeNotification) || !strings.Contains(notified.data, f.conversationID) {
+		t.Errorf("Expected a notification event for the reply, got %+v", notified)
+	}
+
+	doRequest(t, f.server, http.MethodPost, "/api/mivs/"+f.mivID+"/read?desk_id="+bobDesk, f.bob.Token, nil)
+	read := readEvent(t, events)
+	if read.event != string(models.EventTypeMivRead) || !strings.Contains(read.data, f.mivID) {
+		t.Errorf("Expected a read event for the miv, got %+v", read)
+	}
+	closeStream()
+	resp.Body.Close()
+
+	// Reconnecting with the first event's ID replays what came after it
+	resp, events = openEventStream(t, ctx, ts.URL, bobDesk, f.bob.Token, created.id)
+	defer resp.Body.Close()
+	if e := readEvent(t, events); e.id != notified.id {
+		t.Errorf("Expected to resume with %s, got %+v", notified.id, e)
+	}
+	if e := readEvent(t, events); e.id != read.id {
+		t.Errorf("Expected to resume with %s, got %+v", read.id, e)
+	}
+}
+
+func TestEventHubResetsUnknownResumePoints(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	hub := newEventHub(store)
+	for i := 0; i < 3; i++ {
+		hub.publish(models.EventTypeNotification, i, "555-123-4567")
+	}
+	hub.publish(models.EventTypeNotification, "other", "555-765-4321")
+
+	sub, missed, reset, err := hub.subscribe("5551234567", "1")
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	hub.unsubscribe(sub)
+	if reset || len(missed) != 2 || missed[0].ID != "2" || missed[1].ID != "3" {
+		t.Errorf("Expected the desk's two later events, got reset=%v missed=%d", reset, len(missed))
+	}
+
+	for _, id := range []string{"previous-run-5", "99"} {
+		sub, _, reset, _ = hub.subscribe("5551234567", id)
+		hub.unsubscribe(sub)
+		if !reset {
+			t.Errorf("Expected a reset for %q, which is not in the log", id)
+		}
+	}
+
+	if err := store.DeleteEventsBefore(time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("Failed to drop events: %v", err)
+	}
+	sub, missed, reset, _ = hub.subscribe("5551234567", "1")
+	hub.unsubscribe(sub)
+	if !reset || len(missed) != 0 {
+		t.Errorf("Expected a reset once the events after the resume point were dropped, got reset=%v missed=%d", reset, len(missed))
+	}
+
+	// Nothing was missed when resuming from the last event
+	sub, _, reset, _ = hub.subscribe("5551234567", "4")
+	hub.unsubscribe(sub)
+	if reset {
+		t.Errorf("Expected no reset when resuming from the latest event")
+	}
+}
+
+func TestDisabledReadReceiptsHideReadTimes(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+	carolDesk := f.carol.Account.ActiveDesk
+	ts := httptest.NewServer(f.server.router)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	off := true
+	doRequest(t, f.server, http.MethodPut, "/api/desks/"+bobDesk, f.bob.Token, models.UpdateDeskRequest{DisableReadReceipts: &off})
+	w := doRequest(t, f.server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Cc: carolDesk, Subject: "Both", Body: "Hi both"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create conversation: %d %s", w.Code, w.Body.String())
+	}
+	var conv models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &conv)
+	convID, mivID := conv.Conversation.ID, conv.Mivs[0].ID
+
+	resp, events := openEventStream(t, ctx, ts.URL, aliceDesk, f.alice.Token, "")
+	defer resp.Body.Close()
+
+	// Bob's read reaches alice neither as an event nor in the miv; carol's,
+	// which comes after it, does
+	doRequest(t, f.server, http.MethodPost, "/api/mivs/"+mivID+"/read?desk_id="+bobDesk, f.bob.Token, nil)
+	doRequest(t, f.server, http.MethodPost, "/api/mivs/"+mivID+"/read?desk_id="+carolDesk, f.carol.Token, nil)
+	read := readEvent(t, events)
+	if read.event != string(models.EventTypeMivRead) || !strings.Contains(read.data, carolDesk) {
+		t.Errorf("Expected carol's read to be the first event, got %+v", read)
+	}
+
+	w = doRequest(t, f.server, http.MethodGet, "/api/conversations/"+convID+"?desk_id="+aliceDesk, f.alice.Token, nil)
+	json.Unmarshal(w.Body.Bytes(), &conv)
+	miv := conv.Mivs[0]
+	if miv.ReadAt != nil || miv.State != models.StateSENT {
+		t.Errorf("Expected the sender not to see bob's read, got %s %v", miv.State, miv.ReadAt)
+	}
+	for _, r := range miv.Recipients {
+		if (r.DeskID == carolDesk) != (r.ReadAt != nil) {
+			t.Errorf("Expected only carol's read time, got %s at %v", r.DeskID, r.ReadAt)
+		}
+	}
+
+	// Bob still sees his own read
+	w = doRequest(t, f.server, http.MethodGet, "/api/conversations/"+convID+"?desk_id="+bobDesk, f.bob.Token, nil)
+	json.Unmarshal(w.Body.Bytes(), &conv)
+	if conv.Mivs[0].ReadAt == nil {
+		t.Errorf("Expected bob to see when he read the miv")
+	}
+
+	// Turning receipts back on does not reveal reads made while they were off
+	on := false
+	doRequest(t, f.server, http.MethodPut, "/api/desks/"+bobDesk, f.bob.Token, models.UpdateDeskRequest{DisableReadReceipts: &on})
+	w = doRequest(t, f.server, http.MethodGet, "/api/conversations/"+convID+"?desk_id="+aliceDesk, f.alice.Token, nil)
+	var later models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &later)
+	miv = later.Mivs[0]
+	if miv.ReadAt != nil || miv.Recipients[0].ReadAt != nil {
+		t.Errorf("Expected bob's earlier read to stay hidden, got %v %v", miv.ReadAt, miv.Recipients[0].ReadAt)
+	}
+}
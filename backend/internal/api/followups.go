@@ -0,0 +1,84 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// setMivReplyBy sets or clears the time the sender of a miv expects a reply by
+func (s *Server) setMivReplyBy(c *gin.Context) {
+	var req models.SetReplyByRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	desk, ok := s.authorizeDesk(c, requestDeskID(c))
+	if !ok {
+		return
+	}
+	miv, ok := s.authorizeMiv(c, c.Param("id"), desk)
+	if !ok {
+		return
+	}
+
+	// Only the sender waits on a reply
+	if miv.From != desk.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the sender can set a reply deadline"})
+		return
+	}
+	if miv.IsAck && req.ReplyBy != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "An ACK ends the conversation and expects no reply"})
+		return
+	}
+
+	if err := s.storage.SetMivReplyBy(miv.ID, req.ReplyBy); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set reply deadline"})
+		return
+	}
+	miv.ReplyBy = req.ReplyBy
+	miv.FollowUpAt = nil
+
+	c.JSON(http.StatusOK, s.openMiv(desk, miv))
+}
+
+// remindFollowUps notifies senders of mivs whose reply deadline passed by now
+// without a reply. A reply or forgetting the miv takes it out of the sender's
+// SENT basket, which is what cancels the reminder; each miv is followed up
+// once until its deadline is set again. The follow-up is claimed in the
+// store before the sender is notified, so of several servers sharing it
+// only one sends the reminder.
+func (s *Server) remindFollowUps(now time.Time) {
+	due, err := s.storage.ListDueFollowUps(now)
+	if err != nil {
+		log.Printf("Failed to list due follow-ups: %v", err)
+		return
+	}
+
+	for _, miv := range due {
+		claimed, err := s.storage.ClaimFollowUp(miv.ID, now)
+		if err != nil {
+			log.Printf("Failed to mark miv %s followed up: %v", miv.ID, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		notification := &models.Notification{
+			DeskID:         miv.From,
+			Type:           models.NotificationTypeFollowUpDue,
+			MivID:          miv.ID,
+			ConversationID: miv.ConversationID,
+			Message:        fmt.Sprintf("No reply yet from %s in: %s", miv.To, miv.Subject),
+			Read:           false,
+		}
+		if err := s.storage.CreateNotification(notification); err != nil {
+			log.Printf("Failed to notify follow-up of miv %s: %v", miv.ID, err)
+		}
+	}
+}
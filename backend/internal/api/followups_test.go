@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// followUps returns the FOLLOW_UP_DUE notifications of a desk
+func followUps(t *testing.T, server *Server, deskID string) []*models.Notification {
+	t.Helper()
+	notifications, err := server.storage.ListNotificationsByDesk(deskID, false)
+	if err != nil {
+		t.Fatalf("Failed to list notifications: %v", err)
+	}
+	var due []*models.Notification
+	for _, n := range notifications {
+		if n.Type == models.NotificationTypeFollowUpDue {
+			due = append(due, n)
+		}
+	}
+	return due
+}
+
+func TestFollowUpReminder(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+
+	// Only the sender sets a deadline
+	replyBy := time.Now().Add(time.Hour)
+	w := doRequest(t, f.server, http.MethodPut, "/api/mivs/"+f.mivID+"/reply-by?desk_id="+bobDesk, f.bob.Token,
+		models.SetReplyByRequest{ReplyBy: &replyBy})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected a recipient setting the deadline to be forbidden, got %d", w.Code)
+	}
+	w = doRequest(t, f.server, http.MethodPut, "/api/mivs/"+f.mivID+"/reply-by?desk_id="+aliceDesk, f.alice.Token,
+		models.SetReplyByRequest{ReplyBy: &replyBy})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to set reply deadline: %d %s", w.Code, w.Body.String())
+	}
+	var miv models.ConversationMiv
+	json.Unmarshal(w.Body.Bytes(), &miv)
+	if miv.ReplyBy == nil || !miv.ReplyBy.Equal(replyBy) {
+		t.Errorf("Expected the deadline on the miv, got %v", miv.ReplyBy)
+	}
+
+	// Nothing is due before the deadline, and the reminder fires only once
+	f.server.remindFollowUps(time.Now())
+	if due := followUps(t, f.server, aliceDesk); len(due) != 0 {
+		t.Fatalf("Expected no reminder before the deadline, got %d", len(due))
+	}
+	f.server.remindFollowUps(replyBy.Add(time.Minute))
+	f.server.remindFollowUps(replyBy.Add(2 * time.Minute))
+	due := followUps(t, f.server, aliceDesk)
+	if len(due) != 1 || due[0].MivID != f.mivID || due[0].ConversationID != f.conversationID {
+		t.Fatalf("Expected one reminder for the miv, got %+v", due)
+	}
+	if len(followUps(t, f.server, bobDesk)) != 0 {
+		t.Errorf("Expected the recipient not to be reminded")
+	}
+
+	// A reply cancels a reminder set again
+	w = doRequest(t, f.server, http.MethodPut, "/api/mivs/"+f.mivID+"/reply-by?desk_id="+aliceDesk, f.alice.Token,
+		models.SetReplyByRequest{ReplyBy: &replyBy})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to reset reply deadline: %d %s", w.Code, w.Body.String())
+	}
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+bobDesk, f.bob.Token,
+		models.ReplyToConversationRequest{Body: "On it"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to reply: %d %s", w.Code, w.Body.String())
+	}
+	f.server.remindFollowUps(replyBy.Add(time.Hour))
+	if due := followUps(t, f.server, aliceDesk); len(due) != 1 {
+		t.Errorf("Expected a reply to cancel the reminder, got %d reminders", len(due))
+	}
+}
+
+func TestFollowUpCancelledByForget(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+
+	replyBy := time.Now().Add(time.Hour)
+	w := doRequest(t, f.server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Subject: "Deadline", Body: "By noon", ReplyBy: &replyBy})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create conversation: %d %s", w.Code, w.Body.String())
+	}
+	var conv models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &conv)
+	mivID := conv.Mivs[0].ID
+
+	w = doRequest(t, f.server, http.MethodPost, "/api/mivs/"+mivID+"/forget?desk_id="+aliceDesk, f.alice.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to forget miv: %d %s", w.Code, w.Body.String())
+	}
+	f.server.remindFollowUps(replyBy.Add(time.Minute))
+	for _, n := range followUps(t, f.server, aliceDesk) {
+		if n.MivID == mivID {
+			t.Errorf("Expected forgetting the miv to cancel its reminder")
+		}
+	}
+
+	// An ACK expects no reply
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations/"+conv.Conversation.ID+"/reply?desk_id="+bobDesk, f.bob.Token,
+		models.ReplyToConversationRequest{Body: "Done", IsAck: true, ReplyBy: &replyBy})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an ACK with a deadline to be rejected, got %d", w.Code)
+	}
+}
@@ -1,29 +1,26 @@
 package api
 
 import (
-	"crypto/rand"
-	"encoding/base64"
-	"encoding/hex"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"path/filepath"
 	"regexp"
-	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jadefox10200/missiv/backend/internal/crypto"
 	"github.com/jadefox10200/missiv/backend/internal/models"
+	"github.com/jadefox10200/missiv/backend/internal/storage"
 )
 
 // Upload handler constants
 const (
-	maxFileSize         = 10 * 1024 * 1024 // 10MB
-	maxFileExtLength    = 10               // Maximum length for file extension
-	maxFilenameLength   = 100              // Maximum length for sanitized filename
+	maxFileSize       = 10 * 1024 * 1024 // 10MB
+	maxFileExtLength  = 10               // Maximum length for file extension
+	maxFilenameLength = 100              // Maximum length for sanitized filename
 )
 
 // Compiled regex for filename sanitization (compiled once at package level)
@@ -39,6 +36,12 @@ func (s *Server) registerAccount(c *gin.Context) {
 		return
 	}
 
+	// Resolve desk keys first so a rejected key does not leave an account behind
+	publicKey, signingKey, privateKeys, ok := s.newDeskKeys(c, req.PublicKey, req.SigningKey)
+	if !ok {
+		return
+	}
+
 	// Hash the password
 	passwordHash, err := crypto.HashPassword(req.Password)
 	if err != nil {
@@ -81,13 +84,6 @@ func (s *Server) registerAccount(c *gin.Context) {
 		return
 	}
 
-	// Create first desk for the account
-	keyPair, err := crypto.GenerateKeyPair()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate key pair"})
-		return
-	}
-
 	deskID, err := crypto.GeneratePhoneStyleID()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate desk ID"})
@@ -97,7 +93,8 @@ func (s *Server) registerAccount(c *gin.Context) {
 	desk := &models.Desk{
 		ID:                deskID,
 		AccountID:         account.ID,
-		PublicKey:         crypto.PublicKeyToBase64(keyPair.PublicKey),
+		PublicKey:         publicKey,
+		SigningKey:        signingKey,
 		Name:              "Primary Desk",
 		AutoIndent:        true,
 		FontFamily:        "Georgia, serif",
@@ -106,7 +103,7 @@ func (s *Server) registerAccount(c *gin.Context) {
 		DefaultClosure:    "Sincerely,",
 	}
 
-	if err := s.storage.CreateDesk(desk, keyPair.PrivateKey); err != nil {
+	if err := s.storage.CreateDesk(desk, privateKeys); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create desk"})
 		return
 	}
@@ -119,16 +116,17 @@ func (s *Server) registerAccount(c *gin.Context) {
 		return
 	}
 
-	// Generate token
-	token, err := crypto.GenerateToken()
+	// Start a session for the new account
+	token, session, err := s.issueSession(account.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
 	c.JSON(http.StatusCreated, models.LoginResponse{
-		Account: account,
-		Token:   token,
+		Account:   account,
+		Token:     token,
+		ExpiresAt: session.ExpiresAt,
 	})
 }
 
@@ -154,19 +152,31 @@ func (s *Server) loginAccount(c *gin.Context) {
 		return
 	}
 
-	// Generate token
-	token, err := crypto.GenerateToken()
+	// Start a session
+	token, session, err := s.issueSession(account.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
 	c.JSON(http.StatusOK, models.LoginResponse{
-		Account: account,
-		Token:   token,
+		Account:   account,
+		Token:     token,
+		ExpiresAt: session.ExpiresAt,
 	})
 }
 
+func (s *Server) logoutAccount(c *gin.Context) {
+	session := currentSession(c)
+
+	if err := s.storage.DeleteSession(session.TokenHash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+}
+
 func (s *Server) recoverPassword(c *gin.Context) {
 	var req models.RecoverPasswordRequest
 
@@ -201,6 +211,21 @@ func (s *Server) recoverPassword(c *gin.Context) {
 		return
 	}
 
+	// Check re-wrapped key backups before touching the password
+	rewrapped := make(map[string]string)
+	for _, backup := range req.KeyBackups {
+		desk, err := s.storage.GetDesk(backup.DeskID)
+		if err != nil || !ownsDesk(account, desk) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Desk %s does not belong to this account", backup.DeskID)})
+			return
+		}
+		if err := crypto.ValidateWrappedKey(backup.Blob); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rewrapped[desk.ID] = backup.Blob
+	}
+
 	// Hash new password
 	newPasswordHash, err := crypto.HashPassword(req.NewPassword)
 	if err != nil {
@@ -215,21 +240,48 @@ func (s *Server) recoverPassword(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Password updated successfully"})
+	// Whoever knew the old password may still hold a session
+	if err := s.storage.DeleteAccountSessions(account.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to end existing sessions"})
+		return
+	}
+
+	// Backups wrapped under the old password are replaced with the re-wrapped
+	// blobs; any the client did not re-wrap are invalidated
+	invalidated := []string{}
+	for _, deskID := range account.Desks {
+		existing, err := s.storage.GetKeyBackup(deskID)
+		version := 0
+		if err == nil {
+			version = existing.Version
+		}
+
+		if blob, ok := rewrapped[deskID]; ok {
+			if err := s.storage.SaveKeyBackup(&models.KeyBackup{DeskID: deskID, Blob: blob}, version); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update key backup"})
+				return
+			}
+		} else if existing != nil {
+			if err := s.storage.DeleteKeyBackup(deskID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to invalidate key backup"})
+				return
+			}
+			invalidated = append(invalidated, deskID)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":                 "Password updated successfully",
+		"invalidated_key_backups": invalidated,
+	})
 }
 
 // Desk handlers
 
 func (s *Server) listDesks(c *gin.Context) {
-	// In a real implementation, get accountID from authenticated user
-	// For now, list all desks
-	accountID := c.Query("account_id")
-	if accountID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "account_id is required"})
-		return
-	}
+	account := currentAccount(c)
 
-	desks, err := s.storage.ListDesksByAccount(accountID)
+	desks, err := s.storage.ListDesksByAccount(account.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -246,17 +298,11 @@ func (s *Server) createDesk(c *gin.Context) {
 		return
 	}
 
-	// In a real implementation, get accountID from authenticated user
-	accountID := c.Query("account_id")
-	if accountID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "account_id is required"})
-		return
-	}
+	account := currentAccount(c)
 
-	// Generate key pair for the new desk
-	keyPair, err := crypto.GenerateKeyPair()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate key pair"})
+	// Use the client's public keys, or generate pairs if custody allows
+	publicKey, signingKey, privateKeys, ok := s.newDeskKeys(c, req.PublicKey, req.SigningKey)
+	if !ok {
 		return
 	}
 
@@ -269,8 +315,9 @@ func (s *Server) createDesk(c *gin.Context) {
 
 	desk := &models.Desk{
 		ID:                deskID,
-		AccountID:         accountID,
-		PublicKey:         crypto.PublicKeyToBase64(keyPair.PublicKey),
+		AccountID:         account.ID,
+		PublicKey:         publicKey,
+		SigningKey:        signingKey,
 		Name:              req.Name,
 		AutoIndent:        true,
 		FontFamily:        "Georgia, serif",
@@ -279,16 +326,16 @@ func (s *Server) createDesk(c *gin.Context) {
 		DefaultClosure:    "Sincerely,",
 	}
 
-	if err := s.storage.CreateDesk(desk, keyPair.PrivateKey); err != nil {
+	if err := s.storage.CreateDesk(desk, privateKeys); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create desk"})
 		return
 	}
 
 	// Update account's desk list
-	account, err := s.storage.GetAccountByID(accountID)
-	if err == nil {
-		account.Desks = append(account.Desks, deskID)
-		s.storage.UpdateAccount(account)
+	account.Desks = append(account.Desks, deskID)
+	if err := s.storage.UpdateAccount(account); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update account"})
+		return
 	}
 
 	c.JSON(http.StatusCreated, desk)
@@ -302,12 +349,7 @@ func (s *Server) switchDesk(c *gin.Context) {
 		return
 	}
 
-	// In a real implementation, get accountID from authenticated user
-	accountID := c.Query("account_id")
-	if accountID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "account_id is required"})
-		return
-	}
+	account := currentAccount(c)
 
 	// Verify desk belongs to account
 	desk, err := s.storage.GetDesk(req.DeskID)
@@ -316,19 +358,13 @@ func (s *Server) switchDesk(c *gin.Context) {
 		return
 	}
 
-	if desk.AccountID != accountID {
+	if desk.AccountID != account.ID {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Desk does not belong to account"})
 		return
 	}
 
 	// Update active desk
-	account, err := s.storage.GetAccountByID(accountID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
-		return
-	}
-
-	account.ActiveDesk = req.DeskID
+	account.ActiveDesk = desk.ID
 	if err := s.storage.UpdateAccount(account); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to switch desk"})
 		return
@@ -350,16 +386,12 @@ func (s *Server) updateDesk(c *gin.Context) {
 		return
 	}
 
-	// Get existing desk
-	desk, err := s.storage.GetDesk(deskID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Desk not found"})
+	// Get existing desk and verify the caller owns it
+	desk, ok := s.authorizeDesk(c, deskID)
+	if !ok {
 		return
 	}
 
-	// TODO: Add authorization check to verify user owns this desk
-	// This requires implementing proper authentication middleware
-
 	// Update fields if provided
 	if req.Name != nil {
 		desk.Name = *req.Name
@@ -379,6 +411,9 @@ func (s *Server) updateDesk(c *gin.Context) {
 	if req.DefaultClosure != nil {
 		desk.DefaultClosure = *req.DefaultClosure
 	}
+	if req.DisableReadReceipts != nil {
+		desk.DisableReadReceipts = *req.DisableReadReceipts
+	}
 
 	if err := s.storage.UpdateDesk(desk); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update desk"})
@@ -391,125 +426,85 @@ func (s *Server) updateDesk(c *gin.Context) {
 // Conversation handlers
 
 func (s *Server) listConversations(c *gin.Context) {
-	deskID := c.Query("desk_id")
-	if deskID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "desk_id is required"})
+	desk, ok := s.authorizeDesk(c, requestDeskID(c))
+	if !ok {
 		return
 	}
+	deskID := desk.ID
 
-	conversations, err := s.storage.ListConversationsByDesk(deskID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	limit, after, ok := pageParams(c)
+	if !ok {
 		return
 	}
-
-	// Build response with latest miv and unread count
-	var response []*models.ConversationWithLatest
-	for _, conv := range conversations {
-		mivs, err := s.storage.GetConversationMivs(conv.ID)
+	since, until, ok := timeRange(c)
+	if !ok {
+		return
+	}
+	query := storage.ConversationQuery{
+		UnreadOnly:  c.Query("unread_only") == "true",
+		Counterpart: c.Query("counterpart"),
+		Since:       since,
+		Until:       until,
+		After:       after,
+		Limit:       limit + 1,
+	}
+	if raw := c.Query("archived"); raw != "" {
+		archived, err := strconv.ParseBool(raw)
 		if err != nil {
-			continue
-		}
-
-		var latestMiv *models.ConversationMiv
-		unreadCount := 0
-		if len(mivs) > 0 {
-			latestMiv = mivs[len(mivs)-1]
-			normalizedDeskID := crypto.NormalizeDeskID(deskID)
-			for _, miv := range mivs {
-				normalizedMivTo := crypto.NormalizeDeskID(miv.To)
-				if normalizedMivTo == normalizedDeskID && miv.ReadAt == nil {
-					unreadCount++
-				}
-			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "archived must be true or false"})
+			return
 		}
+		query.Archived = &archived
+	}
 
-		response = append(response, &models.ConversationWithLatest{
-			Conversation: conv,
-			LatestMiv:    latestMiv,
-			UnreadCount:  unreadCount,
-		})
+	// The store returns each conversation with its latest miv, unread count
+	// and the desk's state, pinned first and then newest first
+	conversations, err := s.storage.ListConversationPage(deskID, query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
+	conversations, nextCursor := nextPage(conversations, limit, storage.ConversationCursor)
 
-	// Sort by updated_at descending
-	sort.Slice(response, func(i, j int) bool {
-		return response[i].Conversation.UpdatedAt.After(response[j].Conversation.UpdatedAt)
-	})
+	for _, item := range conversations {
+		item.Conversation = deskConversation(item.Conversation, item.State)
+		if item.LatestMiv != nil {
+			item.LatestMiv = s.openMiv(desk, item.LatestMiv)
+		}
+	}
 
 	c.JSON(http.StatusOK, models.ListConversationsResponse{
-		Conversations: response,
-		Total:         len(response),
+		Conversations: conversations,
+		Total:         len(conversations),
+		NextCursor:    nextCursor,
 	})
 }
 
 func (s *Server) getConversation(c *gin.Context) {
 	id := c.Param("id")
-	deskID := c.Query("desk_id")
 
-	conv, err := s.storage.GetConversation(id)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+	desk, ok := s.authorizeDesk(c, requestDeskID(c))
+	if !ok {
 		return
 	}
+	deskID := desk.ID
 
-	mivs, err := s.storage.GetConversationMivs(id)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	conv, mivs, ok := s.authorizeConversation(c, id, desk)
+	if !ok {
 		return
 	}
 
-	// If desk_id is provided, adjust miv states based on desk perspective
-	if deskID != "" {
-		normalizedDeskID := crypto.NormalizeDeskID(deskID)
-		// Adjust states from the perspective of the querying desk
-		for _, miv := range mivs {
-			normalizedMivTo := crypto.NormalizeDeskID(miv.To)
-			if normalizedMivTo == normalizedDeskID {
-				// For incoming mivs
-				if miv.ReadAt == nil {
-					miv.State = models.StateIN
-				} else {
-					// Check if we've replied to this miv
-					hasReply := false
-					for _, laterMiv := range mivs {
-						if laterMiv.From == deskID && laterMiv.SeqNo > miv.SeqNo {
-							hasReply = true
-							break
-						}
-					}
-					if !hasReply {
-						miv.State = models.StatePENDING
-					} else {
-						// Has reply - clear the state so it doesn't appear in baskets
-						miv.State = ""
-					}
-				}
-			} else if miv.From == deskID {
-				// For outgoing mivs, check if there's a reply or if it's forgotten
-				hasReply := false
-				for _, laterMiv := range mivs {
-					if laterMiv.From != deskID && laterMiv.SeqNo > miv.SeqNo {
-						hasReply = true
-						break
-					}
-				}
-				// Only show in SENT basket if not forgotten and no reply
-				if !hasReply && !miv.IsForgotten {
-					miv.State = models.StateSENT
-				} else {
-					// Has reply or is forgotten - clear the state so it doesn't appear in baskets
-					miv.State = ""
-				}
-			}
-		}
-
-		// Note: Removed automatic marking as read when viewing conversation
-		// Mivs must be explicitly marked as read using the /mivs/:id/read endpoint
+	// Show each miv in the basket it sits in for the querying desk
+	opened := s.openMivs(desk, mivs)
+	for _, miv := range opened {
+		miv.State = mivBasket(miv, deskID)
 	}
 
+	state := s.deskConversationState(conv.ID, deskID)
 	c.JSON(http.StatusOK, models.GetConversationResponse{
-		Conversation: conv,
-		Mivs:         mivs,
+		Conversation: deskConversation(conv, state),
+		Mivs:         opened,
+		State:        state,
 	})
 }
 
@@ -521,64 +516,53 @@ func (s *Server) createConversation(c *gin.Context) {
 		return
 	}
 
-	deskID := c.Query("desk_id")
-	if deskID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "desk_id is required"})
+	desk, ok := s.authorizeDesk(c, requestDeskID(c))
+	if !ok {
 		return
 	}
-
-	// Validate that recipient desk exists
-	normalizedTo := crypto.NormalizeDeskID(req.To)
-	_, err := s.storage.GetDesk(normalizedTo)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Recipient desk '%s' does not exist. Please verify the desk number and try again.", req.To)})
+	draft, ok := s.draftToSend(c, desk, req.DraftID, req.DraftVersion, "")
+	if !ok {
 		return
 	}
 
-	// Create conversation
-	conv := &models.Conversation{
-		Subject: req.Subject,
-		DeskID:  deskID,
-	}
-
-	if err := s.storage.CreateConversation(conv); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create conversation"})
+	if req.SendAt != nil {
+		if _, err := s.resolveRecipients(req.To, req.Cc); err != nil {
+			respondError(c, err, "Failed to schedule miv")
+			return
+		}
+		if s.scheduleMiv(c, desk, &models.ScheduledMiv{
+			NewConversationID:   req.ConversationID,
+			To:                  req.To,
+			Cc:                  req.Cc,
+			Subject:             req.Subject,
+			Body:                req.Body,
+			Bodies:              req.Bodies,
+			IsEncrypted:         req.IsEncrypted,
+			RecipientKeyVersion: req.KeyVersion,
+			KeyVersions:         req.KeyVersions,
+			Signature:           req.Signature,
+			FontFamily:          req.FontFamily,
+			FontSize:            req.FontSize,
+			SendAt:              *req.SendAt,
+			ReplyBy:             req.ReplyBy,
+			AttachmentIDs:       req.AttachmentIDs,
+		}) {
+			s.discardDraft(draft)
+		}
 		return
 	}
 
-	// Create first miv
-	miv := &models.ConversationMiv{
-		ConversationID: conv.ID,
-		SeqNo:          1,
-		From:           deskID,
-		To:             req.To, // Store the display format
-		Subject:        req.Subject,
-		Body:           base64.StdEncoding.EncodeToString([]byte(req.Body)),
-		State:          models.StateSENT, // Use SENT state for newly created mivs
-		IsEncrypted:    false,
-		FontFamily:     req.FontFamily,
-		FontSize:       req.FontSize,
-	}
-
-	if err := s.storage.CreateConversationMiv(miv); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create miv"})
+	conv, miv, state, err := s.startConversation(desk, &req, "")
+	if err != nil {
+		respondError(c, err, "Failed to create conversation")
 		return
 	}
-
-	// Create notification for recipient
-	notification := &models.Notification{
-		DeskID:         normalizedTo, // Use normalized ID for routing
-		Type:           models.NotificationTypeNewMiv,
-		MivID:          miv.ID,
-		ConversationID: conv.ID,
-		Message:        fmt.Sprintf("New message from %s: %s", deskID, req.Subject),
-		Read:           false,
-	}
-	s.storage.CreateNotification(notification)
+	s.discardDraft(draft)
 
 	c.JSON(http.StatusCreated, models.GetConversationResponse{
 		Conversation: conv,
-		Mivs:         []*models.ConversationMiv{miv},
+		Mivs:         s.openMivs(desk, []*models.ConversationMiv{miv}),
+		State:        state,
 	})
 }
 
@@ -592,143 +576,120 @@ func (s *Server) replyToConversation(c *gin.Context) {
 		return
 	}
 
-	deskID := c.Query("desk_id")
-	if deskID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "desk_id is required"})
+	desk, ok := s.authorizeDesk(c, requestDeskID(c))
+	if !ok {
 		return
 	}
 
-	// Get conversation
-	conv, err := s.storage.GetConversation(conversationID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+	// Get conversation and existing mivs to determine recipient
+	conv, mivs, ok := s.authorizeConversation(c, conversationID, desk)
+	if !ok {
 		return
 	}
-
-	// Get existing mivs to determine recipient
-	mivs, err := s.storage.GetConversationMivs(conversationID)
-	if err != nil || len(mivs) == 0 {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get conversation mivs"})
+	draft, ok := s.draftToSend(c, desk, req.DraftID, req.DraftVersion, conv.ID)
+	if !ok {
 		return
 	}
 
-	// Determine recipient (the other party in the conversation)
-	var recipientID string
-	for _, m := range mivs {
-		if m.From != deskID {
-			recipientID = m.From
-			break
+	if req.SendAt != nil {
+		if s.scheduleMiv(c, desk, &models.ScheduledMiv{
+			ConversationID:      conv.ID,
+			Body:                req.Body,
+			Bodies:              req.Bodies,
+			IsEncrypted:         req.IsEncrypted,
+			RecipientKeyVersion: req.KeyVersion,
+			KeyVersions:         req.KeyVersions,
+			SeqNo:               req.SeqNo,
+			Signature:           req.Signature,
+			IsAck:               req.IsAck,
+			FontFamily:          req.FontFamily,
+			FontSize:            req.FontSize,
+			SendAt:              *req.SendAt,
+			ReplyBy:             req.ReplyBy,
+			AttachmentIDs:       req.AttachmentIDs,
+		}) {
+			s.discardDraft(draft)
 		}
-		if m.To != deskID {
-			recipientID = m.To
-			break
-		}
-	}
-
-	if recipientID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Could not determine recipient"})
 		return
 	}
 
-	// Create reply miv
-	miv := &models.ConversationMiv{
-		ConversationID: conversationID,
-		From:           deskID,
-		To:             recipientID,
-		Subject:        conv.Subject,
-		Body:           base64.StdEncoding.EncodeToString([]byte(req.Body)),
-		State:          models.StateSENT, // Use SENT state for replies
-		IsEncrypted:    false,
-		IsAck:          req.IsAck,
-		FontFamily:     req.FontFamily,
-		FontSize:       req.FontSize,
-	}
-
-	if err := s.storage.CreateConversationMiv(miv); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reply"})
+	miv, err := s.sendReply(desk, conv, mivs, &req, "")
+	if err != nil {
+		respondError(c, err, "Failed to create reply")
 		return
 	}
+	s.discardDraft(draft)
 
-	// If conversation was archived but we got a reply, unarchive it
-	if conv.IsArchived {
-		conv.IsArchived = false
-		s.storage.UpdateConversation(conv)
-	}
-
-	// If this is an ACK, archive the conversation for the sender
-	if req.IsAck {
-		conv.IsArchived = true
-		s.storage.UpdateConversation(conv)
-	}
-
-	// Create notification for recipient
-	notifType := models.NotificationTypeReply
-	message := fmt.Sprintf("Reply from %s in: %s", deskID, conv.Subject)
-	if req.IsAck {
-		message = fmt.Sprintf("ACK from %s in: %s", deskID, conv.Subject)
-	}
-
-	notification := &models.Notification{
-		DeskID:         recipientID,
-		Type:           notifType,
-		MivID:          miv.ID,
-		ConversationID: conversationID,
-		Message:        message,
-		Read:           false,
-	}
-	s.storage.CreateNotification(notification)
-
-	c.JSON(http.StatusCreated, miv)
+	c.JSON(http.StatusCreated, s.openMiv(desk, miv))
 }
 
 func (s *Server) archiveConversation(c *gin.Context) {
 	conversationID := c.Param("id")
 
+	desk, ok := s.authorizeDesk(c, requestDeskID(c))
+	if !ok {
+		return
+	}
+
 	// Get conversation
-	conv, err := s.storage.GetConversation(conversationID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+	conv, _, ok := s.authorizeConversation(c, conversationID, desk)
+	if !ok {
 		return
 	}
 
-	// Archive the conversation
-	conv.IsArchived = true
-	if err := s.storage.UpdateConversation(conv); err != nil {
+	// Archive the conversation for this desk only
+	archived := true
+	state, _, err := s.storage.UpdateConversationState(conv.ID, desk.ID, storage.ConversationStateChange{IsArchived: &archived})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to archive conversation"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Conversation archived successfully", "conversation": conv})
+	c.JSON(http.StatusOK, gin.H{"message": "Conversation archived successfully", "conversation": deskConversation(conv, state)})
 }
 
 // Notification handlers
 
 func (s *Server) listNotifications(c *gin.Context) {
-	deskID := c.Query("desk_id")
-	if deskID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "desk_id is required"})
+	desk, ok := s.authorizeDesk(c, requestDeskID(c))
+	if !ok {
 		return
 	}
 
-	unreadOnly := c.Query("unread_only") == "true"
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+	since, until, ok := timeRange(c)
+	if !ok {
+		return
+	}
 
-	notifications, err := s.storage.ListNotificationsByDesk(deskID, unreadOnly)
+	notifications, err := s.storage.ListNotificationPage(desk.ID, storage.NotificationQuery{
+		UnreadOnly: c.Query("unread_only") == "true",
+		Since:      since,
+		Until:      until,
+		After:      after,
+		Limit:      limit + 1,
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	notifications, nextCursor := nextPage(notifications, limit, storage.NotificationCursor)
 
-	unreadCount := 0
-	for _, notif := range notifications {
-		if !notif.Read {
-			unreadCount++
-		}
+	// The unread count covers every page, not just this one
+	unreadCount, err := s.storage.CountUnreadNotifications(desk.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
 	c.JSON(http.StatusOK, models.ListNotificationsResponse{
 		Notifications: notifications,
 		UnreadCount:   unreadCount,
 		Total:         len(notifications),
+		NextCursor:    nextCursor,
 	})
 }
 
@@ -741,23 +702,26 @@ func (s *Server) markNotificationAsRead(c *gin.Context) {
 		return
 	}
 
+	// Only the desk a notification was delivered to may acknowledge it
+	if _, ok := s.authorizeDesk(c, notif.DeskID); !ok {
+		return
+	}
+
 	if err := s.storage.MarkNotificationAsRead(notificationID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to mark notification as read"})
 		return
 	}
 
-	// If it's a read receipt notification, update the miv state
+	// Mivs sent before read receipts existed may still be in the deprecated
+	// OUT or UNANSWERED states; a receipt moves them to SENT with the read time
 	if notif.Type == models.NotificationTypeReadReceipt {
-		// Get all conversation mivs
-		mivs, err := s.storage.GetConversationMivs(notif.ConversationID)
-		if err == nil {
-			for _, miv := range mivs {
-				if miv.ID == notif.MivID && miv.State == models.StateOUT {
-					miv.State = models.StateUNANSWERED
-					s.storage.UpdateConversationMiv(miv)
-					break
-				}
+		miv, err := s.storage.GetConversationMiv(notif.MivID)
+		if err == nil && (miv.State == models.StateOUT || miv.State == models.StateUNANSWERED) {
+			miv.State = models.StateSENT
+			if miv.ReadAt == nil {
+				miv.ReadAt = notif.MivReadAt
 			}
+			s.storage.UpdateConversationMiv(miv)
 		}
 	}
 
@@ -768,16 +732,23 @@ func (s *Server) markNotificationAsRead(c *gin.Context) {
 
 func (s *Server) markMivAsRead(c *gin.Context) {
 	mivID := c.Param("id")
-	deskID := c.Query("desk_id")
 
-	// If desk_id is not provided, try to get it from the active desk
-	// For now, we require desk_id to be explicitly provided
-	if deskID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "desk_id is required"})
+	desk, ok := s.authorizeDesk(c, requestDeskID(c))
+	if !ok {
+		return
+	}
+
+	miv, ok := s.authorizeMiv(c, mivID, desk)
+	if !ok {
 		return
 	}
+	// Each recipient reads its own copy
+	alreadyRead := false
+	if r := mivRecipient(miv, desk.ID); r != nil {
+		alreadyRead = r.ReadAt != nil
+	}
 
-	if err := s.storage.MarkConversationMivAsRead(mivID, deskID); err != nil {
+	if err := s.storage.MarkConversationMivAsRead(mivID, desk.ID); err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
@@ -788,8 +759,28 @@ func (s *Server) markMivAsRead(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get updated miv"})
 		return
 	}
+	// The sender hears about the first read only, and only if this desk
+	// shared read receipts when it read the miv
+	if r := mivRecipient(miv, desk.ID); !alreadyRead && r != nil && !r.ReceiptWithheld {
+		s.sendReadReceipt(desk, miv, r.ReadAt)
+	}
+
+	c.JSON(http.StatusOK, s.openMiv(desk, miv))
+}
 
-	c.JSON(http.StatusOK, miv)
+// sendReadReceipt notifies a miv's sender that the reader desk has read it
+func (s *Server) sendReadReceipt(reader *models.Desk, miv *models.ConversationMiv, readAt *time.Time) {
+	notification := &models.Notification{
+		DeskID:         crypto.NormalizeDeskID(miv.From),
+		Type:           models.NotificationTypeReadReceipt,
+		MivID:          miv.ID,
+		ConversationID: miv.ConversationID,
+		Message:        fmt.Sprintf("Read by %s: %s", reader.ID, miv.Subject),
+		MivReadAt:      readAt,
+	}
+	if err := s.storage.CreateNotification(notification); err != nil {
+		log.Printf("Failed to send read receipt for miv %s: %v", miv.ID, err)
+	}
 }
 
 // Miv forget handler
@@ -797,10 +788,20 @@ func (s *Server) markMivAsRead(c *gin.Context) {
 func (s *Server) forgetMiv(c *gin.Context) {
 	mivID := c.Param("id")
 
+	desk, ok := s.authorizeDesk(c, requestDeskID(c))
+	if !ok {
+		return
+	}
+
 	// Get the miv first to validate it exists
-	miv, err := s.storage.GetConversationMiv(mivID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Miv not found"})
+	miv, ok := s.authorizeMiv(c, mivID, desk)
+	if !ok {
+		return
+	}
+
+	// Only the sender tracks replies, so only the sender can forget
+	if miv.From != desk.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the sender can forget a miv"})
 		return
 	}
 
@@ -810,8 +811,7 @@ func (s *Server) forgetMiv(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to forget miv"})
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Miv forgotten successfully", "miv": miv})
+	c.JSON(http.StatusOK, gin.H{"message": "Miv forgotten successfully", "miv": s.openMiv(desk, miv)})
 }
 
 // Contact handlers
@@ -825,15 +825,14 @@ func (s *Server) createContact(c *gin.Context) {
 		return
 	}
 
-	// Verify desk exists
-	_, err := s.storage.GetDesk(deskID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Desk not found"})
+	// Verify desk exists and belongs to the caller
+	desk, ok := s.authorizeDesk(c, deskID)
+	if !ok {
 		return
 	}
 
 	contact := &models.Contact{
-		DeskID:       deskID,
+		DeskID:       desk.ID,
 		Name:         req.Name,
 		FirstName:    req.FirstName,
 		LastName:     req.LastName,
@@ -847,28 +846,41 @@ func (s *Server) createContact(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, contact)
+	c.JSON(http.StatusCreated, s.withKeyStatus(contact, map[string]string{}))
 }
 
 func (s *Server) listContacts(c *gin.Context) {
 	deskID := c.Param("desk_id")
 
-	// Verify desk exists
-	_, err := s.storage.GetDesk(deskID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Desk not found"})
+	// Verify desk exists and belongs to the caller
+	desk, ok := s.authorizeDesk(c, deskID)
+	if !ok {
 		return
 	}
 
-	contacts, err := s.storage.ListContactsForDesk(deskID)
+	limit, after, ok := pageParams(c)
+	if !ok {
+		return
+	}
+
+	contacts, err := s.storage.ListContactPage(desk.ID, storage.ContactQuery{After: after, Limit: limit + 1})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list contacts"})
 		return
 	}
+	contacts, nextCursor := nextPage(contacts, limit, storage.ContactCursor)
+
+	// Flag contacts whose pinned fingerprint no longer matches
+	fingerprints := make(map[string]string)
+	withStatus := make([]*models.Contact, 0, len(contacts))
+	for _, contact := range contacts {
+		withStatus = append(withStatus, s.withKeyStatus(contact, fingerprints))
+	}
 
 	response := &models.ListContactsResponse{
-		Contacts: contacts,
-		Total:    len(contacts),
+		Contacts:   withStatus,
+		Total:      len(withStatus),
+		NextCursor: nextCursor,
 	}
 
 	c.JSON(http.StatusOK, response)
@@ -883,7 +895,11 @@ func (s *Server) getContact(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, contact)
+	if _, ok := s.authorizeDesk(c, contact.DeskID); !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, s.withKeyStatus(contact, map[string]string{}))
 }
 
 func (s *Server) updateContact(c *gin.Context) {
@@ -902,6 +918,10 @@ func (s *Server) updateContact(c *gin.Context) {
 		return
 	}
 
+	if _, ok := s.authorizeDesk(c, existing.DeskID); !ok {
+		return
+	}
+
 	// Update fields
 	if req.Name != "" {
 		existing.Name = req.Name
@@ -910,8 +930,11 @@ func (s *Server) updateContact(c *gin.Context) {
 	existing.FirstName = req.FirstName
 	existing.LastName = req.LastName
 	existing.GreetingName = req.GreetingName
-	if req.DeskIDRef != "" {
+	if req.DeskIDRef != "" && req.DeskIDRef != existing.DeskIDRef {
+		// A pinned fingerprint belongs to the old desk
 		existing.DeskIDRef = req.DeskIDRef
+		existing.PinnedFingerprint = ""
+		existing.PinnedAt = nil
 	}
 	existing.Notes = req.Notes
 
@@ -920,209 +943,28 @@ func (s *Server) updateContact(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, existing)
+	c.JSON(http.StatusOK, s.withKeyStatus(existing, map[string]string{}))
 }
 
 func (s *Server) deleteContact(c *gin.Context) {
 	contactID := c.Param("contact_id")
 
-	if err := s.storage.DeleteContact(contactID); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Contact not found"})
-		return
-	}
-
-	c.JSON(http.StatusNoContent, nil)
-}
-
-// Upload handler - Production implementation
-func (s *Server) uploadFile(c *gin.Context) {
-	// Get the file from the request
-	file, err := c.FormFile("upload")
-	if err != nil {
-		log.Printf("Upload error: No file in request - %v", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
-		return
-	}
-
-	// Validate file size (limit to 10MB)
-	if file.Size > maxFileSize {
-		log.Printf("Upload error: File too large - %d bytes (max: %d)", file.Size, maxFileSize)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File too large. Maximum size is 10MB"})
-		return
-	}
-
-	// Validate file type (only images)
-	contentType := file.Header.Get("Content-Type")
-	allowedTypes := map[string]string{
-		"image/jpeg": ".jpg",
-		"image/jpg":  ".jpg",
-		"image/png":  ".png",
-		"image/gif":  ".gif",
-		"image/webp": ".webp",
-	}
-
-	expectedExt, validContentType := allowedTypes[contentType]
-	if !validContentType {
-		log.Printf("Upload error: Invalid content type - %s", contentType)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file type. Only images are allowed"})
-		return
-	}
-
-	// Additional security: Validate file signature (magic bytes)
-	// Note: This validates the file header but does not protect against polyglot files
-	// (files with valid image headers but malicious payloads). For higher security,
-	// consider re-encoding images or using a dedicated image validation library.
-	// Open the file to read the first few bytes
-	fileContent, err := file.Open()
-	if err != nil {
-		log.Printf("Upload error: Failed to open file - %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
-		return
-	}
-	defer fileContent.Close()
-
-	// Read the first 512 bytes for magic number validation
-	buffer := make([]byte, 512)
-	_, err = fileContent.Read(buffer)
-	if err != nil {
-		log.Printf("Upload error: Failed to read file header - %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file header"})
-		return
-	}
-
-	// Validate magic bytes for common image formats
-	isValidImage := false
-	detectedExt := ""
-	
-	// JPEG: FF D8 FF
-	if len(buffer) >= 3 && buffer[0] == 0xFF && buffer[1] == 0xD8 && buffer[2] == 0xFF {
-		isValidImage = true
-		detectedExt = ".jpg"
-	}
-	// PNG: 89 50 4E 47
-	if len(buffer) >= 4 && buffer[0] == 0x89 && buffer[1] == 0x50 && buffer[2] == 0x4E && buffer[3] == 0x47 {
-		isValidImage = true
-		detectedExt = ".png"
-	}
-	// GIF: 47 49 46
-	if len(buffer) >= 3 && buffer[0] == 0x47 && buffer[1] == 0x49 && buffer[2] == 0x46 {
-		isValidImage = true
-		detectedExt = ".gif"
-	}
-	// WebP: 52 49 46 46 (RIFF) with "WEBP" at offset 8
-	if len(buffer) >= 12 && buffer[0] == 0x52 && buffer[1] == 0x49 && buffer[2] == 0x46 && buffer[3] == 0x46 &&
-		buffer[8] == 0x57 && buffer[9] == 0x45 && buffer[10] == 0x42 && buffer[11] == 0x50 {
-		isValidImage = true
-		detectedExt = ".webp"
-	}
-
-	if !isValidImage {
-		log.Printf("Upload error: File magic bytes do not match any supported image format")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File is not a valid image"})
-		return
-	}
-
-	// Validate that the detected file type matches the declared content type
-	if detectedExt != expectedExt {
-		log.Printf("Upload error: Content-Type mismatch - declared: %s (%s), detected: %s", 
-			contentType, expectedExt, detectedExt)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File type mismatch. The file content does not match the declared type"})
-		return
-	}
-
-	// Sanitize the original filename to prevent path traversal attacks
-	// Use a whitelist approach: only allow alphanumeric, dash, underscore, and dot
-	sanitizedFilename := sanitizeFilename(file.Filename)
-	
-	// Extract and validate the file extension
-	ext := filepath.Ext(sanitizedFilename)
-	if ext == "" || len(ext) > maxFileExtLength {
-		// If no extension or suspicious extension, use the detected one
-		ext = detectedExt
-	}
-
-	// Generate cryptographically secure unique filename
-	uniqueID, err := generateUniqueID()
+	contact, err := s.storage.GetContact(contactID)
 	if err != nil {
-		log.Printf("Upload error: Failed to generate unique ID - %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate unique filename"})
-		return
-	}
-
-	// Construct filename: uniqueID + timestamp + extension
-	filename := fmt.Sprintf("%s_%d%s", uniqueID, time.Now().Unix(), ext)
-
-	// Define upload directory (configurable via environment variable)
-	uploadDir := os.Getenv("UPLOAD_DIR")
-	if uploadDir == "" {
-		uploadDir = "./uploads"
-	}
-
-	// Create uploads directory if it doesn't exist
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		log.Printf("Upload error: Failed to create upload directory - %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "Contact not found"})
 		return
 	}
 
-	// Use filepath.Join for safe path construction
-	filePath := filepath.Join(uploadDir, filename)
-	
-	// Additional security: Ensure the final path is still within the upload directory
-	absUploadDir, err := filepath.Abs(uploadDir)
-	if err != nil {
-		log.Printf("Upload error: Failed to get absolute path of upload directory - %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
-		return
-	}
-	
-	absFilePath, err := filepath.Abs(filePath)
-	if err != nil {
-		log.Printf("Upload error: Failed to get absolute path of file - %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
-		return
-	}
-	
-	if !strings.HasPrefix(absFilePath, absUploadDir) {
-		log.Printf("Upload error: Path traversal attempt detected - file path outside upload directory")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filename"})
+	if _, ok := s.authorizeDesk(c, contact.DeskID); !ok {
 		return
 	}
 
-	// Save the file
-	if err := c.SaveUploadedFile(file, filePath); err != nil {
-		log.Printf("Upload error: Failed to save file - %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+	if err := s.storage.DeleteContact(contactID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Contact not found"})
 		return
 	}
 
-	// Return the full URL where the file can be accessed
-	// Get server URL from environment or use default
-	// Note: For production deployments, SERVER_URL should be set to prevent
-	// Host header injection attacks. The Host header fallback is only for development.
-	serverURL := os.Getenv("SERVER_URL")
-	if serverURL == "" {
-		// Construct from request or use default (development only)
-		// WARNING: In production, always set SERVER_URL environment variable
-		// to avoid potential Host header injection vulnerabilities
-		scheme := "http"
-		if c.Request.TLS != nil {
-			scheme = "https"
-		}
-		host := c.Request.Host
-		if host == "" {
-			host = "localhost:8080"
-		}
-		serverURL = fmt.Sprintf("%s://%s", scheme, host)
-	}
-	
-	fileURL := fmt.Sprintf("%s/uploads/%s", serverURL, filename)
-	
-	log.Printf("File uploaded successfully: %s (size: %d bytes, type: %s)", filename, file.Size, contentType)
-
-	c.JSON(http.StatusOK, gin.H{
-		"url": fileURL,
-	})
+	c.JSON(http.StatusNoContent, nil)
 }
 
 // sanitizeFilename removes potentially dangerous characters from filenames
@@ -1130,18 +972,18 @@ func (s *Server) uploadFile(c *gin.Context) {
 func sanitizeFilename(filename string) string {
 	// Remove any path components
 	filename = filepath.Base(filename)
-	
+
 	// Replace spaces with underscores
 	filename = strings.ReplaceAll(filename, " ", "_")
-	
+
 	// Use package-level regex to keep only safe characters: alphanumeric, dot, hyphen, underscore
 	filename = safeFilenameRegex.ReplaceAllString(filename, "")
-	
+
 	// Prevent filenames that start with a dot (hidden files)
 	if strings.HasPrefix(filename, ".") {
 		filename = "file" + filename
 	}
-	
+
 	// Limit filename length using package-level constant
 	if len(filename) > maxFilenameLength {
 		ext := filepath.Ext(filename)
@@ -1151,15 +993,6 @@ func sanitizeFilename(filename string) string {
 		}
 		filename = nameWithoutExt + ext
 	}
-	
-	return filename
-}
 
-// generateUniqueID creates a cryptographically secure random identifier
-func generateUniqueID() (string, error) {
-	bytes := make([]byte, 16) // 128 bits of randomness
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(bytes), nil
+	return filename
 }
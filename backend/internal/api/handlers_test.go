@@ -8,13 +8,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/textproto"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/models"
 )
 
 // testPNGData represents a valid 1x1 PNG image
@@ -26,15 +26,68 @@ var testPNGData = []byte{
 	0xDE, 0x00, 0x00, 0x00, 0x0C, 0x49, 0x44, 0x41,
 	0x54, 0x08, 0xD7, 0x63, 0xF8, 0xCF, 0xC0, 0x00,
 	0x00, 0x03, 0x01, 0x01, 0x00, 0x18, 0xDD, 0x8D,
-	0xB4, 0x00, 0x00, 0x00, 0x00, 0x49, 0x45, 0x4E,
+	0xB0, 0x00, 0x00, 0x00, 0x00, 0x49, 0x45, 0x4E,
 	0x44, 0xAE, 0x42, 0x60, 0x82,
 }
 
+// registerTestAccount registers an account through the API and returns its login response
+func registerTestAccount(t *testing.T, server *Server, username string) models.LoginResponse {
+	t.Helper()
+
+	payload, _ := json.Marshal(models.RegisterRequest{
+		Username:     username,
+		Password:     "password123",
+		DisplayName:  username,
+		Birthday:     "2000-01-01",
+		FirstPetName: "Rex",
+		MotherMaiden: "Smith",
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/accounts/register", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to register %s: %d %s", username, w.Code, w.Body.String())
+	}
+
+	var response models.LoginResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse register response: %v", err)
+	}
+
+	return response
+}
+
+// doRequest performs an authenticated JSON request against the server
+func doRequest(t *testing.T, server *Server, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("Failed to encode request body: %v", err)
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
 // createUploadRequest creates a multipart form request with the given image data
-func createUploadRequest(imageData []byte, filename string) (*http.Request, error) {
+func createUploadRequest(imageData []byte, filename string, token string) (*http.Request, error) {
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
-	
+
 	// Create form file with proper content type header
 	h := make(textproto.MIMEHeader)
 	h.Set("Content-Disposition", `form-data; name="upload"; filename="`+filename+`"`)
@@ -43,12 +96,12 @@ func createUploadRequest(imageData []byte, filename string) (*http.Request, erro
 	if err != nil {
 		return nil, err
 	}
-	
+
 	_, err = io.Copy(part, bytes.NewReader(imageData))
 	if err != nil {
 		return nil, err
 	}
-	
+
 	err = writer.Close()
 	if err != nil {
 		return nil, err
@@ -56,8 +109,9 @@ func createUploadRequest(imageData []byte, filename string) (*http.Request, erro
 
 	req := httptest.NewRequest(http.MethodPost, "/api/upload", body)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
 	req.Host = "localhost:8080"
-	
+
 	return req, nil
 }
 
@@ -73,8 +127,10 @@ func TestUploadFile_ReturnsFullURL(t *testing.T) {
 	os.Setenv("UPLOAD_DIR", tmpDir)
 	defer os.Unsetenv("UPLOAD_DIR")
 
+	login := registerTestAccount(t, server, "uploader")
+
 	// Create request
-	req, err := createUploadRequest(testPNGData, "test.png")
+	req, err := createUploadRequest(testPNGData, "test.png", login.Token)
 	if err != nil {
 		t.Fatalf("Failed to create upload request: %v", err)
 	}
@@ -106,17 +162,17 @@ func TestUploadFile_ReturnsFullURL(t *testing.T) {
 	}
 
 	// Verify URL format includes full server URL
-	if !strings.HasPrefix(urlStr, "http://localhost:8080/uploads/") {
-		t.Errorf("Expected URL to start with 'http://localhost:8080/uploads/', got: %s", urlStr)
+	if !strings.HasPrefix(urlStr, "http://localhost:8080/api/attachments/") {
+		t.Errorf("Expected URL to start with 'http://localhost:8080/api/attachments/', got: %s", urlStr)
 	}
 
 	// Verify the file was actually saved
-	parsedURL, err := url.Parse(urlStr)
+	id, _ := response["id"].(string)
+	attachment, err := server.storage.GetAttachment(id)
 	if err != nil {
-		t.Fatalf("Failed to parse URL: %v", err)
+		t.Fatalf("Failed to get attachment %q: %v", id, err)
 	}
-	filename := filepath.Base(parsedURL.Path)
-	savedPath := filepath.Join(tmpDir, filename)
+	savedPath := filepath.Join(tmpDir, attachment.StorageKey)
 	if _, err := os.Stat(savedPath); os.IsNotExist(err) {
 		t.Errorf("Expected file to be saved at %s, but it doesn't exist", savedPath)
 	}
@@ -138,8 +194,10 @@ func TestUploadFile_WithServerURLEnv(t *testing.T) {
 	os.Setenv("SERVER_URL", "https://example.com")
 	defer os.Unsetenv("SERVER_URL")
 
+	login := registerTestAccount(t, server, "uploader")
+
 	// Create request
-	req, err := createUploadRequest(testPNGData, "test.png")
+	req, err := createUploadRequest(testPNGData, "test.png", login.Token)
 	if err != nil {
 		t.Fatalf("Failed to create upload request: %v", err)
 	}
@@ -171,7 +229,56 @@ func TestUploadFile_WithServerURLEnv(t *testing.T) {
 	}
 
 	// Verify URL uses the SERVER_URL environment variable
-	if !strings.HasPrefix(urlStr, "https://example.com/uploads/") {
-		t.Errorf("Expected URL to start with 'https://example.com/uploads/', got: %s", urlStr)
+	if !strings.HasPrefix(urlStr, "https://example.com/api/attachments/") {
+		t.Errorf("Expected URL to start with 'https://example.com/api/attachments/', got: %s", urlStr)
+	}
+}
+
+func TestReadReceipts(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+
+	receipts := func() []*models.Notification {
+		notifications, _ := f.server.storage.ListNotificationsByDesk(aliceDesk, false)
+		var result []*models.Notification
+		for _, n := range notifications {
+			if n.Type == models.NotificationTypeReadReceipt {
+				result = append(result, n)
+			}
+		}
+		return result
+	}
+
+	// Only the first read sends a receipt
+	doRequest(t, f.server, http.MethodPost, "/api/mivs/"+f.mivID+"/read?desk_id="+bobDesk, f.bob.Token, nil)
+	doRequest(t, f.server, http.MethodPost, "/api/mivs/"+f.mivID+"/read?desk_id="+bobDesk, f.bob.Token, nil)
+	sent := receipts()
+	if len(sent) != 1 || sent[0].MivID != f.mivID || sent[0].MivReadAt == nil {
+		t.Fatalf("Expected one read receipt with the read time, got %+v", sent)
+	}
+
+	// Mivs from before receipts move from the deprecated states to SENT
+	miv, _ := f.server.storage.GetConversationMiv(f.mivID)
+	miv.State = models.StateOUT
+	f.server.storage.UpdateConversationMiv(miv)
+	w := doRequest(t, f.server, http.MethodPost, "/api/notifications/"+sent[0].ID+"/read?desk_id="+aliceDesk, f.alice.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to mark receipt read: %d %s", w.Code, w.Body.String())
+	}
+	if miv, _ := f.server.storage.GetConversationMiv(f.mivID); miv.State != models.StateSENT || miv.ReadAt == nil {
+		t.Errorf("Expected SENT with a read time, got %s %v", miv.State, miv.ReadAt)
+	}
+
+	// A desk with receipts turned off reads silently
+	off := true
+	doRequest(t, f.server, http.MethodPut, "/api/desks/"+bobDesk, f.bob.Token, models.UpdateDeskRequest{DisableReadReceipts: &off})
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Subject: "Again", Body: "Hi again"})
+	var conv models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &conv)
+	doRequest(t, f.server, http.MethodPost, "/api/mivs/"+conv.Mivs[0].ID+"/read?desk_id="+bobDesk, f.bob.Token, nil)
+	if len(receipts()) != 1 {
+		t.Errorf("Expected no receipt from a desk with receipts disabled")
 	}
 }
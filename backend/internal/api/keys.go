@@ -0,0 +1,196 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+	"github.com/jadefox10200/missiv/backend/internal/storage"
+)
+
+// KeyCustody selects who holds desk private keys
+type KeyCustody string
+
+const (
+	// KeyCustodyServer lets the server generate and hold desk keys when the
+	// client does not supply its own public key (default)
+	KeyCustodyServer KeyCustody = "server"
+	// KeyCustodyClient refuses to hold private keys at all: every desk must
+	// be created with a client-generated public key and every body must
+	// arrive already sealed
+	KeyCustodyClient KeyCustody = "client"
+)
+
+// ParseKeyCustody validates a key custody mode, defaulting to KeyCustodyServer
+func ParseKeyCustody(mode string) (KeyCustody, error) {
+	switch KeyCustody(mode) {
+	case "", KeyCustodyServer:
+		return KeyCustodyServer, nil
+	case KeyCustodyClient:
+		return KeyCustodyClient, nil
+	default:
+		return "", fmt.Errorf("unknown key custody mode: %q", mode)
+	}
+}
+
+// SetKeyCustody changes who is allowed to hold desk private keys
+func (s *Server) SetKeyCustody(mode KeyCustody) {
+	s.keyCustody = mode
+}
+
+// clientKeysOnly reports whether the server refuses to hold private keys
+func (s *Server) clientKeysOnly() bool {
+	return s.keyCustody == KeyCustodyClient
+}
+
+// newDeskKeys returns the key material for a new desk: a Curve25519 key for
+// sealing and an Ed25519 key for signing. Client-supplied public keys must
+// come as a pair and are used as-is with no private keys on the server;
+// otherwise both pairs are generated server-side when custody allows it.
+// On failure the error response has been written and ok is false.
+func (s *Server) newDeskKeys(c *gin.Context, clientPublicKey, clientSigningKey string) (publicKey, signingKey string, privateKeys *storage.DeskPrivateKeys, ok bool) {
+	if clientPublicKey != "" || clientSigningKey != "" {
+		if _, err := crypto.PublicKeyFromBase64(clientPublicKey); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid public key: " + err.Error()})
+			return "", "", nil, false
+		}
+		if _, err := crypto.SigningKeyFromBase64(clientSigningKey); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signing key: " + err.Error()})
+			return "", "", nil, false
+		}
+		return clientPublicKey, clientSigningKey, nil, true
+	}
+
+	if s.clientKeysOnly() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This server does not hold private keys; a client-generated public_key and signing_key are required"})
+		return "", "", nil, false
+	}
+
+	keyPair, err := crypto.GenerateKeyPair()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate key pair"})
+		return "", "", nil, false
+	}
+	signingPair, err := crypto.GenerateSigningKeyPair()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate signing key pair"})
+		return "", "", nil, false
+	}
+	privateKeys = &storage.DeskPrivateKeys{BoxKey: keyPair.PrivateKey, SigningKey: signingPair.PrivateKey}
+	return crypto.PublicKeyToBase64(keyPair.PublicKey), crypto.SigningKeyToBase64(signingPair.PublicKey), privateKeys, true
+}
+
+// rotateDeskKey replaces a desk's key pair. The old pair is kept as a
+// retired version so mivs sealed to it still open; new mivs use the new one.
+func (s *Server) rotateDeskKey(c *gin.Context) {
+	var req models.RotateDeskKeyRequest
+
+	// The body is optional: server-custody desks can rotate without one
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	desk, ok := s.authorizeDesk(c, c.Param("desk_id"))
+	if !ok {
+		return
+	}
+
+	// A desk whose key the client holds must be rotated by the client, or
+	// the server would end up holding its private key
+	if req.PublicKey == "" && req.SigningKey == "" {
+		if _, err := s.storage.GetDeskPrivateKey(desk.ID, 0); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "This desk holds its own keys; a client-generated public_key and signing_key are required"})
+			return
+		}
+	}
+
+	publicKey, signingKey, privateKeys, ok := s.newDeskKeys(c, req.PublicKey, req.SigningKey)
+	if !ok {
+		return
+	}
+
+	rotated, err := s.storage.RotateDeskKey(desk.ID, publicKey, signingKey, privateKeys)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate desk key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, rotated)
+}
+
+// Key backup handlers. The blob is wrapped on the client
+// (crypto.WrapKeyBundle); the server checks its shape but never has the
+// password to open it.
+
+func (s *Server) getKeyBackup(c *gin.Context) {
+	desk, ok := s.authorizeDesk(c, c.Param("desk_id"))
+	if !ok {
+		return
+	}
+
+	backup, err := s.storage.GetKeyBackup(desk.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No key backup for this desk"})
+		return
+	}
+
+	c.JSON(http.StatusOK, backup)
+}
+
+func (s *Server) uploadKeyBackup(c *gin.Context) {
+	var req models.UploadKeyBackupRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	desk, ok := s.authorizeDesk(c, c.Param("desk_id"))
+	if !ok {
+		return
+	}
+
+	s.saveKeyBackup(c, desk.ID, req.Blob, 0, http.StatusCreated)
+}
+
+func (s *Server) rotateKeyBackup(c *gin.Context) {
+	var req models.RotateKeyBackupRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	desk, ok := s.authorizeDesk(c, c.Param("desk_id"))
+	if !ok {
+		return
+	}
+
+	s.saveKeyBackup(c, desk.ID, req.Blob, req.Version, http.StatusOK)
+}
+
+// saveKeyBackup validates and stores a blob, answering 409 when
+// expectedVersion is stale
+func (s *Server) saveKeyBackup(c *gin.Context, deskID, blob string, expectedVersion int, status int) {
+	if err := crypto.ValidateWrappedKey(blob); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	backup := &models.KeyBackup{DeskID: deskID, Blob: blob}
+	if err := s.storage.SaveKeyBackup(backup, expectedVersion); err != nil {
+		if errors.Is(err, storage.ErrVersionConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Key backup has changed; fetch the current version and retry"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save key backup"})
+		return
+	}
+
+	c.JSON(status, backup)
+}
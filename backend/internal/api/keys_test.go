@@ -0,0 +1,471 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// clientKeys are a desk's key pairs as held by a client
+type clientKeys struct {
+	*crypto.KeyPair
+	Signing *crypto.SigningKeyPair
+}
+
+// newClientKeys generates a desk's key pairs on the "client"
+func newClientKeys(t *testing.T) *clientKeys {
+	t.Helper()
+
+	keyPair, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	signing, err := crypto.GenerateSigningKeyPair()
+	if err != nil {
+		t.Fatalf("Failed to generate signing key pair: %v", err)
+	}
+	return &clientKeys{KeyPair: keyPair, Signing: signing}
+}
+
+// publicKeys returns the base64 public halves sent to the server
+func (k *clientKeys) publicKeys() (publicKey, signingKey string) {
+	return crypto.PublicKeyToBase64(k.PublicKey), crypto.SigningKeyToBase64(k.Signing.PublicKey)
+}
+
+// wrap wraps the keys as the only version in a key backup
+func (k *clientKeys) wrap(password, deskID string) (string, error) {
+	return crypto.WrapKeyBundle(&crypto.KeyBundle{Keys: []crypto.BundledKey{k.bundled(1)}}, password, deskID)
+}
+
+// bundled returns the keys as a version in a key backup
+func (k *clientKeys) bundled(version int) crypto.BundledKey {
+	return crypto.BundledKey{Version: version, BoxKey: k.PrivateKey[:], SigningKey: k.Signing.PrivateKey.Seed()}
+}
+
+// sign signs a miv the way a client would before sending it
+func (k *clientKeys) sign(miv *models.ConversationMiv) string {
+	return crypto.SignMiv(k.Signing.PrivateKey, signedFields(miv))
+}
+
+// registerClientKeyedAccount registers an account whose first desk uses key
+// pairs generated on the "client"
+func registerClientKeyedAccount(t *testing.T, server *Server, username string) (models.LoginResponse, *clientKeys) {
+	t.Helper()
+
+	keys := newClientKeys(t)
+	publicKey, signingKey := keys.publicKeys()
+
+	w := doRequest(t, server, http.MethodPost, "/api/accounts/register", "", models.RegisterRequest{
+		Username:     username,
+		Password:     "password123",
+		DisplayName:  username,
+		Birthday:     "2000-01-01",
+		FirstPetName: "Rex",
+		MotherMaiden: "Smith",
+		PublicKey:    publicKey,
+		SigningKey:   signingKey,
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to register %s: %d %s", username, w.Code, w.Body.String())
+	}
+
+	var response models.LoginResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return response, keys
+}
+
+func TestClientKeyedDesksKeepPrivateKeysOffServer(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+
+	alice, aliceKeys := registerClientKeyedAccount(t, server, "alice")
+	bob, bobKeys := registerClientKeyedAccount(t, server, "bob")
+	aliceDesk := alice.Account.ActiveDesk
+	bobDesk := bob.Account.ActiveDesk
+
+	if _, err := server.storage.GetDeskPrivateKey(aliceDesk, 0); err == nil {
+		t.Errorf("Expected no server-held private key for a client-keyed desk")
+	}
+
+	// Bob's client looks up alice's key in the directory
+	w := doRequest(t, server, http.MethodGet, "/api/desks/"+aliceDesk+"/publickey", bob.Token, nil)
+	var directory struct {
+		PublicKey string `json:"public_key"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &directory)
+	if w.Code != http.StatusOK || directory.PublicKey != crypto.PublicKeyToBase64(aliceKeys.PublicKey) {
+		t.Fatalf("Expected alice's public key, got %d %s", w.Code, w.Body.String())
+	}
+
+	// Plaintext cannot be sealed without a server-held sender key
+	w = doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Subject: "Hello", Body: "Hi Bob"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected plaintext from client-keyed desk to be rejected, got %d", w.Code)
+	}
+
+	w = doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Subject: "Hello", Body: "bm90IGEgYm94", IsEncrypted: true, KeyVersion: 1})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected malformed ciphertext to be rejected, got %d", w.Code)
+	}
+
+	sealed, _ := crypto.Encrypt([]byte("Hi Bob"), bobKeys.PublicKey, aliceKeys.PrivateKey)
+	body := base64.StdEncoding.EncodeToString(sealed)
+	w = doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Subject: "Hello", Body: body, IsEncrypted: true, KeyVersion: 1})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unsigned miv from a client-keyed desk to be rejected, got %d", w.Code)
+	}
+
+	convID := "conv-chosen-by-alice"
+	signature := aliceKeys.sign(&models.ConversationMiv{ConversationID: convID, SeqNo: 1, From: aliceDesk, To: bobDesk, Subject: "Hello", Body: body})
+	w = doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token,
+		models.CreateConversationRequest{ConversationID: convID, To: bobDesk, Subject: "Hello", Body: body, IsEncrypted: true, Signature: signature})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a body without the key version it is sealed to be rejected, got %d", w.Code)
+	}
+
+	w = doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token,
+		models.CreateConversationRequest{ConversationID: convID, To: bobDesk, Subject: "Hello", Body: body, IsEncrypted: true, KeyVersion: 1, Signature: signature})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected client-sealed conversation to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+	var created models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	// The server relays the ciphertext untouched; only bob's client opens it
+	w = doRequest(t, server, http.MethodGet, "/api/conversations/"+created.Conversation.ID+"?desk_id="+bobDesk, bob.Token, nil)
+	var fetched models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &fetched)
+	if len(fetched.Mivs) != 1 || fetched.Mivs[0].Body != body || !fetched.Mivs[0].IsEncrypted || !fetched.Mivs[0].IsVerified {
+		t.Fatalf("Expected ciphertext to be relayed unchanged, got %+v", fetched.Mivs)
+	}
+	received, _ := base64.StdEncoding.DecodeString(fetched.Mivs[0].Body)
+	plaintext, err := crypto.Decrypt(received, aliceKeys.PublicKey, bobKeys.PrivateKey)
+	if err != nil || string(plaintext) != "Hi Bob" {
+		t.Errorf("Expected bob's client to open the miv, got %q (err %v)", plaintext, err)
+	}
+}
+
+func TestClientKeyCustodyRefusesServerKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+	server.SetKeyCustody(KeyCustodyClient)
+
+	w := doRequest(t, server, http.MethodPost, "/api/accounts/register", "", models.RegisterRequest{
+		Username:     "alice",
+		Password:     "password123",
+		DisplayName:  "alice",
+		Birthday:     "2000-01-01",
+		FirstPetName: "Rex",
+		MotherMaiden: "Smith",
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected registration without a public key to be refused, got %d", w.Code)
+	}
+	if _, err := server.storage.GetAccountByUsername("alice"); err == nil {
+		t.Errorf("Expected refused registration to leave no account behind")
+	}
+
+	alice, _ := registerClientKeyedAccount(t, server, "alice")
+
+	w = doRequest(t, server, http.MethodPost, "/api/desks", alice.Token, models.CreateDeskRequest{Name: "Second"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected desk without a public key to be refused, got %d", w.Code)
+	}
+
+	w = doRequest(t, server, http.MethodPost, "/api/desks", alice.Token, models.CreateDeskRequest{Name: "Second", PublicKey: "not-a-key"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid public key to be refused, got %d", w.Code)
+	}
+
+	publicKey, signingKey := newClientKeys(t).publicKeys()
+	w = doRequest(t, server, http.MethodPost, "/api/desks", alice.Token,
+		models.CreateDeskRequest{Name: "Second", PublicKey: publicKey})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a public key without a signing key to be refused, got %d", w.Code)
+	}
+
+	w = doRequest(t, server, http.MethodPost, "/api/desks", alice.Token,
+		models.CreateDeskRequest{Name: "Second", PublicKey: publicKey, SigningKey: signingKey})
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected client-keyed desk to be created, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestParseKeyCustody(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected KeyCustody
+		wantErr  bool
+	}{
+		{"", KeyCustodyServer, false},
+		{"server", KeyCustodyServer, false},
+		{"client", KeyCustodyClient, false},
+		{"nobody", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseKeyCustody(test.input)
+		if (err != nil) != test.wantErr || got != test.expected {
+			t.Errorf("ParseKeyCustody(%q) = %q, %v", test.input, got, err)
+		}
+	}
+}
+
+func TestKeyBackupLifecycle(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+
+	alice, aliceKeys := registerClientKeyedAccount(t, server, "alice")
+	bob := registerTestAccount(t, server, "bob")
+	deskID := alice.Account.ActiveDesk
+	path := "/api/desks/" + deskID + "/key-backup"
+
+	blob, err := aliceKeys.wrap("password123", deskID)
+	if err != nil {
+		t.Fatalf("WrapKeyBundle failed: %v", err)
+	}
+
+	if w := doRequest(t, server, http.MethodPut, path, alice.Token, models.UploadKeyBackupRequest{Blob: "plaintext key"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected malformed blob to be rejected, got %d", w.Code)
+	}
+	if w := doRequest(t, server, http.MethodPut, path, bob.Token, models.UploadKeyBackupRequest{Blob: blob}); w.Code != http.StatusForbidden {
+		t.Errorf("Expected upload to a foreign desk to be forbidden, got %d", w.Code)
+	}
+	if w := doRequest(t, server, http.MethodPut, path, alice.Token, models.UploadKeyBackupRequest{Blob: blob}); w.Code != http.StatusCreated {
+		t.Fatalf("Expected upload to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := doRequest(t, server, http.MethodPut, path, alice.Token, models.UploadKeyBackupRequest{Blob: blob}); w.Code != http.StatusConflict {
+		t.Errorf("Expected second upload to conflict, got %d", w.Code)
+	}
+
+	// A new device downloads the blob and unwraps it with the password
+	w := doRequest(t, server, http.MethodGet, path, alice.Token, nil)
+	var backup models.KeyBackup
+	json.Unmarshal(w.Body.Bytes(), &backup)
+	bundle, err := crypto.UnwrapKeyBundle(backup.Blob, "password123", deskID)
+	if err != nil || !bytes.Equal(bundle.Current().BoxKey, aliceKeys.PrivateKey[:]) {
+		t.Fatalf("Expected downloaded backup to unwrap to the desk key (err %v)", err)
+	}
+	if w := doRequest(t, server, http.MethodGet, path, bob.Token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected download of a foreign backup to be forbidden, got %d", w.Code)
+	}
+
+	rotated, _ := aliceKeys.wrap("new password", deskID)
+	if w := doRequest(t, server, http.MethodPost, path+"/rotate", alice.Token, models.RotateKeyBackupRequest{Blob: rotated, Version: backup.Version + 1}); w.Code != http.StatusConflict {
+		t.Errorf("Expected rotation from a wrong version to conflict, got %d", w.Code)
+	}
+	w = doRequest(t, server, http.MethodPost, path+"/rotate", alice.Token, models.RotateKeyBackupRequest{Blob: rotated, Version: backup.Version})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected rotation to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &backup)
+	if backup.Version != 2 || backup.Blob != rotated {
+		t.Errorf("Expected rotated backup at version 2, got %+v", backup)
+	}
+}
+
+func TestKeyBackupRestoresRetiredKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+
+	alice, aliceKeys := registerClientKeyedAccount(t, server, "alice")
+	bob, bobKeys := registerClientKeyedAccount(t, server, "bob")
+	aliceDesk, bobDesk := alice.Account.ActiveDesk, bob.Account.ActiveDesk
+
+	// Bob writes to alice's first key, then alice rotates it
+	sealed, _ := crypto.Encrypt([]byte("Hi Alice"), aliceKeys.PublicKey, bobKeys.PrivateKey)
+	body := base64.StdEncoding.EncodeToString(sealed)
+	convID := "conv-chosen-by-bob"
+	signature := bobKeys.sign(&models.ConversationMiv{ConversationID: convID, SeqNo: 1, From: bobDesk, To: aliceDesk, Subject: "Hello", Body: body})
+	w := doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+bobDesk, bob.Token,
+		models.CreateConversationRequest{ConversationID: convID, To: aliceDesk, Subject: "Hello", Body: body, IsEncrypted: true, KeyVersion: 1, Signature: signature})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create conversation: %d %s", w.Code, w.Body.String())
+	}
+	newKeys := newClientKeys(t)
+	publicKey, signingKey := newKeys.publicKeys()
+	if w := doRequest(t, server, http.MethodPost, "/api/desks/"+aliceDesk+"/rotate-key", alice.Token, models.RotateDeskKeyRequest{PublicKey: publicKey, SigningKey: signingKey}); w.Code != http.StatusOK {
+		t.Fatalf("Failed to rotate key: %d %s", w.Code, w.Body.String())
+	}
+
+	bundle := &crypto.KeyBundle{Keys: []crypto.BundledKey{aliceKeys.bundled(1), newKeys.bundled(2)}}
+	blob, err := crypto.WrapKeyBundle(bundle, "password123", aliceDesk)
+	if err != nil {
+		t.Fatalf("WrapKeyBundle failed: %v", err)
+	}
+	path := "/api/desks/" + aliceDesk + "/key-backup"
+	if w := doRequest(t, server, http.MethodPut, path, alice.Token, models.UploadKeyBackupRequest{Blob: blob}); w.Code != http.StatusCreated {
+		t.Fatalf("Expected upload to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A new device restores the backup and still opens the miv sealed to
+	// the retired key
+	w = doRequest(t, server, http.MethodGet, path, alice.Token, nil)
+	var backup models.KeyBackup
+	json.Unmarshal(w.Body.Bytes(), &backup)
+	restored, err := crypto.UnwrapKeyBundle(backup.Blob, "password123", aliceDesk)
+	if err != nil {
+		t.Fatalf("UnwrapKeyBundle failed: %v", err)
+	}
+
+	w = doRequest(t, server, http.MethodGet, "/api/conversations/"+convID+"?desk_id="+aliceDesk, alice.Token, nil)
+	var fetched models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &fetched)
+	if len(fetched.Mivs) != 1 || fetched.Mivs[0].RecipientKeyVersion != 1 {
+		t.Fatalf("Expected one miv sealed to key version 1, got %+v", fetched.Mivs)
+	}
+	key := restored.Key(fetched.Mivs[0].RecipientKeyVersion)
+	if key == nil {
+		t.Fatalf("Expected the restored bundle to hold key version 1")
+	}
+	received, _ := base64.StdEncoding.DecodeString(fetched.Mivs[0].Body)
+	plaintext, err := crypto.Decrypt(received, bobKeys.PublicKey, [32]byte(key.BoxKey))
+	if err != nil || string(plaintext) != "Hi Alice" {
+		t.Errorf("Expected the retired key to open the miv, got %q (err %v)", plaintext, err)
+	}
+
+	// Both signing keys come back, matching the desk's published ones
+	for version, want := range map[int]*clientKeys{1: aliceKeys, 2: newKeys} {
+		signing := restored.Key(version).SigningPrivateKey()
+		if signing == nil || !want.Signing.PublicKey.Equal(signing.Public().(ed25519.PublicKey)) {
+			t.Errorf("Expected signing key version %d to be restored", version)
+		}
+	}
+}
+
+func TestRecoverPasswordRewrapsOrInvalidatesKeyBackups(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+
+	alice, aliceKeys := registerClientKeyedAccount(t, server, "alice")
+	primary := alice.Account.ActiveDesk
+
+	secondKeys := newClientKeys(t)
+	publicKey, signingKey := secondKeys.publicKeys()
+	w := doRequest(t, server, http.MethodPost, "/api/desks", alice.Token,
+		models.CreateDeskRequest{Name: "Second", PublicKey: publicKey, SigningKey: signingKey})
+	var second models.Desk
+	json.Unmarshal(w.Body.Bytes(), &second)
+
+	for deskID, keys := range map[string]*clientKeys{primary: aliceKeys, second.ID: secondKeys} {
+		blob, _ := keys.wrap("password123", deskID)
+		doRequest(t, server, http.MethodPut, "/api/desks/"+deskID+"/key-backup", alice.Token, models.UploadKeyBackupRequest{Blob: blob})
+	}
+
+	// The client still has the primary key locally and re-wraps only that one
+	rewrapped, _ := aliceKeys.wrap("brand new password", primary)
+	w = doRequest(t, server, http.MethodPost, "/api/accounts/recover-password", "", models.RecoverPasswordRequest{
+		Username:     "alice",
+		Birthday:     "2000-01-01",
+		FirstPetName: "Rex",
+		MotherMaiden: "Smith",
+		NewPassword:  "brand new password",
+		KeyBackups:   []models.RewrappedKeyBackup{{DeskID: primary, Blob: rewrapped}},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected recovery to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	backup, err := server.storage.GetKeyBackup(primary)
+	if err != nil || backup.Blob != rewrapped || backup.Version != 2 {
+		t.Errorf("Expected primary backup to be re-wrapped, got %+v (err %v)", backup, err)
+	}
+	if bundle, err := crypto.UnwrapKeyBundle(backup.Blob, "brand new password", primary); err != nil || !bytes.Equal(bundle.Current().BoxKey, aliceKeys.PrivateKey[:]) {
+		t.Errorf("Expected re-wrapped backup to open with the new password (err %v)", err)
+	}
+	if _, err := server.storage.GetKeyBackup(second.ID); err == nil {
+		t.Errorf("Expected backup wrapped under the old password to be invalidated")
+	}
+}
+
+func TestRotateDeskKeyKeepsOldMivsReadable(t *testing.T) {
+	f := newPolicyFixture(t)
+	bobDesk := f.bob.Account.ActiveDesk
+	aliceDesk := f.alice.Account.ActiveDesk
+
+	if w := doRequest(t, f.server, http.MethodPost, "/api/desks/"+bobDesk+"/rotate-key", f.carol.Token, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Expected rotating a foreign desk to be forbidden, got %d", w.Code)
+	}
+
+	w := doRequest(t, f.server, http.MethodPost, "/api/desks/"+bobDesk+"/rotate-key", f.bob.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected rotation to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var rotated models.Desk
+	json.Unmarshal(w.Body.Bytes(), &rotated)
+	if rotated.KeyVersion != 2 {
+		t.Fatalf("Expected key version 2, got %d", rotated.KeyVersion)
+	}
+
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+aliceDesk, f.alice.Token,
+		models.ReplyToConversationRequest{Body: "After rotation"})
+	var reply models.ConversationMiv
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	if reply.RecipientKeyVersion != 2 || reply.SenderKeyVersion != 1 {
+		t.Errorf("Expected reply sealed from v1 to v2, got sender %d recipient %d", reply.SenderKeyVersion, reply.RecipientKeyVersion)
+	}
+
+	// Bob opens the miv sealed to his retired key and the one sealed to his new key
+	w = doRequest(t, f.server, http.MethodGet, "/api/conversations/"+f.conversationID+"?desk_id="+bobDesk, f.bob.Token, nil)
+	var conv models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &conv)
+	expected := []string{"Hi Bob", "After rotation"}
+	if len(conv.Mivs) != len(expected) {
+		t.Fatalf("Expected %d mivs, got %d", len(expected), len(conv.Mivs))
+	}
+	for i, miv := range conv.Mivs {
+		body, _ := base64.StdEncoding.DecodeString(miv.Body)
+		if string(body) != expected[i] || miv.IsEncrypted {
+			t.Errorf("Expected miv %d to read %q, got %q", i, expected[i], body)
+		}
+	}
+}
+
+func TestRotateClientKeyedDesk(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+
+	alice, aliceKeys := registerClientKeyedAccount(t, server, "alice")
+	bob, _ := registerClientKeyedAccount(t, server, "bob")
+	bobDesk := bob.Account.ActiveDesk
+	path := "/api/desks/" + bobDesk + "/rotate-key"
+
+	if w := doRequest(t, server, http.MethodPost, path, bob.Token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected server-side rotation of a client-keyed desk to be refused, got %d", w.Code)
+	}
+
+	newKeys := newClientKeys(t)
+	publicKey, signingKey := newKeys.publicKeys()
+	if w := doRequest(t, server, http.MethodPost, path, bob.Token, models.RotateDeskKeyRequest{PublicKey: publicKey, SigningKey: signingKey}); w.Code != http.StatusOK {
+		t.Fatalf("Expected client rotation to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := server.storage.GetDeskPrivateKey(bobDesk, 0); err == nil {
+		t.Errorf("Expected no server-held key after a client rotation")
+	}
+
+	// A client that sealed to the old key is told to re-fetch
+	sealed, _ := crypto.Encrypt([]byte("Hi"), newKeys.PublicKey, aliceKeys.PrivateKey)
+	body := base64.StdEncoding.EncodeToString(sealed)
+	convID := "conv-chosen-by-alice"
+	signature := aliceKeys.sign(&models.ConversationMiv{ConversationID: convID, SeqNo: 1, From: alice.Account.ActiveDesk, To: bobDesk, Subject: "Hello", Body: body})
+	w := doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+alice.Account.ActiveDesk, alice.Token,
+		models.CreateConversationRequest{ConversationID: convID, To: bobDesk, Subject: "Hello", Body: body, IsEncrypted: true, KeyVersion: 1, Signature: signature})
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected stale key version to conflict, got %d", w.Code)
+	}
+	w = doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+alice.Account.ActiveDesk, alice.Token,
+		models.CreateConversationRequest{ConversationID: convID, To: bobDesk, Subject: "Hello", Body: body, IsEncrypted: true, KeyVersion: 2, Signature: signature})
+	if w.Code != http.StatusCreated {
+		t.Errorf("Expected current key version to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/storage"
+)
+
+// List endpoints return pages of defaultPageSize items unless the request
+// asks for another limit, up to maxPageSize
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// encodeCursor turns the sort key of a page's last item into the opaque
+// cursor clients send back for the next page
+func encodeCursor(cursor storage.Cursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reverses encodeCursor
+func decodeCursor(raw string) (*storage.Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, err
+	}
+	var cursor storage.Cursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	if cursor.ID == "" {
+		return nil, fmt.Errorf("cursor has no position")
+	}
+	return &cursor, nil
+}
+
+// pageParams reads the limit and cursor query parameters.
+// On failure the error response has been written and ok is false.
+func pageParams(c *gin.Context) (limit int, after *storage.Cursor, ok bool) {
+	limit = defaultPageSize
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Limit must be a number from 1 to %d", maxPageSize)})
+			return 0, nil, false
+		}
+		limit = n
+	}
+
+	if raw := c.Query("cursor"); raw != "" {
+		cursor, err := decodeCursor(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return 0, nil, false
+		}
+		after = cursor
+	}
+	return limit, after, true
+}
+
+// timeRange reads the since and until query parameters, both RFC 3339 times
+// and either one optional.
+// On failure the error response has been written and ok is false.
+func timeRange(c *gin.Context) (since, until time.Time, ok bool) {
+	for _, param := range []struct {
+		name string
+		dest *time.Time
+	}{{"since", &since}, {"until", &until}} {
+		raw := c.Query(param.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s time; use RFC 3339, e.g. 2024-01-02T15:04:05Z", param.name)})
+			return time.Time{}, time.Time{}, false
+		}
+		*param.dest = t
+	}
+	return since, until, true
+}
+
+// nextPage cuts a page fetched with one item beyond limit back to limit and
+// returns the cursor for the following page, or "" when this is the last
+func nextPage[T any](items []T, limit int, key func(T) storage.Cursor) ([]T, string) {
+	if len(items) <= limit {
+		return items, ""
+	}
+	items = items[:limit]
+	return items, encodeCursor(key(items[limit-1]))
+}
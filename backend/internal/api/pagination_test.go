@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+func TestListPagination(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+	carolDesk := f.carol.Account.ActiveDesk
+
+	for _, to := range []string{carolDesk, bobDesk} {
+		w := doRequest(t, f.server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token,
+			models.CreateConversationRequest{To: to, Subject: "More", Body: "Hi"})
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Failed to create conversation: %d %s", w.Code, w.Body.String())
+		}
+	}
+
+	// Following next_cursor walks every conversation once
+	seen := make(map[string]bool)
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages == 3 {
+			t.Fatalf("Expected the cursor to run out")
+		}
+		w := doRequest(t, f.server, http.MethodGet, "/api/conversations?desk_id="+aliceDesk+"&limit=2&cursor="+cursor, f.alice.Token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Failed to list conversations: %d %s", w.Code, w.Body.String())
+		}
+		var page models.ListConversationsResponse
+		json.Unmarshal(w.Body.Bytes(), &page)
+		for _, item := range page.Conversations {
+			if seen[item.Conversation.ID] || item.LatestMiv == nil {
+				t.Errorf("Unexpected conversation on page %d: %+v", pages, item)
+			}
+			seen[item.Conversation.ID] = true
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected 3 conversations across the pages, got %d", len(seen))
+	}
+
+	w := doRequest(t, f.server, http.MethodGet, "/api/conversations?desk_id="+aliceDesk+"&counterpart="+carolDesk, f.alice.Token, nil)
+	var filtered models.ListConversationsResponse
+	json.Unmarshal(w.Body.Bytes(), &filtered)
+	if len(filtered.Conversations) != 1 || filtered.NextCursor != "" {
+		t.Errorf("Expected one conversation with carol, got %+v", filtered)
+	}
+
+	w = doRequest(t, f.server, http.MethodGet, "/api/conversations?desk_id="+bobDesk+"&unread_only=true&archived=false", f.bob.Token, nil)
+	json.Unmarshal(w.Body.Bytes(), &filtered)
+	if len(filtered.Conversations) != 2 {
+		t.Errorf("Expected bob's two unread conversations, got %+v", filtered)
+	}
+
+	// The unread count covers every page of notifications
+	w = doRequest(t, f.server, http.MethodGet, "/api/notifications?desk_id="+bobDesk+"&limit=1", f.bob.Token, nil)
+	var notifs models.ListNotificationsResponse
+	json.Unmarshal(w.Body.Bytes(), &notifs)
+	if len(notifs.Notifications) != 1 || notifs.UnreadCount != 2 || notifs.NextCursor == "" {
+		t.Errorf("Expected one notification of two unread with a cursor, got %+v", notifs)
+	}
+
+	w = doRequest(t, f.server, http.MethodGet, "/api/desks/"+aliceDesk+"/contacts?limit=1", f.alice.Token, nil)
+	var contacts models.ListContactsResponse
+	json.Unmarshal(w.Body.Bytes(), &contacts)
+	if len(contacts.Contacts) != 1 || contacts.NextCursor != "" {
+		t.Errorf("Expected alice's only contact without a cursor, got %+v", contacts)
+	}
+
+	for _, query := range []string{"limit=0", "limit=abc", "cursor=nonsense", "archived=maybe", "since=yesterday"} {
+		w = doRequest(t, f.server, http.MethodGet, "/api/conversations?desk_id="+aliceDesk+"&"+query, f.alice.Token, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// Authorization policy
+//
+// Every desk-scoped operation goes through these helpers. A desk may only be
+// acted on by the account that owns it (Desk.AccountID), and a conversation
+// may only be read or written by one of its participant desks. Each helper
+// writes the error response itself and returns false when access is refused,
+// so handlers can simply return.
+
+// authorizeDesk loads the desk and verifies the authenticated account owns it
+func (s *Server) authorizeDesk(c *gin.Context, deskID string) (*models.Desk, bool) {
+	if deskID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "desk_id is required"})
+		return nil, false
+	}
+
+	desk, err := s.storage.GetDesk(deskID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Desk not found"})
+		return nil, false
+	}
+
+	if !ownsDesk(currentAccount(c), desk) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Desk does not belong to account"})
+		return nil, false
+	}
+
+	return desk, true
+}
+
+// authorizeConversation loads a conversation with its mivs and verifies the
+// desk is one of its participants
+func (s *Server) authorizeConversation(c *gin.Context, conversationID string, desk *models.Desk) (*models.Conversation, []*models.ConversationMiv, bool) {
+	conv, err := s.storage.GetConversation(conversationID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conversation not found"})
+		return nil, nil, false
+	}
+
+	mivs, err := s.storage.GetConversationMivs(conversationID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, nil, false
+	}
+
+	if !isConversationParticipant(conv, mivs, desk.ID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Desk is not a participant in this conversation"})
+		return nil, nil, false
+	}
+
+	return conv, mivs, true
+}
+
+// authorizeMiv loads a conversation miv and verifies the desk is a participant
+// in the conversation it belongs to
+func (s *Server) authorizeMiv(c *gin.Context, mivID string, desk *models.Desk) (*models.ConversationMiv, bool) {
+	miv, err := s.storage.GetConversationMiv(mivID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Miv not found"})
+		return nil, false
+	}
+
+	if _, _, ok := s.authorizeConversation(c, miv.ConversationID, desk); !ok {
+		return nil, false
+	}
+
+	return miv, true
+}
+
+// ownsDesk reports whether the account owns the desk
+func ownsDesk(account *models.Account, desk *models.Desk) bool {
+	return account != nil && desk != nil && desk.AccountID == account.ID
+}
+
+// isConversationParticipant reports whether the desk created the conversation,
+// is one of its participants or has sent or received any miv in it
+func isConversationParticipant(conv *models.Conversation, mivs []*models.ConversationMiv, deskID string) bool {
+	normalizedDeskID := crypto.NormalizeDeskID(deskID)
+	if crypto.NormalizeDeskID(conv.DeskID) == normalizedDeskID {
+		return true
+	}
+
+	for _, p := range conv.Participants {
+		if crypto.NormalizeDeskID(p.DeskID) == normalizedDeskID {
+			return true
+		}
+	}
+
+	for _, miv := range mivs {
+		if crypto.NormalizeDeskID(miv.From) == normalizedDeskID || crypto.NormalizeDeskID(miv.To) == normalizedDeskID {
+			return true
+		}
+	}
+
+	return false
+}
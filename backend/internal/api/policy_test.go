@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// policyFixture holds three accounts where alice and bob share a conversation
+// and carol is an outsider
+type policyFixture struct {
+	server         *Server
+	alice          models.LoginResponse
+	bob            models.LoginResponse
+	carol          models.LoginResponse
+	conversationID string
+	mivID          string
+	contactID      string
+	notificationID string
+}
+
+func newPolicyFixture(t *testing.T) *policyFixture {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	f := &policyFixture{server: NewServer()}
+	f.alice = registerTestAccount(t, f.server, "alice")
+	f.bob = registerTestAccount(t, f.server, "bob")
+	f.carol = registerTestAccount(t, f.server, "carol")
+
+	w := doRequest(t, f.server, http.MethodPost, "/api/conversations?desk_id="+f.alice.Account.ActiveDesk, f.alice.Token,
+		models.CreateConversationRequest{To: f.bob.Account.ActiveDesk, Subject: "Hello", Body: "Hi Bob"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create conversation: %d %s", w.Code, w.Body.String())
+	}
+	var conv models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &conv)
+	f.conversationID = conv.Conversation.ID
+	f.mivID = conv.Mivs[0].ID
+
+	w = doRequest(t, f.server, http.MethodPost, "/api/desks/"+f.alice.Account.ActiveDesk+"/contacts", f.alice.Token,
+		models.CreateContactRequest{Name: "Bob", DeskIDRef: f.bob.Account.ActiveDesk})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create contact: %d %s", w.Code, w.Body.String())
+	}
+	var contact models.Contact
+	json.Unmarshal(w.Body.Bytes(), &contact)
+	f.contactID = contact.ID
+
+	notifications, _ := f.server.storage.ListNotificationsByDesk(f.bob.Account.ActiveDesk, false)
+	if len(notifications) == 0 {
+		t.Fatalf("Expected a notification for bob")
+	}
+	f.notificationID = notifications[0].ID
+
+	return f
+}
+
+func TestDeskOwnershipPolicy(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+	carolDesk := f.carol.Account.ActiveDesk
+	newName := "Hijacked"
+
+	tests := []struct {
+		name     string
+		token    string
+		method   string
+		path     string
+		body     interface{}
+		expected int
+	}{
+		// Acting as a desk owned by another account
+		{"update foreign desk", f.carol.Token, http.MethodPut, "/api/desks/" + aliceDesk, models.UpdateDeskRequest{Name: &newName}, http.StatusForbidden},
+		{"switch to foreign desk", f.carol.Token, http.MethodPost, "/api/desks/switch", models.SwitchDeskRequest{DeskID: aliceDesk}, http.StatusForbidden},
+		{"list conversations of foreign desk", f.carol.Token, http.MethodGet, "/api/conversations?desk_id=" + aliceDesk, nil, http.StatusForbidden},
+		{"get conversation as foreign desk", f.carol.Token, http.MethodGet, "/api/conversations/" + f.conversationID + "?desk_id=" + aliceDesk, nil, http.StatusForbidden},
+		{"create conversation from foreign desk", f.carol.Token, http.MethodPost, "/api/conversations?desk_id=" + aliceDesk, models.CreateConversationRequest{To: bobDesk, Subject: "Spoof", Body: "Spoof"}, http.StatusForbidden},
+		{"reply as foreign desk", f.carol.Token, http.MethodPost, "/api/conversations/" + f.conversationID + "/reply?desk_id=" + bobDesk, models.ReplyToConversationRequest{Body: "Spoof"}, http.StatusForbidden},
+		{"archive as foreign desk", f.carol.Token, http.MethodPost, "/api/conversations/" + f.conversationID + "/archive?desk_id=" + aliceDesk, nil, http.StatusForbidden},
+		{"mark read as foreign desk", f.carol.Token, http.MethodPost, "/api/mivs/" + f.mivID + "/read?desk_id=" + bobDesk, nil, http.StatusForbidden},
+		{"forget as foreign desk", f.carol.Token, http.MethodPost, "/api/mivs/" + f.mivID + "/forget?desk_id=" + aliceDesk, nil, http.StatusForbidden},
+		{"list notifications of foreign desk", f.carol.Token, http.MethodGet, "/api/notifications?desk_id=" + bobDesk, nil, http.StatusForbidden},
+		{"read foreign notification", f.carol.Token, http.MethodPost, "/api/notifications/" + f.notificationID + "/read", nil, http.StatusForbidden},
+		{"list contacts of foreign desk", f.carol.Token, http.MethodGet, "/api/desks/" + aliceDesk + "/contacts", nil, http.StatusForbidden},
+		{"create contact on foreign desk", f.carol.Token, http.MethodPost, "/api/desks/" + aliceDesk + "/contacts", models.CreateContactRequest{Name: "X", DeskIDRef: carolDesk}, http.StatusForbidden},
+		{"get foreign contact", f.carol.Token, http.MethodGet, "/api/contacts/" + f.contactID, nil, http.StatusForbidden},
+		{"update foreign contact", f.carol.Token, http.MethodPut, "/api/contacts/" + f.contactID, models.UpdateContactRequest{Name: "X"}, http.StatusForbidden},
+		{"delete foreign contact", f.carol.Token, http.MethodDelete, "/api/contacts/" + f.contactID, nil, http.StatusForbidden},
+
+		// Using an owned desk on a conversation it is not part of
+		{"get conversation as non-participant", f.carol.Token, http.MethodGet, "/api/conversations/" + f.conversationID + "?desk_id=" + carolDesk, nil, http.StatusForbidden},
+		{"reply as non-participant", f.carol.Token, http.MethodPost, "/api/conversations/" + f.conversationID + "/reply?desk_id=" + carolDesk, models.ReplyToConversationRequest{Body: "Spoof"}, http.StatusForbidden},
+		{"archive as non-participant", f.carol.Token, http.MethodPost, "/api/conversations/" + f.conversationID + "/archive?desk_id=" + carolDesk, nil, http.StatusForbidden},
+		{"mark read as non-participant", f.carol.Token, http.MethodPost, "/api/mivs/" + f.mivID + "/read?desk_id=" + carolDesk, nil, http.StatusForbidden},
+		{"forget as recipient", f.bob.Token, http.MethodPost, "/api/mivs/" + f.mivID + "/forget?desk_id=" + bobDesk, nil, http.StatusForbidden},
+
+		// Legacy mivs have no owning desk to check, so their routes are gone
+		{"list legacy mivs", f.carol.Token, http.MethodGet, "/api/mivs", nil, http.StatusNotFound},
+		{"get miv through legacy route", f.carol.Token, http.MethodGet, "/api/mivs/" + f.mivID, nil, http.StatusNotFound},
+		{"create legacy miv", f.carol.Token, http.MethodPost, "/api/mivs", map[string]string{"to": bobDesk, "subject": "Spoof", "body": "Spoof"}, http.StatusNotFound},
+		{"set miv state through legacy route", f.carol.Token, http.MethodPut, "/api/mivs/" + f.mivID + "/state", map[string]string{"state": "ARCHIVED"}, http.StatusNotFound},
+
+		// Participants keep their access
+		{"get conversation as sender", f.alice.Token, http.MethodGet, "/api/conversations/" + f.conversationID + "?desk_id=" + aliceDesk, nil, http.StatusOK},
+		{"get conversation as recipient", f.bob.Token, http.MethodGet, "/api/conversations/" + f.conversationID + "?desk_id=" + bobDesk, nil, http.StatusOK},
+		{"mark read as recipient", f.bob.Token, http.MethodPost, "/api/mivs/" + f.mivID + "/read?desk_id=" + bobDesk, nil, http.StatusOK},
+		{"reply as recipient", f.bob.Token, http.MethodPost, "/api/conversations/" + f.conversationID + "/reply?desk_id=" + bobDesk, models.ReplyToConversationRequest{Body: "Hi Alice"}, http.StatusCreated},
+		{"get own contact", f.alice.Token, http.MethodGet, "/api/contacts/" + f.contactID, nil, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := doRequest(t, f.server, test.method, test.path, test.token, test.body)
+			if w.Code != test.expected {
+				t.Errorf("%s %s: expected status %d, got %d: %s", test.method, test.path, test.expected, w.Code, w.Body.String())
+			}
+		})
+	}
+}
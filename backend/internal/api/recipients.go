@@ -0,0 +1,114 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// splitDeskIDs splits a comma-separated list of desk IDs, dropping blanks
+func splitDeskIDs(list string) []string {
+	var deskIDs []string
+	for _, deskID := range strings.Split(list, ",") {
+		if deskID = strings.TrimSpace(deskID); deskID != "" {
+			deskIDs = append(deskIDs, deskID)
+		}
+	}
+	return deskIDs
+}
+
+// resolveRecipients turns the To and CC lists of a new conversation into the
+// first miv's recipients, To desks first. Every desk must exist; a desk
+// listed twice is addressed once, as To if it appears there. Failures to report
+// are statusErrors.
+func (s *Server) resolveRecipients(to, cc string) ([]*models.MivRecipient, error) {
+	toIDs := splitDeskIDs(to)
+	if len(toIDs) == 0 {
+		return nil, newStatusError(http.StatusBadRequest, "At least one recipient desk is required")
+	}
+
+	var recipients []*models.MivRecipient
+	seen := make(map[string]bool)
+	add := func(deskIDs []string, role models.ParticipantRole) error {
+		for _, deskID := range deskIDs {
+			normalized := crypto.NormalizeDeskID(deskID)
+			if seen[normalized] {
+				continue
+			}
+			if _, err := s.storage.GetDesk(normalized); err != nil {
+				return newStatusError(http.StatusBadRequest, "Recipient desk '%s' does not exist. Please verify the desk number and try again.", deskID)
+			}
+			seen[normalized] = true
+			recipients = append(recipients, &models.MivRecipient{DeskID: normalized, Role: role})
+		}
+		return nil
+	}
+
+	if err := add(toIDs, models.ParticipantRoleTo); err != nil {
+		return nil, err
+	}
+	if err := add(splitDeskIDs(cc), models.ParticipantRoleCc); err != nil {
+		return nil, err
+	}
+	return recipients, nil
+}
+
+// replyRecipients addresses a reply to every other participant. The desk
+// being answered, the sender of the latest miv from another desk, is the
+// reply's To desk; everyone else keeps the role they joined with.
+func replyRecipients(conv *models.Conversation, mivs []*models.ConversationMiv, senderID string) []*models.MivRecipient {
+	self := crypto.NormalizeDeskID(senderID)
+
+	answered := ""
+	for i := len(mivs) - 1; i >= 0; i-- {
+		if from := crypto.NormalizeDeskID(mivs[i].From); from != self {
+			answered = from
+			break
+		}
+	}
+	if answered == "" && len(mivs) > 0 {
+		// Nobody has answered yet; follow up with the first miv's To desk
+		answered = crypto.NormalizeDeskID(mivs[0].To)
+	}
+
+	var recipients []*models.MivRecipient
+	for _, p := range conv.Participants {
+		if p.DeskID == self {
+			continue
+		}
+		if p.DeskID == answered {
+			recipients = append([]*models.MivRecipient{{DeskID: p.DeskID, Role: models.ParticipantRoleTo}}, recipients...)
+			continue
+		}
+		recipients = append(recipients, &models.MivRecipient{DeskID: p.DeskID, Role: p.Role})
+	}
+
+	// The first recipient is the miv's To desk, so it is always addressed
+	if len(recipients) > 0 {
+		recipients[0].Role = models.ParticipantRoleTo
+	}
+	return recipients
+}
+
+// mivRecipient returns the desk's entry in a miv's recipients, or nil when
+// the miv was not sent to it
+func mivRecipient(miv *models.ConversationMiv, deskID string) *models.MivRecipient {
+	normalizedDeskID := crypto.NormalizeDeskID(deskID)
+	for _, r := range miv.Recipients {
+		if crypto.NormalizeDeskID(r.DeskID) == normalizedDeskID {
+			return r
+		}
+	}
+	return nil
+}
+
+// recipientDeskIDs returns the desk IDs a miv was sent to
+func recipientDeskIDs(miv *models.ConversationMiv) []string {
+	deskIDs := make([]string, 0, len(miv.Recipients))
+	for _, r := range miv.Recipients {
+		deskIDs = append(deskIDs, r.DeskID)
+	}
+	return deskIDs
+}
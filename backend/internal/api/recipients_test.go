@@ -0,0 +1,144 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+func TestGroupConversation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+	alice := registerTestAccount(t, server, "alice")
+	bob := registerTestAccount(t, server, "bob")
+	carol := registerTestAccount(t, server, "carol")
+	aliceDesk, bobDesk, carolDesk := alice.Account.ActiveDesk, bob.Account.ActiveDesk, carol.Account.ActiveDesk
+
+	w := doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Cc: "5550000000", Subject: "Plans", Body: "Hi all"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown CC desk to be rejected, got %d", w.Code)
+	}
+
+	w = doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Cc: carolDesk, Subject: "Plans", Body: "Hi all"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create conversation: %d %s", w.Code, w.Body.String())
+	}
+	var created models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &created)
+	convID, mivID := created.Conversation.ID, created.Mivs[0].ID
+
+	if len(created.Conversation.Participants) != 3 {
+		t.Fatalf("Expected 3 participants, got %+v", created.Conversation.Participants)
+	}
+	if recipients := created.Mivs[0].Recipients; len(recipients) != 2 || recipients[1].Role != models.ParticipantRoleCc {
+		t.Errorf("Expected bob To and carol CC, got %+v", recipients)
+	}
+
+	// Every recipient is notified and opens its own copy
+	for _, login := range []models.LoginResponse{bob, carol} {
+		notifications, _ := server.storage.ListNotificationsByDesk(login.Account.ActiveDesk, false)
+		if len(notifications) != 1 || notifications[0].Type != models.NotificationTypeNewMiv {
+			t.Errorf("Expected %s to be notified, got %+v", login.Account.Username, notifications)
+		}
+
+		w = doRequest(t, server, http.MethodGet, "/api/conversations/"+convID+"?desk_id="+login.Account.ActiveDesk, login.Token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected %s to see the conversation, got %d", login.Account.Username, w.Code)
+		}
+		var resp models.GetConversationResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		body, _ := base64.StdEncoding.DecodeString(resp.Mivs[0].Body)
+		if string(body) != "Hi all" || !resp.Mivs[0].IsVerified || resp.Mivs[0].State != models.StateIN {
+			t.Errorf("Expected %s to read a verified copy in IN, got %q %+v", login.Account.Username, body, resp.Mivs[0])
+		}
+	}
+
+	// Reading is tracked per recipient
+	w = doRequest(t, server, http.MethodPost, "/api/mivs/"+mivID+"/read?desk_id="+carolDesk, carol.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to mark read: %d %s", w.Code, w.Body.String())
+	}
+	var read models.ConversationMiv
+	json.Unmarshal(w.Body.Bytes(), &read)
+	if read.ReadAt == nil {
+		t.Errorf("Expected carol's copy to be read")
+	}
+	w = doRequest(t, server, http.MethodGet, "/api/conversations?desk_id="+bobDesk, bob.Token, nil)
+	var list models.ListConversationsResponse
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Conversations) != 1 || list.Conversations[0].UnreadCount != 1 {
+		t.Errorf("Expected bob's copy to stay unread, got %+v", list.Conversations)
+	}
+
+	// A reply goes to every other participant, To the desk it answers
+	w = doRequest(t, server, http.MethodPost, "/api/conversations/"+convID+"/reply?desk_id="+bobDesk, bob.Token,
+		models.ReplyToConversationRequest{Body: "Sounds good"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to reply: %d %s", w.Code, w.Body.String())
+	}
+	var reply models.ConversationMiv
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	if len(reply.Recipients) != 2 || reply.Recipients[0].DeskID != aliceDesk || reply.Recipients[1].Role != models.ParticipantRoleCc {
+		t.Errorf("Expected the reply To alice and CC carol, got %+v", reply.Recipients)
+	}
+	notifications, _ := server.storage.ListNotificationsByDesk(carolDesk, false)
+	if len(notifications) != 2 {
+		t.Errorf("Expected carol to be notified of the reply, got %d notifications", len(notifications))
+	}
+}
+
+func TestClientSealedCopiesTargetCurrentKeys(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk, bobDesk, carolDesk := f.alice.Account.ActiveDesk, f.bob.Account.ActiveDesk, f.carol.Account.ActiveDesk
+
+	// Alice's client seals a copy for carol before carol rotates her key
+	sealFor := func(deskID, text string) string {
+		desk, _ := f.server.storage.GetDesk(deskID)
+		publicKey, _ := crypto.PublicKeyFromBase64(desk.PublicKey)
+		alicePrivate, _ := f.server.storage.GetDeskPrivateKey(aliceDesk, 0)
+		sealed, _ := crypto.Encrypt([]byte(text), publicKey, alicePrivate)
+		return base64.StdEncoding.EncodeToString(sealed)
+	}
+	staleCopy := sealFor(carolDesk, "Hi all")
+	if w := doRequest(t, f.server, http.MethodPost, "/api/desks/"+carolDesk+"/rotate-key", f.carol.Token, nil); w.Code != http.StatusOK {
+		t.Fatalf("Failed to rotate carol's key: %d %s", w.Code, w.Body.String())
+	}
+
+	send := func(copied string, versions map[string]int) *httptest.ResponseRecorder {
+		return doRequest(t, f.server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token, models.CreateConversationRequest{
+			To: bobDesk, Cc: carolDesk, Subject: "Plans", IsEncrypted: true, KeyVersion: 1,
+			Body:        sealFor(bobDesk, "Hi all"),
+			Bodies:      map[string]string{carolDesk: copied},
+			KeyVersions: versions,
+		})
+	}
+	if w := send(staleCopy, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a copy without a key version to be rejected, got %d", w.Code)
+	}
+	if w := send(staleCopy, map[string]int{carolDesk: 1}); w.Code != http.StatusConflict {
+		t.Errorf("Expected a copy sealed to a retired CC key to be rejected, got %d", w.Code)
+	}
+
+	w := send(sealFor(carolDesk, "Hi all"), map[string]int{carolDesk: 2})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to send: %d %s", w.Code, w.Body.String())
+	}
+	var created models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &created)
+
+	w = doRequest(t, f.server, http.MethodGet, "/api/conversations/"+created.Conversation.ID+"?desk_id="+carolDesk, f.carol.Token, nil)
+	var conv models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &conv)
+	body, _ := base64.StdEncoding.DecodeString(conv.Mivs[0].Body)
+	if string(body) != "Hi all" || conv.Mivs[0].IsEncrypted {
+		t.Errorf("Expected carol to open her copy, got %q", body)
+	}
+}
@@ -0,0 +1,227 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+	"github.com/jadefox10200/missiv/backend/internal/storage"
+)
+
+// openReplica starts a server on its own connection to the SQLite database
+// at path, as one of several processes sharing it would
+func openReplica(t *testing.T, path string) *Server {
+	t.Helper()
+	store, err := storage.NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite storage: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return NewServerWithStore(store)
+}
+
+// replicaFixture holds two servers sharing one database, with alice and
+// bob registered through the first
+type replicaFixture struct {
+	path       string
+	a, b       *Server
+	alice, bob models.LoginResponse
+}
+
+func newReplicaFixture(t *testing.T) *replicaFixture {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	f := &replicaFixture{path: filepath.Join(t.TempDir(), "missiv.db")}
+	f.a = openReplica(t, f.path)
+	f.b = openReplica(t, f.path)
+	f.alice = registerTestAccount(t, f.a, "alice")
+	f.bob = registerTestAccount(t, f.a, "bob")
+	return f
+}
+
+// searchOn runs a search as a desk on one server and returns the results
+func searchOn(t *testing.T, server *Server, login models.LoginResponse, q string) []*models.SearchResult {
+	t.Helper()
+	w := doRequest(t, server, http.MethodGet, "/api/desks/"+login.Account.ActiveDesk+"/search?q="+url.QueryEscape(q), login.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to search: %d %s", w.Code, w.Body.String())
+	}
+	var resp models.SearchResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Results
+}
+
+func TestReplicasShareEvents(t *testing.T) {
+	f := newReplicaFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+	tsA := httptest.NewServer(f.a.router)
+	defer tsA.Close()
+	tsB := httptest.NewServer(f.b.router)
+	defer tsB.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Bob listens on B while alice writes to him through A
+	streamCtx, closeStream := context.WithCancel(ctx)
+	resp, events := openEventStream(t, streamCtx, tsB.URL, bobDesk, f.bob.Token, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", resp.StatusCode)
+	}
+	w := doRequest(t, f.a, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Subject: "Across", Body: "From the other server"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create conversation: %d %s", w.Code, w.Body.String())
+	}
+	var conv models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &conv)
+
+	// B picks the events up from the shared log on its next pass
+	f.b.events.deliver()
+	created := readEvent(t, events)
+	if created.event != string(models.EventTypeConversation) || !strings.Contains(created.data, conv.Conversation.ID) {
+		t.Errorf("Expected B to stream the conversation created on A, got %+v", created)
+	}
+	notified := readEvent(t, events)
+	if notified.event != string(models.EventTypeNotification) {
+		t.Errorf("Expected B to stream the notification created on A, got %+v", notified)
+	}
+	closeStream()
+	resp.Body.Close()
+
+	// An ID B handed out resumes on A, which saw the events only in the log
+	w = doRequest(t, f.a, http.MethodPost, "/api/mivs/"+conv.Mivs[0].ID+"/read?desk_id="+bobDesk, f.bob.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to read the miv: %d %s", w.Code, w.Body.String())
+	}
+	resp, events = openEventStream(t, ctx, tsA.URL, bobDesk, f.bob.Token, created.id)
+	if e := readEvent(t, events); e.id != notified.id {
+		t.Errorf("Expected A to resume with %s, got %+v", notified.id, e)
+	}
+	var replayed []streamedEvent
+	for len(replayed) == 0 || replayed[len(replayed)-1].event != string(models.EventTypeMivRead) {
+		if len(replayed) == 3 {
+			t.Fatalf("Expected A to replay the read, got %+v", replayed)
+		}
+		replayed = append(replayed, readEvent(t, events))
+	}
+	resp.Body.Close()
+
+	// So does a server started after all of it
+	tsC := httptest.NewServer(openReplica(t, f.path).router)
+	defer tsC.Close()
+	resp, events = openEventStream(t, ctx, tsC.URL, bobDesk, f.bob.Token, notified.id)
+	defer resp.Body.Close()
+	for _, want := range replayed {
+		if e := readEvent(t, events); e.id != want.id {
+			t.Errorf("Expected a restarted server to resume with %s, got %+v", want.id, e)
+		}
+	}
+}
+
+func TestReplicasDispatchOnce(t *testing.T) {
+	f := newReplicaFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+
+	sendAt := time.Now().Add(time.Minute)
+	w := doRequest(t, f.a, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Subject: "Queued", Body: "Once only", SendAt: &sendAt})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected the miv to be scheduled, got %d %s", w.Code, w.Body.String())
+	}
+	replyBy := sendAt.Add(time.Hour)
+	w = doRequest(t, f.b, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Subject: "Chasing", Body: "Reply soon", ReplyBy: &replyBy})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create conversation: %d %s", w.Code, w.Body.String())
+	}
+
+	// Both servers run their dispatchers at once, several passes each
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		for _, server := range []*Server{f.a, f.b} {
+			wg.Add(1)
+			go func(server *Server) {
+				defer wg.Done()
+				server.dispatchDue(sendAt)
+				server.remindFollowUps(replyBy.Add(time.Minute))
+			}(server)
+		}
+	}
+	wg.Wait()
+
+	convs, _ := f.a.storage.ListConversationsByDesk(bobDesk)
+	if len(convs) != 2 {
+		t.Fatalf("Expected bob to have both conversations once, got %d", len(convs))
+	}
+	for _, conv := range convs {
+		if mivs, _ := f.a.storage.GetConversationMivs(conv.ID); len(mivs) != 1 {
+			t.Errorf("Expected one miv in %q, got %d", conv.Subject, len(mivs))
+		}
+	}
+	var newMivs int
+	bobNotifications, _ := f.a.storage.ListNotificationsByDesk(bobDesk, false)
+	for _, n := range bobNotifications {
+		if n.Type == models.NotificationTypeNewMiv {
+			newMivs++
+		}
+	}
+	if newMivs != 2 {
+		t.Errorf("Expected bob to be notified of each miv once, got %d notifications", newMivs)
+	}
+	var reminders int
+	aliceNotifications, _ := f.a.storage.ListNotificationsByDesk(aliceDesk, false)
+	for _, n := range aliceNotifications {
+		if n.Type == models.NotificationTypeFollowUpDue {
+			reminders++
+		}
+	}
+	if reminders != 1 {
+		t.Errorf("Expected alice to be reminded once, got %d reminders", reminders)
+	}
+}
+
+func TestReplicasSearchOtherServersWrites(t *testing.T) {
+	f := newReplicaFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+
+	w := doRequest(t, f.a, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Subject: "Figures", Body: "The annual figures"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create conversation: %d %s", w.Code, w.Body.String())
+	}
+	var conv models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &conv)
+
+	// B builds bob's index from what A wrote, then brings it up to date
+	// with a reply sent through A after that
+	if results := searchOn(t, f.b, f.bob, "annual"); len(results) != 1 {
+		t.Fatalf("Expected B to find the miv written on A, got %+v", results)
+	}
+	w = doRequest(t, f.a, http.MethodPost, "/api/conversations/"+conv.Conversation.ID+"/reply?desk_id="+aliceDesk, f.alice.Token,
+		models.ReplyToConversationRequest{Body: "And the quarterly ones"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to reply: %d %s", w.Code, w.Body.String())
+	}
+	if results := searchOn(t, f.b, f.bob, "quarterly"); len(results) != 1 || results[0].SeqNo != 2 {
+		t.Errorf("Expected B to find the reply written on A, got %+v", results)
+	}
+
+	// A server started afterwards indexes everything from the store
+	if results := searchOn(t, openReplica(t, f.path), f.bob, "annual"); len(results) != 1 {
+		t.Errorf("Expected a restarted server to find the miv, got %+v", results)
+	}
+}
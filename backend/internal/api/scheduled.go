@@ -0,0 +1,435 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+	"github.com/jadefox10200/missiv/backend/internal/storage"
+)
+
+// dispatchInterval is how often the dispatcher looks for scheduled mivs
+// that are due
+const dispatchInterval = 15 * time.Second
+
+// dispatchLease is how long a dispatcher's claim on a scheduled miv keeps
+// others off it. A claim older than this is taken to belong to a server
+// that stopped mid-delivery, and another server delivers the miv instead;
+// the miv keeps its ID, so it is not sent twice.
+const dispatchLease = 5 * time.Minute
+
+// scheduleMiv holds a new miv back until sched.SendAt and reports whether it
+// was scheduled, having written the response either way. A plaintext body is
+// sealed and signed when it is delivered, so the server must hold the
+// sender's keys; until then the body is sealed to the sender's own key. A
+// client-sealed body is kept with its copies and signature as received.
+func (s *Server) scheduleMiv(c *gin.Context, desk *models.Desk, sched *models.ScheduledMiv) bool {
+	if sched.IsAck && sched.ReplyBy != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "An ACK ends the conversation and expects no reply"})
+		return false
+	}
+	sched.AttachmentIDs = withLinks(sched.AttachmentIDs, bodyLinks(sched.Body, sched.IsEncrypted))
+	if _, err := s.resolveAttachments(desk, sched.AttachmentIDs); err != nil {
+		respondError(c, err, "Failed to schedule miv")
+		return false
+	}
+
+	sched.DeskID = desk.ID
+	if err := s.sealScheduledBody(desk, sched); err != nil {
+		respondError(c, err, "Failed to schedule miv")
+		return false
+	}
+	if err := s.storage.CreateScheduledMiv(sched); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to schedule miv"})
+		return false
+	}
+
+	c.JSON(http.StatusAccepted, s.openScheduledMiv(sched))
+	return true
+}
+
+// sealScheduledBody prepares a scheduled miv's body for storage. A plaintext
+// body is sealed to the sender's own current key. A client-sealed one, and
+// each of its copies, only gets a shape check here, as a signature over a
+// reply can only be checked against the conversation it is delivered into;
+// whatever no longer fits at delivery is reported in the miv's Error.
+// Failures to report are statusErrors.
+func (s *Server) sealScheduledBody(desk *models.Desk, sched *models.ScheduledMiv) error {
+	if !sched.IsEncrypted {
+		if sched.Signature != "" {
+			return newStatusError(http.StatusBadRequest, "A plaintext body is signed when it is sent; seal the body and set is_encrypted to sign it yourself")
+		}
+		sealed, keyVersion, err := s.sealForSelf(desk, sched.Body)
+		if errors.Is(err, errClientHeldKeys) {
+			return newStatusError(http.StatusBadRequest, "This desk holds its own keys; seal the body and set is_encrypted")
+		}
+		if err != nil {
+			return err
+		}
+		sched.Body = sealed
+		sched.KeyVersion = keyVersion
+		sched.Bodies, sched.RecipientKeyVersion, sched.KeyVersions, sched.SeqNo = nil, 0, nil, 0
+		sched.NewConversationID = ""
+		return nil
+	}
+
+	for _, sealed := range append([]string{sched.Body}, mapValues(sched.Bodies)...) {
+		decoded, err := base64.StdEncoding.DecodeString(sealed)
+		if err != nil || len(decoded) < minSealedLength {
+			return newStatusError(http.StatusBadRequest, "Encrypted body must be a base64 NaCl box")
+		}
+	}
+	if sched.RecipientKeyVersion == 0 {
+		return newStatusError(http.StatusBadRequest, "Missing the key version the body is sealed to")
+	}
+	for deskID := range sched.Bodies {
+		if sched.KeyVersions[deskID] == 0 {
+			return newStatusError(http.StatusBadRequest, "Missing the key version of the sealed copy for desk '%s'", deskID)
+		}
+	}
+	if sched.Signature == "" && desk.SigningKey != "" && !s.holdsDeskKey(desk) {
+		return newStatusError(http.StatusBadRequest, "This desk holds its own keys; sign the miv and send its signature")
+	}
+	if sched.ConversationID == "" && sched.Signature != "" && !conversationIDPattern.MatchString(sched.NewConversationID) {
+		return newStatusError(http.StatusBadRequest, "Choose a conversation_id and sign it with the first miv")
+	}
+	sched.KeyVersion = 0
+	return nil
+}
+
+// mapValues returns the values of a map of strings
+func mapValues(m map[string]string) []string {
+	values := make([]string, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+// openScheduledBody returns the plaintext of a scheduled miv's body sealed
+// to its sender
+func (s *Server) openScheduledBody(sched *models.ScheduledMiv) (string, error) {
+	return s.openForSelf(sched.DeskID, sched.KeyVersion, sched.Body)
+}
+
+// openScheduledMiv returns a copy of a scheduled miv with its body opened and
+// base64 encoded like an opened miv's; a body that cannot be opened is left
+// empty. A client-sealed body is returned sealed for the client to open.
+func (s *Server) openScheduledMiv(sched *models.ScheduledMiv) *models.ScheduledMiv {
+	copied := *sched
+	if sched.IsEncrypted {
+		return &copied
+	}
+	copied.Body = ""
+	if body, err := s.openScheduledBody(sched); err == nil {
+		copied.Body = base64.StdEncoding.EncodeToString([]byte(body))
+	}
+	return &copied
+}
+
+// authorizeScheduledMiv looks up the scheduled miv named in the path and
+// checks that the caller owns the desk sending it. On failure it writes the
+// error response and returns ok=false.
+func (s *Server) authorizeScheduledMiv(c *gin.Context) (*models.ScheduledMiv, *models.Desk, bool) {
+	sched, err := s.storage.GetScheduledMiv(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scheduled miv not found"})
+		return nil, nil, false
+	}
+	desk, ok := s.authorizeDesk(c, sched.DeskID)
+	if !ok {
+		return nil, nil, false
+	}
+	return sched, desk, true
+}
+
+// listScheduledMivs lists a desk's scheduled mivs, soonest first
+func (s *Server) listScheduledMivs(c *gin.Context) {
+	desk, ok := s.authorizeDesk(c, c.Param("desk_id"))
+	if !ok {
+		return
+	}
+
+	scheduled, err := s.storage.ListScheduledMivs(desk.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list scheduled mivs"})
+		return
+	}
+
+	opened := make([]*models.ScheduledMiv, 0, len(scheduled))
+	for _, sched := range scheduled {
+		opened = append(opened, s.openScheduledMiv(sched))
+	}
+	c.JSON(http.StatusOK, models.ListScheduledMivsResponse{
+		Scheduled: opened,
+		Total:     len(opened),
+	})
+}
+
+// getScheduledMiv returns one scheduled miv
+func (s *Server) getScheduledMiv(c *gin.Context) {
+	sched, _, ok := s.authorizeScheduledMiv(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, s.openScheduledMiv(sched))
+}
+
+// updateScheduledMiv edits a scheduled miv that has not been delivered yet.
+// Editing clears a failed delivery so the dispatcher tries again.
+func (s *Server) updateScheduledMiv(c *gin.Context) {
+	var req models.UpdateScheduledMivRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sched, desk, ok := s.authorizeScheduledMiv(c)
+	if !ok {
+		return
+	}
+
+	// A reply goes to the conversation's participants under its subject
+	if sched.ConversationID != "" && (req.To != nil || req.Cc != nil || req.Subject != nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A scheduled reply takes its recipients and subject from the conversation"})
+		return
+	}
+	// What a client sealed and signed covers its recipients and subject
+	if sched.IsEncrypted && req.Body == nil && (req.To != nil || req.Cc != nil || req.Subject != nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Seal and sign the body again when changing the recipients or subject"})
+		return
+	}
+	if req.To != nil {
+		if _, err := s.resolveRecipients(*req.To, sched.Cc); err != nil {
+			respondError(c, err, "Failed to update scheduled miv")
+			return
+		}
+		sched.To = *req.To
+	}
+	if req.Cc != nil {
+		if _, err := s.resolveRecipients(sched.To, *req.Cc); err != nil {
+			respondError(c, err, "Failed to update scheduled miv")
+			return
+		}
+		sched.Cc = *req.Cc
+	}
+	if req.Subject != nil {
+		if *req.Subject == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Subject cannot be empty"})
+			return
+		}
+		sched.Subject = *req.Subject
+	}
+	var links []string
+	if req.Body != nil {
+		if *req.Body == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Body cannot be empty"})
+			return
+		}
+		links = bodyLinks(*req.Body, req.IsEncrypted)
+		sched.Body, sched.Bodies, sched.IsEncrypted = *req.Body, req.Bodies, req.IsEncrypted
+		sched.RecipientKeyVersion, sched.KeyVersions = req.KeyVersion, req.KeyVersions
+		sched.SeqNo, sched.Signature = req.SeqNo, req.Signature
+		if err := s.sealScheduledBody(desk, sched); err != nil {
+			respondError(c, err, "Failed to update scheduled miv")
+			return
+		}
+	}
+	if req.SendAt != nil {
+		sched.SendAt = *req.SendAt
+	}
+	if req.ReplyBy != nil {
+		if sched.IsAck {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "An ACK ends the conversation and expects no reply"})
+			return
+		}
+		sched.ReplyBy = req.ReplyBy
+	}
+	if req.AttachmentIDs != nil || len(links) > 0 {
+		attachmentIDs := sched.AttachmentIDs
+		if req.AttachmentIDs != nil {
+			attachmentIDs = req.AttachmentIDs
+		}
+		attachmentIDs = withLinks(attachmentIDs, links)
+		if _, err := s.resolveAttachments(desk, attachmentIDs); err != nil {
+			respondError(c, err, "Failed to update scheduled miv")
+			return
+		}
+		sched.AttachmentIDs = attachmentIDs
+	}
+	if req.FontFamily != nil {
+		sched.FontFamily = req.FontFamily
+	}
+	if req.FontSize != nil {
+		sched.FontSize = req.FontSize
+	}
+	sched.Error = ""
+
+	if err := s.storage.UpdateScheduledMiv(sched); err != nil {
+		if errors.Is(err, storage.ErrScheduledMivClaimed) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Scheduled miv is being sent"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update scheduled miv"})
+		return
+	}
+
+	c.JSON(http.StatusOK, s.openScheduledMiv(sched))
+}
+
+// cancelScheduledMiv drops a scheduled miv before it is delivered
+func (s *Server) cancelScheduledMiv(c *gin.Context) {
+	sched, _, ok := s.authorizeScheduledMiv(c)
+	if !ok {
+		return
+	}
+
+	if err := s.storage.DeleteScheduledMiv(sched.ID); err != nil {
+		if errors.Is(err, storage.ErrScheduledMivClaimed) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Scheduled miv is being sent"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel scheduled miv"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// runDispatcher delivers scheduled mivs as they fall due and reminds senders
+// of overdue replies. Both are kept in the store, so after a restart the
+// first run catches up on whatever came due while the server was down.
+// Every server sharing the store runs one; each miv and reminder is claimed
+// in the store first, so only one of them acts on it.
+func (s *Server) runDispatcher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		s.dispatchDue(now)
+		s.remindFollowUps(now)
+		<-ticker.C
+	}
+}
+
+// dispatchDue delivers every scheduled miv due by now. A miv that cannot be
+// delivered as it stands keeps the reason in Error and waits for its sender
+// to edit it; other failures are retried on the next run.
+func (s *Server) dispatchDue(now time.Time) {
+	due, err := s.storage.ListDueScheduledMivs(now)
+	if err != nil {
+		log.Printf("Failed to list scheduled mivs: %v", err)
+		return
+	}
+
+	for _, sched := range due {
+		s.dispatchScheduledMiv(sched.ID, now)
+	}
+}
+
+// dispatchScheduledMiv delivers one scheduled miv, unless its sender has
+// cancelled or postponed it since it was found due, or another server has
+// claimed it. Edits and cancellations are refused while it is claimed.
+func (s *Server) dispatchScheduledMiv(id string, now time.Time) {
+	claimed, err := s.storage.ClaimScheduledMiv(id, now, now.Add(-dispatchLease))
+	if err != nil {
+		log.Printf("Failed to claim scheduled miv %s: %v", id, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+	sched, err := s.storage.GetScheduledMiv(id)
+	if err != nil {
+		log.Printf("Failed to read claimed scheduled miv %s: %v", id, err)
+		return
+	}
+
+	err = s.deliverScheduledMiv(sched)
+	var statusErr *statusError
+	var failure string
+	switch {
+	case err == nil:
+		if err := s.storage.FinishScheduledMiv(sched.ID); err != nil {
+			log.Printf("Failed to remove delivered scheduled miv %s: %v", sched.ID, err)
+		}
+		return
+	case errors.As(err, &statusErr):
+		failure = statusErr.message
+	default:
+		log.Printf("Failed to deliver scheduled miv %s: %v", sched.ID, err)
+	}
+	if err := s.storage.ReleaseScheduledMiv(sched.ID, failure); err != nil {
+		log.Printf("Failed to record scheduled miv %s failure: %v", sched.ID, err)
+	}
+}
+
+// deliverScheduledMiv sends a scheduled miv the way its sender would have
+// sent it at its send time. The miv takes the scheduled miv's ID, so one
+// already delivered before a restart is not sent twice. Failures that need
+// the sender's attention are statusErrors.
+func (s *Server) deliverScheduledMiv(sched *models.ScheduledMiv) error {
+	if _, err := s.storage.GetConversationMiv(sched.ID); err == nil {
+		return nil
+	}
+
+	desk, err := s.storage.GetDesk(sched.DeskID)
+	if err != nil {
+		return newStatusError(http.StatusBadRequest, "Sending desk '%s' no longer exists", sched.DeskID)
+	}
+	body := sched.Body
+	if !sched.IsEncrypted {
+		if body, err = s.openScheduledBody(sched); err != nil {
+			return newStatusError(http.StatusInternalServerError, "Scheduled body can no longer be opened")
+		}
+	}
+
+	if sched.ConversationID == "" {
+		_, _, _, err := s.startConversation(desk, &models.CreateConversationRequest{
+			ConversationID: sched.NewConversationID,
+			To:             sched.To,
+			Cc:             sched.Cc,
+			Subject:        sched.Subject,
+			Body:           body,
+			Bodies:         sched.Bodies,
+			IsEncrypted:    sched.IsEncrypted,
+			KeyVersion:     sched.RecipientKeyVersion,
+			KeyVersions:    sched.KeyVersions,
+			Signature:      sched.Signature,
+			FontFamily:     sched.FontFamily,
+			FontSize:       sched.FontSize,
+			ReplyBy:        sched.ReplyBy,
+			AttachmentIDs:  sched.AttachmentIDs,
+		}, sched.ID)
+		return err
+	}
+
+	conv, err := s.storage.GetConversation(sched.ConversationID)
+	if err != nil {
+		return newStatusError(http.StatusNotFound, "Conversation not found")
+	}
+	mivs, err := s.storage.GetConversationMivs(conv.ID)
+	if err != nil {
+		return err
+	}
+	_, err = s.sendReply(desk, conv, mivs, &models.ReplyToConversationRequest{
+		Body:          body,
+		Bodies:        sched.Bodies,
+		IsAck:         sched.IsAck,
+		IsEncrypted:   sched.IsEncrypted,
+		KeyVersion:    sched.RecipientKeyVersion,
+		KeyVersions:   sched.KeyVersions,
+		SeqNo:         sched.SeqNo,
+		Signature:     sched.Signature,
+		FontFamily:    sched.FontFamily,
+		FontSize:      sched.FontSize,
+		ReplyBy:       sched.ReplyBy,
+		AttachmentIDs: sched.AttachmentIDs,
+	}, sched.ID)
+	return err
+}
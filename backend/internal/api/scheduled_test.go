@@ -0,0 +1,318 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+	"github.com/jadefox10200/missiv/backend/internal/storage"
+)
+
+// listScheduled returns a desk's scheduled mivs
+func listScheduled(t *testing.T, server *Server, login models.LoginResponse) []*models.ScheduledMiv {
+	t.Helper()
+	w := doRequest(t, server, http.MethodGet, "/api/desks/"+login.Account.ActiveDesk+"/scheduled", login.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to list scheduled mivs: %d %s", w.Code, w.Body.String())
+	}
+	var resp models.ListScheduledMivsResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Scheduled
+}
+
+func TestScheduledConversation(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	carolDesk := f.carol.Account.ActiveDesk
+
+	sendAt := time.Now().Add(time.Hour)
+	w := doRequest(t, f.server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token,
+		models.CreateConversationRequest{To: carolDesk, Subject: "Later", Body: "See you tomorrow", SendAt: &sendAt})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected the miv to be scheduled, got %d %s", w.Code, w.Body.String())
+	}
+	var sched models.ScheduledMiv
+	json.Unmarshal(w.Body.Bytes(), &sched)
+	if sched.State != models.StateSCHEDULED || sched.Body != base64.StdEncoding.EncodeToString([]byte("See you tomorrow")) {
+		t.Errorf("Expected a SCHEDULED miv with its body opened, got %+v", sched)
+	}
+
+	// The body is sealed at rest
+	stored, _ := f.server.storage.GetScheduledMiv(sched.ID)
+	if stored.Body == "" || stored.Body == sched.Body {
+		t.Errorf("Expected the stored body to be sealed, got %q", stored.Body)
+	}
+
+	// Carol sees nothing until it is delivered, and cannot touch it
+	f.server.dispatchDue(time.Now())
+	if convs, _ := f.server.storage.ListConversationsByDesk(carolDesk); len(convs) != 0 {
+		t.Fatalf("Expected a scheduled miv to stay hidden, got %d conversations", len(convs))
+	}
+	if notifs, _ := f.server.storage.ListNotificationsByDesk(carolDesk, false); len(notifs) != 0 {
+		t.Fatalf("Expected no notification for a scheduled miv, got %d", len(notifs))
+	}
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		w = doRequest(t, f.server, method, "/api/scheduled/"+sched.ID, f.carol.Token, models.UpdateScheduledMivRequest{})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected %s by another account to be forbidden, got %d", method, w.Code)
+		}
+	}
+
+	// Editing it to go out now gets it delivered on the next run
+	body := "See you today"
+	now := time.Now()
+	w = doRequest(t, f.server, http.MethodPut, "/api/scheduled/"+sched.ID, f.alice.Token,
+		models.UpdateScheduledMivRequest{Body: &body, SendAt: &now})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to update scheduled miv: %d %s", w.Code, w.Body.String())
+	}
+	if scheduled := listScheduled(t, f.server, f.alice); len(scheduled) != 1 || scheduled[0].Body != base64.StdEncoding.EncodeToString([]byte(body)) {
+		t.Fatalf("Expected the edited miv in alice's list, got %+v", scheduled)
+	}
+
+	f.server.dispatchDue(time.Now())
+	f.server.dispatchDue(time.Now())
+	if scheduled := listScheduled(t, f.server, f.alice); len(scheduled) != 0 {
+		t.Errorf("Expected a delivered miv to leave the queue, got %+v", scheduled)
+	}
+	miv, err := f.server.storage.GetConversationMiv(sched.ID)
+	if err != nil {
+		t.Fatalf("Expected the miv to be delivered under its scheduled ID: %v", err)
+	}
+	carol, _ := f.server.storage.GetDesk(carolDesk)
+	if opened := f.server.openMiv(carol, miv); opened.Body != base64.StdEncoding.EncodeToString([]byte(body)) || !opened.IsVerified {
+		t.Errorf("Expected carol to open the signed, edited body, got %+v", opened)
+	}
+	if notifs, _ := f.server.storage.ListNotificationsByDesk(carolDesk, false); len(notifs) != 1 {
+		t.Errorf("Expected one notification on delivery, got %d", len(notifs))
+	}
+}
+
+func TestScheduledReply(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	f := newPolicyFixture(t)
+	bobDesk := f.bob.Account.ActiveDesk
+	replyPath := "/api/conversations/" + f.conversationID + "/reply?desk_id=" + bobDesk
+
+	w := uploadAttachment(t, f.server, f.bob, bobDesk, "notes.txt", "text/plain", []byte("some notes"))
+	var att models.Attachment
+	json.Unmarshal(w.Body.Bytes(), &att)
+
+	past := time.Now().Add(-time.Minute)
+	w = doRequest(t, f.server, http.MethodPost, replyPath, f.bob.Token,
+		models.ReplyToConversationRequest{Body: `Cancelled <a href="` + att.URL + `">notes</a>`, SendAt: &past})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected the reply to be scheduled, got %d %s", w.Code, w.Body.String())
+	}
+	var cancelled models.ScheduledMiv
+	json.Unmarshal(w.Body.Bytes(), &cancelled)
+
+	// The attachment the body links is held for the scheduled miv
+	if len(cancelled.AttachmentIDs) != 1 || cancelled.AttachmentIDs[0] != att.ID {
+		t.Errorf("Expected the body's link to be listed, got %v", cancelled.AttachmentIDs)
+	}
+	w = doRequest(t, f.server, http.MethodDelete, "/api/attachments/"+att.ID+"?desk_id="+bobDesk, f.bob.Token, nil)
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected deleting an attachment a scheduled miv lists to conflict, got %d", w.Code)
+	}
+
+	// A reply's recipients come from the conversation
+	subject := "Changed"
+	w = doRequest(t, f.server, http.MethodPut, "/api/scheduled/"+cancelled.ID, f.bob.Token, models.UpdateScheduledMivRequest{Subject: &subject})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a reply's subject to be fixed, got %d", w.Code)
+	}
+
+	w = doRequest(t, f.server, http.MethodDelete, "/api/scheduled/"+cancelled.ID, f.bob.Token, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Failed to cancel scheduled miv: %d %s", w.Code, w.Body.String())
+	}
+	w = doRequest(t, f.server, http.MethodDelete, "/api/attachments/"+att.ID+"?desk_id="+bobDesk, f.bob.Token, nil)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected the attachment to be deletable once the miv is cancelled, got %d", w.Code)
+	}
+
+	w = doRequest(t, f.server, http.MethodPost, replyPath, f.bob.Token,
+		models.ReplyToConversationRequest{Body: "Thanks", IsAck: true, SendAt: &past})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected the ACK to be scheduled, got %d %s", w.Code, w.Body.String())
+	}
+
+	f.server.dispatchDue(time.Now())
+	mivs, _ := f.server.storage.GetConversationMivs(f.conversationID)
+	if len(mivs) != 2 || !mivs[1].IsAck || mivs[1].SeqNo != 2 {
+		t.Fatalf("Expected only the ACK to be delivered, got %+v", mivs)
+	}
+
+	// Client-sealed bodies are checked like those sent at once
+	w = doRequest(t, f.server, http.MethodPost, replyPath, f.bob.Token,
+		models.ReplyToConversationRequest{Body: "sealed", IsEncrypted: true, KeyVersion: 1, SendAt: &past})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a malformed client-sealed body to be rejected, got %d", w.Code)
+	}
+}
+
+func TestScheduledClientSealedMivs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+
+	alice, aliceKeys := registerClientKeyedAccount(t, server, "alice")
+	bob, bobKeys := registerClientKeyedAccount(t, server, "bob")
+	aliceDesk := alice.Account.ActiveDesk
+	bobDesk := bob.Account.ActiveDesk
+
+	seal := func(plaintext string, to *clientKeys, from *clientKeys) string {
+		sealed, _ := crypto.Encrypt([]byte(plaintext), to.PublicKey, from.PrivateKey)
+		return base64.StdEncoding.EncodeToString(sealed)
+	}
+
+	// A client-keyed desk schedules what it sealed and signed itself
+	past := time.Now().Add(-time.Minute)
+	body := seal("Hi Bob", bobKeys, aliceKeys)
+	if w := doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Subject: "Hello", Body: "Hi Bob", SendAt: &past}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a plaintext scheduled miv from a client-keyed desk to be rejected, got %d", w.Code)
+	}
+	if w := doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Subject: "Hello", Body: body, IsEncrypted: true, KeyVersion: 1, SendAt: &past}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unsigned scheduled miv from a client-keyed desk to be rejected, got %d", w.Code)
+	}
+
+	first := &models.ConversationMiv{ConversationID: "conv-chosen-by-alice", SeqNo: 1, From: aliceDesk, To: bobDesk, Subject: "Hello", Body: body}
+	w := doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token,
+		models.CreateConversationRequest{ConversationID: first.ConversationID, To: bobDesk, Subject: "Hello", Body: body,
+			IsEncrypted: true, KeyVersion: 1, Signature: aliceKeys.sign(first), SendAt: &past})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected the client-sealed miv to be scheduled, got %d %s", w.Code, w.Body.String())
+	}
+	var sched models.ScheduledMiv
+	json.Unmarshal(w.Body.Bytes(), &sched)
+	if sched.Body != body || !sched.IsEncrypted {
+		t.Errorf("Expected the sealed body back as sent, got %+v", sched)
+	}
+
+	// Changing the subject would break the signature unless sealed again
+	subject := "Changed"
+	if w := doRequest(t, server, http.MethodPut, "/api/scheduled/"+sched.ID, alice.Token,
+		models.UpdateScheduledMivRequest{Subject: &subject}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a subject change without a new signature to be rejected, got %d", w.Code)
+	}
+
+	server.dispatchDue(time.Now())
+	w = doRequest(t, server, http.MethodGet, "/api/conversations/"+first.ConversationID+"?desk_id="+bobDesk, bob.Token, nil)
+	var fetched models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &fetched)
+	if len(fetched.Mivs) != 1 || fetched.Mivs[0].ID != sched.ID || fetched.Mivs[0].Body != body || !fetched.Mivs[0].IsVerified {
+		t.Fatalf("Expected the sealed, signed miv to be delivered as scheduled, got %d %+v", w.Code, fetched.Mivs)
+	}
+
+	// A signed reply whose sequence number was taken waits for a new one
+	reply := &models.ConversationMiv{ConversationID: first.ConversationID, SeqNo: 2, From: bobDesk, To: aliceDesk, Subject: "Hello", Body: seal("Later", aliceKeys, bobKeys)}
+	replyPath := "/api/conversations/" + first.ConversationID + "/reply?desk_id=" + bobDesk
+	w = doRequest(t, server, http.MethodPost, replyPath, bob.Token, models.ReplyToConversationRequest{
+		Body: reply.Body, IsEncrypted: true, KeyVersion: 1, SeqNo: 2, Signature: bobKeys.sign(reply), SendAt: &past})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected the client-sealed reply to be scheduled, got %d %s", w.Code, w.Body.String())
+	}
+	json.Unmarshal(w.Body.Bytes(), &sched)
+
+	now := *reply
+	now.Body = seal("Now", aliceKeys, bobKeys)
+	if w := doRequest(t, server, http.MethodPost, replyPath, bob.Token, models.ReplyToConversationRequest{
+		Body: now.Body, IsEncrypted: true, KeyVersion: 1, SeqNo: 2, Signature: bobKeys.sign(&now)}); w.Code != http.StatusCreated {
+		t.Fatalf("Failed to reply: %d %s", w.Code, w.Body.String())
+	}
+	server.dispatchDue(time.Now())
+	stored, err := server.storage.GetScheduledMiv(sched.ID)
+	if err != nil || stored.Error == "" {
+		t.Fatalf("Expected the stale reply to wait with its error, got %+v (err %v)", stored, err)
+	}
+
+	reply.SeqNo = 3
+	w = doRequest(t, server, http.MethodPut, "/api/scheduled/"+sched.ID, bob.Token, models.UpdateScheduledMivRequest{
+		Body: &reply.Body, IsEncrypted: true, KeyVersion: 1, SeqNo: 3, Signature: bobKeys.sign(reply)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to sign the scheduled reply again: %d %s", w.Code, w.Body.String())
+	}
+	server.dispatchDue(time.Now())
+	if miv, err := server.storage.GetConversationMiv(sched.ID); err != nil || miv.SeqNo != 3 || miv.Body != reply.Body {
+		t.Errorf("Expected the re-signed reply to be delivered, got %+v (err %v)", miv, err)
+	}
+}
+
+func TestScheduledMivClaimedByDispatcher(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+
+	past := time.Now().Add(-time.Minute)
+	w := doRequest(t, f.server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, f.alice.Token,
+		models.CreateConversationRequest{To: f.carol.Account.ActiveDesk, Subject: "Now", Body: "Going out", SendAt: &past})
+	var sched models.ScheduledMiv
+	json.Unmarshal(w.Body.Bytes(), &sched)
+
+	// Another server has claimed it and is delivering it
+	if claimed, err := f.server.storage.ClaimScheduledMiv(sched.ID, time.Now(), time.Now().Add(-dispatchLease)); err != nil || !claimed {
+		t.Fatalf("Failed to claim scheduled miv: %v (claimed %v)", err, claimed)
+	}
+	subject := "Edited"
+	if w := doRequest(t, f.server, http.MethodPut, "/api/scheduled/"+sched.ID, f.alice.Token,
+		models.UpdateScheduledMivRequest{Subject: &subject}); w.Code != http.StatusConflict {
+		t.Errorf("Expected editing a miv being sent to conflict, got %d", w.Code)
+	}
+	if w := doRequest(t, f.server, http.MethodDelete, "/api/scheduled/"+sched.ID, f.alice.Token, nil); w.Code != http.StatusConflict {
+		t.Errorf("Expected cancelling a miv being sent to conflict, got %d", w.Code)
+	}
+	f.server.dispatchDue(time.Now())
+	if _, err := f.server.storage.GetConversationMiv(sched.ID); err == nil {
+		t.Errorf("Expected a miv claimed elsewhere not to be delivered here")
+	}
+
+	// Once the claim is stale this server takes over
+	f.server.dispatchDue(time.Now().Add(dispatchLease + time.Minute))
+	if _, err := f.server.storage.GetConversationMiv(sched.ID); err != nil {
+		t.Errorf("Expected a stale claim to be taken over: %v", err)
+	}
+}
+
+func TestScheduledSendSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missiv.db")
+	store, err := storage.NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite storage: %v", err)
+	}
+	server := NewServerWithStore(store)
+	alice := registerTestAccount(t, server, "alice")
+	bob := registerTestAccount(t, server, "bob")
+
+	sendAt := time.Now().Add(time.Minute)
+	w := doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+alice.Account.ActiveDesk, alice.Token,
+		models.CreateConversationRequest{To: bob.Account.ActiveDesk, Subject: "Queued", Body: "Still here", SendAt: &sendAt})
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected the miv to be scheduled, got %d %s", w.Code, w.Body.String())
+	}
+	var sched models.ScheduledMiv
+	json.Unmarshal(w.Body.Bytes(), &sched)
+	store.Close()
+
+	// A new server on the same database delivers it once it falls due
+	store, err = storage.NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen sqlite storage: %v", err)
+	}
+	defer store.Close()
+	server = NewServerWithStore(store)
+
+	server.dispatchDue(sendAt)
+	if _, err := server.storage.GetConversationMiv(sched.ID); err != nil {
+		t.Fatalf("Expected the miv to be delivered after a restart: %v", err)
+	}
+	if convs, _ := server.storage.ListConversationsByDesk(bob.Account.ActiveDesk); len(convs) != 1 {
+		t.Errorf("Expected bob to get the conversation, got %d", len(convs))
+	}
+}
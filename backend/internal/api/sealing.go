@@ -0,0 +1,263 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// minSealedLength is the size of a NaCl box holding an empty message
+const minSealedLength = 24 + box.Overhead
+
+// errClientHeldKeys is returned by sealForSelf for a desk whose private keys
+// the server does not hold
+var errClientHeldKeys = errors.New("desk keys are held by its client")
+
+// sealForSelf seals a body a desk keeps for itself, such as a scheduled miv,
+// to its own current key. It returns the sealed body and the key version it
+// is sealed with. Failures to report are statusErrors.
+func (s *Server) sealForSelf(desk *models.Desk, body string) (string, int, error) {
+	if s.clientKeysOnly() {
+		return "", 0, errClientHeldKeys
+	}
+	privateKey, err := s.storage.GetDeskPrivateKey(desk.ID, desk.KeyVersion)
+	if err != nil {
+		return "", 0, errClientHeldKeys
+	}
+	publicKey, err := crypto.PublicKeyFromBase64(desk.PublicKey)
+	if err != nil {
+		return "", 0, newStatusError(http.StatusInternalServerError, "Desk public key is invalid")
+	}
+
+	sealed, err := crypto.Encrypt([]byte(body), publicKey, privateKey)
+	if err != nil {
+		return "", 0, newStatusError(http.StatusInternalServerError, "Failed to encrypt body")
+	}
+	return base64.StdEncoding.EncodeToString(sealed), desk.KeyVersion, nil
+}
+
+// openForSelf opens a body sealed by sealForSelf with the desk's key at
+// keyVersion
+func (s *Server) openForSelf(deskID string, keyVersion int, sealed string) (string, error) {
+	privateKey, err := s.storage.GetDeskPrivateKey(deskID, keyVersion)
+	if err != nil {
+		return "", err
+	}
+	deskKey, err := s.storage.GetDeskKey(deskID, keyVersion)
+	if err != nil {
+		return "", err
+	}
+	publicKey, err := crypto.PublicKeyFromBase64(deskKey.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := crypto.Decrypt(decoded, publicKey, privateKey)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// sealMivBody sets the stored bodies of a new miv: the body for miv.To and a
+// copy for each further recipient, along with the key versions they are
+// sealed with. Client-sealed bodies are stored as received after a shape
+// check. Each must target its recipient's current key: the body for To
+// names its version in keyVersion, defaulting to current, and copies come
+// in bodies with their versions in keyVersions, both keyed by desk ID.
+// Plaintext bodies are sealed here, which needs a server-held sender key.
+// Failures to report are statusErrors.
+func (s *Server) sealMivBody(sender *models.Desk, miv *models.ConversationMiv, body string, bodies map[string]string, clientSealed bool, keyVersion int, keyVersions map[string]int) error {
+	if len(miv.Recipients) == 0 {
+		miv.Recipients = []*models.MivRecipient{{DeskID: crypto.NormalizeDeskID(miv.To), Role: models.ParticipantRoleTo}}
+	}
+	copies := make(map[string]string, len(bodies))
+	for deskID, copied := range bodies {
+		copies[crypto.NormalizeDeskID(deskID)] = copied
+	}
+	versions := make(map[string]int, len(keyVersions))
+	for deskID, version := range keyVersions {
+		versions[crypto.NormalizeDeskID(deskID)] = version
+	}
+
+	miv.IsEncrypted = true
+	miv.SenderKeyVersion = sender.KeyVersion
+
+	var senderKey *[32]byte
+	for i, r := range miv.Recipients {
+		recipient, err := s.storage.GetDesk(crypto.NormalizeDeskID(r.DeskID))
+		if err != nil {
+			return newStatusError(http.StatusBadRequest, "Recipient desk '%s' does not exist", r.DeskID)
+		}
+		r.KeyVersion = recipient.KeyVersion
+
+		var sealed string
+		if clientSealed {
+			// A copy sealed to a retired key could never be opened, so
+			// every copy must say which key it targets
+			version := keyVersion
+			sealed = body
+			if i > 0 {
+				deskID := crypto.NormalizeDeskID(r.DeskID)
+				sealed, version = copies[deskID], versions[deskID]
+				if sealed == "" {
+					return newStatusError(http.StatusBadRequest, "Missing a sealed copy of the body for desk '%s'", r.DeskID)
+				}
+			}
+			if version == 0 {
+				return newStatusError(http.StatusBadRequest, "Missing the key version of the sealed copy for desk '%s'", r.DeskID)
+			}
+			if version != recipient.KeyVersion {
+				return newStatusError(http.StatusConflict, "Key of desk '%s' has been rotated; fetch the current key and seal again", r.DeskID)
+			}
+			decoded, err := base64.StdEncoding.DecodeString(sealed)
+			if err != nil || len(decoded) < minSealedLength {
+				return newStatusError(http.StatusBadRequest, "Encrypted body must be a base64 NaCl box")
+			}
+		} else {
+			if senderKey == nil {
+				if s.clientKeysOnly() {
+					return newStatusError(http.StatusBadRequest, "This server only relays ciphertext; seal the body and set is_encrypted")
+				}
+				key, err := s.storage.GetDeskPrivateKey(sender.ID, sender.KeyVersion)
+				if err != nil {
+					return newStatusError(http.StatusBadRequest, "This desk holds its own keys; seal the body and set is_encrypted")
+				}
+				senderKey = &key
+			}
+
+			recipientKey, err := crypto.PublicKeyFromBase64(recipient.PublicKey)
+			if err != nil {
+				return newStatusError(http.StatusInternalServerError, "Recipient public key is invalid")
+			}
+			encrypted, err := crypto.Encrypt([]byte(body), recipientKey, *senderKey)
+			if err != nil {
+				return newStatusError(http.StatusInternalServerError, "Failed to encrypt miv")
+			}
+			sealed = base64.StdEncoding.EncodeToString(encrypted)
+		}
+
+		// The To desk's body stays on the miv itself
+		if i == 0 {
+			miv.Body = sealed
+			miv.RecipientKeyVersion = recipient.KeyVersion
+		} else {
+			r.Body = sealed
+		}
+	}
+	return nil
+}
+
+// openMivs returns copies of mivs with bodies opened for desk.
+// Only the sender and the recipients hold a key that opens a miv; each
+// recipient sees its own copy and read state, and each side uses the key
+// versions recorded for it, so mivs sealed before a rotation still open.
+// Mivs the desk cannot open, or that belong to a client-keyed desk, keep
+// their ciphertext and IsEncrypted flag for the client to open. Opened
+// bodies are base64 encoded like unencrypted ones. Signatures are checked
+// against the stored body before it is opened, and a body that was replaced
+// is kept in SignedBody so clients can check them too. The sender only sees the
+// reads of recipients that shared read receipts when they read the miv.
+func (s *Server) openMivs(desk *models.Desk, mivs []*models.ConversationMiv) []*models.ConversationMiv {
+	self := crypto.NormalizeDeskID(desk.ID)
+	signingKeys := make(map[string]string)
+
+	opened := make([]*models.ConversationMiv, 0, len(mivs))
+	for _, miv := range mivs {
+		copied := *miv
+		copied.IsVerified = s.verifyMiv(miv, signingKeys)
+		if self != crypto.NormalizeDeskID(miv.From) {
+			copied.FollowUpAt = nil
+		}
+		opened = append(opened, &copied)
+
+		// A recipient past the To desk reads its own copy of the body
+		recipient := mivRecipient(miv, self)
+		if recipient != nil {
+			copied.ReadAt = recipient.ReadAt
+			if recipient.Body != "" {
+				copied.SignedBody = miv.Body
+				copied.Body = recipient.Body
+				copied.RecipientKeyVersion = recipient.KeyVersion
+			}
+		} else if self == crypto.NormalizeDeskID(miv.From) {
+			withholdReads(&copied)
+		}
+		if !miv.IsEncrypted || s.clientKeysOnly() {
+			continue
+		}
+
+		// The peer is whichever side of the exchange this desk is not
+		var peer string
+		var ownVersion, peerVersion int
+		switch {
+		case recipient != nil || self == crypto.NormalizeDeskID(miv.To):
+			peer, ownVersion, peerVersion = miv.From, copied.RecipientKeyVersion, miv.SenderKeyVersion
+		case self == crypto.NormalizeDeskID(miv.From):
+			peer, ownVersion, peerVersion = miv.To, miv.SenderKeyVersion, miv.RecipientKeyVersion
+		default:
+			continue
+		}
+
+		privateKey, err := s.storage.GetDeskPrivateKey(desk.ID, ownVersion)
+		if err != nil {
+			continue
+		}
+		peerKey, err := s.storage.GetDeskKey(peer, peerVersion)
+		if err != nil {
+			continue
+		}
+		peerPublic, err := crypto.PublicKeyFromBase64(peerKey.PublicKey)
+		if err != nil {
+			continue
+		}
+
+		sealed, err := base64.StdEncoding.DecodeString(copied.Body)
+		if err != nil {
+			continue
+		}
+		plaintext, err := crypto.Decrypt(sealed, peerPublic, privateKey)
+		if err != nil {
+			continue
+		}
+		copied.SignedBody = miv.Body
+		copied.Body = base64.StdEncoding.EncodeToString(plaintext)
+		copied.IsEncrypted = false
+	}
+	return opened
+}
+
+// withholdReads clears, from the sender's copy of a miv, the reads of
+// recipients that had read receipts off when they read it
+func withholdReads(miv *models.ConversationMiv) {
+	recipients := make([]*models.MivRecipient, len(miv.Recipients))
+	for i, r := range miv.Recipients {
+		copied := *r
+		if copied.ReceiptWithheld {
+			copied.ReadAt = nil
+		}
+		recipients[i] = &copied
+	}
+	miv.Recipients = recipients
+
+	// The To desk's read also moves the miv itself to PENDING
+	if to := mivRecipient(miv, miv.To); miv.ReadAt != nil && to != nil && to.ReceiptWithheld {
+		miv.ReadAt = nil
+		if miv.State == models.StatePENDING {
+			miv.State = models.StateSENT
+		}
+	}
+}
+
+// openMiv is openMivs for a single miv
+func (s *Server) openMiv(desk *models.Desk, miv *models.ConversationMiv) *models.ConversationMiv {
+	return s.openMivs(desk, []*models.ConversationMiv{miv})[0]
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+func TestConversationBodiesAreSealed(t *testing.T) {
+	f := newPolicyFixture(t)
+	store := f.server.storage
+
+	stored, err := store.GetConversationMiv(f.mivID)
+	if err != nil {
+		t.Fatalf("Failed to load stored miv: %v", err)
+	}
+	if !stored.IsEncrypted {
+		t.Errorf("Expected stored miv to be marked encrypted")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(stored.Body)
+	if err != nil {
+		t.Fatalf("Expected base64 ciphertext, got %q", stored.Body)
+	}
+	if strings.Contains(string(sealed), "Hi Bob") {
+		t.Fatalf("Stored body contains the plaintext")
+	}
+
+	alice, _ := store.GetDesk(f.alice.Account.ActiveDesk)
+	alicePublic, _ := crypto.PublicKeyFromBase64(alice.PublicKey)
+
+	// The recipient's key opens the box; an outsider's does not
+	bobPrivate, _ := store.GetDeskPrivateKey(f.bob.Account.ActiveDesk, 0)
+	plaintext, err := crypto.Decrypt(sealed, alicePublic, bobPrivate)
+	if err != nil || string(plaintext) != "Hi Bob" {
+		t.Errorf("Expected recipient to decrypt body, got %q (err %v)", plaintext, err)
+	}
+	carolPrivate, _ := store.GetDeskPrivateKey(f.carol.Account.ActiveDesk, 0)
+	if _, err := crypto.Decrypt(sealed, alicePublic, carolPrivate); err == nil {
+		t.Errorf("Expected outsider key to fail to decrypt body")
+	}
+
+	// Both participants get the opened body back, base64 encoded as before
+	for _, login := range []models.LoginResponse{f.alice, f.bob} {
+		w := doRequest(t, f.server, http.MethodGet, "/api/conversations/"+f.conversationID+"?desk_id="+login.Account.ActiveDesk, login.Token, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp models.GetConversationResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		body, _ := base64.StdEncoding.DecodeString(resp.Mivs[0].Body)
+		if string(body) != "Hi Bob" || resp.Mivs[0].IsEncrypted {
+			t.Errorf("Expected %s to read the opened body, got %q", login.Account.Username, body)
+		}
+	}
+
+	// Opening for display must not overwrite the stored ciphertext
+	stored, _ = store.GetConversationMiv(f.mivID)
+	if !stored.IsEncrypted {
+		t.Errorf("Expected stored miv to stay encrypted after reading")
+	}
+}
+
+func TestRepliesAreSealed(t *testing.T) {
+	f := newPolicyFixture(t)
+	bobDesk := f.bob.Account.ActiveDesk
+
+	w := doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+bobDesk, f.bob.Token,
+		models.ReplyToConversationRequest{Body: "Hi Alice"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var reply models.ConversationMiv
+	json.Unmarshal(w.Body.Bytes(), &reply)
+
+	stored, _ := f.server.storage.GetConversationMiv(reply.ID)
+	sealed, _ := base64.StdEncoding.DecodeString(stored.Body)
+	if !stored.IsEncrypted || strings.Contains(string(sealed), "Hi Alice") {
+		t.Fatalf("Expected reply to be stored as ciphertext")
+	}
+
+	bob, _ := f.server.storage.GetDesk(bobDesk)
+	bobPublic, _ := crypto.PublicKeyFromBase64(bob.PublicKey)
+	alicePrivate, _ := f.server.storage.GetDeskPrivateKey(f.alice.Account.ActiveDesk, 0)
+	plaintext, err := crypto.Decrypt(sealed, bobPublic, alicePrivate)
+	if err != nil || string(plaintext) != "Hi Alice" {
+		t.Errorf("Expected alice to decrypt reply, got %q (err %v)", plaintext, err)
+	}
+}
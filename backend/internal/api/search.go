@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+	"github.com/jadefox10200/missiv/backend/internal/search"
+)
+
+// Searches return defaultSearchResults results unless the request asks for
+// another limit, up to maxSearchResults
+const (
+	defaultSearchResults = 20
+	maxSearchResults     = 100
+)
+
+// searchDesk finds the mivs in a desk's conversations whose subject, body or
+// counterpart contact name match the q parameter, best match first
+func (s *Server) searchDesk(c *gin.Context) {
+	desk, ok := s.authorizeDesk(c, c.Param("desk_id"))
+	if !ok {
+		return
+	}
+
+	query := strings.TrimSpace(c.Query("q"))
+	if len(search.Tokenize(query)) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Search query is required"})
+		return
+	}
+	limit := defaultSearchResults
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxSearchResults {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Limit must be a number from 1 to %d", maxSearchResults)})
+			return
+		}
+		limit = n
+	}
+
+	index, err := s.deskIndex(desk)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search"})
+		return
+	}
+	contacts, err := s.storage.ListContactsForDesk(desk.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search"})
+		return
+	}
+	names := make(map[string]string, len(contacts))
+	for _, contact := range contacts {
+		deskID := crypto.NormalizeDeskID(contact.DeskIDRef)
+		names[deskID] = strings.Join([]string{names[deskID], contact.Name, contact.FirstName, contact.LastName, contact.GreetingName}, " ")
+	}
+
+	results := index.Search(query, names, limit)
+	c.JSON(http.StatusOK, models.SearchResponse{
+		Query:        query,
+		Results:      results,
+		Total:        len(results),
+		SealedBodies: index.Sealed(),
+	})
+}
+
+// deskIndex returns the desk's search index, first re-indexing the
+// conversations that changed in the store since it was last brought up to
+// date, whichever server changed them. Only the desk's own view of each
+// miv, opened with its keys, goes into its index.
+func (s *Server) deskIndex(desk *models.Desk) (*search.Index, error) {
+	index := s.searchIndexes.For(desk.ID)
+
+	convs, err := s.storage.ListConversationsByDesk(desk.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, conv := range convs {
+		version := fmt.Sprintf("%d-%d", conv.MivCount, conv.UpdatedAt.UnixNano())
+		if index.Version(conv.ID) == version {
+			continue
+		}
+		mivs, err := s.storage.GetConversationMivs(conv.ID)
+		if err != nil {
+			return nil, err
+		}
+		docs := make([]*search.Document, 0, len(mivs))
+		for _, miv := range s.openMivs(desk, mivs) {
+			docs = append(docs, mivDocument(miv, desk.ID))
+		}
+		index.ReplaceConversation(conv.ID, version, docs)
+	}
+	return index, nil
+}
+
+// mivDocument turns a miv opened for a desk into that desk's search
+// document. Bodies the desk cannot open are left out and marked sealed.
+func mivDocument(miv *models.ConversationMiv, deskID string) *search.Document {
+	doc := &search.Document{
+		MivID:          miv.ID,
+		ConversationID: miv.ConversationID,
+		SeqNo:          miv.SeqNo,
+		Subject:        miv.Subject,
+		Sealed:         miv.IsEncrypted,
+		CreatedAt:      miv.CreatedAt,
+	}
+	if !miv.IsEncrypted {
+		if body, err := base64.StdEncoding.DecodeString(miv.Body); err == nil {
+			doc.Body = search.PlainText(string(body))
+		}
+	}
+	if crypto.NormalizeDeskID(miv.From) == crypto.NormalizeDeskID(deskID) {
+		doc.Counterparts = recipientDeskIDs(miv)
+	} else {
+		doc.Counterparts = []string{miv.From}
+	}
+	return doc
+}
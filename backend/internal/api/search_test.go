@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// searchAs runs a search as a desk and returns the results
+func searchAs(t *testing.T, f *policyFixture, login models.LoginResponse, q string) []*models.SearchResult {
+	t.Helper()
+	w := doRequest(t, f.server, http.MethodGet, "/api/desks/"+login.Account.ActiveDesk+"/search?q="+url.QueryEscape(q), login.Token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to search: %d %s", w.Code, w.Body.String())
+	}
+	var resp models.SearchResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.Results
+}
+
+func TestSearch(t *testing.T) {
+	f := newPolicyFixture(t)
+	bobDesk := f.bob.Account.ActiveDesk
+
+	// Bodies are sealed in the store but searchable by both sides
+	for _, login := range []models.LoginResponse{f.alice, f.bob} {
+		results := searchAs(t, f, login, "bob")
+		if len(results) != 1 || results[0].MivID != f.mivID || results[0].ConversationID != f.conversationID || results[0].SeqNo != 1 {
+			t.Fatalf("Expected %s to find the miv, got %+v", login.Account.Username, results)
+		}
+		if results[0].Snippet != "Hi <mark>Bob</mark>" {
+			t.Errorf("Expected a highlighted snippet, got %q", results[0].Snippet)
+		}
+	}
+
+	// A desk outside the conversation finds nothing and cannot search another desk
+	if results := searchAs(t, f, f.carol, "bob"); len(results) != 0 {
+		t.Errorf("Expected carol's index to be her own, got %+v", results)
+	}
+	w := doRequest(t, f.server, http.MethodGet, "/api/desks/"+bobDesk+"/search?q=bob", f.carol.Token, nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected another account's search to be forbidden, got %d", w.Code)
+	}
+
+	// Replies are indexed on the next search
+	w = doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+bobDesk, f.bob.Token,
+		models.ReplyToConversationRequest{Body: "<p>The <b>quarterly</b> figures</p>"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to reply: %d %s", w.Code, w.Body.String())
+	}
+	results := searchAs(t, f, f.alice, "quarter")
+	if len(results) != 1 || results[0].SeqNo != 2 || results[0].Snippet != "The <mark>quarterly</mark> figures" {
+		t.Errorf("Expected the reply to be found, got %+v", results)
+	}
+
+	// Alice's contact name for bob matches everything bob sent her, while
+	// bob has no such contact
+	if results := searchAs(t, f, f.alice, "Bob figures"); len(results) != 1 || results[0].SeqNo != 2 {
+		t.Errorf("Expected the contact name to match bob's reply, got %+v", results)
+	}
+	if results := searchAs(t, f, f.bob, "Bob figures"); len(results) != 0 {
+		t.Errorf("Expected alice's contacts to stay out of bob's search, got %+v", results)
+	}
+
+	w = doRequest(t, f.server, http.MethodGet, "/api/desks/"+bobDesk+"/search?q=+", f.bob.Token, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an empty query to be rejected, got %d", w.Code)
+	}
+}
+
+func TestSearchReportsSealedBodies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+	alice, aliceKeys := registerClientKeyedAccount(t, server, "alice")
+	bob, bobKeys := registerClientKeyedAccount(t, server, "bob")
+	aliceDesk := alice.Account.ActiveDesk
+	bobDesk := bob.Account.ActiveDesk
+
+	sealed, _ := crypto.Encrypt([]byte("The quarterly figures"), bobKeys.PublicKey, aliceKeys.PrivateKey)
+	first := &models.ConversationMiv{ConversationID: "conv-sealed-budget", SeqNo: 1, From: aliceDesk, To: bobDesk, Subject: "Budget",
+		Body: base64.StdEncoding.EncodeToString(sealed)}
+	w := doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token, models.CreateConversationRequest{
+		To: bobDesk, Subject: first.Subject, Body: first.Body, IsEncrypted: true, KeyVersion: 1, ConversationID: first.ConversationID, Signature: aliceKeys.sign(first)})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create conversation: %d %s", w.Code, w.Body.String())
+	}
+
+	// The server cannot read the body, so the search says it was left out
+	for _, q := range []string{"budget", "quarterly"} {
+		w = doRequest(t, server, http.MethodGet, "/api/desks/"+bobDesk+"/search?q="+q, bob.Token, nil)
+		var resp models.SearchResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.SealedBodies != 1 {
+			t.Errorf("Expected one sealed body to be reported for %q, got %+v", q, resp)
+		}
+		if want := q == "budget"; (len(resp.Results) == 1) != want {
+			t.Errorf("Expected %q to match by subject only, got %+v", q, resp.Results)
+		}
+	}
+}
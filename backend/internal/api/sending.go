@@ -0,0 +1,185 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jadefox10200/missiv/backend/internal/models"
+	"github.com/jadefox10200/missiv/backend/internal/storage"
+)
+
+// startConversation sends the first miv of a new conversation from desk and
+// notifies its recipients. It returns the conversation, its first miv and
+// the sender's state. A non-empty mivID is kept as the miv's ID. Failures to
+// report are statusErrors.
+func (s *Server) startConversation(desk *models.Desk, req *models.CreateConversationRequest, mivID string) (*models.Conversation, *models.ConversationMiv, *models.ConversationState, error) {
+	deskID := desk.ID
+
+	// Validate that every recipient desk exists
+	recipients, err := s.resolveRecipients(req.To, req.Cc)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	attachments, err := s.resolveAttachments(desk, withLinks(req.AttachmentIDs, bodyLinks(req.Body, req.IsEncrypted)))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	conversationID, err := s.chooseConversationID(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Conversation, first miv and the recipients' notifications are written
+	// together so a failure cannot leave an orphaned conversation behind
+	conv := &models.Conversation{
+		ID:      conversationID,
+		Subject: req.Subject,
+		DeskID:  deskID,
+	}
+
+	miv := &models.ConversationMiv{
+		ID:             mivID,
+		ConversationID: conversationID,
+		SeqNo:          1,
+		From:           deskID,
+		To:             splitDeskIDs(req.To)[0], // Store the display format
+		Subject:        req.Subject,
+		State:          models.StateSENT, // Use SENT state for newly created mivs
+		FontFamily:     req.FontFamily,
+		FontSize:       req.FontSize,
+		ReplyBy:        req.ReplyBy,
+		Recipients:     recipients,
+		Attachments:    attachments,
+	}
+	if err := s.sealMivBody(desk, miv, req.Body, req.Bodies, req.IsEncrypted, req.KeyVersion, req.KeyVersions); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := s.signMiv(desk, miv, req.Signature); err != nil {
+		return nil, nil, nil, err
+	}
+
+	var notifications []*models.Notification
+	for _, r := range recipients {
+		notifications = append(notifications, &models.Notification{
+			DeskID:  r.DeskID, // Use normalized ID for routing
+			Type:    models.NotificationTypeNewMiv,
+			Message: fmt.Sprintf("New message from %s: %s", deskID, req.Subject),
+			Read:    false,
+		})
+	}
+
+	if err := s.storage.StartConversation(conv, miv, notifications); err != nil {
+		if errors.Is(err, storage.ErrAttachmentUnavailable) {
+			return nil, nil, nil, newStatusError(http.StatusConflict, "An attachment is no longer available")
+		}
+		return nil, nil, nil, err
+	}
+
+	return conv, miv, s.deskConversationState(conv.ID, deskID), nil
+}
+
+// sendReply adds desk's reply to a conversation, given its mivs so far, and
+// notifies the other participants. A non-empty mivID is kept as the miv's
+// ID. Failures to report are statusErrors.
+func (s *Server) sendReply(desk *models.Desk, conv *models.Conversation, mivs []*models.ConversationMiv, req *models.ReplyToConversationRequest, mivID string) (*models.ConversationMiv, error) {
+	deskID := desk.ID
+	if len(mivs) == 0 {
+		return nil, newStatusError(http.StatusInternalServerError, "Failed to get conversation mivs")
+	}
+
+	if req.IsAck && req.ReplyBy != nil {
+		return nil, newStatusError(http.StatusBadRequest, "An ACK ends the conversation and expects no reply")
+	}
+
+	// Address every other participant, To the desk being answered
+	recipients := replyRecipients(conv, mivs, deskID)
+	if len(recipients) == 0 {
+		return nil, newStatusError(http.StatusBadRequest, "Could not determine recipient")
+	}
+	attachments, err := s.resolveAttachments(desk, withLinks(req.AttachmentIDs, bodyLinks(req.Body, req.IsEncrypted)))
+	if err != nil {
+		return nil, err
+	}
+
+	// Create reply miv
+	miv := &models.ConversationMiv{
+		ID:             mivID,
+		ConversationID: conv.ID,
+		From:           deskID,
+		To:             recipients[0].DeskID,
+		Subject:        conv.Subject,
+		State:          models.StateSENT, // Use SENT state for replies
+		IsAck:          req.IsAck,
+		FontFamily:     req.FontFamily,
+		FontSize:       req.FontSize,
+		ReplyBy:        req.ReplyBy,
+		Recipients:     recipients,
+		Attachments:    attachments,
+	}
+	if err := s.sealMivBody(desk, miv, req.Body, req.Bodies, req.IsEncrypted, req.KeyVersion, req.KeyVersions); err != nil {
+		return nil, err
+	}
+
+	// The signature covers the sequence number, so it is chosen up front. A
+	// client signs the number it expects; a server-signed reply that loses
+	// its number to a concurrent reply is signed again with the next one.
+	for attempt := 0; ; attempt++ {
+		miv.SeqNo = nextSeqNo(mivs)
+		if req.SeqNo != 0 && req.SeqNo != miv.SeqNo {
+			return nil, newStatusError(http.StatusConflict, "Conversation has moved on; sign the reply with seq_no %d", miv.SeqNo)
+		}
+		if err := s.signMiv(desk, miv, req.Signature); err != nil {
+			return nil, err
+		}
+
+		err := s.storage.CreateConversationMiv(miv)
+		if err == nil {
+			break
+		}
+		if errors.Is(err, storage.ErrAttachmentUnavailable) {
+			return nil, newStatusError(http.StatusConflict, "An attachment is no longer available")
+		}
+		if !errors.Is(err, storage.ErrDuplicateSeqNo) || attempt >= maxReplySeqRetries {
+			return nil, err
+		}
+		if req.Signature != "" {
+			return nil, newStatusError(http.StatusConflict, "Conversation has moved on; sign the reply with the next seq_no")
+		}
+		if mivs, err = s.storage.GetConversationMivs(conv.ID); err != nil {
+			return nil, newStatusError(http.StatusInternalServerError, "Failed to get conversation mivs")
+		}
+	}
+
+	// A reply brings the conversation back for its sender, and an ACK archives
+	// it for them. Recipients get it back too unless they have muted it.
+	s.changeConversationStates(conv.ID, storage.ConversationStateChange{IsArchived: &req.IsAck}, deskID)
+	reopened := false
+	states := s.changeConversationStates(conv.ID, storage.ConversationStateChange{IsArchived: &reopened, KeepArchivedIfMuted: true},
+		recipientDeskIDs(miv)...)
+
+	// Create notification for each recipient
+	notifType := models.NotificationTypeReply
+	message := fmt.Sprintf("Reply from %s in: %s", deskID, conv.Subject)
+	if req.IsAck {
+		message = fmt.Sprintf("ACK from %s in: %s", deskID, conv.Subject)
+	}
+
+	for _, r := range recipients {
+		// Muted desks are not notified of replies
+		if state, ok := states[r.DeskID]; ok && state.IsMuted {
+			continue
+		}
+		notification := &models.Notification{
+			DeskID:         r.DeskID,
+			Type:           notifType,
+			MivID:          miv.ID,
+			ConversationID: conv.ID,
+			Message:        message,
+			Read:           false,
+		}
+		s.storage.CreateNotification(notification)
+	}
+	return miv, nil
+}
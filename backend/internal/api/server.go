@@ -1,30 +1,54 @@
 package api
 
 import (
-	"encoding/base64"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jadefox10200/missiv/backend/internal/crypto"
 	"github.com/jadefox10200/missiv/backend/internal/models"
+	"github.com/jadefox10200/missiv/backend/internal/search"
 	"github.com/jadefox10200/missiv/backend/internal/storage"
 )
 
 // Server represents the API server
 type Server struct {
-	storage *storage.MemoryStorage
-	router  *gin.Engine
-	keyPair *crypto.KeyPair
+	storage    storage.Store
+	router     *gin.Engine
+	keyPair    *crypto.KeyPair
+	keyCustody KeyCustody
+	events     *eventHub
+
+	searchIndexes *search.Indexes   // Each desk's in-memory search index
+	deskQuota     int64             // Bytes of attachments each desk may upload
+	blobs         storage.BlobStore // Where attachment files are kept; see blobStore
+	fileKeySecret []byte            // Mixed into the keys of server-encrypted files
+	blobGC        BlobGCMode        // Whether Run collects unreferenced blobs
+	blobGCGrace   time.Duration     // How long unreferenced blobs are kept
+	blobGCOrphans bool              // Whether the collector removes unrecorded blobs too
+}
+
+// NewServer creates a new API server backed by in-memory storage
+func NewServer() *Server {
+	return NewServerWithStore(storage.NewMemoryStorage())
 }
 
-// NewServer creates a new API server
-func NewServer() *Server {
+// NewServerWithStore creates a new API server backed by the given store
+func NewServerWithStore(store storage.Store) *Server {
+	events := newEventHub(store)
 	s := &Server{
-		storage: storage.NewMemoryStorage(),
-		router:  gin.Default(),
+		storage:    &eventStore{Store: store, hub: events},
+		router:     gin.New(),
+		keyCustody: KeyCustodyServer,
+		events:     events,
+
+		searchIndexes: search.NewIndexes(search.DefaultMaxDesks, search.DefaultIdleTime),
+		deskQuota:     defaultDeskQuota,
+		blobGC:        BlobGCOff,
+		blobGCGrace:   defaultBlobGCGrace,
 	}
 
+	s.router.Use(gin.LoggerWithFormatter(logFormatter), gin.Recovery())
 	s.setupRoutes()
 	return s
 }
@@ -51,68 +75,102 @@ func (s *Server) setupRoutes() {
 		api.POST("/accounts/register", s.registerAccount)
 		api.POST("/accounts/login", s.loginAccount)
 		api.POST("/accounts/recover-password", s.recoverPassword)
+	}
+
+	// Everything else requires a valid session token
+	authed := api.Group("", s.requireAuth())
+	{
+		authed.POST("/accounts/logout", s.logoutAccount)
+		authed.POST("/tickets", s.issueTicket)
 
 		// Desk endpoints
-		api.GET("/desks", s.listDesks)
-		api.POST("/desks", s.createDesk)
-		api.PUT("/desks/:desk_id", s.updateDesk)
-		api.POST("/desks/switch", s.switchDesk)
+		authed.GET("/desks", s.listDesks)
+		authed.POST("/desks", s.createDesk)
+		authed.PUT("/desks/:desk_id", s.updateDesk)
+		authed.GET("/desks/:desk_id/publickey", s.getDeskPublicKey)
+		authed.GET("/desks/:desk_id/safety-number/:other_desk_id", s.getSafetyNumber)
+		authed.POST("/desks/:desk_id/rotate-key", s.rotateDeskKey)
+		authed.GET("/desks/:desk_id/key-backup", s.getKeyBackup)
+		authed.PUT("/desks/:desk_id/key-backup", s.uploadKeyBackup)
+		authed.POST("/desks/:desk_id/key-backup/rotate", s.rotateKeyBackup)
+		authed.POST("/desks/switch", s.switchDesk)
 
 		// Conversation endpoints
-		api.GET("/conversations", s.listConversations)
-		api.GET("/conversations/:id", s.getConversation)
-		api.POST("/conversations", s.createConversation)
-		api.POST("/conversations/:id/reply", s.replyToConversation)
-		api.POST("/conversations/:id/archive", s.archiveConversation)
+		authed.GET("/conversations", s.listConversations)
+		authed.GET("/conversations/:id", s.getConversation)
+		authed.POST("/conversations", s.createConversation)
+		authed.POST("/conversations/:id/reply", s.replyToConversation)
+		authed.POST("/conversations/:id/archive", s.archiveConversation)
+		authed.PUT("/conversations/:id/state", s.updateConversationState)
+		authed.GET("/desks/:desk_id/baskets/:basket", s.getBasket)
+		authed.GET("/desks/:desk_id/search", s.searchDesk)
+
+		// Scheduled miv endpoints
+		authed.GET("/desks/:desk_id/scheduled", s.listScheduledMivs)
+		authed.GET("/scheduled/:id", s.getScheduledMiv)
+		authed.PUT("/scheduled/:id", s.updateScheduledMiv)
+		authed.DELETE("/scheduled/:id", s.cancelScheduledMiv)
+
+		// Draft endpoints
+		authed.GET("/desks/:desk_id/drafts", s.listDrafts)
+		authed.POST("/desks/:desk_id/drafts", s.createDraft)
+		authed.GET("/drafts/:id", s.getDraft)
+		authed.PUT("/drafts/:id", s.updateDraft)
+		authed.DELETE("/drafts/:id", s.deleteDraft)
 
 		// Miv read endpoints
-		api.POST("/mivs/:id/read", s.markMivAsRead)
-		api.POST("/mivs/:id/forget", s.forgetMiv)
+		authed.POST("/mivs/:id/read", s.markMivAsRead)
+		authed.POST("/mivs/:id/forget", s.forgetMiv)
+		authed.PUT("/mivs/:id/reply-by", s.setMivReplyBy)
 
 		// Notification endpoints
-		api.GET("/notifications", s.listNotifications)
-		api.POST("/notifications/:id/read", s.markNotificationAsRead)
+		authed.GET("/notifications", s.listNotifications)
+		authed.POST("/notifications/:id/read", s.markNotificationAsRead)
 
 		// Contact endpoints
-		api.GET("/desks/:desk_id/contacts", s.listContacts)
-		api.POST("/desks/:desk_id/contacts", s.createContact)
-		api.GET("/contacts/:contact_id", s.getContact)
-		api.PUT("/contacts/:contact_id", s.updateContact)
-		api.DELETE("/contacts/:contact_id", s.deleteContact)
-
-		// Upload endpoint
-		api.POST("/upload", s.uploadFile)
+		authed.GET("/desks/:desk_id/contacts", s.listContacts)
+		authed.POST("/desks/:desk_id/contacts", s.createContact)
+		authed.GET("/contacts/:contact_id", s.getContact)
+		authed.PUT("/contacts/:contact_id", s.updateContact)
+		authed.DELETE("/contacts/:contact_id", s.deleteContact)
+		authed.PUT("/contacts/:contact_id/pinned-key", s.pinContactKey)
+		authed.DELETE("/contacts/:contact_id/pinned-key", s.unpinContactKey)
+
+		// Attachment endpoints
+		authed.POST("/upload", s.uploadFile)
+		authed.GET("/desks/:desk_id/attachments", s.listAttachments)
+		authed.GET("/attachments/:id", s.getAttachment)
+		authed.DELETE("/attachments/:id", s.deleteAttachment)
 
 		// Legacy Identity endpoints (for backward compatibility)
-		api.GET("/identity", s.getIdentity)
-		api.POST("/identity", s.createIdentity)
-		api.GET("/identity/publickey", s.getPublicKey)
-
-		// Legacy Miv endpoints (for backward compatibility)
-		api.GET("/mivs", s.listMivs)
-		api.GET("/mivs/:id", s.getMiv)
-		api.POST("/mivs", s.createMiv)
-		api.PUT("/mivs/:id/state", s.updateMivState)
-
-		// Filtered miv endpoints
-		api.GET("/mivs/inbox", s.getInbox)
-		api.GET("/mivs/pending", s.getPending)
-		api.GET("/mivs/sent", s.getSent)             // Returns SENT state (combines old OUT and UNANSWERED)
-		api.GET("/mivs/unanswered", s.getUnanswered) // DEPRECATED: Use /mivs/sent instead
-		api.GET("/mivs/archived", s.getArchived)
+		authed.GET("/identity", s.getIdentity)
+		authed.POST("/identity", s.createIdentity)
+		authed.GET("/identity/publickey", s.getPublicKey)
+	}
+
+	// Event streams and downloads also accept a ticket as a query
+	// parameter, since browsers cannot set headers on an EventSource or an
+	// image embedded in a miv
+	streams := api.Group("", s.requireAuthOrTicket())
+	{
+		streams.GET("/desks/:desk_id/events", s.streamDeskEvents)
+		streams.GET("/attachments/:id/download", s.downloadAttachment)
 	}
 
 	// Health check
 	s.router.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
-
-	// Serve uploaded files
-	s.router.Static("/uploads", "./uploads")
 }
 
-// Run starts the API server
+// Run starts the API server, the dispatcher of scheduled mivs and
+// follow-ups, and the blob collector unless it is off
 func (s *Server) Run(addr string) error {
+	go s.runDispatcher(dispatchInterval)
+	go s.runEventRelay(eventPollInterval)
+	if s.blobGC != BlobGCOff {
+		go s.runBlobCollector(blobGCInterval)
+	}
 	return s.router.Run(addr)
 }
 
@@ -138,6 +196,12 @@ func (s *Server) createIdentity(c *gin.Context) {
 		return
 	}
 
+	// The identity is server-wide, so once set no account may replace it
+	if _, err := s.storage.GetIdentity(); err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Identity already exists"})
+		return
+	}
+
 	// Generate new key pair
 	keyPair, err := crypto.GenerateKeyPair()
 	if err != nil {
@@ -159,7 +223,10 @@ func (s *Server) createIdentity(c *gin.Context) {
 		Name:      req.Name,
 	}
 
-	s.storage.SetIdentity(identity)
+	if err := s.storage.SetIdentity(identity); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save identity"})
+		return
+	}
 
 	c.JSON(http.StatusCreated, identity)
 }
@@ -176,139 +243,3 @@ func (s *Server) getPublicKey(c *gin.Context) {
 		"id":         identity.ID,
 	})
 }
-
-// Miv handlers
-
-func (s *Server) listMivs(c *gin.Context) {
-	mivs, err := s.storage.ListMivs("")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, mivs)
-}
-
-func (s *Server) getMiv(c *gin.Context) {
-	id := c.Param("id")
-
-	miv, err := s.storage.GetMiv(id)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Miv not found"})
-		return
-	}
-
-	c.JSON(http.StatusOK, miv)
-}
-
-func (s *Server) createMiv(c *gin.Context) {
-	var req models.CreateMivRequest
-
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	identity, err := s.storage.GetIdentity()
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Identity not set"})
-		return
-	}
-
-	// For now, store as plain text. In production, encrypt the body.
-	// Encryption would require recipient's public key.
-	from := identity.ID
-	if req.From != "" {
-		from = req.From
-	}
-	miv := &models.Miv{
-		From:        from,
-		To:          req.To,
-		Subject:     req.Subject,
-		Body:        base64.StdEncoding.EncodeToString([]byte(req.Body)), // Base64 encode for now
-		State:       models.StatePENDING,
-		CreatedAt:   time.Now(),
-		IsEncrypted: false, // Set to true when implementing full encryption
-		FontFamily:  req.FontFamily,
-		FontSize:    req.FontSize,
-	}
-
-	if err := s.storage.CreateMiv(miv); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create miv"})
-		return
-	}
-
-	c.JSON(http.StatusCreated, miv)
-}
-
-func (s *Server) updateMivState(c *gin.Context) {
-	id := c.Param("id")
-
-	var req models.UpdateStateRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	if err := s.storage.UpdateMivState(id, req.State); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
-		return
-	}
-
-	miv, _ := s.storage.GetMiv(id)
-	c.JSON(http.StatusOK, miv)
-}
-
-// Filtered miv endpoints
-
-func (s *Server) getInbox(c *gin.Context) {
-	mivs, err := s.storage.ListMivs(models.StateIN)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, mivs)
-}
-
-func (s *Server) getPending(c *gin.Context) {
-	mivs, err := s.storage.ListMivs(models.StatePENDING)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, mivs)
-}
-
-func (s *Server) getSent(c *gin.Context) {
-	sentMivs, err := s.storage.ListMivs(models.StateSENT)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	// For backwards compatibility, also include old OUT and UNANSWERED states
-	outMivs, _ := s.storage.ListMivs(models.StateOUT)
-	unansweredMivs, _ := s.storage.ListMivs(models.StateUNANSWERED)
-
-	allMivs := append(sentMivs, outMivs...)
-	allMivs = append(allMivs, unansweredMivs...)
-
-	c.JSON(http.StatusOK, allMivs)
-}
-
-func (s *Server) getUnanswered(c *gin.Context) {
-	// DEPRECATED: redirect to getSent for backwards compatibility
-	s.getSent(c)
-}
-
-func (s *Server) getArchived(c *gin.Context) {
-	mivs, err := s.storage.ListMivs(models.StateARCHIVED)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	c.JSON(http.StatusOK, mivs)
-}
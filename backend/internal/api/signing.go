@@ -0,0 +1,123 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// maxReplySeqRetries bounds how often a server-signed reply is re-signed
+// after a concurrent reply takes its sequence number
+const maxReplySeqRetries = 3
+
+// signedFields returns the canonical fields a miv's signature covers. The
+// first miv of a conversation covers the ID chosen for it before it is
+// created, so it cannot be replayed as the start of another conversation.
+// Recipients past the To desk are covered with their role and copy of the
+// body, and ACKs with their flag.
+func signedFields(miv *models.ConversationMiv) crypto.SignedMivFields {
+	var copies []crypto.SignedCopy
+	for i, r := range miv.Recipients {
+		if i > 0 {
+			copies = append(copies, crypto.SignedCopy{Role: string(r.Role), DeskID: r.DeskID, Body: r.Body})
+		}
+	}
+	return crypto.SignedMivFields{
+		ConversationID: miv.ConversationID,
+		SeqNo:          miv.SeqNo,
+		From:           miv.From,
+		To:             miv.To,
+		Subject:        miv.Subject,
+		Body:           miv.Body,
+		Copies:         copies,
+		IsAck:          miv.IsAck,
+	}
+}
+
+// conversationIDPattern matches the conversation IDs clients may choose
+var conversationIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,64}$`)
+
+// chooseConversationID returns the ID a new conversation is created with,
+// which its first miv is signed over: the one the client chose and signed,
+// or a random one when the server signs. Failures to report are
+// statusErrors.
+func (s *Server) chooseConversationID(req *models.CreateConversationRequest) (string, error) {
+	if req.ConversationID == "" {
+		if req.Signature != "" {
+			return "", newStatusError(http.StatusBadRequest, "Choose a conversation_id and sign it with the first miv")
+		}
+		return crypto.GenerateConversationID()
+	}
+	if !conversationIDPattern.MatchString(req.ConversationID) {
+		return "", newStatusError(http.StatusBadRequest, "conversation_id must be 16 to 64 letters, digits, dashes or underscores")
+	}
+	if _, err := s.storage.GetConversation(req.ConversationID); err == nil {
+		return "", newStatusError(http.StatusConflict, "Conversation %s already exists; choose another conversation_id", req.ConversationID)
+	}
+	return req.ConversationID, nil
+}
+
+// nextSeqNo returns the sequence number the next miv in a conversation gets
+func nextSeqNo(mivs []*models.ConversationMiv) int {
+	next := 1
+	for _, m := range mivs {
+		if m.SeqNo >= next {
+			next = m.SeqNo + 1
+		}
+	}
+	return next
+}
+
+// signMiv attaches the sender's signature to a new miv once its body is
+// sealed and its sequence number chosen. A client-supplied signature must
+// verify against the sender's current signing key; otherwise the server signs
+// with the key it holds. Desks created before mivs were signed have no
+// signing key and send unsigned mivs. Failures to report are
+// statusErrors.
+func (s *Server) signMiv(sender *models.Desk, miv *models.ConversationMiv, signature string) error {
+	if signature != "" {
+		if !crypto.VerifyMiv(sender.SigningKey, signature, signedFields(miv)) {
+			return newStatusError(http.StatusBadRequest, "Signature does not match the miv; sign the sealed body with the desk's current signing key")
+		}
+		miv.Signature = signature
+		return nil
+	}
+
+	if sender.SigningKey == "" {
+		return nil
+	}
+	if s.clientKeysOnly() {
+		return newStatusError(http.StatusBadRequest, "This server does not sign mivs; sign the miv and send its signature")
+	}
+	signingKey, err := s.storage.GetDeskSigningPrivateKey(sender.ID, sender.KeyVersion)
+	if err != nil {
+		return newStatusError(http.StatusBadRequest, "This desk holds its own keys; sign the miv and send its signature")
+	}
+	miv.Signature = crypto.SignMiv(signingKey, signedFields(miv))
+	return nil
+}
+
+// verifyMiv reports whether a miv carries a valid signature by its sender's
+// signing key at the key version it was sent with. Signing keys already
+// looked up are kept in keys, keyed by desk and version.
+func (s *Server) verifyMiv(miv *models.ConversationMiv, keys map[string]string) bool {
+	if miv.Signature == "" {
+		return false
+	}
+
+	cacheKey := fmt.Sprintf("%s/%d", crypto.NormalizeDeskID(miv.From), miv.SenderKeyVersion)
+	signingKey, cached := keys[cacheKey]
+	if !cached {
+		if deskKey, err := s.storage.GetDeskKey(miv.From, miv.SenderKeyVersion); err == nil {
+			signingKey = deskKey.SigningKey
+		}
+		keys[cacheKey] = signingKey
+	}
+	if signingKey == "" {
+		return false
+	}
+	return crypto.VerifyMiv(signingKey, miv.Signature, signedFields(miv))
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+func TestServerSignedMivsVerify(t *testing.T) {
+	f := newPolicyFixture(t)
+	aliceDesk := f.alice.Account.ActiveDesk
+	bobDesk := f.bob.Account.ActiveDesk
+
+	w := doRequest(t, f.server, http.MethodPost, "/api/conversations/"+f.conversationID+"/reply?desk_id="+bobDesk, f.bob.Token,
+		models.ReplyToConversationRequest{Body: "Hi Alice"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to reply: %d %s", w.Code, w.Body.String())
+	}
+
+	// Both sides see both mivs verified against the sender's published key
+	for _, login := range []models.LoginResponse{f.alice, f.bob} {
+		w = doRequest(t, f.server, http.MethodGet, "/api/conversations/"+f.conversationID+"?desk_id="+login.Account.ActiveDesk, login.Token, nil)
+		var resp models.GetConversationResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if len(resp.Mivs) != 2 {
+			t.Fatalf("Expected 2 mivs, got %d", len(resp.Mivs))
+		}
+		for _, miv := range resp.Mivs {
+			if miv.Signature == "" || !miv.IsVerified {
+				t.Errorf("Expected miv %d to be signed and verified for %s", miv.SeqNo, login.Account.Username)
+			}
+		}
+	}
+
+	// The signature covers the stored ciphertext, which clients can check too
+	stored, _ := f.server.storage.GetConversationMiv(f.mivID)
+	alice, _ := f.server.storage.GetDesk(aliceDesk)
+	if !crypto.VerifyMiv(alice.SigningKey, stored.Signature, signedFields(stored)) {
+		t.Errorf("Expected stored signature to verify against alice's signing key")
+	}
+	w = doRequest(t, f.server, http.MethodGet, "/api/conversations/"+f.conversationID+"?desk_id="+bobDesk, f.bob.Token, nil)
+	var opened models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &opened)
+	received := *opened.Mivs[0]
+	if received.SignedBody != stored.Body || received.Body == stored.Body {
+		t.Fatalf("Expected the opened miv to carry the stored body it was signed over")
+	}
+	received.Body = received.SignedBody
+	if !crypto.VerifyMiv(alice.SigningKey, received.Signature, signedFields(&received)) {
+		t.Errorf("Expected the miv as served to verify with its signed body")
+	}
+
+	// A body swapped in storage no longer verifies
+	stored.Body = base64.StdEncoding.EncodeToString([]byte("forged"))
+	f.server.storage.UpdateConversationMiv(stored)
+	w = doRequest(t, f.server, http.MethodGet, "/api/conversations/"+f.conversationID+"?desk_id="+bobDesk, f.bob.Token, nil)
+	var resp models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Mivs[0].IsVerified {
+		t.Errorf("Expected tampered miv to fail verification")
+	}
+}
+
+func TestFirstMivIsBoundToItsConversation(t *testing.T) {
+	f := newPolicyFixture(t)
+	bobDesk := f.bob.Account.ActiveDesk
+
+	// Alice starts a second conversation, so there is one to move the
+	// first miv of the fixture's conversation into
+	w := doRequest(t, f.server, http.MethodPost, "/api/conversations?desk_id="+f.alice.Account.ActiveDesk, f.alice.Token,
+		models.CreateConversationRequest{To: bobDesk, Subject: "Other", Body: "Another conversation"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create conversation: %d %s", w.Code, w.Body.String())
+	}
+	var other models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &other)
+	if other.Conversation.ID == f.conversationID {
+		t.Fatalf("Expected a new conversation ID")
+	}
+
+	stored, _ := f.server.storage.GetConversationMiv(f.mivID)
+	alice, _ := f.server.storage.GetDesk(f.alice.Account.ActiveDesk)
+	if !crypto.VerifyMiv(alice.SigningKey, stored.Signature, signedFields(stored)) {
+		t.Fatalf("Expected the first miv to verify in its own conversation")
+	}
+	moved := *stored
+	moved.ConversationID = other.Conversation.ID
+	if crypto.VerifyMiv(alice.SigningKey, moved.Signature, signedFields(&moved)) {
+		t.Errorf("Expected the first miv not to verify in another conversation")
+	}
+
+	// Nor does its signature pass for the other conversation's first miv
+	replayed := *other.Mivs[0]
+	replayed.Signature = stored.Signature
+	f.server.storage.UpdateConversationMiv(&replayed)
+	w = doRequest(t, f.server, http.MethodGet, "/api/conversations/"+other.Conversation.ID+"?desk_id="+bobDesk, f.bob.Token, nil)
+	var resp models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Mivs) != 1 || resp.Mivs[0].IsVerified {
+		t.Errorf("Expected a replayed signature to fail verification")
+	}
+}
+
+func TestClientSignedReplies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := NewServer()
+
+	alice, aliceKeys := registerClientKeyedAccount(t, server, "alice")
+	bob, bobKeys := registerClientKeyedAccount(t, server, "bob")
+	aliceDesk := alice.Account.ActiveDesk
+	bobDesk := bob.Account.ActiveDesk
+
+	seal := func(plaintext string, to *clientKeys, from *clientKeys) string {
+		sealed, _ := crypto.Encrypt([]byte(plaintext), to.PublicKey, from.PrivateKey)
+		return base64.StdEncoding.EncodeToString(sealed)
+	}
+
+	body := seal("Hi Bob", bobKeys, aliceKeys)
+	first := &models.ConversationMiv{ConversationID: "conv-chosen-by-alice", SeqNo: 1, From: aliceDesk, To: bobDesk, Subject: "Hello", Body: body}
+	request := models.CreateConversationRequest{To: bobDesk, Subject: "Hello", Body: body, IsEncrypted: true, KeyVersion: 1, Signature: aliceKeys.sign(first)}
+
+	// The first miv's signature covers the conversation ID the client chose
+	w := doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token, request)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a signed first miv without a conversation_id to be rejected, got %d", w.Code)
+	}
+	request.ConversationID = "conv-chosen-by-mallory"
+	w = doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token, request)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a signature over another conversation ID to be rejected, got %d", w.Code)
+	}
+	request.ConversationID = first.ConversationID
+	w = doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token, request)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Failed to create conversation: %d %s", w.Code, w.Body.String())
+	}
+	var created models.GetConversationResponse
+	json.Unmarshal(w.Body.Bytes(), &created)
+	convID := created.Conversation.ID
+	if convID != first.ConversationID || len(created.Mivs) != 1 || !created.Mivs[0].IsVerified {
+		t.Fatalf("Expected a verified conversation with the chosen ID, got %+v", created)
+	}
+	if w := doRequest(t, server, http.MethodPost, "/api/conversations?desk_id="+aliceDesk, alice.Token, request); w.Code != http.StatusConflict {
+		t.Errorf("Expected a taken conversation_id to conflict, got %d", w.Code)
+	}
+	replyPath := "/api/conversations/" + convID + "/reply?desk_id=" + bobDesk
+
+	reply := &models.ConversationMiv{ConversationID: convID, SeqNo: 2, From: bobDesk, To: aliceDesk, Subject: "Hello", Body: seal("Hi Alice", aliceKeys, bobKeys)}
+
+	// A signature by someone else's key is rejected
+	w = doRequest(t, server, http.MethodPost, replyPath, bob.Token,
+		models.ReplyToConversationRequest{Body: reply.Body, IsEncrypted: true, KeyVersion: 1, SeqNo: 2, Signature: aliceKeys.sign(reply)})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a signature by the wrong key to be rejected, got %d", w.Code)
+	}
+
+	// A client that signed a stale sequence number is told to sign again
+	stale := *reply
+	stale.SeqNo = 1
+	w = doRequest(t, server, http.MethodPost, replyPath, bob.Token,
+		models.ReplyToConversationRequest{Body: reply.Body, IsEncrypted: true, KeyVersion: 1, SeqNo: 1, Signature: bobKeys.sign(&stale)})
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected a stale seq_no to conflict, got %d", w.Code)
+	}
+
+	w = doRequest(t, server, http.MethodPost, replyPath, bob.Token,
+		models.ReplyToConversationRequest{Body: reply.Body, IsEncrypted: true, KeyVersion: 1, SeqNo: 2, Signature: bobKeys.sign(reply)})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected signed reply to be accepted, got %d: %s", w.Code, w.Body.String())
+	}
+	var stored models.ConversationMiv
+	json.Unmarshal(w.Body.Bytes(), &stored)
+	if stored.SeqNo != 2 || !stored.IsVerified {
+		t.Errorf("Expected verified reply at seq_no 2, got %+v", stored)
+	}
+}
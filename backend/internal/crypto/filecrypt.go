@@ -0,0 +1,303 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// File encryption seals an attachment with a random 256-bit key using
+// AES-256-GCM in fixed-size chunks, so files of any size are encrypted and
+// decrypted as a stream. AES-GCM is what browsers offer through WebCrypto,
+// so clients can do either side without a crypto library. The layout is
+//
+//	"MVF1" | 7-byte nonce prefix | chunk | chunk | ...
+//
+// Each chunk seals up to FileChunkSize bytes under the nonce
+// prefix | 4-byte big-endian chunk index | final flag, with the header as
+// associated data. Only the last chunk has the final flag set, so a file
+// cut short, reordered or extended fails to decrypt.
+const (
+	// FileChunkSize is how many plaintext bytes each chunk seals
+	FileChunkSize = 64 * 1024
+
+	// FileKeySize is the size of a file key
+	FileKeySize = 32
+
+	fileMagic         = "MVF1"
+	fileNoncePrefix   = 7
+	fileHeaderSize    = len(fileMagic) + fileNoncePrefix
+	fileChunkOverhead = 16
+	fileSealedChunk   = FileChunkSize + fileChunkOverhead
+)
+
+// ErrInvalidEncryptedFile is returned for data that is not an encrypted file
+// or does not decrypt with the key
+var ErrInvalidEncryptedFile = errors.New("invalid encrypted file")
+
+// GenerateFileKey returns a random file key
+func GenerateFileKey() ([FileKeySize]byte, error) {
+	var key [FileKeySize]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return key, fmt.Errorf("failed to generate file key: %w", err)
+	}
+	return key, nil
+}
+
+// MinFileKeySecretSize is the shortest secret ConvergentFileKey accepts
+const MinFileKeySecretSize = 32
+
+// ErrWeakFileKeySecret is returned by ConvergentFileKey for secrets shorter
+// than MinFileKeySecretSize
+var ErrWeakFileKeySecret = errors.New("file key secret is too short")
+
+// ConvergentFileKey derives the file key of a plaintext from its SHA-256
+// digest and a secret the server keeps, so that encrypting the same file
+// twice gives the same ciphertext and it is stored once. Without the secret
+// the key would be a public function of the plaintext: anyone who could
+// guess a file could derive its key and confirm it is stored. The secret
+// must therefore be random and at least MinFileKeySecretSize bytes.
+func ConvergentFileKey(secret []byte, digest [sha256.Size]byte) ([FileKeySize]byte, error) {
+	var key [FileKeySize]byte
+	if len(secret) < MinFileKeySecretSize {
+		return key, ErrWeakFileKeySecret
+	}
+	mac := hmac.New(sha256.New, append([]byte("missiv convergent file key\x00"), secret...))
+	mac.Write(digest[:])
+	copy(key[:], mac.Sum(nil))
+	return key, nil
+}
+
+// FileKeyToString encodes a file key as unpadded base64url, which fits in a
+// URL fragment
+func FileKeyToString(key [FileKeySize]byte) string {
+	return base64.RawURLEncoding.EncodeToString(key[:])
+}
+
+// FileKeyFromString decodes a file key encoded by FileKeyToString
+func FileKeyFromString(s string) ([FileKeySize]byte, error) {
+	var key [FileKeySize]byte
+	decoded, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return key, fmt.Errorf("failed to decode file key: %w", err)
+	}
+	if len(decoded) != FileKeySize {
+		return key, fmt.Errorf("invalid file key length: %d", len(decoded))
+	}
+	copy(key[:], decoded)
+	return key, nil
+}
+
+// EncryptedFileSize returns the size of the encrypted form of a file of
+// plainSize bytes
+func EncryptedFileSize(plainSize int64) int64 {
+	chunks := plainSize/FileChunkSize + 1
+	if plainSize > 0 && plainSize%FileChunkSize == 0 {
+		chunks--
+	}
+	return int64(fileHeaderSize) + plainSize + chunks*fileChunkOverhead
+}
+
+// ValidateEncryptedFile checks that the first bytes of a file and its size
+// fit the encrypted file layout without decrypting it, so the server can
+// reject uploads that are not encrypted files
+func ValidateEncryptedFile(header []byte, size int64) error {
+	if len(header) < len(fileMagic) || string(header[:len(fileMagic)]) != fileMagic {
+		return ErrInvalidEncryptedFile
+	}
+	body := size - int64(fileHeaderSize)
+	if body < fileChunkOverhead {
+		return ErrInvalidEncryptedFile
+	}
+	if rest := body % fileSealedChunk; rest != 0 && rest < fileChunkOverhead {
+		return ErrInvalidEncryptedFile
+	}
+	return nil
+}
+
+// fileNonce returns the nonce of chunk index
+func fileNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[fileNoncePrefix:], index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newFileAEAD(key [FileKeySize]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// fileEncrypter is the io.WriteCloser returned by NewFileEncrypter
+type fileEncrypter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte
+	buf    []byte
+	index  uint32
+	closed bool
+}
+
+// NewFileEncrypter returns a writer that encrypts what is written to it into
+// w under key. Close must be called to seal the final chunk; it does not
+// close w.
+func NewFileEncrypter(w io.Writer, key [FileKeySize]byte) (io.WriteCloser, error) {
+	prefix := make([]byte, fileNoncePrefix)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return newFileEncrypter(w, key, prefix)
+}
+
+// NewConvergentFileEncrypter is NewFileEncrypter with the nonce prefix
+// derived from the key and the SHA-256 digest of the plaintext to be written
+// instead of drawn at random, so the same plaintext under the same key always
+// encrypts to the same file. Different plaintexts get unrelated prefixes, as
+// random ones would be; the caller must pass the digest of what it writes.
+func NewConvergentFileEncrypter(w io.Writer, key [FileKeySize]byte, digest [sha256.Size]byte) (io.WriteCloser, error) {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("missiv convergent nonce\x00"))
+	mac.Write(digest[:])
+	return newFileEncrypter(w, key, mac.Sum(nil)[:fileNoncePrefix])
+}
+
+func newFileEncrypter(w io.Writer, key [FileKeySize]byte, prefix []byte) (io.WriteCloser, error) {
+	aead, err := newFileAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, fileHeaderSize)
+	copy(header, fileMagic)
+	copy(header[len(fileMagic):], prefix)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &fileEncrypter{w: w, aead: aead, header: header, buf: make([]byte, 0, FileChunkSize)}, nil
+}
+
+func (e *fileEncrypter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("write to closed file encrypter")
+	}
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data follows, since the
+		// last chunk must carry the final flag
+		if len(e.buf) == FileChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):FileChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the final chunk
+func (e *fileEncrypter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.seal(true)
+}
+
+func (e *fileEncrypter) seal(final bool) error {
+	sealed := e.aead.Seal(nil, fileNonce(e.header[len(fileMagic):], e.index, final), e.buf, e.header)
+	if _, err := e.w.Write(sealed); err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// fileDecrypter is the io.Reader returned by NewFileDecrypter
+type fileDecrypter struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	header []byte
+	sealed []byte
+	next   []byte // Sealed bytes read ahead to tell whether a chunk is final
+	plain  []byte
+	index  uint32
+	done   bool
+}
+
+// NewFileDecrypter returns a reader that decrypts a file encrypted by
+// NewFileEncrypter from r. Reads fail with ErrInvalidEncryptedFile if the
+// file was tampered with or the key is wrong; no plaintext of a chunk is
+// returned before the chunk is authenticated.
+func NewFileDecrypter(r io.Reader, key [FileKeySize]byte) (io.Reader, error) {
+	aead, err := newFileAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, fileHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrInvalidEncryptedFile
+	}
+	if !bytes.Equal(header[:len(fileMagic)], []byte(fileMagic)) {
+		return nil, ErrInvalidEncryptedFile
+	}
+	return &fileDecrypter{r: r, aead: aead, header: header, sealed: make([]byte, fileSealedChunk+1)}, nil
+}
+
+func (d *fileDecrypter) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// open authenticates and decrypts the next chunk. It reads one byte past
+// the chunk so that a chunk followed by nothing is opened as the final one.
+func (d *fileDecrypter) open() error {
+	buf := d.sealed[:copy(d.sealed, d.next)]
+	n, err := io.ReadFull(d.r, d.sealed[len(buf):])
+	buf = d.sealed[:len(buf)+n]
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return err
+	}
+
+	final := len(buf) <= fileSealedChunk
+	chunk := buf
+	d.next = nil
+	if !final {
+		chunk = buf[:fileSealedChunk]
+		d.next = append([]byte(nil), buf[fileSealedChunk:]...)
+	}
+
+	plain, err := d.aead.Open(nil, fileNonce(d.header[len(fileMagic):], d.index, final), chunk, d.header)
+	if err != nil {
+		return ErrInvalidEncryptedFile
+	}
+	d.plain = plain
+	d.index++
+	d.done = final
+	return nil
+}
@@ -0,0 +1,147 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func encryptFile(t *testing.T, key [FileKeySize]byte, plain []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := NewFileEncrypter(&out, key)
+	if err != nil {
+		t.Fatalf("NewFileEncrypter failed: %v", err)
+	}
+	// Write in odd-sized pieces to cross chunk boundaries
+	for len(plain) > 0 {
+		n := 1000
+		if n > len(plain) {
+			n = len(plain)
+		}
+		if _, err := w.Write(plain[:n]); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		plain = plain[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	return out.Bytes()
+}
+
+func decryptFile(key [FileKeySize]byte, sealed []byte) ([]byte, error) {
+	r, err := NewFileDecrypter(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestFileEncryptionRoundTrip(t *testing.T) {
+	key, err := GenerateFileKey()
+	if err != nil {
+		t.Fatalf("GenerateFileKey failed: %v", err)
+	}
+
+	for _, size := range []int{0, 1, FileChunkSize - 1, FileChunkSize, FileChunkSize + 1, 3*FileChunkSize + 17} {
+		plain := bytes.Repeat([]byte{byte(size)}, size)
+		sealed := encryptFile(t, key, plain)
+		if int64(len(sealed)) != EncryptedFileSize(int64(size)) {
+			t.Errorf("Size %d: expected %d encrypted bytes, got %d", size, EncryptedFileSize(int64(size)), len(sealed))
+		}
+		if err := ValidateEncryptedFile(sealed, int64(len(sealed))); err != nil {
+			t.Errorf("Size %d: expected encrypted file to validate: %v", size, err)
+		}
+		got, err := decryptFile(key, sealed)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("Size %d: expected plaintext back, err %v", size, err)
+		}
+	}
+
+	decoded, err := FileKeyFromString(FileKeyToString(key))
+	if err != nil || decoded != key {
+		t.Errorf("Expected file key to survive encoding, err %v", err)
+	}
+}
+
+func TestFileDecryptionRejectsTampering(t *testing.T) {
+	key, _ := GenerateFileKey()
+	plain := bytes.Repeat([]byte("missiv"), FileChunkSize/2)
+	sealed := encryptFile(t, key, plain)
+
+	otherKey, _ := GenerateFileKey()
+	flipped := append([]byte(nil), sealed...)
+	flipped[len(flipped)/2] ^= 1
+	fullChunks := sealed[:fileHeaderSize+2*fileSealedChunk]
+
+	tests := map[string]struct {
+		key    [FileKeySize]byte
+		sealed []byte
+	}{
+		"wrong key":     {otherKey, sealed},
+		"flipped bit":   {key, flipped},
+		"truncated":     {key, sealed[:len(sealed)-1]},
+		"missing chunk": {key, fullChunks},
+		"extended":      {key, append(append([]byte(nil), sealed...), 0)},
+		"not encrypted": {key, plain},
+	}
+	for name, tt := range tests {
+		if _, err := decryptFile(tt.key, tt.sealed); !errors.Is(err, ErrInvalidEncryptedFile) {
+			t.Errorf("%s: expected ErrInvalidEncryptedFile, got %v", name, err)
+		}
+	}
+
+	if err := ValidateEncryptedFile(plain, int64(len(plain))); err == nil {
+		t.Errorf("Expected plaintext not to validate as an encrypted file")
+	}
+	if err := ValidateEncryptedFile(sealed, int64(fileHeaderSize+fileSealedChunk+5)); err == nil {
+		t.Errorf("Expected a size no encrypted file can have not to validate")
+	}
+}
+
+func TestConvergentFileEncryption(t *testing.T) {
+	seal := func(secret string, plain []byte) []byte {
+		digest := sha256.Sum256(plain)
+		key, err := ConvergentFileKey([]byte(secret), digest)
+		if err != nil {
+			t.Fatalf("ConvergentFileKey failed: %v", err)
+		}
+		var out bytes.Buffer
+		w, err := NewConvergentFileEncrypter(&out, key, digest)
+		if err != nil {
+			t.Fatalf("NewConvergentFileEncrypter failed: %v", err)
+		}
+		w.Write(plain)
+		w.Close()
+
+		opened, err := decryptFile(key, out.Bytes())
+		if err != nil || !bytes.Equal(opened, plain) {
+			t.Fatalf("Expected a convergent file to decrypt, err %v", err)
+		}
+		return out.Bytes()
+	}
+
+	secret := strings.Repeat("s", MinFileKeySecretSize)
+	logo := bytes.Repeat([]byte("logo"), 20000)
+	if !bytes.Equal(seal(secret, logo), seal(secret, logo)) {
+		t.Errorf("Expected the same file to encrypt the same way")
+	}
+	if bytes.Equal(seal(secret, logo), seal(strings.Repeat("o", MinFileKeySecretSize), logo)) {
+		t.Errorf("Expected another secret to give another ciphertext")
+	}
+	other := seal(secret, []byte("another file"))
+	if bytes.Equal(other[:fileHeaderSize], seal(secret, logo)[:fileHeaderSize]) {
+		t.Errorf("Expected different files to get different nonce prefixes")
+	}
+
+	// A key derived from the plaintext alone could be derived by anyone
+	for _, weak := range []string{"", "secret"} {
+		if _, err := ConvergentFileKey([]byte(weak), sha256.Sum256(logo)); !errors.Is(err, ErrWeakFileKeySecret) {
+			t.Errorf("Expected secret %q to be refused, got %v", weak, err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package crypto
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// fingerprintIterations slows down searching for a key pair whose
+// fingerprint collides with a given one
+const fingerprintIterations = 5200
+
+// fingerprintGroups is the number of five-digit groups in a fingerprint
+const fingerprintGroups = 6
+
+// KeyFingerprint returns a human-comparable fingerprint of a desk's public
+// keys: 30 digits in groups of five. It changes whenever either key does.
+func KeyFingerprint(deskID, publicKey, signingKey string) string {
+	input := []byte(strings.Join([]string{"missiv-fingerprint-v1", NormalizeDeskID(deskID), publicKey, signingKey}, "\x00"))
+
+	hash := sha512.Sum512(input)
+	for i := 1; i < fingerprintIterations; i++ {
+		hash = sha512.Sum512(append(hash[:], input...))
+	}
+
+	groups := make([]string, fingerprintGroups)
+	for i := range groups {
+		// 5 bytes per group, reduced to five decimal digits
+		var chunk [8]byte
+		copy(chunk[3:], hash[i*5:i*5+5])
+		groups[i] = fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk[:])%100000)
+	}
+	return strings.Join(groups, " ")
+}
+
+// SafetyNumber combines the fingerprints of two desks into one number both
+// sides can read to each other out of band. The lower desk ID comes first so
+// both sides compute the same number.
+func SafetyNumber(deskA, fingerprintA, deskB, fingerprintB string) string {
+	if NormalizeDeskID(deskB) < NormalizeDeskID(deskA) {
+		fingerprintA, fingerprintB = fingerprintB, fingerprintA
+	}
+	return fingerprintA + " " + fingerprintB
+}
@@ -0,0 +1,41 @@
+package crypto
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestKeyFingerprint(t *testing.T) {
+	fingerprint := KeyFingerprint("555-123-4567", "pk", "sk")
+
+	if !regexp.MustCompile(`^\d{5}( \d{5}){5}$`).MatchString(fingerprint) {
+		t.Fatalf("Expected six groups of five digits, got %q", fingerprint)
+	}
+	if KeyFingerprint("5551234567", "pk", "sk") != fingerprint {
+		t.Errorf("Expected fingerprint to ignore desk ID formatting")
+	}
+
+	for _, other := range []string{
+		KeyFingerprint("5551234568", "pk", "sk"),
+		KeyFingerprint("5551234567", "pk2", "sk"),
+		KeyFingerprint("5551234567", "pk", "sk2"),
+	} {
+		if other == fingerprint {
+			t.Errorf("Expected fingerprint to change with desk ID and keys")
+		}
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	alice := KeyFingerprint("5551111111", "pk-a", "sk-a")
+	bob := KeyFingerprint("5552222222", "pk-b", "sk-b")
+
+	fromAlice := SafetyNumber("5551111111", alice, "5552222222", bob)
+	fromBob := SafetyNumber("5552222222", bob, "5551111111", alice)
+	if fromAlice != fromBob {
+		t.Errorf("Expected both sides to compute the same safety number, got %q and %q", fromAlice, fromBob)
+	}
+	if fromAlice != alice+" "+bob {
+		t.Errorf("Expected lower desk ID first, got %q", fromAlice)
+	}
+}
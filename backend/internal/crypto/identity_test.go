@@ -23,4 +23,4 @@ func TestNormalizeDeskID(t *testing.T) {
 			t.Errorf("NormalizeDeskID(%q) = %q, expected %q", test.input, result, test.expected)
 		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,206 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// KeyWrapAlgorithm identifies the password-based key wrapping scheme:
+// an Argon2id-derived key sealing the private keys with XChaCha20-Poly1305
+const KeyWrapAlgorithm = "argon2id-xchacha20poly1305"
+
+// KeyBundle is what a key backup holds: every version of a desk's private
+// keys, so mivs sealed to or signed with a retired key still open and
+// verify after a restore
+type KeyBundle struct {
+	Keys []BundledKey `json:"keys"` // Every key version, oldest first; the last is current
+}
+
+// BundledKey is one version of a desk's private keys
+type BundledKey struct {
+	Version    int    `json:"version"`               // Desk key version, starting at 1
+	BoxKey     []byte `json:"box_key"`               // Curve25519 private key
+	SigningKey []byte `json:"signing_key,omitempty"` // Ed25519 seed; empty for desks created before signing
+}
+
+// maxKeyBundleSize bounds a sealed bundle, which is far larger than any
+// desk's key history needs
+const maxKeyBundleSize = 64 << 10
+
+// Ceilings on the Argon2 parameters a backup may ask for. The parameters
+// come from the stored blob, so without them whoever stores backups could
+// make a restoring client allocate any amount of memory.
+const (
+	maxWrapMemory  = 256 * 1024 // KiB, four times Argon2Memory
+	maxWrapTime    = 10
+	maxWrapThreads = 16
+)
+
+// Current returns the bundle's current key
+func (b *KeyBundle) Current() *BundledKey {
+	return &b.Keys[len(b.Keys)-1]
+}
+
+// Key returns the key for a version, or nil if the bundle does not hold it
+func (b *KeyBundle) Key(version int) *BundledKey {
+	for i := range b.Keys {
+		if b.Keys[i].Version == version {
+			return &b.Keys[i]
+		}
+	}
+	return nil
+}
+
+// SigningPrivateKey expands the key's signing seed, or returns nil when it
+// has none
+func (k *BundledKey) SigningPrivateKey() ed25519.PrivateKey {
+	if len(k.SigningKey) == 0 {
+		return nil
+	}
+	return ed25519.NewKeyFromSeed(k.SigningKey)
+}
+
+func (b *KeyBundle) validate() error {
+	if len(b.Keys) == 0 {
+		return fmt.Errorf("key bundle holds no keys")
+	}
+	for i, key := range b.Keys {
+		if key.Version < 1 || (i > 0 && key.Version <= b.Keys[i-1].Version) {
+			return fmt.Errorf("key bundle versions must be positive and ascending")
+		}
+		if len(key.BoxKey) != 32 {
+			return fmt.Errorf("invalid box key for version %d", key.Version)
+		}
+		if len(key.SigningKey) != 0 && len(key.SigningKey) != ed25519.SeedSize {
+			return fmt.Errorf("invalid signing key for version %d", key.Version)
+		}
+	}
+	return nil
+}
+
+// WrapKeyBundle seals a desk's key bundle under a key derived from password.
+// The deskID is bound as associated data so a blob cannot be swapped onto
+// another desk. The result is a self-describing string in the same style
+// as HashPassword:
+//
+//	$argon2id-xchacha20poly1305$v=1$m=65536,t=1,p=4$salt$nonce$ciphertext
+//
+// Wrapping is meant to run on the client; the server only stores the blob.
+func WrapKeyBundle(bundle *KeyBundle, password, deskID string) (string, error) {
+	if err := bundle.validate(); err != nil {
+		return "", err
+	}
+	plaintext, err := json.Marshal(bundle)
+	if err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	aead, err := chacha20poly1305.NewX(argon2.IDKey([]byte(password), salt, Argon2Time, Argon2Memory, Argon2Threads, chacha20poly1305.KeySize))
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	ciphertext := aead.Seal(nil, nonce, plaintext, []byte(deskID))
+
+	enc := base64.StdEncoding
+	return fmt.Sprintf("$%s$v=1$m=%d,t=%d,p=%d$%s$%s$%s", KeyWrapAlgorithm,
+		Argon2Memory, Argon2Time, Argon2Threads,
+		enc.EncodeToString(salt), enc.EncodeToString(nonce), enc.EncodeToString(ciphertext)), nil
+}
+
+// UnwrapKeyBundle recovers a key bundle sealed by WrapKeyBundle
+func UnwrapKeyBundle(wrapped, password, deskID string) (*KeyBundle, error) {
+	w, err := parseWrappedKey(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := chacha20poly1305.NewX(argon2.IDKey([]byte(password), w.salt, w.time, w.memory, w.threads, chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aead.Open(nil, w.nonce, w.ciphertext, []byte(deskID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key: wrong password or corrupted backup")
+	}
+
+	bundle := &KeyBundle{}
+	if err := json.Unmarshal(plaintext, bundle); err != nil {
+		return nil, fmt.Errorf("invalid key bundle: %w", err)
+	}
+	if err := bundle.validate(); err != nil {
+		return nil, err
+	}
+	return bundle, nil
+}
+
+// ValidateWrappedKey checks that a blob is well formed without decrypting it,
+// so the server can reject garbage it is asked to store
+func ValidateWrappedKey(wrapped string) error {
+	_, err := parseWrappedKey(wrapped)
+	return err
+}
+
+// wrappedKey is the decoded form of a wrapped key blob
+type wrappedKey struct {
+	memory, time uint32
+	threads      uint8
+	salt         []byte
+	nonce        []byte
+	ciphertext   []byte
+}
+
+func parseWrappedKey(wrapped string) (*wrappedKey, error) {
+	parts := strings.Split(wrapped, "$")
+	if len(parts) != 7 || parts[0] != "" {
+		return nil, fmt.Errorf("invalid key backup format")
+	}
+	if parts[1] != KeyWrapAlgorithm {
+		return nil, fmt.Errorf("unsupported key backup algorithm: %s", parts[1])
+	}
+	if parts[2] != "v=1" {
+		return nil, fmt.Errorf("unsupported key backup version: %s", parts[2])
+	}
+
+	w := &wrappedKey{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &w.memory, &w.time, &w.threads); err != nil {
+		return nil, fmt.Errorf("failed to parse parameters: %w", err)
+	}
+	if w.time == 0 || w.threads == 0 || w.memory < 8*uint32(w.threads) {
+		return nil, fmt.Errorf("invalid key backup parameters")
+	}
+	if w.memory > maxWrapMemory || w.time > maxWrapTime || w.threads > maxWrapThreads {
+		return nil, fmt.Errorf("key backup parameters exceed the allowed maximum")
+	}
+
+	var err error
+	enc := base64.StdEncoding
+	if w.salt, err = enc.DecodeString(parts[4]); err != nil || len(w.salt) < SaltLen {
+		return nil, fmt.Errorf("invalid key backup salt")
+	}
+	if w.nonce, err = enc.DecodeString(parts[5]); err != nil || len(w.nonce) != chacha20poly1305.NonceSizeX {
+		return nil, fmt.Errorf("invalid key backup nonce")
+	}
+	if w.ciphertext, err = enc.DecodeString(parts[6]); err != nil ||
+		len(w.ciphertext) <= chacha20poly1305.Overhead || len(w.ciphertext) > maxKeyBundleSize+chacha20poly1305.Overhead {
+		return nil, fmt.Errorf("invalid key backup ciphertext")
+	}
+	return w, nil
+}
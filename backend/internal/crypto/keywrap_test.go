@@ -0,0 +1,103 @@
+package crypto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// testKeyBundle builds a bundle of a retired and a current key version
+func testKeyBundle(t *testing.T) *KeyBundle {
+	t.Helper()
+
+	bundle := &KeyBundle{}
+	for version := 1; version <= 2; version++ {
+		keyPair, err := GenerateKeyPair()
+		if err != nil {
+			t.Fatalf("GenerateKeyPair failed: %v", err)
+		}
+		signing, err := GenerateSigningKeyPair()
+		if err != nil {
+			t.Fatalf("GenerateSigningKeyPair failed: %v", err)
+		}
+		bundle.Keys = append(bundle.Keys, BundledKey{Version: version, BoxKey: keyPair.PrivateKey[:], SigningKey: signing.PrivateKey.Seed()})
+	}
+	return bundle
+}
+
+func TestWrapKeyBundleRoundTrip(t *testing.T) {
+	bundle := testKeyBundle(t)
+
+	wrapped, err := WrapKeyBundle(bundle, "correct horse", "5551234567")
+	if err != nil {
+		t.Fatalf("WrapKeyBundle failed: %v", err)
+	}
+	if err := ValidateWrappedKey(wrapped); err != nil {
+		t.Errorf("Expected wrapped bundle to validate: %v", err)
+	}
+
+	got, err := UnwrapKeyBundle(wrapped, "correct horse", "5551234567")
+	if err != nil {
+		t.Fatalf("UnwrapKeyBundle failed: %v", err)
+	}
+	if len(got.Keys) != 2 || got.Current().Version != 2 {
+		t.Fatalf("Expected both key versions back, got %+v", got)
+	}
+	for _, want := range bundle.Keys {
+		key := got.Key(want.Version)
+		if key == nil || !bytes.Equal(key.BoxKey, want.BoxKey) || !bytes.Equal(key.SigningKey, want.SigningKey) {
+			t.Errorf("Expected version %d back unchanged", want.Version)
+		}
+	}
+	if !bytes.Equal(got.Key(1).SigningPrivateKey(), bundle.Keys[0].SigningPrivateKey()) {
+		t.Errorf("Expected the retired signing key to expand")
+	}
+
+	if _, err := UnwrapKeyBundle(wrapped, "wrong password", "5551234567"); err == nil {
+		t.Errorf("Expected wrong password to fail")
+	}
+	if _, err := UnwrapKeyBundle(wrapped, "correct horse", "5559999999"); err == nil {
+		t.Errorf("Expected blob bound to another desk to fail")
+	}
+}
+
+func TestWrapKeyBundleRejectsInvalidBundles(t *testing.T) {
+	valid := testKeyBundle(t)
+	tests := map[string]*KeyBundle{
+		"empty":          {},
+		"version 0":      {Keys: []BundledKey{{Version: 0, BoxKey: valid.Keys[0].BoxKey}}},
+		"out of order":   {Keys: []BundledKey{valid.Keys[1], valid.Keys[0]}},
+		"short box key":  {Keys: []BundledKey{{Version: 1, BoxKey: []byte("short")}}},
+		"short sign key": {Keys: []BundledKey{{Version: 1, BoxKey: valid.Keys[0].BoxKey, SigningKey: []byte("short")}}},
+	}
+
+	for name, bundle := range tests {
+		if _, err := WrapKeyBundle(bundle, "pw", "5551234567"); err == nil {
+			t.Errorf("Expected %s bundle to be rejected", name)
+		}
+	}
+}
+
+func TestValidateWrappedKeyRejectsMalformedBlobs(t *testing.T) {
+	wrapped, _ := WrapKeyBundle(testKeyBundle(t), "pw", "5551234567")
+	parts := strings.Split(wrapped, "$")
+
+	tests := []string{
+		"",
+		"not a backup",
+		strings.Replace(wrapped, KeyWrapAlgorithm, "rot13", 1),
+		strings.Replace(wrapped, "$v=1$", "$v=2$", 1),
+		strings.Join(append(parts[:6:6], ""), "$"),
+		strings.Join(parts[:6], "$"),
+		// Parameters a restoring client must not be made to run
+		strings.Replace(wrapped, "$m=65536,", "$m=4294967295,", 1),
+		strings.Replace(wrapped, ",t=1,", ",t=1000000,", 1),
+		strings.Replace(wrapped, ",p=4$", ",p=255$", 1),
+	}
+
+	for _, input := range tests {
+		if err := ValidateWrappedKey(input); err == nil {
+			t.Errorf("Expected %q to be rejected", input)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// SigningKeyPair represents an Ed25519 key pair used to sign mivs
+type SigningKeyPair struct {
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+}
+
+// GenerateSigningKeyPair generates a new Ed25519 key pair
+func GenerateSigningKeyPair() (*SigningKeyPair, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key pair: %w", err)
+	}
+	return &SigningKeyPair{PublicKey: publicKey, PrivateKey: privateKey}, nil
+}
+
+// SigningKeyToBase64 converts an Ed25519 public key to a base64 string
+func SigningKeyToBase64(publicKey ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(publicKey)
+}
+
+// SigningKeyFromBase64 converts a base64 string to an Ed25519 public key
+func SigningKeyFromBase64(s string) (ed25519.PublicKey, error) {
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode base64: %w", err)
+	}
+	if len(decoded) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid signing key length: %d", len(decoded))
+	}
+	return ed25519.PublicKey(decoded), nil
+}
+
+// SignedMivFields are the parts of a miv covered by its signature.
+// Body is the stored body (ciphertext for encrypted mivs), so signatures can
+// be checked without opening it. The first miv of a conversation is signed
+// over the ConversationID the client chooses for it, so it cannot be moved
+// into another conversation.
+// To and Body are the primary recipient and its copy; Copies lists any
+// further recipients, each with a copy sealed to it. IsAck is covered so an
+// ACK cannot be passed off as a miv that expects a reply, or the reverse.
+type SignedMivFields struct {
+	ConversationID string
+	SeqNo          int
+	From           string
+	To             string
+	Subject        string
+	Body           string
+	Copies         []SignedCopy
+	IsAck          bool
+}
+
+// SignedCopy is a further recipient of a miv and the body stored for it
+type SignedCopy struct {
+	Role   string // "to" or "cc"
+	DeskID string
+	Body   string
+}
+
+// Payload returns the canonical bytes that are signed: a JSON array of a
+// version tag, the conversation ID, sequence number, normalized sender and
+// recipient desk IDs, subject and the hex SHA-256 of the body. Mivs with
+// further recipients append an array of [role, normalized desk ID, body
+// hash] entries sorted by desk ID, so two-party payloads are unchanged and
+// the order copies are listed in does not matter. ACKs end with the string
+// "ack", so the payloads of other mivs are unchanged too.
+func (f SignedMivFields) Payload() []byte {
+	fields := []interface{}{
+		"missiv-miv-v1",
+		f.ConversationID,
+		f.SeqNo,
+		NormalizeDeskID(f.From),
+		NormalizeDeskID(f.To),
+		f.Subject,
+		hashBody(f.Body),
+	}
+	if len(f.Copies) > 0 {
+		copies := make([][]string, 0, len(f.Copies))
+		for _, c := range f.Copies {
+			copies = append(copies, []string{c.Role, NormalizeDeskID(c.DeskID), hashBody(c.Body)})
+		}
+		sort.Slice(copies, func(i, j int) bool { return copies[i][1] < copies[j][1] })
+		fields = append(fields, copies)
+	}
+	if f.IsAck {
+		fields = append(fields, "ack")
+	}
+	payload, _ := json.Marshal(fields)
+	return payload
+}
+
+func hashBody(body string) string {
+	sum := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// SignMiv signs the miv fields and returns a base64 signature
+func SignMiv(privateKey ed25519.PrivateKey, fields SignedMivFields) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, fields.Payload()))
+}
+
+// VerifyMiv reports whether signature is a valid signature of the miv fields
+// by the base64 Ed25519 public key
+func VerifyMiv(publicKey, signature string, fields SignedMivFields) bool {
+	key, err := SigningKeyFromBase64(publicKey)
+	if err != nil {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(key, fields.Payload(), sig)
+}
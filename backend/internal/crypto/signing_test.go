@@ -0,0 +1,93 @@
+package crypto
+
+import "testing"
+
+func TestSignMiv(t *testing.T) {
+	keyPair, err := GenerateSigningKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateSigningKeyPair failed: %v", err)
+	}
+	publicKey := SigningKeyToBase64(keyPair.PublicKey)
+
+	fields := SignedMivFields{ConversationID: "conv-1", SeqNo: 2, From: "555-111-1111", To: "5552222222", Subject: "Hello", Body: "c2VhbGVk"}
+	signature := SignMiv(keyPair.PrivateKey, fields)
+
+	if !VerifyMiv(publicKey, signature, fields) {
+		t.Fatalf("Expected signature to verify")
+	}
+
+	// Formatting of desk IDs does not matter; every other field does
+	formatted := fields
+	formatted.From = "5551111111"
+	formatted.To = "(555) 222-2222"
+	if !VerifyMiv(publicKey, signature, formatted) {
+		t.Errorf("Expected signature to verify with reformatted desk IDs")
+	}
+
+	tampered := []SignedMivFields{
+		{ConversationID: "conv-2", SeqNo: 2, From: fields.From, To: fields.To, Subject: fields.Subject, Body: fields.Body},
+		{ConversationID: "conv-1", SeqNo: 3, From: fields.From, To: fields.To, Subject: fields.Subject, Body: fields.Body},
+		{ConversationID: "conv-1", SeqNo: 2, From: "5553333333", To: fields.To, Subject: fields.Subject, Body: fields.Body},
+		{ConversationID: "conv-1", SeqNo: 2, From: fields.From, To: "5553333333", Subject: fields.Subject, Body: fields.Body},
+		{ConversationID: "conv-1", SeqNo: 2, From: fields.From, To: fields.To, Subject: "Goodbye", Body: fields.Body},
+		{ConversationID: "conv-1", SeqNo: 2, From: fields.From, To: fields.To, Subject: fields.Subject, Body: "b3RoZXI="},
+		{ConversationID: "conv-1", SeqNo: 2, From: fields.From, To: fields.To, Subject: fields.Subject, Body: fields.Body, IsAck: true},
+	}
+	for _, f := range tampered {
+		if VerifyMiv(publicKey, signature, f) {
+			t.Errorf("Expected signature to fail for %+v", f)
+		}
+	}
+
+	other, _ := GenerateSigningKeyPair()
+	if VerifyMiv(SigningKeyToBase64(other.PublicKey), signature, fields) {
+		t.Errorf("Expected signature to fail under another key")
+	}
+	if VerifyMiv(publicKey, "garbage", fields) {
+		t.Errorf("Expected malformed signature to fail")
+	}
+}
+
+func TestSignMivCopies(t *testing.T) {
+	keyPair, _ := GenerateSigningKeyPair()
+	publicKey := SigningKeyToBase64(keyPair.PublicKey)
+
+	fields := SignedMivFields{SeqNo: 1, From: "5551111111", To: "5552222222", Subject: "Hello", Body: "Zmlyc3Q=",
+		Copies: []SignedCopy{{Role: "cc", DeskID: "555-333-3333", Body: "c2Vjb25k"}}}
+	signature := SignMiv(keyPair.PrivateKey, fields)
+	if !VerifyMiv(publicKey, signature, fields) {
+		t.Fatalf("Expected signature with copies to verify")
+	}
+
+	// Dropping a recipient, changing its role or swapping its copy all break the signature
+	withoutCopies := fields
+	withoutCopies.Copies = nil
+	promoted := fields
+	promoted.Copies = []SignedCopy{{Role: "to", DeskID: "5553333333", Body: "c2Vjb25k"}}
+	swapped := fields
+	swapped.Copies = []SignedCopy{{Role: "cc", DeskID: "5553333333", Body: "b3RoZXI="}}
+	for _, f := range []SignedMivFields{withoutCopies, promoted, swapped} {
+		if VerifyMiv(publicKey, signature, f) {
+			t.Errorf("Expected signature to fail for %+v", f.Copies)
+		}
+	}
+}
+
+func TestSignMivAck(t *testing.T) {
+	keyPair, _ := GenerateSigningKeyPair()
+	publicKey := SigningKeyToBase64(keyPair.PublicKey)
+
+	fields := SignedMivFields{ConversationID: "conv-1", SeqNo: 3, From: "5551111111", To: "5552222222", Subject: "Hello", Body: "VGhhbmtz", IsAck: true,
+		Copies: []SignedCopy{{Role: "cc", DeskID: "5553333333", Body: "c2Vjb25k"}}}
+	signature := SignMiv(keyPair.PrivateKey, fields)
+	if !VerifyMiv(publicKey, signature, fields) {
+		t.Fatalf("Expected an ACK's signature to verify")
+	}
+
+	// An ACK cannot be turned into a miv that expects a reply
+	notAck := fields
+	notAck.IsAck = false
+	if VerifyMiv(publicKey, signature, notAck) {
+		t.Errorf("Expected the signature to fail once the ACK flag is dropped")
+	}
+}
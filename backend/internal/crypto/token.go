@@ -2,7 +2,9 @@ package crypto
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 )
 
@@ -15,3 +17,29 @@ func GenerateToken() (string, error) {
 	}
 	return base64.URLEncoding.EncodeToString(b), nil
 }
+
+// HashToken returns the hex SHA-256 of a token, under which sessions are
+// stored so that reading the store does not yield working tokens
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateConversationID generates a random conversation ID, so a
+// conversation's ID is known before its first miv is signed
+func GenerateConversationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate conversation ID: %w", err)
+	}
+	return "conv-" + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// GenerateSecret generates size random bytes for a server-side secret
+func GenerateSecret(size int) ([]byte, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return b, nil
+}
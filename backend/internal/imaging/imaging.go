@@ -0,0 +1,276 @@
+// Package imaging re-encodes uploaded images and makes their thumbnails.
+// Decoding an image and encoding it afresh keeps only its pixels: EXIF and
+// GPS metadata, comments and anything appended to or hidden in the file are
+// dropped, so an image cannot double as another kind of file.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+const (
+	// MaxDimension is the most pixels an image may have on either side
+	MaxDimension = 8192
+	// MaxPixels is the most pixels an image may have across all its frames,
+	// which bounds the memory decoding it takes
+	MaxPixels = 40_000_000
+
+	jpegQuality      = 90
+	thumbnailQuality = 85
+)
+
+var (
+	// ErrUnsupported is returned for content types that are not re-encoded
+	ErrUnsupported = errors.New("image type is not supported")
+	// ErrTooLarge is returned for images over MaxDimension or MaxPixels
+	ErrTooLarge = errors.New("image dimensions are too large")
+	// ErrInvalid is returned for files that do not decode as their type
+	ErrInvalid = errors.New("image could not be decoded")
+)
+
+// ThumbnailSize is a box thumbnails are scaled down to fit in
+type ThumbnailSize struct {
+	Name string
+	Max  int // Most pixels on the longer side
+}
+
+// ThumbnailSizes are the thumbnails made of an image, smallest first. Sizes
+// the image already fits in are skipped.
+var ThumbnailSizes = []ThumbnailSize{
+	{Name: "small", Max: 160},
+	{Name: "medium", Max: 480},
+	{Name: "large", Max: 1024},
+}
+
+// Image is an encoded image
+type Image struct {
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// Thumbnail is a scaled-down copy of an image
+type Thumbnail struct {
+	Name string // Name of its ThumbnailSize
+	Image
+}
+
+// Result is a re-encoded image and its thumbnails
+type Result struct {
+	Image
+	Thumbnails []Thumbnail
+}
+
+// Supported reports whether images of a content type are re-encoded
+func Supported(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/gif":
+		return true
+	}
+	return false
+}
+
+// Process decodes an image of contentType, checks it against the size
+// limits before decoding its pixels, and returns it re-encoded in the same
+// format with its thumbnails. JPEGs are turned upright as their EXIF
+// orientation says, since the orientation goes with the rest of the
+// metadata. Animated GIFs keep their frames; their thumbnails show the
+// first.
+func Process(data []byte, contentType string) (*Result, error) {
+	if !Supported(contentType) {
+		return nil, ErrUnsupported
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	frames := 1
+	if contentType == "image/gif" {
+		if frames, err = gifFrameCount(data); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+	}
+	if err := checkSize(cfg.Width, cfg.Height, frames); err != nil {
+		return nil, err
+	}
+
+	switch contentType {
+	case "image/jpeg":
+		return processJPEG(data)
+	case "image/png":
+		return processPNG(data)
+	default:
+		return processGIF(data)
+	}
+}
+
+// checkSize enforces MaxDimension and MaxPixels
+func checkSize(width, height, frames int) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("%w: image has no pixels", ErrInvalid)
+	}
+	if width > MaxDimension || height > MaxDimension || int64(width)*int64(height)*int64(frames) > MaxPixels {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+func processJPEG(data []byte) (*Result, error) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if orientation := jpegOrientation(data); orientation > 1 {
+		img = orient(toRGBA(img), orientation)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return nil, err
+	}
+	return finish(buf.Bytes(), "image/jpeg", img, "image/jpeg")
+}
+
+func processPNG(data []byte) (*Result, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return finish(buf.Bytes(), "image/png", img, "image/png")
+}
+
+func processGIF(data []byte) (*Result, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	// EncodeAll writes only the frames, their timing and the loop count
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, err
+	}
+
+	// Thumbnails show the first frame drawn on the whole canvas
+	first := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	draw.Draw(first, g.Image[0].Bounds(), g.Image[0], g.Image[0].Bounds().Min, draw.Src)
+	return finish(buf.Bytes(), "image/gif", first, "image/png")
+}
+
+// finish makes the thumbnails of img, encoded as thumbType, and returns them
+// with the re-encoded image
+func finish(data []byte, contentType string, img image.Image, thumbType string) (*Result, error) {
+	bounds := img.Bounds()
+	result := &Result{Image: Image{Data: data, ContentType: contentType, Width: bounds.Dx(), Height: bounds.Dy()}}
+
+	var src *image.RGBA
+	for _, size := range ThumbnailSizes {
+		if bounds.Dx() <= size.Max && bounds.Dy() <= size.Max {
+			break
+		}
+		if src == nil {
+			src = toRGBA(img)
+		}
+		width, height := fit(bounds.Dx(), bounds.Dy(), size.Max)
+		thumb := resize(src, width, height)
+
+		var buf bytes.Buffer
+		var err error
+		if thumbType == "image/jpeg" {
+			err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: thumbnailQuality})
+		} else {
+			err = png.Encode(&buf, thumb)
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.Thumbnails = append(result.Thumbnails, Thumbnail{
+			Name:  size.Name,
+			Image: Image{Data: buf.Bytes(), ContentType: thumbType, Width: width, Height: height},
+		})
+	}
+	return result, nil
+}
+
+// fit scales width by height down to fit in a max by max box, keeping the
+// aspect ratio
+func fit(width, height, max int) (int, int) {
+	if width >= height {
+		return max, maxInt(1, (height*max+width/2)/width)
+	}
+	return maxInt(1, (width*max+height/2)/height), max
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// toRGBA copies img into an RGBA image whose bounds start at the origin
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	return dst
+}
+
+// resize scales src down to width by height, averaging the source pixels
+// each destination pixel covers. Premultiplied alpha keeps transparent
+// pixels from bleeding their color into the average.
+func resize(src *image.RGBA, width, height int) *image.RGBA {
+	srcW, srcH := src.Rect.Dx(), src.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	// The source columns each destination column covers
+	x0 := make([]int, width)
+	x1 := make([]int, width)
+	for x := 0; x < width; x++ {
+		x0[x] = x * srcW / width
+		x1[x] = maxInt((x+1)*srcW/width, x0[x]+1)
+	}
+
+	sums := make([]uint64, width*4)
+	for y := 0; y < height; y++ {
+		y0 := y * srcH / height
+		y1 := maxInt((y+1)*srcH/height, y0+1)
+		for i := range sums {
+			sums[i] = 0
+		}
+		for sy := y0; sy < y1; sy++ {
+			row := src.Pix[sy*src.Stride:]
+			for x := 0; x < width; x++ {
+				sum := sums[x*4 : x*4+4]
+				for sx := x0[x]; sx < x1[x]; sx++ {
+					p := row[sx*4 : sx*4+4]
+					sum[0] += uint64(p[0])
+					sum[1] += uint64(p[1])
+					sum[2] += uint64(p[2])
+					sum[3] += uint64(p[3])
+				}
+			}
+		}
+		out := dst.Pix[y*dst.Stride:]
+		for x := 0; x < width; x++ {
+			n := uint64((x1[x] - x0[x]) * (y1 - y0))
+			for c := 0; c < 4; c++ {
+				out[x*4+c] = uint8((sums[x*4+c] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,196 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testImage is a width by height image, red in its top-left quarter and
+// blue elsewhere
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{0, 0, 255, 255}
+			if x < width/2 && y < height/2 {
+				c = color.RGBA{255, 0, 0, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// withExif inserts an APP1 segment after a JPEG's SOI marker, holding an
+// orientation tag and a GPS marker string
+func withExif(jpg []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2A\x00\x00\x00\x08")
+	tiff = append(tiff, 0x00, 0x01) // One entry
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], 0x0112)
+	binary.BigEndian.PutUint16(entry[2:], 3) // SHORT
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	tiff = append(tiff, entry...)
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(tiff, []byte("GPSLatitude 51.5007N")...)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, segment...)
+	return append(out, jpg[2:]...)
+}
+
+func TestProcessJPEGStripsMetadataAndOrients(t *testing.T) {
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, testImage(1200, 600), nil)
+	data := withExif(buf.Bytes(), 6)
+	if jpegOrientation(data) != 6 {
+		t.Fatalf("Expected orientation 6, got %d", jpegOrientation(data))
+	}
+
+	result, err := Process(data, "image/jpeg")
+	if err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if bytes.Contains(result.Data, []byte("Exif")) || bytes.Contains(result.Data, []byte("GPS")) {
+		t.Errorf("Expected the metadata to be stripped")
+	}
+	// Turned clockwise: the red quarter moves to the top right
+	if result.Width != 600 || result.Height != 1200 {
+		t.Fatalf("Expected a 600x1200 image, got %dx%d", result.Width, result.Height)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(result.Data))
+	if err != nil {
+		t.Fatalf("Re-encoded JPEG does not decode: %v", err)
+	}
+	if r, _, b, _ := img.At(450, 150).RGBA(); r < b {
+		t.Errorf("Expected red at the top right after orienting")
+	}
+
+	names := []string{}
+	for _, thumb := range result.Thumbnails {
+		names = append(names, thumb.Name)
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(thumb.Data))
+		if err != nil || cfg.Width != thumb.Width || cfg.Height != thumb.Height {
+			t.Errorf("Thumbnail %s does not decode as %dx%d: %v", thumb.Name, thumb.Width, thumb.Height, err)
+		}
+	}
+	if len(names) != 3 || result.Thumbnails[0].Width != 80 || result.Thumbnails[0].Height != 160 ||
+		result.Thumbnails[2].Width != 512 || result.Thumbnails[2].Height != 1024 {
+		t.Errorf("Unexpected thumbnails: %v", names)
+	}
+}
+
+func TestProcessSkipsThumbnailsLargerThanTheImage(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, testImage(300, 200))
+	// Anything after IEND survives a magic-byte check but not re-encoding
+	data := append(buf.Bytes(), []byte("<script>alert(1)</script>")...)
+
+	result, err := Process(data, "image/png")
+	if err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if bytes.Contains(result.Data, []byte("<script>")) {
+		t.Errorf("Expected trailing data to be dropped")
+	}
+	if len(result.Thumbnails) != 1 || result.Thumbnails[0].Name != "small" || result.Thumbnails[0].ContentType != "image/png" {
+		t.Fatalf("Expected only a small PNG thumbnail, got %+v", result.Thumbnails)
+	}
+	thumb, err := png.Decode(bytes.NewReader(result.Thumbnails[0].Data))
+	if err != nil || thumb.Bounds().Dx() != 160 || thumb.Bounds().Dy() != 107 {
+		t.Fatalf("Unexpected thumbnail: %v %v", thumb.Bounds(), err)
+	}
+	if r, _, b, _ := thumb.At(10, 10).RGBA(); r < b {
+		t.Errorf("Expected the thumbnail to keep the red corner")
+	}
+}
+
+func TestProcessAnimatedGIF(t *testing.T) {
+	g := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 200, 100), palette.Plan9)
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	gif.EncodeAll(&buf, g)
+	if n, err := gifFrameCount(buf.Bytes()); err != nil || n != 3 {
+		t.Fatalf("Expected 3 frames, got %d %v", n, err)
+	}
+
+	result, err := Process(buf.Bytes(), "image/gif")
+	if err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	decoded, err := gif.DecodeAll(bytes.NewReader(result.Data))
+	if err != nil || len(decoded.Image) != 3 {
+		t.Fatalf("Expected the animation to keep its frames: %v", err)
+	}
+	if len(result.Thumbnails) != 1 || result.Thumbnails[0].ContentType != "image/png" {
+		t.Errorf("Expected a PNG thumbnail of the first frame, got %+v", result.Thumbnails)
+	}
+}
+
+// pngHeader returns a PNG signature and IHDR chunk claiming a size, which
+// is all DecodeConfig reads
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], width)
+	binary.BigEndian.PutUint32(ihdr[8:], height)
+	ihdr[12] = 8 // Bit depth
+	ihdr[13] = 2 // Truecolor
+
+	data := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestProcessLimits(t *testing.T) {
+	if _, err := Process(pngHeader(MaxDimension+1, 10), "image/png"); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected a wide image to be rejected, got %v", err)
+	}
+	// A decompression bomb: a few bytes claiming 64 megapixels
+	if _, err := Process(pngHeader(8000, 8000), "image/png"); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected a huge image to be rejected, got %v", err)
+	}
+	if _, err := Process(pngHeader(100, 100), "image/png"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected a truncated image to be invalid, got %v", err)
+	}
+
+	// Tiny frames on a huge canvas add up
+	g := &gif.GIF{Config: image.Config{Width: 8000, Height: 4000, ColorModel: color.Palette(palette.Plan9)}}
+	for i := 0; i < 2; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 1, 1), palette.Plan9))
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("Failed to encode GIF: %v", err)
+	}
+	if _, err := Process(buf.Bytes(), "image/gif"); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected a long animation to be rejected, got %v", err)
+	}
+
+	if _, err := Process([]byte("GIF89a"), "image/gif"); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Expected a malformed GIF to be invalid, got %v", err)
+	}
+	if _, err := Process(nil, "image/webp"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Expected WebP to be unsupported, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+)
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, or 0 when
+// it has none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 0
+		}
+		marker := data[i+1]
+		if marker == 0xFF {
+			i++ // Fill byte
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			return 0 // Start of scan or end of image: no more metadata
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 0
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 0
+}
+
+// exifOrientation reads the orientation tag from IFD0 of an EXIF TIFF block
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if value := int(order.Uint16(tiff[entry+8:])); value >= 1 && value <= 8 {
+				return value
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// orient turns an image the way its EXIF orientation says to display it
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored
+				sx, sy = w-1-x, y
+			case 3: // Upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // Mirrored upside down
+				sx, sy = x, h-1-y
+			case 5: // Transposed
+				sx, sy = y, x
+			case 6: // Turned counterclockwise; rotate clockwise
+				sx, sy = y, h-1-x
+			case 7: // Transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // Turned clockwise; rotate counterclockwise
+				sx, sy = w-1-y, x
+			default:
+				sx, sy = x, y
+			}
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:])
+		}
+	}
+	return dst
+}
+
+// gifFrameCount counts the frames of a GIF by walking its blocks without
+// decompressing them, so animations can be checked against MaxPixels
+// before they are decoded
+func gifFrameCount(data []byte) (int, error) {
+	errFormat := errors.New("malformed GIF")
+	if len(data) < 13 || (string(data[:6]) != "GIF87a" && string(data[:6]) != "GIF89a") {
+		return 0, errFormat
+	}
+	i := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << (flags&0x07 + 1) // Global color table
+	}
+
+	// skipSubBlocks returns the offset after a chain of data sub-blocks
+	skipSubBlocks := func(i int) (int, error) {
+		for {
+			if i >= len(data) {
+				return 0, errFormat
+			}
+			size := int(data[i])
+			i++
+			if size == 0 {
+				return i, nil
+			}
+			i += size
+		}
+	}
+
+	frames := 0
+	for {
+		if i >= len(data) {
+			return 0, errFormat
+		}
+		var err error
+		switch data[i] {
+		case 0x21: // Extension: label, then sub-blocks
+			i, err = skipSubBlocks(i + 2)
+		case 0x2C: // Image descriptor, local color table, LZW code size, sub-blocks
+			if i+10 > len(data) {
+				return 0, errFormat
+			}
+			frames++
+			next := i + 10
+			if flags := data[i+9]; flags&0x80 != 0 {
+				next += 3 << (flags&0x07 + 1)
+			}
+			i, err = skipSubBlocks(next + 1)
+		case 0x3B: // Trailer
+			if frames == 0 {
+				return 0, errFormat
+			}
+			return frames, nil
+		default:
+			return 0, errFormat
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
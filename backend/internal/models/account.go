@@ -19,13 +19,24 @@ type Account struct {
 	MotherMaidenHash string `json:"-"` // Hash of mother's maiden name
 }
 
+// Session represents an authenticated login session
+type Session struct {
+	TokenHash string    `json:"-"`               // SHA-256 of the bearer token, which is never stored
+	AccountID string    `json:"account_id"`      // Account this session authenticates
+	CreatedAt time.Time `json:"created_at"`      // When the session was issued
+	ExpiresAt time.Time `json:"expires_at"`      // When the session stops being accepted
+	Scope     string    `json:"scope,omitempty"` // Path a ticket may open; empty for a full session
+}
+
 // Desk represents a desk/identity that belongs to an account
 type Desk struct {
-	ID        string    `json:"id"`         // Phone-number-style ID (zID)
-	AccountID string    `json:"account_id"` // Parent account ID
-	PublicKey string    `json:"public_key"` // Curve25519 public key (base64)
-	Name      string    `json:"name"`       // Display name for this desk
-	CreatedAt time.Time `json:"created_at"` // When the desk was created
+	ID         string    `json:"id"`          // Phone-number-style ID (zID)
+	AccountID  string    `json:"account_id"`  // Parent account ID
+	PublicKey  string    `json:"public_key"`  // Current Curve25519 public key (base64)
+	SigningKey string    `json:"signing_key"` // Current Ed25519 public key (base64) that mivs are signed with
+	KeyVersion int       `json:"key_version"` // Version of the current key pair, starting at 1
+	Name       string    `json:"name"`        // Display name for this desk
+	CreatedAt  time.Time `json:"created_at"`  // When the desk was created
 
 	// Settings for miv rendering
 	AutoIndent        bool   `json:"auto_indent"`        // Enable auto-indent for epistle-style rendering
@@ -33,6 +44,48 @@ type Desk struct {
 	FontSize          string `json:"font_size"`          // Default font size
 	DefaultSalutation string `json:"default_salutation"` // Default salutation (e.g., "Dear [User]")
 	DefaultClosure    string `json:"default_closure"`    // Default closure/signature
+
+	// Privacy settings
+	DisableReadReceipts bool `json:"disable_read_receipts"` // Don't tell senders when this desk reads their mivs
+}
+
+// DeskKey is one version of a desk's public keys. Rotating a desk's key
+// retires the current version instead of discarding it, so mivs sealed to
+// it can still be opened and mivs signed with it still verify.
+type DeskKey struct {
+	DeskID      string     `json:"desk_id"`               // Desk the key belongs to
+	Version     int        `json:"version"`               // Key version, starting at 1
+	PublicKey   string     `json:"public_key"`            // Curve25519 public key (base64)
+	SigningKey  string     `json:"signing_key,omitempty"` // Ed25519 public key (base64); empty for desks created before signing
+	Fingerprint string     `json:"fingerprint,omitempty"` // Human-comparable fingerprint of both keys; computed, not stored
+	CreatedAt   time.Time  `json:"created_at"`            // When the key became current
+	RetiredAt   *time.Time `json:"retired_at,omitempty"`  // When the key was rotated out
+}
+
+// DeskPublicKeyResponse is a desk's entry in the public key directory
+type DeskPublicKeyResponse struct {
+	DeskID      string     `json:"desk_id"`
+	PublicKey   string     `json:"public_key"`  // Current Curve25519 public key (base64)
+	SigningKey  string     `json:"signing_key"` // Current Ed25519 public key (base64)
+	KeyVersion  int        `json:"key_version"` // Version of the current keys
+	Fingerprint string     `json:"fingerprint"` // Fingerprint of the current keys
+	Keys        []*DeskKey `json:"keys"`        // Every key version, oldest first
+}
+
+// SafetyNumberResponse is the number two desks compare out of band to
+// confirm neither side's keys were swapped
+type SafetyNumberResponse struct {
+	DeskID          string `json:"desk_id"`
+	OtherDeskID     string `json:"other_desk_id"`
+	SafetyNumber    string `json:"safety_number"`     // 60 digits in groups of five
+	KeyVersion      int    `json:"key_version"`       // Key version of DeskID the number covers
+	OtherKeyVersion int    `json:"other_key_version"` // Key version of OtherDeskID the number covers
+}
+
+// RotateDeskKeyRequest represents a request to rotate a desk's key pair
+type RotateDeskKeyRequest struct {
+	PublicKey  string `json:"public_key,omitempty"`  // Client-generated replacement key; generated server-side when empty
+	SigningKey string `json:"signing_key,omitempty"` // Client-generated replacement Ed25519 key, required with public_key
 }
 
 // RegisterRequest represents an account registration request
@@ -45,6 +98,12 @@ type RegisterRequest struct {
 	Birthday     string `json:"birthday" binding:"required"`       // Format: YYYY-MM-DD
 	FirstPetName string `json:"first_pet_name" binding:"required"` // First pet's name
 	MotherMaiden string `json:"mother_maiden" binding:"required"`  // Mother's maiden name
+
+	// Optional client-generated Curve25519 public key and Ed25519 signing key
+	// (both base64) for the first desk; when set the server never sees the
+	// desk's private keys
+	PublicKey  string `json:"public_key,omitempty"`
+	SigningKey string `json:"signing_key,omitempty"`
 }
 
 // LoginRequest represents a login request
@@ -55,13 +114,28 @@ type LoginRequest struct {
 
 // LoginResponse represents a successful login response
 type LoginResponse struct {
-	Account *Account `json:"account"`
-	Token   string   `json:"token"` // JWT token for authentication
+	Account   *Account  `json:"account"`
+	Token     string    `json:"token"`      // Bearer token for the Authorization header
+	ExpiresAt time.Time `json:"expires_at"` // When the token expires
+}
+
+// TicketRequest asks for a ticket to open one event stream or download
+type TicketRequest struct {
+	Path string `json:"path" binding:"required"` // e.g. /api/desks/<desk_id>/events
+}
+
+// TicketResponse is a short-lived ticket for the ticket query parameter
+type TicketResponse struct {
+	Ticket    string    `json:"ticket"`
+	Path      string    `json:"path"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
 // CreateDeskRequest represents a request to create a new desk
 type CreateDeskRequest struct {
-	Name string `json:"name" binding:"required"`
+	Name       string `json:"name" binding:"required"`
+	PublicKey  string `json:"public_key,omitempty"`  // Optional client-generated Curve25519 public key (base64)
+	SigningKey string `json:"signing_key,omitempty"` // Client-generated Ed25519 public key (base64), required with public_key
 }
 
 // SwitchDeskRequest represents a request to switch active desk
@@ -76,6 +150,10 @@ type RecoverPasswordRequest struct {
 	FirstPetName string `json:"first_pet_name" binding:"required"`
 	MotherMaiden string `json:"mother_maiden" binding:"required"`
 	NewPassword  string `json:"new_password" binding:"required,min=8"`
+
+	// Key backups the client re-wrapped under the new password. Backups of
+	// the account's other desks can no longer be opened and are deleted.
+	KeyBackups []RewrappedKeyBackup `json:"key_backups,omitempty"`
 }
 
 // UpdateDeskRequest represents a request to update desk settings
@@ -86,4 +164,6 @@ type UpdateDeskRequest struct {
 	FontSize          *string `json:"font_size"`
 	DefaultSalutation *string `json:"default_salutation"`
 	DefaultClosure    *string `json:"default_closure"`
+
+	DisableReadReceipts *bool `json:"disable_read_receipts"`
 }
@@ -0,0 +1,59 @@
+package models
+
+import "time"
+
+// Attachment is a file a desk uploaded. It is pending until it is sent with a
+// miv; from then on only the conversation's participants can download it.
+// The server keeps it encrypted under a file key that only travels inside
+// sealed miv bodies.
+type Attachment struct {
+	ID             string      `json:"id"`
+	DeskID         string      `json:"desk_id"`                   // Uploading desk
+	ConversationID string      `json:"conversation_id,omitempty"` // Conversation of the miv it was sent with
+	MivID          string      `json:"miv_id,omitempty"`          // Miv it was sent with; empty while pending
+	Filename       string      `json:"filename"`                  // Sanitized name it was uploaded under
+	ContentType    string      `json:"content_type"`              // MIME type the file was checked against
+	Size           int64       `json:"size"`                      // Size in bytes as stored, encrypted
+	Checksum       string      `json:"checksum"`                  // Hex SHA-256 of the stored, encrypted bytes
+	StorageKey     string      `json:"-"`                         // Where the bytes are kept
+	Width          int         `json:"width,omitempty"`           // Pixels across, for images the server re-encoded
+	Height         int         `json:"height,omitempty"`          // Pixels down, for images the server re-encoded
+	Thumbnails     []Thumbnail `json:"thumbnails,omitempty"`      // Scaled-down copies of an image the server re-encoded, smallest first
+	URL            string      `json:"url,omitempty"`             // Authorized download URL; filled in by the API
+	Key            string      `json:"key,omitempty"`             // File key of an upload the server encrypted; returned once and never stored
+	CreatedAt      time.Time   `json:"created_at"`
+}
+
+// Thumbnail is a scaled-down copy of an image attachment, encrypted under
+// the same file key
+type Thumbnail struct {
+	Name        string `json:"name"`         // "small", "medium" or "large"
+	ContentType string `json:"content_type"` // MIME type of the thumbnail itself
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Size        int64  `json:"size"`          // Size in bytes as stored, encrypted
+	StorageKey  string `json:"-"`             // Where the bytes are kept
+	URL         string `json:"url,omitempty"` // Authorized download URL; filled in by the API
+}
+
+// Blob is the record of a stored file, kept under the hex SHA-256 of its
+// bytes so that identical files are stored once. A blob that no attachment
+// or miv has used for a grace period is garbage collected.
+type Blob struct {
+	Key        string    `json:"key"`
+	Size       int64     `json:"size"`
+	Refs       int       `json:"refs"`        // Attachments, thumbnails and miv links stored in it
+	Stored     bool      `json:"stored"`      // Whether its bytes have been written
+	Collecting bool      `json:"collecting"`  // Claimed by the garbage collector, which is deleting it
+	ReleasedAt time.Time `json:"released_at"` // When an upload last held it or it lost its last reference
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ListAttachmentsResponse lists a desk's attachments, newest first, with how
+// much of its quota they use
+type ListAttachmentsResponse struct {
+	Attachments []*Attachment `json:"attachments"`
+	Total       int           `json:"total"`
+	Used        int64         `json:"used"`  // Bytes taken by all of the desk's attachments and their thumbnails
+	Quota       int64         `json:"quota"` // Bytes the desk may upload in total
+}
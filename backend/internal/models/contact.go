@@ -14,6 +14,13 @@ type Contact struct {
 	Notes        string    `json:"notes"`         // Optional notes about the contact
 	CreatedAt    time.Time `json:"created_at"`    // When the contact was created
 	UpdatedAt    time.Time `json:"updated_at"`    // When the contact was last updated
+
+	// Key pinning: once the user has compared the contact's fingerprint out
+	// of band it is pinned, and a later key change is flagged
+	PinnedFingerprint  string     `json:"pinned_fingerprint,omitempty"`  // Fingerprint the user verified
+	PinnedAt           *time.Time `json:"pinned_at,omitempty"`           // When it was pinned
+	CurrentFingerprint string     `json:"current_fingerprint,omitempty"` // Fingerprint of the contact desk's current keys; computed, not stored
+	KeyChanged         bool       `json:"key_changed"`                   // Current keys no longer match the pinned fingerprint; computed, not stored
 }
 
 // CreateContactRequest represents a request to create a new contact
@@ -36,8 +43,14 @@ type UpdateContactRequest struct {
 	Notes        string `json:"notes"`
 }
 
+// PinContactKeyRequest pins the fingerprint the user verified for a contact
+type PinContactKeyRequest struct {
+	Fingerprint string `json:"fingerprint" binding:"required"`
+}
+
 // ListContactsResponse represents a list of contacts
 type ListContactsResponse struct {
-	Contacts []*Contact `json:"contacts"`
-	Total    int        `json:"total"`
+	Contacts   []*Contact `json:"contacts"`
+	Total      int        `json:"total"`                 // Contacts in this page
+	NextCursor string     `json:"next_cursor,omitempty"` // Set when more contacts follow
 }
@@ -2,70 +2,174 @@ package models
 
 import "time"
 
+// ParticipantRole is how a desk is addressed in a conversation
+type ParticipantRole string
+
+const (
+	ParticipantRoleTo ParticipantRole = "to" // Addressed directly; the creator counts as addressed
+	ParticipantRoleCc ParticipantRole = "cc" // Copied
+)
+
 // Conversation represents a threaded conversation
 type Conversation struct {
-	ID         string    `json:"id"`          // Unique conversation ID
-	Subject    string    `json:"subject"`     // Conversation subject
-	DeskID     string    `json:"desk_id"`     // Desk this conversation belongs to
-	CreatedAt  time.Time `json:"created_at"`  // When the conversation was created
-	UpdatedAt  time.Time `json:"updated_at"`  // When the conversation was last updated
-	MivCount   int       `json:"miv_count"`   // Number of mivs in this conversation
-	IsArchived bool      `json:"is_archived"` // Whether this conversation is archived
+	ID           string                     `json:"id"`           // Unique conversation ID
+	Subject      string                     `json:"subject"`      // Conversation subject
+	DeskID       string                     `json:"desk_id"`      // Desk that started the conversation
+	CreatedAt    time.Time                  `json:"created_at"`   // When the conversation was created
+	UpdatedAt    time.Time                  `json:"updated_at"`   // When the conversation was last updated
+	MivCount     int                        `json:"miv_count"`    // Number of mivs in this conversation
+	IsArchived   bool                       `json:"is_archived"`  // Whether the requesting desk has archived it; mirrors its ConversationState
+	Participants []*ConversationParticipant `json:"participants"` // Desks taking part, in the order they joined
+}
+
+// ConversationParticipant is a desk taking part in a conversation. Desks join
+// when they start the conversation or are first sent a miv in it.
+type ConversationParticipant struct {
+	DeskID   string          `json:"desk_id"`   // Normalized desk ID
+	Role     ParticipantRole `json:"role"`      // How the desk was first addressed
+	JoinedAt time.Time       `json:"joined_at"` // When the desk joined
+}
+
+// ConversationState is one participant's own view of a conversation. Each
+// desk archives, mutes and pins independently of the others.
+type ConversationState struct {
+	ConversationID string    `json:"conversation_id"`
+	DeskID         string    `json:"desk_id"`       // Normalized desk ID
+	IsArchived     bool      `json:"is_archived"`   // Archived by this desk, or by its ACK
+	IsMuted        bool      `json:"is_muted"`      // Replies neither notify this desk nor bring the conversation back from the archive
+	IsPinned       bool      `json:"is_pinned"`     // Listed ahead of unpinned conversations
+	LastReadSeq    int       `json:"last_read_seq"` // Highest seq_no this desk has sent or read
+	Basket         MivState  `json:"basket"`        // IN, PENDING or SENT; empty when the conversation needs nothing from this desk
+	UpdatedAt      time.Time `json:"updated_at"`    // When this desk's state last changed
+}
+
+// MivRecipient is one desk a miv was sent to. The first recipient is the
+// miv's To desk and its copy is the miv's Body; every further recipient gets
+// its own copy sealed to it. Read state is tracked per recipient.
+type MivRecipient struct {
+	DeskID     string          `json:"desk_id"`               // Normalized desk ID
+	Role       ParticipantRole `json:"role"`                  // Whether the desk was addressed or copied
+	Body       string          `json:"body,omitempty"`        // Body stored for this recipient; empty for the first, whose copy is the miv's Body
+	KeyVersion int             `json:"key_version,omitempty"` // Recipient key version the copy is sealed to
+	ReadAt     *time.Time      `json:"read_at,omitempty"`     // When this recipient read the miv
+	Basket     MivState        `json:"-"`                     // Basket the miv sits in for this recipient (IN, PENDING or empty); kept by the store
+
+	// ReceiptWithheld records that the recipient had read receipts turned
+	// off when it read the miv, so its sender never learns of that read
+	ReceiptWithheld bool `json:"-"`
 }
 
 // ConversationMiv represents a miv within a conversation thread
 type ConversationMiv struct {
-	ID             string     `json:"id"`
-	ConversationID string     `json:"conversation_id"`       // Parent conversation ID
-	SeqNo          int        `json:"seq_no"`                // Sequence number in conversation (1, 2, 3, ...)
-	From           string     `json:"from"`                  // Sender desk ID
-	To             string     `json:"to"`                    // Recipient desk ID
-	Subject        string     `json:"subject"`               // Miv subject (usually conversation subject for replies)
-	Body           string     `json:"body"`                  // Encrypted miv body
-	State          MivState   `json:"state"`                 // Current state
-	CreatedAt      time.Time  `json:"created_at"`            // When the miv was created
-	SentAt         *time.Time `json:"sent_at,omitempty"`     // When the miv was sent
-	ReceivedAt     *time.Time `json:"received_at,omitempty"` // When the miv was received
-	ReadAt         *time.Time `json:"read_at,omitempty"`     // When the miv was read
-	IsEncrypted    bool       `json:"is_encrypted"`          // Whether the body is encrypted
-	IsAck          bool       `json:"is_ack"`                // Whether this is an ACK message
-	IsForgotten    bool       `json:"is_forgotten"`          // Whether this miv has been forgotten (stops tracking replies)
-	FontFamily     *string    `json:"font_family,omitempty"` // Font family for message display
-	FontSize       *string    `json:"font_size,omitempty"`   // Font size for message display
+	ID                  string     `json:"id"`
+	ConversationID      string     `json:"conversation_id"`                 // Parent conversation ID
+	SeqNo               int        `json:"seq_no"`                          // Sequence number in conversation (1, 2, 3, ...)
+	From                string     `json:"from"`                            // Sender desk ID
+	To                  string     `json:"to"`                              // Recipient desk ID
+	Subject             string     `json:"subject"`                         // Miv subject (usually conversation subject for replies)
+	Body                string     `json:"body"`                            // Encrypted miv body
+	State               MivState   `json:"state"`                           // Current state
+	CreatedAt           time.Time  `json:"created_at"`                      // When the miv was created
+	SentAt              *time.Time `json:"sent_at,omitempty"`               // When the miv was sent
+	ReceivedAt          *time.Time `json:"received_at,omitempty"`           // When the miv was received
+	ReadAt              *time.Time `json:"read_at,omitempty"`               // When the miv was read
+	IsEncrypted         bool       `json:"is_encrypted"`                    // Whether the body is encrypted
+	SenderKeyVersion    int        `json:"sender_key_version,omitempty"`    // Sender desk key version used to seal the body
+	RecipientKeyVersion int        `json:"recipient_key_version,omitempty"` // Recipient desk key version the body is sealed to
+	Signature           string     `json:"signature,omitempty"`             // Sender's Ed25519 signature over the canonical miv fields (base64)
+	IsVerified          bool       `json:"is_verified"`                     // Whether Signature checks out against the sender's signing key; computed, not stored
+	SignedBody          string     `json:"signed_body,omitempty"`           // Stored body the signature covers, when Body is the viewer's copy or was opened; computed, not stored
+	IsAck               bool       `json:"is_ack"`                          // Whether this is an ACK message
+	IsForgotten         bool       `json:"is_forgotten"`                    // Whether this miv has been forgotten (stops tracking replies)
+	FontFamily          *string    `json:"font_family,omitempty"`           // Font family for message display
+	FontSize            *string    `json:"font_size,omitempty"`             // Font size for message display
+	ReplyBy             *time.Time `json:"reply_by,omitempty"`              // When the sender expects a reply
+	FollowUpAt          *time.Time `json:"follow_up_at,omitempty"`          // When the sender was reminded the reply is overdue; shown to the sender only
+
+	Recipients   []*MivRecipient `json:"recipients,omitempty"`  // Every desk the miv was sent to, To first
+	Attachments  []*Attachment   `json:"attachments,omitempty"` // Files sent or linked with the miv, in the order given
+	SenderBasket MivState        `json:"-"`                     // Basket the miv sits in for its sender (SENT or empty); kept by the store
 }
 
 // CreateConversationRequest represents a request to create a new conversation
 type CreateConversationRequest struct {
-	To         string  `json:"to" binding:"required"`
-	Subject    string  `json:"subject" binding:"required"`
-	Body       string  `json:"body" binding:"required"`
-	FontFamily *string `json:"font_family,omitempty"` // Font family for message display
-	FontSize   *string `json:"font_size,omitempty"`   // Font size for message display
+	ConversationID string            `json:"conversation_id,omitempty"` // ID the first miv is signed over; required with a client signature, random otherwise
+	To             string            `json:"to" binding:"required"`     // Recipient desk IDs, comma-separated; the first is the miv's To desk
+	Cc             string            `json:"cc,omitempty"`              // Copied desk IDs, comma-separated
+	Subject        string            `json:"subject" binding:"required"`
+	Body           string            `json:"body" binding:"required"`
+	Bodies         map[string]string `json:"bodies,omitempty"`         // Client-sealed copies for every recipient after the first, keyed by desk ID
+	IsEncrypted    bool              `json:"is_encrypted"`             // Body is already sealed by the client (base64 NaCl box)
+	KeyVersion     int               `json:"key_version,omitempty"`    // Recipient key version a client-sealed body is sealed to
+	KeyVersions    map[string]int    `json:"key_versions,omitempty"`   // Key version each copy in bodies is sealed to, keyed by desk ID
+	Signature      string            `json:"signature,omitempty"`      // Client signature over the sealed miv; required for client-keyed desks
+	FontFamily     *string           `json:"font_family,omitempty"`    // Font family for message display
+	FontSize       *string           `json:"font_size,omitempty"`      // Font size for message display
+	SendAt         *time.Time        `json:"send_at,omitempty"`        // Hold the miv back as SCHEDULED until this time
+	DraftID        string            `json:"draft_id,omitempty"`       // Draft this miv is sent from; deleted once sent
+	DraftVersion   int               `json:"draft_version,omitempty"`  // Version of the draft the sender sent; required with DraftID
+	ReplyBy        *time.Time        `json:"reply_by,omitempty"`       // Remind the sender if no reply has arrived by this time
+	AttachmentIDs  []string          `json:"attachment_ids,omitempty"` // Attachments to send or link with the miv
 }
 
 // ReplyToConversationRequest represents a request to reply in a conversation
 type ReplyToConversationRequest struct {
-	Body       string  `json:"body" binding:"required"`
-	IsAck      bool    `json:"is_ack"`                // Whether this is an ACK message to end the conversation
-	FontFamily *string `json:"font_family,omitempty"` // Font family for message display
-	FontSize   *string `json:"font_size,omitempty"`   // Font size for message display
+	Body          string            `json:"body" binding:"required"`
+	Bodies        map[string]string `json:"bodies,omitempty"`         // Client-sealed copies for every recipient after the first, keyed by desk ID
+	IsAck         bool              `json:"is_ack"`                   // Whether this is an ACK message to end the conversation
+	IsEncrypted   bool              `json:"is_encrypted"`             // Body is already sealed by the client (base64 NaCl box)
+	KeyVersion    int               `json:"key_version,omitempty"`    // Recipient key version a client-sealed body is sealed to
+	KeyVersions   map[string]int    `json:"key_versions,omitempty"`   // Key version each copy in bodies is sealed to, keyed by desk ID
+	SeqNo         int               `json:"seq_no,omitempty"`         // Sequence number the client signed; must be the next one in the conversation
+	Signature     string            `json:"signature,omitempty"`      // Client signature over the sealed miv; required for client-keyed desks
+	FontFamily    *string           `json:"font_family,omitempty"`    // Font family for message display
+	FontSize      *string           `json:"font_size,omitempty"`      // Font size for message display
+	SendAt        *time.Time        `json:"send_at,omitempty"`        // Hold the miv back as SCHEDULED until this time
+	DraftID       string            `json:"draft_id,omitempty"`       // Draft this miv is sent from; deleted once sent
+	DraftVersion  int               `json:"draft_version,omitempty"`  // Version of the draft the sender sent; required with DraftID
+	ReplyBy       *time.Time        `json:"reply_by,omitempty"`       // Remind the sender if no reply has arrived by this time
+	AttachmentIDs []string          `json:"attachment_ids,omitempty"` // Attachments to send or link with the miv
+}
+
+// SetReplyByRequest sets or, with a null reply_by, clears a sent miv's reply
+// deadline
+type SetReplyByRequest struct {
+	ReplyBy *time.Time `json:"reply_by"`
 }
 
 // ListConversationsResponse represents a list of conversations with metadata
 type ListConversationsResponse struct {
 	Conversations []*ConversationWithLatest `json:"conversations"`
-	Total         int                       `json:"total"`
+	Total         int                       `json:"total"`                 // Conversations in this page
+	NextCursor    string                    `json:"next_cursor,omitempty"` // Set when more conversations follow
 }
 
 // ConversationWithLatest includes conversation with latest miv info
 type ConversationWithLatest struct {
-	Conversation *Conversation    `json:"conversation"`
-	LatestMiv    *ConversationMiv `json:"latest_miv,omitempty"`
-	UnreadCount  int              `json:"unread_count"`
+	Conversation *Conversation      `json:"conversation"`
+	LatestMiv    *ConversationMiv   `json:"latest_miv,omitempty"`
+	UnreadCount  int                `json:"unread_count"`
+	State        *ConversationState `json:"state"` // The requesting desk's own state
 }
 
 // GetConversationResponse represents a conversation with all its mivs
 type GetConversationResponse struct {
 	Conversation *Conversation      `json:"conversation"`
 	Mivs         []*ConversationMiv `json:"mivs"`
+	State        *ConversationState `json:"state"` // The requesting desk's own state
+}
+
+// BasketResponse lists the mivs in one of a desk's baskets, newest first
+type BasketResponse struct {
+	Basket MivState           `json:"basket"`
+	Mivs   []*ConversationMiv `json:"mivs"`
+	Total  int                `json:"total"`
+}
+
+// UpdateConversationStateRequest changes the requesting desk's own state;
+// fields left out are unchanged
+type UpdateConversationStateRequest struct {
+	IsArchived *bool `json:"is_archived,omitempty"`
+	IsMuted    *bool `json:"is_muted,omitempty"`
+	IsPinned   *bool `json:"is_pinned,omitempty"`
 }
@@ -0,0 +1,59 @@
+package models
+
+import "time"
+
+// Draft is a miv being composed on a desk, saved so it can be picked up again
+// on any device. It becomes a real miv when it is sent with its ID as the
+// request's draft_id.
+type Draft struct {
+	ID             string    `json:"id"`
+	DeskID         string    `json:"desk_id"`                   // Desk composing the draft
+	ConversationID string    `json:"conversation_id,omitempty"` // Conversation a reply draft answers; empty when it starts one
+	To             string    `json:"to,omitempty"`              // Recipient desk IDs, comma-separated
+	Cc             string    `json:"cc,omitempty"`              // Copied desk IDs, comma-separated
+	Subject        string    `json:"subject,omitempty"`
+	Body           string    `json:"body"`                  // As composed, or sealed by the client when IsEncrypted
+	IsEncrypted    bool      `json:"is_encrypted"`          // Whether Body was sealed by the client and is served as stored
+	IsAck          bool      `json:"is_ack"`                // Whether the reply is an ACK
+	FontFamily     *string   `json:"font_family,omitempty"` // Font family for message display
+	FontSize       *string   `json:"font_size,omitempty"`   // Font size for message display
+	Version        int       `json:"version"`               // Incremented on every save
+	KeyVersion     int       `json:"key_version,omitempty"` // Desk key version the stored body is sealed with; served only for client-sealed drafts
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// CreateDraftRequest represents a request to save a new draft
+type CreateDraftRequest struct {
+	ConversationID string  `json:"conversation_id,omitempty"` // Set for a reply draft
+	To             string  `json:"to,omitempty"`
+	Cc             string  `json:"cc,omitempty"`
+	Subject        string  `json:"subject,omitempty"`
+	Body           string  `json:"body"`
+	IsEncrypted    bool    `json:"is_encrypted"`          // Body is sealed to the desk's own key; required for desks that hold their own keys
+	KeyVersion     int     `json:"key_version,omitempty"` // Desk key version an encrypted body is sealed to
+	IsAck          bool    `json:"is_ack"`
+	FontFamily     *string `json:"font_family,omitempty"`
+	FontSize       *string `json:"font_size,omitempty"`
+}
+
+// UpdateDraftRequest replaces a draft's contents. Version must match the
+// stored draft so a save from a stale editor cannot clobber a newer one.
+type UpdateDraftRequest struct {
+	Version     int     `json:"version" binding:"required"`
+	To          string  `json:"to,omitempty"`
+	Cc          string  `json:"cc,omitempty"`
+	Subject     string  `json:"subject,omitempty"`
+	Body        string  `json:"body"`
+	IsEncrypted bool    `json:"is_encrypted"`          // As in CreateDraftRequest
+	KeyVersion  int     `json:"key_version,omitempty"` // As in CreateDraftRequest
+	IsAck       bool    `json:"is_ack"`
+	FontFamily  *string `json:"font_family,omitempty"`
+	FontSize    *string `json:"font_size,omitempty"`
+}
+
+// ListDraftsResponse lists a desk's drafts, most recently saved first
+type ListDraftsResponse struct {
+	Drafts []*Draft `json:"drafts"`
+	Total  int      `json:"total"`
+}
@@ -0,0 +1,51 @@
+package models
+
+import "time"
+
+// EventType names an event pushed on a desk's event stream
+type EventType string
+
+const (
+	EventTypeNotification     EventType = "notification"      // A notification was delivered; data is the Notification
+	EventTypeNotificationRead EventType = "notification_read" // A notification was marked read; data is the Notification
+	EventTypeConversation     EventType = "conversation"      // A conversation or one of its mivs changed; data is a ConversationEvent
+	EventTypeMivRead          EventType = "miv_read"          // A miv was read by its recipient; data is a MivReadEvent
+	EventTypeReset            EventType = "reset"             // Events were missed; the client should reload its state
+)
+
+// ConversationAction says what changed in a conversation event
+type ConversationAction string
+
+const (
+	ConversationActionMivCreated ConversationAction = "miv_created" // A new miv was added
+	ConversationActionMivUpdated ConversationAction = "miv_updated" // An existing miv changed state
+	ConversationActionUpdated    ConversationAction = "updated"     // The conversation itself changed
+	ConversationActionState      ConversationAction = "state"       // The desk's own state (archived, muted, pinned, basket) changed
+)
+
+// Event is one entry on a desk's event stream
+type Event struct {
+	ID        string      `json:"id"`      // Opaque ID; send it back as Last-Event-ID to resume
+	Type      EventType   `json:"type"`    // What happened
+	DeskID    string      `json:"desk_id"` // Desk the event is for
+	Data      interface{} `json:"data"`    // Type-specific payload; JSON once stored
+	Seq       int64       `json:"-"`       // Position in the event log every server shares
+	CreatedAt time.Time   `json:"-"`
+}
+
+// ConversationEvent tells participants a conversation changed. It carries no
+// miv content; clients fetch the conversation to see it.
+type ConversationEvent struct {
+	ConversationID string             `json:"conversation_id"`
+	Action         ConversationAction `json:"action"`
+	MivID          string             `json:"miv_id,omitempty"`
+	SeqNo          int                `json:"seq_no,omitempty"`
+}
+
+// MivReadEvent tells participants a miv was read
+type MivReadEvent struct {
+	ConversationID string    `json:"conversation_id"`
+	MivID          string    `json:"miv_id"`
+	DeskID         string    `json:"desk_id"` // Desk that read the miv
+	ReadAt         time.Time `json:"read_at"`
+}
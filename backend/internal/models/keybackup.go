@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// KeyBackup is a desk's private keys, every version of them, wrapped under a
+// password-derived key by the client (see crypto.WrapKeyBundle). The server
+// stores it but can never open it.
+type KeyBackup struct {
+	DeskID    string    `json:"desk_id"`    // Desk whose private key is wrapped
+	Version   int       `json:"version"`    // Incremented every time the blob is replaced
+	Blob      string    `json:"blob"`       // Self-describing wrapped key bundle
+	CreatedAt time.Time `json:"created_at"` // When the first backup was uploaded
+	UpdatedAt time.Time `json:"updated_at"` // When the blob was last replaced
+}
+
+// UploadKeyBackupRequest represents a request to store a desk's first key backup
+type UploadKeyBackupRequest struct {
+	Blob string `json:"blob" binding:"required"`
+}
+
+// RotateKeyBackupRequest replaces a key backup, e.g. after a password change.
+// Version must match the stored backup so concurrent rotations cannot clobber
+// each other.
+type RotateKeyBackupRequest struct {
+	Blob    string `json:"blob" binding:"required"`
+	Version int    `json:"version" binding:"required"`
+}
+
+// RewrappedKeyBackup carries a desk key backup re-wrapped under a new password
+type RewrappedKeyBackup struct {
+	DeskID string `json:"desk_id" binding:"required"`
+	Blob   string `json:"blob" binding:"required"`
+}
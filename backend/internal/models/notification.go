@@ -6,9 +6,10 @@ import "time"
 type NotificationType string
 
 const (
-	NotificationTypeReadReceipt NotificationType = "READ_RECEIPT" // Miv was read by recipient
-	NotificationTypeNewMiv      NotificationType = "NEW_MIV"      // New miv received
-	NotificationTypeReply       NotificationType = "REPLY"        // Reply to conversation
+	NotificationTypeReadReceipt NotificationType = "READ_RECEIPT"  // Miv was read by recipient
+	NotificationTypeNewMiv      NotificationType = "NEW_MIV"       // New miv received
+	NotificationTypeReply       NotificationType = "REPLY"         // Reply to conversation
+	NotificationTypeFollowUpDue NotificationType = "FOLLOW_UP_DUE" // A sent miv's reply deadline passed without a reply
 )
 
 // Notification represents a notification for a desk
@@ -22,6 +23,7 @@ type Notification struct {
 	Read           bool             `json:"read"`                      // Whether the notification has been read
 	CreatedAt      time.Time        `json:"created_at"`                // When the notification was created
 	ReadAt         *time.Time       `json:"read_at,omitempty"`         // When the notification was read
+	MivReadAt      *time.Time       `json:"miv_read_at,omitempty"`     // When the miv was read, for read receipts
 }
 
 // CreateNotificationRequest represents a request to create a notification
@@ -41,6 +43,7 @@ type MarkNotificationReadRequest struct {
 // ListNotificationsResponse represents a list of notifications
 type ListNotificationsResponse struct {
 	Notifications []*Notification `json:"notifications"`
-	UnreadCount   int             `json:"unread_count"`
-	Total         int             `json:"total"`
+	UnreadCount   int             `json:"unread_count"`          // Across all of the desk's notifications
+	Total         int             `json:"total"`                 // Notifications in this page
+	NextCursor    string          `json:"next_cursor,omitempty"` // Set when more notifications follow
 }
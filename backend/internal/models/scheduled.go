@@ -0,0 +1,69 @@
+package models
+
+import "time"
+
+// ScheduledMiv is a miv held back until its send time. Until the dispatcher
+// delivers it only its sender sees it: recipients get neither the miv nor a
+// notification.
+//
+// A plaintext body is sealed to the sender's own key until delivery, when
+// the server seals and signs it for the recipients. A client-sealed body
+// (IsEncrypted) is kept as received, with its copies, key versions and
+// signature, and delivered as the client would have sent it.
+type ScheduledMiv struct {
+	ID                  string            `json:"id"`                            // Also the ID of the miv once delivered
+	DeskID              string            `json:"desk_id"`                       // Sending desk
+	ConversationID      string            `json:"conversation_id,omitempty"`     // Conversation replied to; empty when the miv starts one
+	NewConversationID   string            `json:"new_conversation_id,omitempty"` // ID a client-signed miv starting a conversation is signed over
+	To                  string            `json:"to,omitempty"`                  // Recipient desk IDs of a new conversation, comma-separated
+	Cc                  string            `json:"cc,omitempty"`                  // Copied desk IDs of a new conversation, comma-separated
+	Subject             string            `json:"subject,omitempty"`             // Subject of a new conversation
+	Body                string            `json:"body"`                          // Base64 encoded in responses; sealed to the sender's own key at rest unless client-sealed
+	Bodies              map[string]string `json:"bodies,omitempty"`              // Client-sealed copies for every recipient after the first, keyed by desk ID
+	IsEncrypted         bool              `json:"is_encrypted"`                  // Body was sealed by the client for its recipients
+	RecipientKeyVersion int               `json:"key_version,omitempty"`         // Recipient key version a client-sealed body is sealed to
+	KeyVersions         map[string]int    `json:"key_versions,omitempty"`        // Key version each copy in bodies is sealed to, keyed by desk ID
+	SeqNo               int               `json:"seq_no,omitempty"`              // Sequence number a client-signed reply is signed over
+	Signature           string            `json:"signature,omitempty"`           // Client signature the delivered miv carries
+	IsAck               bool              `json:"is_ack"`                        // Whether the reply is an ACK
+	FontFamily          *string           `json:"font_family,omitempty"`         // Font family for message display
+	FontSize            *string           `json:"font_size,omitempty"`           // Font size for message display
+	SendAt              time.Time         `json:"send_at"`                       // When the dispatcher delivers the miv
+	ReplyBy             *time.Time        `json:"reply_by,omitempty"`            // Reply deadline the delivered miv gets
+	AttachmentIDs       []string          `json:"attachment_ids,omitempty"`      // Attachments sent or linked with the miv
+	KeyVersion          int               `json:"-"`                             // Sender key version a server-sealed body is sealed with
+	ClaimedAt           *time.Time        `json:"-"`                             // When a dispatcher claimed the miv for delivery
+	State               MivState          `json:"state"`                         // Always SCHEDULED
+	Error               string            `json:"error,omitempty"`               // Why delivery failed; set until the miv is edited
+	CreatedAt           time.Time         `json:"created_at"`
+	UpdatedAt           time.Time         `json:"updated_at"`
+}
+
+// UpdateScheduledMivRequest edits a scheduled miv; fields left out keep their
+// value. To, Cc and Subject only apply to a miv that starts a conversation.
+// A new body replaces the stored one along with its sealing fields; a
+// client-sealed miv must be sealed and signed again whenever its
+// recipients, subject or body change.
+type UpdateScheduledMivRequest struct {
+	To            *string           `json:"to,omitempty"`
+	Cc            *string           `json:"cc,omitempty"`
+	Subject       *string           `json:"subject,omitempty"`
+	Body          *string           `json:"body,omitempty"`
+	Bodies        map[string]string `json:"bodies,omitempty"`       // Client-sealed copies of body, keyed by desk ID
+	IsEncrypted   bool              `json:"is_encrypted"`           // Body is already sealed by the client
+	KeyVersion    int               `json:"key_version,omitempty"`  // Recipient key version a client-sealed body is sealed to
+	KeyVersions   map[string]int    `json:"key_versions,omitempty"` // Key version each copy in bodies is sealed to, keyed by desk ID
+	SeqNo         int               `json:"seq_no,omitempty"`       // Sequence number a client-signed reply is signed over
+	Signature     string            `json:"signature,omitempty"`    // Client signature over the sealed miv
+	SendAt        *time.Time        `json:"send_at,omitempty"`
+	ReplyBy       *time.Time        `json:"reply_by,omitempty"`
+	AttachmentIDs []string          `json:"attachment_ids,omitempty"` // Replaces the pending attachments when set
+	FontFamily    *string           `json:"font_family,omitempty"`
+	FontSize      *string           `json:"font_size,omitempty"`
+}
+
+// ListScheduledMivsResponse lists a desk's scheduled mivs, soonest first
+type ListScheduledMivsResponse struct {
+	Scheduled []*ScheduledMiv `json:"scheduled"`
+	Total     int             `json:"total"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// SearchResult is one miv matching a desk's search
+type SearchResult struct {
+	ConversationID string    `json:"conversation_id"`
+	MivID          string    `json:"miv_id"`
+	SeqNo          int       `json:"seq_no"`
+	Subject        string    `json:"subject"`
+	Snippet        string    `json:"snippet"` // HTML-escaped text with matches wrapped in <mark>
+	Score          float64   `json:"score"`   // Higher is more relevant
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// SearchResponse lists search results, best match first
+type SearchResponse struct {
+	Query   string          `json:"query"`
+	Results []*SearchResult `json:"results"`
+	Total   int             `json:"total"`
+	// SealedBodies counts the desk's mivs whose bodies the server cannot
+	// open, which were only matched by subject and contact names; a client
+	// holding the desk's keys searches those bodies itself
+	SealedBodies int `json:"sealed_bodies"`
+}
@@ -0,0 +1,342 @@
+// Package search keeps a full-text index of each desk's mivs. An index is
+// built from the content as its desk sees it, after the server has opened
+// sealed bodies for that desk, and lives only in memory: it is never stored
+// and never shared between desks or servers. As an index holds plaintext,
+// Indexes keeps a bounded number of them and drops those left unused; a
+// dropped index is rebuilt from the store on its desk's next search.
+package search
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// Matches in a subject count for more than matches in a body; a match on a
+// counterpart's contact name falls in between
+const (
+	subjectWeight = 3.0
+	nameWeight    = 2.0
+	bodyWeight    = 1.0
+
+	prefixWeight = 0.5 // A query term that only starts a word counts half
+)
+
+// Document is one miv as a desk sees it
+type Document struct {
+	MivID          string
+	ConversationID string
+	SeqNo          int
+	Subject        string
+	Body           string   // Plain text; empty when the desk cannot open it
+	Sealed         bool     // Whether the body is left out because the desk cannot open it
+	Counterparts   []string // Desks on the other side of the miv
+	CreatedAt      time.Time
+}
+
+// termCounts is how often a term appears in each field of a document
+type termCounts struct {
+	subject, body int
+}
+
+// Index is the inverted index of one desk's mivs. It is safe for concurrent use.
+type Index struct {
+	mu            sync.RWMutex
+	docs          map[string]*Document              // miv ID -> document
+	terms         map[string]map[string]*termCounts // term -> miv ID -> counts
+	counterparts  map[string]map[string]bool        // counterpart desk ID -> miv IDs
+	conversations map[string]string                 // conversation ID -> version indexed
+	byConv        map[string][]string               // conversation ID -> miv IDs
+	sealed        int                               // documents whose bodies are left out
+}
+
+// NewIndex returns an empty index
+func NewIndex() *Index {
+	return &Index{
+		docs:          make(map[string]*Document),
+		terms:         make(map[string]map[string]*termCounts),
+		counterparts:  make(map[string]map[string]bool),
+		conversations: make(map[string]string),
+		byConv:        make(map[string][]string),
+	}
+}
+
+// Version returns the version of a conversation the index holds, or "" when
+// it has not been indexed
+func (ix *Index) Version(conversationID string) string {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.conversations[conversationID]
+}
+
+// ReplaceConversation swaps the documents indexed for a conversation for
+// docs and records the conversation version they came from
+func (ix *Index) ReplaceConversation(conversationID, version string, docs []*Document) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	for _, mivID := range ix.byConv[conversationID] {
+		ix.removeLocked(mivID)
+	}
+	ix.byConv[conversationID] = nil
+	for _, doc := range docs {
+		ix.addLocked(doc)
+		ix.byConv[conversationID] = append(ix.byConv[conversationID], doc.MivID)
+	}
+	ix.conversations[conversationID] = version
+}
+
+// Sealed returns how many indexed mivs have bodies the desk cannot open,
+// which searches only match by subject and contact names
+func (ix *Index) Sealed() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return ix.sealed
+}
+
+func (ix *Index) addLocked(doc *Document) {
+	ix.docs[doc.MivID] = doc
+	if doc.Sealed {
+		ix.sealed++
+	}
+	count := func(text string, field func(*termCounts) *int) {
+		for _, term := range Tokenize(text) {
+			postings, exists := ix.terms[term]
+			if !exists {
+				postings = make(map[string]*termCounts)
+				ix.terms[term] = postings
+			}
+			counts, exists := postings[doc.MivID]
+			if !exists {
+				counts = &termCounts{}
+				postings[doc.MivID] = counts
+			}
+			*field(counts)++
+		}
+	}
+	count(doc.Subject, func(c *termCounts) *int { return &c.subject })
+	count(doc.Body, func(c *termCounts) *int { return &c.body })
+
+	for _, deskID := range doc.Counterparts {
+		deskID = crypto.NormalizeDeskID(deskID)
+		if ix.counterparts[deskID] == nil {
+			ix.counterparts[deskID] = make(map[string]bool)
+		}
+		ix.counterparts[deskID][doc.MivID] = true
+	}
+}
+
+func (ix *Index) removeLocked(mivID string) {
+	doc, exists := ix.docs[mivID]
+	if !exists {
+		return
+	}
+	for _, term := range append(Tokenize(doc.Subject), Tokenize(doc.Body)...) {
+		if postings, exists := ix.terms[term]; exists {
+			delete(postings, mivID)
+			if len(postings) == 0 {
+				delete(ix.terms, term)
+			}
+		}
+	}
+	for _, deskID := range doc.Counterparts {
+		deskID = crypto.NormalizeDeskID(deskID)
+		delete(ix.counterparts[deskID], mivID)
+		if len(ix.counterparts[deskID]) == 0 {
+			delete(ix.counterparts, deskID)
+		}
+	}
+	if doc.Sealed {
+		ix.sealed--
+	}
+	delete(ix.docs, mivID)
+}
+
+// Search returns up to limit mivs matching every term of the query, best
+// first. A term matches a word it equals or starts, in the subject, the body
+// or the contact name of a counterpart; names maps counterpart desk IDs to
+// the desk's own names for them.
+func (ix *Index) Search(query string, names map[string]string, limit int) []*models.SearchResult {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	queryTerms := uniqueTerms(query)
+	if len(queryTerms) == 0 {
+		return []*models.SearchResult{}
+	}
+
+	total := float64(len(ix.docs))
+	var scores map[string]float64
+	for _, term := range queryTerms {
+		termScores := make(map[string]float64)
+		for word, postings := range ix.terms {
+			weight := matchWeight(word, term)
+			if weight == 0 {
+				continue
+			}
+			idf := math.Log(1 + total/float64(len(postings)))
+			for mivID, counts := range postings {
+				termScores[mivID] += weight * idf * (subjectWeight*float64(counts.subject) + bodyWeight*float64(counts.body))
+			}
+		}
+		for deskID, name := range names {
+			weight := 0.0
+			for _, word := range Tokenize(name) {
+				weight = math.Max(weight, matchWeight(word, term))
+			}
+			if weight == 0 {
+				continue
+			}
+			mivIDs := ix.counterparts[crypto.NormalizeDeskID(deskID)]
+			idf := math.Log(1 + total/float64(len(mivIDs)+1))
+			for mivID := range mivIDs {
+				termScores[mivID] += weight * idf * nameWeight
+			}
+		}
+
+		// Every term must match somewhere
+		if scores == nil {
+			scores = termScores
+			continue
+		}
+		for mivID := range scores {
+			if extra, matched := termScores[mivID]; matched {
+				scores[mivID] += extra
+			} else {
+				delete(scores, mivID)
+			}
+		}
+	}
+
+	results := make([]*models.SearchResult, 0, len(scores))
+	for mivID, score := range scores {
+		doc := ix.docs[mivID]
+		results = append(results, &models.SearchResult{
+			ConversationID: doc.ConversationID,
+			MivID:          doc.MivID,
+			SeqNo:          doc.SeqNo,
+			Subject:        doc.Subject,
+			Snippet:        Snippet(doc, queryTerms),
+			Score:          math.Round(score*1000) / 1000,
+			CreatedAt:      doc.CreatedAt,
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if !results[i].CreatedAt.Equal(results[j].CreatedAt) {
+			return results[i].CreatedAt.After(results[j].CreatedAt)
+		}
+		return results[i].MivID < results[j].MivID
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// matchWeight scores how well a query term matches an indexed word
+func matchWeight(word, term string) float64 {
+	switch {
+	case word == term:
+		return 1
+	case strings.HasPrefix(word, term):
+		return prefixWeight
+	}
+	return 0
+}
+
+// uniqueTerms tokenizes a query, dropping repeated terms
+func uniqueTerms(query string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, term := range Tokenize(query) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// Defaults for NewIndexes
+const (
+	DefaultMaxDesks = 1000
+	DefaultIdleTime = 30 * time.Minute
+)
+
+// Indexes holds one Index per desk for up to maxDesks desks. Past that the
+// least recently used index is dropped, as is any not used for idleTime.
+type Indexes struct {
+	mu       sync.Mutex
+	byDesk   map[string]*deskIndex
+	maxDesks int
+	idleTime time.Duration
+	now      func() time.Time
+}
+
+// deskIndex is a desk's index and when it was last used
+type deskIndex struct {
+	index    *Index
+	lastUsed time.Time
+}
+
+// NewIndexes returns an empty set of desk indexes holding at most maxDesks
+// indexes, each for as long as it is used at least every idleTime
+func NewIndexes(maxDesks int, idleTime time.Duration) *Indexes {
+	return &Indexes{
+		byDesk:   make(map[string]*deskIndex),
+		maxDesks: maxDesks,
+		idleTime: idleTime,
+		now:      time.Now,
+	}
+}
+
+// For returns the desk's own index, creating it empty on first use or after
+// it was dropped
+func (i *Indexes) For(deskID string) *Index {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := i.now()
+	for id, held := range i.byDesk {
+		if now.Sub(held.lastUsed) > i.idleTime {
+			delete(i.byDesk, id)
+		}
+	}
+
+	deskID = crypto.NormalizeDeskID(deskID)
+	held, exists := i.byDesk[deskID]
+	if !exists {
+		if len(i.byDesk) >= i.maxDesks {
+			i.dropLeastRecentLocked()
+		}
+		held = &deskIndex{index: NewIndex()}
+		i.byDesk[deskID] = held
+	}
+	held.lastUsed = now
+	return held.index
+}
+
+// Len returns how many desk indexes are held
+func (i *Indexes) Len() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.byDesk)
+}
+
+func (i *Indexes) dropLeastRecentLocked() {
+	var oldest string
+	for id, held := range i.byDesk {
+		if oldest == "" || held.lastUsed.Before(i.byDesk[oldest].lastUsed) {
+			oldest = id
+		}
+	}
+	delete(i.byDesk, oldest)
+}
@@ -0,0 +1,123 @@
+package search
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIndexSearch(t *testing.T) {
+	now := time.Now()
+	ix := NewIndex()
+	ix.ReplaceConversation("conv-1", "1", []*Document{
+		{MivID: "m1", ConversationID: "conv-1", SeqNo: 1, Subject: "Budget review", Body: "Please send the quarterly numbers.",
+			Counterparts: []string{"5552222222"}, CreatedAt: now.Add(-2 * time.Hour)},
+		{MivID: "m2", ConversationID: "conv-1", SeqNo: 2, Subject: "Budget review", Body: "Numbers attached <for> you & the team.",
+			Counterparts: []string{"5552222222"}, CreatedAt: now.Add(-time.Hour)},
+	})
+	ix.ReplaceConversation("conv-2", "1", []*Document{
+		{MivID: "m3", ConversationID: "conv-2", SeqNo: 1, Subject: "Lunch", Body: "The budget for lunch is small.",
+			Counterparts: []string{"5553333333"}, CreatedAt: now},
+	})
+
+	// Subject matches rank above body matches
+	results := ix.Search("budget", nil, 0)
+	if len(results) != 3 || results[2].MivID != "m3" {
+		t.Fatalf("Expected the subject matches first, got %+v", results)
+	}
+	if results[0].MivID != "m2" || results[0].SeqNo != 2 || results[0].ConversationID != "conv-1" {
+		t.Errorf("Expected equal scores to put the newest first, got %+v", results[0])
+	}
+
+	// Every term must match, and a term may start a word
+	if results := ix.Search("numb quarterly", nil, 0); len(results) != 1 || results[0].MivID != "m1" {
+		t.Errorf("Expected only m1 to match both terms, got %+v", results)
+	}
+	if results := ix.Search("budget dinner", nil, 0); len(results) != 0 {
+		t.Errorf("Expected no match when a term is missing, got %+v", results)
+	}
+
+	// Snippets are escaped with the matches marked
+	results = ix.Search("attached", nil, 0)
+	if len(results) != 1 || results[0].Snippet != "Numbers <mark>attached</mark> &lt;for&gt; you &amp; the team." {
+		t.Errorf("Unexpected snippet: %+v", results)
+	}
+
+	// Contact names match the desks on the other side
+	names := map[string]string{"555-333-3333": "Carol Jones"}
+	if results := ix.Search("carol", names, 0); len(results) != 1 || results[0].MivID != "m3" || results[0].Snippet != "The budget for lunch is small." {
+		t.Errorf("Expected carol's miv with its body as the snippet, got %+v", results)
+	}
+
+	// Replacing a conversation drops what it held before
+	ix.ReplaceConversation("conv-2", "2", []*Document{
+		{MivID: "m3", ConversationID: "conv-2", SeqNo: 1, Subject: "Dinner", Body: "Somewhere nice.", CreatedAt: now},
+	})
+	if ix.Version("conv-2") != "2" {
+		t.Errorf("Expected version 2, got %q", ix.Version("conv-2"))
+	}
+	if results := ix.Search("lunch", nil, 0); len(results) != 0 {
+		t.Errorf("Expected the old content to be gone, got %+v", results)
+	}
+	if results := ix.Search("budget", nil, 1); len(results) != 1 {
+		t.Errorf("Expected the limit to apply, got %d results", len(results))
+	}
+
+	// Mivs the desk cannot open are counted, and only their subjects match
+	ix.ReplaceConversation("conv-3", "1", []*Document{
+		{MivID: "m4", ConversationID: "conv-3", SeqNo: 1, Subject: "Sealed budget", Sealed: true, CreatedAt: now},
+	})
+	if ix.Sealed() != 1 {
+		t.Errorf("Expected one sealed miv, got %d", ix.Sealed())
+	}
+	ix.ReplaceConversation("conv-3", "2", nil)
+	if ix.Sealed() != 0 {
+		t.Errorf("Expected the sealed miv to be dropped, got %d", ix.Sealed())
+	}
+}
+
+func TestIndexesAreBounded(t *testing.T) {
+	now := time.Now()
+	indexes := NewIndexes(2, time.Hour)
+	indexes.now = func() time.Time { return now }
+
+	alice := indexes.For("5551111111")
+	alice.ReplaceConversation("conv-1", "1", nil)
+	if indexes.For("555-111-1111") != alice {
+		t.Fatalf("Expected a desk to keep its index")
+	}
+
+	// Past the limit the least recently used index goes
+	now = now.Add(time.Minute)
+	indexes.For("5552222222")
+	now = now.Add(time.Minute)
+	indexes.For("5551111111")
+	indexes.For("5553333333")
+	if indexes.Len() != 2 || indexes.For("5551111111") != alice {
+		t.Errorf("Expected the least recently used index to be dropped")
+	}
+
+	// An index left unused for the idle time goes too, and comes back empty
+	now = now.Add(2 * time.Hour)
+	if fresh := indexes.For("5551111111"); fresh == alice || fresh.Version("conv-1") != "" {
+		t.Errorf("Expected an idle index to be dropped and rebuilt")
+	}
+	if indexes.Len() != 1 {
+		t.Errorf("Expected only the index in use to be held, got %d", indexes.Len())
+	}
+}
+
+func TestPlainTextAndSnippet(t *testing.T) {
+	if got := PlainText("<p>Hello&nbsp;<b>world</b></p>\n<p>a < b</p>"); got != "Hello world a < b" {
+		t.Errorf("Unexpected plain text: %q", got)
+	}
+
+	long := strings.Repeat("filler ", 20) + "needle " + strings.Repeat("tail ", 40)
+	snippet := Snippet(&Document{Body: long}, []string{"needle"})
+	if !strings.HasPrefix(snippet, "…") || !strings.HasSuffix(snippet, "…") || !strings.Contains(snippet, "<mark>needle</mark>") {
+		t.Errorf("Expected an excerpt around the match, got %q", snippet)
+	}
+	if plain := strings.NewReplacer("<mark>", "", "</mark>", "", "…", "").Replace(snippet); len(plain) > snippetLength {
+		t.Errorf("Expected at most %d bytes of text, got %d", snippetLength, len(plain))
+	}
+}
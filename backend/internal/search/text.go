@@ -0,0 +1,151 @@
+package search
+
+import (
+	"html"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Snippets show up to snippetLength bytes of text, starting up to
+// snippetLead bytes before the first match
+const (
+	snippetLength = 160
+	snippetLead   = 40
+)
+
+// Tokenize splits text into lowercase words of letters and digits
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// PlainText turns a miv body, which the editor writes as HTML, into plain
+// text with its whitespace collapsed
+func PlainText(body string) string {
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		if body[i] == '<' && i+1 < len(body) && isTagStart(body[i+1]) {
+			if end := strings.IndexByte(body[i:], '>'); end >= 0 {
+				b.WriteByte(' ')
+				i += end
+				continue
+			}
+		}
+		b.WriteByte(body[i])
+	}
+	return strings.Join(strings.Fields(html.UnescapeString(b.String())), " ")
+}
+
+func isTagStart(c byte) bool {
+	return c == '/' || c == '!' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// Snippet returns an HTML-escaped excerpt of a document around the first
+// word matching a query term, with each matching word wrapped in <mark>.
+// The body is preferred, then the subject; when neither matches, as for a
+// match on a contact name, the start of the body is shown.
+func Snippet(doc *Document, terms []string) string {
+	for _, text := range []string{doc.Body, doc.Subject} {
+		if snippet, matched := highlight(text, terms); matched {
+			return snippet
+		}
+	}
+	text := doc.Body
+	if text == "" {
+		text = doc.Subject
+	}
+	snippet, _ := highlight(text, nil)
+	return snippet
+}
+
+// span is the byte range of one word
+type span struct {
+	start, end int
+}
+
+// wordSpans finds the words of text as Tokenize splits them
+func wordSpans(text string) []span {
+	var spans []span
+	start := -1
+	for i, r := range text {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case inWord && start < 0:
+			start = i
+		case !inWord && start >= 0:
+			spans = append(spans, span{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, span{start, len(text)})
+	}
+	return spans
+}
+
+// highlight builds the excerpt for Snippet and reports whether any word matched
+func highlight(text string, terms []string) (string, bool) {
+	spans := wordSpans(text)
+	matched := make([]bool, len(spans))
+	first := -1
+	for i, s := range spans {
+		word := strings.ToLower(text[s.start:s.end])
+		for _, term := range terms {
+			if strings.HasPrefix(word, term) {
+				matched[i] = true
+				break
+			}
+		}
+		if matched[i] && first < 0 {
+			first = i
+		}
+	}
+
+	// Start on a word boundary a little before the first match
+	start := 0
+	if first >= 0 {
+		start = spans[first].start
+		for i := first - 1; i >= 0 && spans[first].start-spans[i].start <= snippetLead; i-- {
+			start = spans[i].start
+		}
+	}
+
+	// End after the last whole word that fits
+	end := len(text)
+	if end-start > snippetLength {
+		end = start + snippetLength
+		for i := len(spans) - 1; i >= 0; i-- {
+			if spans[i].start >= start && spans[i].end <= end {
+				end = spans[i].end
+				break
+			}
+		}
+		// A single word longer than the snippet is cut between runes
+		for end > start && end < len(text) && !utf8.RuneStart(text[end]) {
+			end--
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for i, s := range spans {
+		if !matched[i] || s.start < start || s.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[pos:s.start]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[s.start:s.end]))
+		b.WriteString("</mark>")
+		pos = s.end
+	}
+	b.WriteString(html.EscapeString(text[pos:end]))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String(), first >= 0
+}
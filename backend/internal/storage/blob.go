@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// ErrBlobNotFound is returned when a blob does not exist
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps the files behind attachments. Keys are flat names chosen
+// by the server, without path separators. Implementations must be safe for
+// concurrent use, and several servers may share one store.
+type BlobStore interface {
+	// Put stores size bytes read from r under key, replacing any blob there.
+	// It fails if r does not yield exactly size bytes.
+	Put(key string, r io.Reader, size int64) error
+	// Get opens a blob for reading. The reader is also an io.Seeker when the
+	// store supports random access.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes a blob; deleting a missing blob is not an error
+	Delete(key string) error
+	// DownloadURL returns a URL that serves the blob directly for expires,
+	// or "" when downloads must be proxied through the server
+	DownloadURL(key string, expires time.Duration) (string, error)
+	// List calls fn for every blob in the store, in no particular order,
+	// stopping at the first error fn returns
+	List(fn func(BlobInfo) error) error
+}
+
+// BlobInfo describes a blob found by BlobStore.List
+type BlobInfo struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// blobRef is a blob an attachment is stored in
+type blobRef struct {
+	key  string
+	size int64
+}
+
+// attachmentBlobs returns the blobs an attachment's file and thumbnails are
+// stored in
+func attachmentBlobs(att *models.Attachment) []blobRef {
+	refs := []blobRef{{att.StorageKey, att.Size}}
+	for _, thumb := range att.Thumbnails {
+		refs = append(refs, blobRef{thumb.StorageKey, thumb.Size})
+	}
+	return refs
+}
+
+// attachmentSize returns the bytes an attachment's file and thumbnails take
+func attachmentSize(att *models.Attachment) int64 {
+	var size int64
+	for _, ref := range attachmentBlobs(att) {
+		size += ref.size
+	}
+	return size
+}
+
+// validBlobKey checks that key names a blob and nothing else
+func validBlobKey(key string) error {
+	if key == "" || key == "." || key == ".." || filepath.Base(key) != key || key != filepath.Clean(key) {
+		return fmt.Errorf("invalid blob key: %q", key)
+	}
+	return nil
+}
+
+// FileBlobStore keeps blobs as files in a local directory, which replicas
+// can share over a network file system
+type FileBlobStore struct {
+	dir string
+}
+
+// NewFileBlobStore creates a blob store in dir (default "./uploads"). The
+// directory is created on the first Put.
+func NewFileBlobStore(dir string) *FileBlobStore {
+	if dir == "" {
+		dir = "./uploads"
+	}
+	return &FileBlobStore{dir: dir}
+}
+
+func (f *FileBlobStore) path(key string) (string, error) {
+	if err := validBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(f.dir, key), nil
+}
+
+// Put writes the blob to a temporary file and renames it into place, so
+// readers never see a partial blob
+func (f *FileBlobStore) Put(key string, r io.Reader, size int64) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(f.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(tmp, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("blob %s: expected %d bytes, got %d", key, size, n)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// Get opens the blob's file, which is also an io.ReadSeeker
+func (f *FileBlobStore) Get(key string) (io.ReadCloser, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+// Delete removes the blob's file
+func (f *FileBlobStore) Delete(key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// DownloadURL returns "": files are only served through the server
+func (f *FileBlobStore) DownloadURL(key string, expires time.Duration) (string, error) {
+	return "", nil
+}
+
+// List walks the directory, skipping the temporary files of unfinished Puts
+func (f *FileBlobStore) List(fn func(BlobInfo) error) error {
+	entries, err := os.ReadDir(f.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Deleted since the directory was read
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(BlobInfo{Key: entry.Name(), Size: info.Size(), Modified: info.ModTime()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config configures an S3BlobStore
+type S3Config struct {
+	Endpoint  string // Server URL, e.g. "http://localhost:9000" for MinIO; AWS's regional endpoint by default
+	Region    string // Signing region (default "us-east-1")
+	Bucket    string // Bucket the blobs are kept in; it must exist
+	AccessKey string
+	SecretKey string
+	PathStyle bool // Address the bucket in the path, as MinIO needs, rather than in the host name
+	Presign   bool // Hand out presigned download URLs instead of proxying downloads
+}
+
+// S3BlobStore keeps blobs in a bucket of an S3-compatible object store,
+// such as AWS S3 or MinIO. Requests are signed with AWS Signature Version 4.
+type S3BlobStore struct {
+	cfg    S3Config
+	base   *url.URL
+	client *http.Client
+	now    func() time.Time
+}
+
+// s3UnsignedPayload stands in for the payload hash of requests whose body is
+// streamed without hashing it first; TLS protects it in transit
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// NewS3BlobStore creates a blob store on the bucket described by cfg
+func NewS3BlobStore(cfg S3Config) (*S3BlobStore, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket must be set")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("S3 access key and secret key must be set")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+	base, err := url.Parse(cfg.Endpoint)
+	if err != nil || base.Host == "" || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint: %q", cfg.Endpoint)
+	}
+	return &S3BlobStore{
+		cfg:    cfg,
+		base:   base,
+		client: &http.Client{Timeout: 5 * time.Minute},
+		now:    time.Now,
+	}, nil
+}
+
+// objectURL returns the URL of a blob, or of the bucket when key is empty
+func (s *S3BlobStore) objectURL(key string) *url.URL {
+	u := *s.base
+	if s.cfg.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket + "/" + key
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+	return &u
+}
+
+// newRequest returns a signed request for a blob
+func (s *S3BlobStore) newRequest(method, key string, body io.Reader, size int64) (*http.Request, error) {
+	req, err := http.NewRequest(method, s.objectURL(key).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	s.sign(req, s3UnsignedPayload, s.now())
+	return req, nil
+}
+
+// do sends a request and returns the response if its status is one of ok
+func (s *S3BlobStore) do(req *http.Request, ok ...int) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && req.Method != http.MethodPut {
+		return nil, ErrBlobNotFound
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, fmt.Errorf("S3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(message)))
+}
+
+// Put uploads the blob in a single request. The HTTP client fails the
+// request if r does not yield exactly size bytes.
+func (s *S3BlobStore) Put(key string, r io.Reader, size int64) error {
+	if err := validBlobKey(key); err != nil {
+		return err
+	}
+	req, err := s.newRequest(http.MethodPut, key, r, size)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get streams the blob; the reader does not seek
+func (s *S3BlobStore) Get(key string) (io.ReadCloser, error) {
+	if err := validBlobKey(key); err != nil {
+		return nil, err
+	}
+	req, err := s.newRequest(http.MethodGet, key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the blob
+func (s *S3BlobStore) Delete(key string) error {
+	if err := validBlobKey(key); err != nil {
+		return err
+	}
+	req, err := s.newRequest(http.MethodDelete, key, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, http.StatusNoContent, http.StatusOK)
+	if err == ErrBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// DownloadURL presigns a GET of the blob when presigning is enabled
+func (s *S3BlobStore) DownloadURL(key string, expires time.Duration) (string, error) {
+	if !s.cfg.Presign {
+		return "", nil
+	}
+	if err := validBlobKey(key); err != nil {
+		return "", err
+	}
+	return s.presign(http.MethodGet, s.objectURL(key), expires, s.now()), nil
+}
+
+// s3ListResult is the part of a ListObjectsV2 response List reads
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List pages through the bucket with ListObjectsV2
+func (s *S3BlobStore) List(fn func(BlobInfo) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := s.objectURL("")
+		u.RawQuery = s3CanonicalQuery(query)
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		s.sign(req, s3UnsignedPayload, s.now())
+		resp, err := s.do(req, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		var page s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("S3 list %s: %w", s.cfg.Bucket, err)
+		}
+
+		for _, object := range page.Contents {
+			if err := fn(BlobInfo{Key: object.Key, Size: object.Size, Modified: object.LastModified}); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// sign adds Signature Version 4 headers to req, signing the host, any Range
+// and Content-Type, and every x-amz- header
+func (s *S3BlobStore) sign(req *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": requestHost(req)}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "range" || lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		s3EncodePath(req.URL.Path),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope, signature := s.signature(canonical, t)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+// presign returns u with a query-string signature valid for expires
+func (s *S3BlobStore) presign(method string, u *url.URL, expires time.Duration, t time.Time) string {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.cfg.AccessKey+"/"+s.scope(t))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", fmt.Sprint(int64(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonical := strings.Join([]string{
+		method,
+		s3EncodePath(u.Path),
+		s3CanonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+	_, signature := s.signature(canonical, t)
+
+	signed := *u
+	signed.RawQuery = s3CanonicalQuery(query) + "&X-Amz-Signature=" + signature
+	return signed.String()
+}
+
+// scope returns the credential scope of requests signed at t
+func (s *S3BlobStore) scope(t time.Time) string {
+	return t.UTC().Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+// signature signs a canonical request and returns its scope and signature
+func (s *S3BlobStore) signature(canonical string, t time.Time) (string, string) {
+	scope := s.scope(t)
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + t.UTC().Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), t.UTC().Format("20060102"))
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+// s3Encode percent-encodes everything but unreserved characters, and '/'
+// too unless keepSlash is set, as Signature Version 4 requires
+func s3Encode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EncodePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return s3Encode(path, true)
+}
+
+// s3CanonicalQuery encodes a query sorted by name
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3Encode(name, false)+"="+s3Encode(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// BlobReport describes what a run of CollectBlobs removed, or in a dry run
+// would have removed
+type BlobReport struct {
+	DryRun   bool
+	Released []BlobInfo // Recorded blobs no attachment references; Modified is when they were released
+	Orphaned []BlobInfo // Blobs in the store with no record, such as files from before blobs were counted
+	Errors   []error    // Blobs that could not be removed; they are retried on the next run
+}
+
+// Bytes is the total size of the blobs in the report
+func (r *BlobReport) Bytes() int64 {
+	var total int64
+	for _, blob := range r.Released {
+		total += blob.Size
+	}
+	for _, blob := range r.Orphaned {
+		total += blob.Size
+	}
+	return total
+}
+
+func (r *BlobReport) String() string {
+	verb := "removed"
+	if r.DryRun {
+		verb = "would remove"
+	}
+	return fmt.Sprintf("blob collection %s %d released and %d orphaned blobs (%d bytes), %d failed",
+		verb, len(r.Released), len(r.Orphaned), r.Bytes(), len(r.Errors))
+}
+
+// BlobCollection says what CollectBlobs removes
+type BlobCollection struct {
+	Grace  time.Duration // How long blobs must have been unreferenced
+	DryRun bool          // Only report what would be removed
+	// Orphans also removes blobs in the store the database has no record
+	// of once they are older than Grace. Only safe when the blob store is
+	// Missiv's alone and the database outlives restarts, and after every
+	// upload from before blobs were counted has been migrated.
+	Orphans bool
+}
+
+// CollectBlobs removes the blobs that have been unreferenced for the grace
+// period, and with Orphans the unrecorded ones. Each blob is claimed before
+// it is deleted, so an upload of the same content waits rather than reusing
+// a blob that is going away.
+func CollectBlobs(store Store, blobs BlobStore, opts BlobCollection, now time.Time) (*BlobReport, error) {
+	before := now.Add(-opts.Grace)
+	dryRun := opts.DryRun
+	report := &BlobReport{DryRun: dryRun}
+
+	released, err := store.ListReleasedBlobs(before)
+	if err != nil {
+		return nil, err
+	}
+	for _, blob := range released {
+		info := BlobInfo{Key: blob.Key, Size: blob.Size, Modified: blob.ReleasedAt}
+		if ok, err := collectBlob(store, blobs, info, before, dryRun); err != nil {
+			report.Errors = append(report.Errors, err)
+		} else if ok {
+			report.Released = append(report.Released, info)
+		}
+	}
+
+	if !opts.Orphans {
+		return report, nil
+	}
+
+	// Listing first keeps deletions from disturbing the listing
+	var orphans []BlobInfo
+	err = blobs.List(func(info BlobInfo) error {
+		if !info.Modified.Before(before) {
+			return nil
+		}
+		_, err := store.GetBlob(info.Key)
+		if errors.Is(err, ErrBlobNotFound) {
+			orphans = append(orphans, info)
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+	for _, info := range orphans {
+		if ok, err := collectBlob(store, blobs, info, before, dryRun); err != nil {
+			report.Errors = append(report.Errors, err)
+		} else if ok {
+			report.Orphaned = append(report.Orphaned, info)
+		}
+	}
+	return report, nil
+}
+
+// collectBlob claims a blob and deletes it and its record, reporting
+// whether it was still unreferenced. A blob whose deletion fails stays
+// claimed, and is retried.
+func collectBlob(store Store, blobs BlobStore, info BlobInfo, before time.Time, dryRun bool) (bool, error) {
+	if dryRun {
+		return true, nil
+	}
+	claimed, err := store.ClaimBlob(info.Key, info.Size, before)
+	if err != nil || !claimed {
+		return false, err
+	}
+	if err := blobs.Delete(info.Key); err != nil {
+		return false, fmt.Errorf("blob %s: %w", info.Key, err)
+	}
+	if err := store.DeleteBlobRecord(info.Key); err != nil {
+		return false, fmt.Errorf("blob %s: %w", info.Key, err)
+	}
+	return true, nil
+}
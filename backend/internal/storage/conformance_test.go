@@ -0,0 +1,1806 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// storeFactory returns a fresh, empty store for a single subtest
+type storeFactory func(t *testing.T) Store
+
+func TestMemoryStorageConformance(t *testing.T) {
+	runStoreConformance(t, func(t *testing.T) Store {
+		return NewMemoryStorage()
+	})
+}
+
+func TestSQLiteStorageConformance(t *testing.T) {
+	runStoreConformance(t, func(t *testing.T) Store {
+		store, err := NewSQLiteStorage(filepath.Join(t.TempDir(), "missiv.db"))
+		if err != nil {
+			t.Fatalf("Failed to open sqlite storage: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+func TestSQLiteStorageMigrationsAreIdempotent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missiv.db")
+
+	store, err := NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite storage: %v", err)
+	}
+	account := &models.Account{Username: "alice", Desks: []string{}}
+	if err := store.CreateAccount(account); err != nil {
+		t.Fatalf("CreateAccount failed: %v", err)
+	}
+	store.Close()
+
+	// Reopening must not re-run migrations and must keep the data
+	store, err = NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen sqlite storage: %v", err)
+	}
+	defer store.Close()
+
+	if _, err := store.GetAccountByUsername("alice"); err != nil {
+		t.Errorf("Expected account to survive reopen: %v", err)
+	}
+}
+
+func TestSQLiteMigrationMovesDeskKeysIntoHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missiv.db")
+
+	// Build a database at schema version 2, before key versions existed
+	db, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	if err := migrate(db, sqliteDialect, sqliteMigrations[:2]); err != nil {
+		t.Fatalf("Failed to apply early migrations: %v", err)
+	}
+	privateKey := [32]byte{7}
+	if _, err := db.Exec(`INSERT INTO desks (id, account_id, public_key, private_key, name, created_at, auto_indent,
+		font_family, font_size, default_salutation, default_closure) VALUES ('5551234567', 'acc-1', 'pk', ?, 'Primary', 1, 1, '', '', '', '')`,
+		privateKey[:]); err != nil {
+		t.Fatalf("Failed to insert legacy desk: %v", err)
+	}
+	db.Close()
+
+	store, err := NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to migrate sqlite storage: %v", err)
+	}
+	defer store.Close()
+
+	desk, err := store.GetDesk("5551234567")
+	if err != nil || desk.KeyVersion != 1 {
+		t.Fatalf("Expected migrated desk at key version 1, got %+v (err %v)", desk, err)
+	}
+	if key, err := store.GetDeskPrivateKey(desk.ID, 1); err != nil || key != privateKey {
+		t.Errorf("Expected legacy private key to move into key history (err %v)", err)
+	}
+}
+
+func TestSQLiteMigrationCountsBlobReferences(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missiv.db")
+
+	// Build a database at schema version 14, before blobs were counted
+	db, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	if err := migrate(db, sqliteDialect, sqliteMigrations[:14]); err != nil {
+		t.Fatalf("Failed to apply early migrations: %v", err)
+	}
+	statements := []string{
+		`INSERT INTO attachments (id, desk_id, conversation_id, miv_id, position, filename, content_type, size, checksum,
+			storage_key, width, height, thumbnails, created_at)
+			VALUES ('att-1', '5551111111', '', '', 0, 'a.txt', 'text/plain', 40, 'c0ffee', 'shared.enc', 0, 0, '[]', 1)`,
+		`INSERT INTO attachments (id, desk_id, conversation_id, miv_id, position, filename, content_type, size, checksum,
+			storage_key, width, height, thumbnails, created_at)
+			VALUES ('att-2', '5551111111', '', '', 0, 'b.txt', 'text/plain', 40, 'c0ffee', 'shared.enc', 0, 0, '[]', 2)`,
+		`INSERT INTO attachments (id, desk_id, conversation_id, miv_id, position, filename, content_type, size, checksum,
+			storage_key, width, height, thumbnails, created_at)
+			VALUES ('att-3', '5551111111', '', '', 0, 'c.png', 'image/png', 900, 'c0ffee', 'photo.enc', 400, 300,
+			'[{"name":"small","content_type":"image/png","width":160,"height":120,"size":90,"storage_key":"photo_small.enc"}]', 3)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("Failed to insert legacy rows: %v", err)
+		}
+	}
+	db.Close()
+
+	store, err := NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to migrate sqlite storage: %v", err)
+	}
+	defer store.Close()
+
+	for key, want := range map[string]models.Blob{
+		"shared.enc":      {Size: 40, Refs: 2},
+		"photo.enc":       {Size: 900, Refs: 1},
+		"photo_small.enc": {Size: 90, Refs: 1},
+	} {
+		got, err := store.GetBlob(key)
+		if err != nil {
+			t.Fatalf("GetBlob %s failed: %v", key, err)
+		}
+		if got.Size != want.Size || got.Refs != want.Refs || !got.Stored || got.Collecting {
+			t.Errorf("Expected %s stored with %d references, got %+v", key, want.Refs, got)
+		}
+	}
+}
+
+func TestSQLiteMigrationBackfillsConversationStates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missiv.db")
+
+	// Build a database at schema version 6, when archiving was shared
+	db, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatalf("Failed to open sqlite: %v", err)
+	}
+	if err := migrate(db, sqliteDialect, sqliteMigrations[:6]); err != nil {
+		t.Fatalf("Failed to apply early migrations: %v", err)
+	}
+	statements := []string{
+		`INSERT INTO conversations (id, subject, desk_id, created_at, updated_at, miv_count, is_archived)
+			VALUES ('conv-1', 'Hello', '5551111111', 1, 3, 2, 1)`,
+		`INSERT INTO conversation_mivs (id, conversation_id, seq_no, from_desk, to_desk, to_desk_id, subject, body, state,
+			created_at, read_at, is_encrypted, is_ack, is_forgotten)
+			VALUES ('miv-1', 'conv-1', 1, '5551111111', '555-222-2222', '5552222222', 'Hello', 'b25l', 'SENT', 1, 2, 0, 0, 0)`,
+		`INSERT INTO conversation_mivs (id, conversation_id, seq_no, from_desk, to_desk, to_desk_id, subject, body, state,
+			created_at, is_encrypted, is_ack, is_forgotten)
+			VALUES ('miv-2', 'conv-1', 2, '5552222222', '5551111111', '5551111111', 'Hello', 'dHdv', 'SENT', 3, 0, 0, 0)`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("Failed to insert legacy rows: %v", err)
+		}
+	}
+	db.Close()
+
+	store, err := NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatalf("Failed to migrate sqlite storage: %v", err)
+	}
+	defer store.Close()
+
+	expected := []models.ConversationState{
+		{DeskID: "5551111111", IsArchived: true, LastReadSeq: 1, Basket: models.StateIN},
+		{DeskID: "5552222222", IsArchived: true, LastReadSeq: 2, Basket: models.StateSENT},
+	}
+	for _, want := range expected {
+		got, err := store.GetConversationState("conv-1", want.DeskID)
+		if err != nil {
+			t.Fatalf("GetConversationState failed: %v", err)
+		}
+		if got.IsArchived != want.IsArchived || got.LastReadSeq != want.LastReadSeq || got.Basket != want.Basket {
+			t.Errorf("Expected migrated state %+v, got %+v", want, got)
+		}
+	}
+}
+
+// TestPostgresStorageConformance runs against a real Postgres server and is
+// skipped unless MISSIV_TEST_POSTGRES_DSN is set (see "make test-postgres").
+// Each subtest gets its own schema so runs never see each other's rows.
+func TestPostgresStorageConformance(t *testing.T) {
+	dsn := os.Getenv("MISSIV_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("MISSIV_TEST_POSTGRES_DSN not set")
+	}
+
+	admin, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatalf("Failed to open postgres: %v", err)
+	}
+	defer admin.Close()
+
+	var counter int
+	runStoreConformance(t, func(t *testing.T) Store {
+		counter++
+		schema := fmt.Sprintf("missiv_test_%d_%d", time.Now().UnixNano(), counter)
+		if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+			t.Fatalf("Failed to create schema: %v", err)
+		}
+
+		store, err := NewPostgresStorage(withSearchPath(dsn, schema))
+		if err != nil {
+			t.Fatalf("Failed to open postgres storage: %v", err)
+		}
+		t.Cleanup(func() {
+			store.Close()
+			admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		})
+		return store
+	})
+}
+
+// withSearchPath points every connection opened from dsn at schema
+func withSearchPath(dsn, schema string) string {
+	if strings.Contains(dsn, "://") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		return dsn + sep + "search_path=" + schema
+	}
+	return dsn + " search_path=" + schema
+}
+
+// runStoreConformance exercises the behaviour every Store implementation must share
+func runStoreConformance(t *testing.T, newStore storeFactory) {
+	t.Run("Identity", func(t *testing.T) { testIdentity(t, newStore(t)) })
+	t.Run("Accounts", func(t *testing.T) { testAccounts(t, newStore(t)) })
+	t.Run("Sessions", func(t *testing.T) { testSessions(t, newStore(t)) })
+	t.Run("Desks", func(t *testing.T) { testDesks(t, newStore(t)) })
+	t.Run("DeskKeyRotation", func(t *testing.T) { testDeskKeyRotation(t, newStore(t)) })
+	t.Run("Conversations", func(t *testing.T) { testConversations(t, newStore(t)) })
+	t.Run("StartConversation", func(t *testing.T) { testStartConversation(t, newStore(t)) })
+	t.Run("ConversationRecipients", func(t *testing.T) { testConversationRecipients(t, newStore(t)) })
+	t.Run("ConversationStates", func(t *testing.T) { testConversationStates(t, newStore(t)) })
+	t.Run("Baskets", func(t *testing.T) { testBaskets(t, newStore(t)) })
+	t.Run("FollowUps", func(t *testing.T) { testFollowUps(t, newStore(t)) })
+	t.Run("Pagination", func(t *testing.T) { testPagination(t, newStore(t)) })
+	t.Run("ConcurrentReplies", func(t *testing.T) { testConcurrentReplies(t, newStore(t)) })
+	t.Run("Notifications", func(t *testing.T) { testNotifications(t, newStore(t)) })
+	t.Run("Events", func(t *testing.T) { testEvents(t, newStore(t)) })
+	t.Run("Contacts", func(t *testing.T) { testContacts(t, newStore(t)) })
+	t.Run("KeyBackups", func(t *testing.T) { testKeyBackups(t, newStore(t)) })
+	t.Run("ScheduledMivs", func(t *testing.T) { testScheduledMivs(t, newStore(t)) })
+	t.Run("ScheduledMivClaims", func(t *testing.T) { testScheduledMivClaims(t, newStore(t)) })
+	t.Run("Drafts", func(t *testing.T) { testDrafts(t, newStore(t)) })
+	t.Run("Attachments", func(t *testing.T) { testAttachments(t, newStore(t)) })
+	t.Run("AttachmentQuota", func(t *testing.T) { testAttachmentQuota(t, newStore(t)) })
+	t.Run("Blobs", func(t *testing.T) { testBlobs(t, newStore(t)) })
+	t.Run("ServerSecrets", func(t *testing.T) { testServerSecrets(t, newStore(t)) })
+}
+
+func testIdentity(t *testing.T, store Store) {
+	if _, err := store.GetIdentity(); err == nil {
+		t.Errorf("Expected error before identity is set")
+	}
+
+	for _, name := range []string{"first", "second"} {
+		if err := store.SetIdentity(&models.Identity{ID: "5551234567", PublicKey: "pk", Name: name}); err != nil {
+			t.Fatalf("SetIdentity failed: %v", err)
+		}
+	}
+
+	identity, err := store.GetIdentity()
+	if err != nil {
+		t.Fatalf("GetIdentity failed: %v", err)
+	}
+	if identity.Name != "second" {
+		t.Errorf("Expected identity to be replaced, got %q", identity.Name)
+	}
+}
+
+func testAccounts(t *testing.T, store Store) {
+	account := &models.Account{Username: "alice", PasswordHash: "hash", DisplayName: "Alice", Desks: []string{}}
+	if err := store.CreateAccount(account); err != nil {
+		t.Fatalf("CreateAccount failed: %v", err)
+	}
+	if account.ID == "" {
+		t.Errorf("Expected account ID to be assigned")
+	}
+
+	if err := store.CreateAccount(&models.Account{Username: "alice"}); err == nil {
+		t.Errorf("Expected duplicate username to be rejected")
+	}
+
+	account.Desks = append(account.Desks, "5551234567")
+	account.ActiveDesk = "5551234567"
+	if err := store.UpdateAccount(account); err != nil {
+		t.Fatalf("UpdateAccount failed: %v", err)
+	}
+
+	byID, err := store.GetAccountByID(account.ID)
+	if err != nil {
+		t.Fatalf("GetAccountByID failed: %v", err)
+	}
+	byName, err := store.GetAccountByUsername("alice")
+	if err != nil {
+		t.Fatalf("GetAccountByUsername failed: %v", err)
+	}
+	for _, got := range []*models.Account{byID, byName} {
+		if got.ActiveDesk != "5551234567" || len(got.Desks) != 1 || got.PasswordHash != "hash" {
+			t.Errorf("Unexpected account: %+v", got)
+		}
+	}
+
+	if _, err := store.GetAccountByID("missing"); err == nil {
+		t.Errorf("Expected error for missing account")
+	}
+	if err := store.UpdateAccount(&models.Account{ID: "missing"}); err == nil {
+		t.Errorf("Expected error updating missing account")
+	}
+}
+
+func testSessions(t *testing.T, store Store) {
+	account := &models.Account{Username: "alice", Desks: []string{}}
+	store.CreateAccount(account)
+
+	now := time.Now()
+	live := &models.Session{TokenHash: "live", AccountID: account.ID, ExpiresAt: now.Add(time.Hour)}
+	stale := &models.Session{TokenHash: "stale", AccountID: account.ID, ExpiresAt: now.Add(-time.Hour)}
+	for _, session := range []*models.Session{live, stale} {
+		if err := store.CreateSession(session); err != nil {
+			t.Fatalf("CreateSession failed: %v", err)
+		}
+	}
+
+	if err := store.CreateSession(&models.Session{AccountID: account.ID}); err == nil {
+		t.Errorf("Expected session without token hash to be rejected")
+	}
+
+	got, err := store.GetSession("live")
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if got.AccountID != account.ID || !got.ExpiresAt.Equal(live.ExpiresAt) {
+		t.Errorf("Unexpected session: %+v", got)
+	}
+
+	ticket := &models.Session{TokenHash: "ticket", AccountID: account.ID, ExpiresAt: now.Add(time.Minute), Scope: "/api/desks/5551111111/events"}
+	if err := store.CreateSession(ticket); err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if got, err := store.GetSession("ticket"); err != nil || got.Scope != ticket.Scope {
+		t.Errorf("Expected the ticket's scope to be kept, got %+v (err %v)", got, err)
+	}
+
+	if err := store.DeleteExpiredSessions(now); err != nil {
+		t.Fatalf("DeleteExpiredSessions failed: %v", err)
+	}
+	if _, err := store.GetSession("stale"); err == nil {
+		t.Errorf("Expected expired session to be pruned")
+	}
+
+	if err := store.DeleteSession("live"); err != nil {
+		t.Fatalf("DeleteSession failed: %v", err)
+	}
+	if _, err := store.GetSession("live"); err == nil {
+		t.Errorf("Expected deleted session to be gone")
+	}
+
+	other := &models.Account{Username: "bob", Desks: []string{}}
+	store.CreateAccount(other)
+	store.CreateSession(&models.Session{TokenHash: "live", AccountID: account.ID, ExpiresAt: now.Add(time.Hour)})
+	store.CreateSession(&models.Session{TokenHash: "bob", AccountID: other.ID, ExpiresAt: now.Add(time.Hour)})
+	if err := store.DeleteAccountSessions(account.ID); err != nil {
+		t.Fatalf("DeleteAccountSessions failed: %v", err)
+	}
+	for _, tokenHash := range []string{"live", "ticket"} {
+		if _, err := store.GetSession(tokenHash); err == nil {
+			t.Errorf("Expected %s to be revoked with its account", tokenHash)
+		}
+	}
+	if _, err := store.GetSession("bob"); err != nil {
+		t.Errorf("Expected other accounts to keep their sessions: %v", err)
+	}
+}
+
+func testDesks(t *testing.T, store Store) {
+	var privateKey [32]byte
+	privateKey[0] = 42
+	signingKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+
+	desk := &models.Desk{ID: "5551234567", AccountID: "acc-1", PublicKey: "pk", SigningKey: "sk", Name: "Primary", AutoIndent: true, FontSize: "14px"}
+	if err := store.CreateDesk(desk, &DeskPrivateKeys{BoxKey: privateKey, SigningKey: signingKey}); err != nil {
+		t.Fatalf("CreateDesk failed: %v", err)
+	}
+	store.CreateDesk(&models.Desk{ID: "5559876543", AccountID: "acc-2", Name: "Other"}, nil)
+
+	got, err := store.GetDesk("(555) 123-4567")
+	if err != nil {
+		t.Fatalf("GetDesk with formatted ID failed: %v", err)
+	}
+	if got.Name != "Primary" || got.SigningKey != "sk" || !got.AutoIndent || got.FontSize != "14px" {
+		t.Errorf("Unexpected desk: %+v", got)
+	}
+
+	key, err := store.GetDeskPrivateKey(desk.ID, 0)
+	if err != nil || key != privateKey {
+		t.Errorf("Expected stored private key, got %v (err %v)", key, err)
+	}
+	if _, err := store.GetDeskPrivateKey("5559876543", 0); err == nil {
+		t.Errorf("Expected no private key for a client-keyed desk")
+	}
+	signing, err := store.GetDeskSigningPrivateKey(desk.ID, 0)
+	if err != nil || !signing.Equal(signingKey) {
+		t.Errorf("Expected stored signing key (err %v)", err)
+	}
+	if _, err := store.GetDeskSigningPrivateKey("5559876543", 0); err == nil {
+		t.Errorf("Expected no signing key for a client-keyed desk")
+	}
+
+	desks, _ := store.ListDesksByAccount("acc-1")
+	if len(desks) != 1 || desks[0].ID != desk.ID {
+		t.Errorf("Expected one desk for acc-1, got %+v", desks)
+	}
+
+	got.Name = "Renamed"
+	got.DisableReadReceipts = true
+	if err := store.UpdateDesk(got); err != nil {
+		t.Fatalf("UpdateDesk failed: %v", err)
+	}
+	got, _ = store.GetDesk(desk.ID)
+	if got.Name != "Renamed" || !got.DisableReadReceipts {
+		t.Errorf("Expected renamed desk with read receipts off, got %+v", got)
+	}
+
+	if err := store.UpdateDesk(&models.Desk{ID: "missing"}); err == nil {
+		t.Errorf("Expected error updating missing desk")
+	}
+}
+
+func testDeskKeyRotation(t *testing.T, store Store) {
+	first := [32]byte{1}
+	firstSigning := ed25519.NewKeyFromSeed(append(make([]byte, ed25519.SeedSize-1), 1))
+	desk := &models.Desk{ID: "5551234567", AccountID: "acc-1", PublicKey: "pk-1", SigningKey: "sk-1", Name: "Primary"}
+	if err := store.CreateDesk(desk, &DeskPrivateKeys{BoxKey: first, SigningKey: firstSigning}); err != nil {
+		t.Fatalf("CreateDesk failed: %v", err)
+	}
+	if desk.KeyVersion != 1 {
+		t.Errorf("Expected new desk at key version 1, got %d", desk.KeyVersion)
+	}
+
+	second := [32]byte{2}
+	secondSigning := ed25519.NewKeyFromSeed(append(make([]byte, ed25519.SeedSize-1), 2))
+	rotated, err := store.RotateDeskKey("555-123-4567", "pk-2", "sk-2", &DeskPrivateKeys{BoxKey: second, SigningKey: secondSigning})
+	if err != nil {
+		t.Fatalf("RotateDeskKey failed: %v", err)
+	}
+	if rotated.KeyVersion != 2 || rotated.PublicKey != "pk-2" || rotated.SigningKey != "sk-2" {
+		t.Errorf("Expected desk at version 2 with the new key, got %+v", rotated)
+	}
+
+	// Both versions stay available; only the new one is current
+	for version, expected := range map[int][32]byte{0: second, 1: first, 2: second} {
+		key, err := store.GetDeskPrivateKey(desk.ID, version)
+		if err != nil || key != expected {
+			t.Errorf("Expected private key for version %d, got %v (err %v)", version, key, err)
+		}
+	}
+	if _, err := store.GetDeskPrivateKey(desk.ID, 3); err == nil {
+		t.Errorf("Expected error for an unknown key version")
+	}
+	if signing, err := store.GetDeskSigningPrivateKey(desk.ID, 1); err != nil || !signing.Equal(firstSigning) {
+		t.Errorf("Expected retired signing key for version 1 (err %v)", err)
+	}
+
+	keys, _ := store.ListDeskKeys(desk.ID)
+	if len(keys) != 2 || keys[0].RetiredAt == nil || keys[1].RetiredAt != nil || keys[0].PublicKey != "pk-1" || keys[0].SigningKey != "sk-1" {
+		t.Fatalf("Expected retired v1 and current v2, got %+v", keys)
+	}
+	current, err := store.GetDeskKey(desk.ID, 0)
+	if err != nil || current.Version != 2 {
+		t.Errorf("Expected current key to be version 2, got %+v (err %v)", current, err)
+	}
+
+	// A client-held key leaves no private key on the server
+	if _, err := store.RotateDeskKey(desk.ID, "pk-3", "sk-3", nil); err != nil {
+		t.Fatalf("RotateDeskKey without private key failed: %v", err)
+	}
+	if _, err := store.GetDeskPrivateKey(desk.ID, 0); err == nil {
+		t.Errorf("Expected no private key for a client-held version")
+	}
+
+	// Settings updates never touch the key
+	got, _ := store.GetDesk(desk.ID)
+	got.Name = "Renamed"
+	got.PublicKey = "tampered"
+	got.SigningKey = "tampered"
+	store.UpdateDesk(got)
+	got, _ = store.GetDesk(desk.ID)
+	if got.PublicKey != "pk-3" || got.SigningKey != "sk-3" || got.KeyVersion != 3 {
+		t.Errorf("Expected UpdateDesk to leave keys alone, got %+v", got)
+	}
+
+	if _, err := store.RotateDeskKey("5550000000", "pk", "sk", nil); err == nil {
+		t.Errorf("Expected error rotating a missing desk")
+	}
+}
+
+func testConversations(t *testing.T, store Store) {
+	conv := &models.Conversation{Subject: "Hello", DeskID: "5551111111"}
+	fontSize := "16px"
+	first := &models.ConversationMiv{From: "5551111111", To: "555-222-2222",
+		Subject: "Hello", Body: "b1", State: models.StateSENT, FontSize: &fontSize}
+	if err := store.StartConversation(conv, first, nil); err != nil {
+		t.Fatalf("StartConversation failed: %v", err)
+	}
+	if conv.ID == "" || first.ConversationID != conv.ID {
+		t.Errorf("Expected ID to be assigned to the conversation and its miv, got %+v", conv)
+	}
+
+	reply := &models.ConversationMiv{ConversationID: conv.ID, From: "5552222222", To: "5551111111",
+		Subject: "Hello", Body: "b2", State: models.StateSENT, Signature: "sig"}
+	if err := store.CreateConversationMiv(reply); err != nil {
+		t.Fatalf("CreateConversationMiv failed: %v", err)
+	}
+	if first.SeqNo != 1 || reply.SeqNo != 2 {
+		t.Errorf("Expected sequence numbers 1 and 2, got %d and %d", first.SeqNo, reply.SeqNo)
+	}
+
+	if err := store.CreateConversationMiv(&models.ConversationMiv{ConversationID: "missing"}); err == nil {
+		t.Errorf("Expected error adding miv to missing conversation")
+	}
+
+	stored, _ := store.GetConversation(conv.ID)
+	if stored.MivCount != 2 {
+		t.Errorf("Expected miv count 2, got %d", stored.MivCount)
+	}
+
+	mivs, err := store.GetConversationMivs(conv.ID)
+	if err != nil || len(mivs) != 2 || mivs[0].ID != first.ID || mivs[1].ID != reply.ID {
+		t.Fatalf("Expected mivs in sequence order, got %+v (err %v)", mivs, err)
+	}
+	if mivs[0].FontSize == nil || *mivs[0].FontSize != "16px" || mivs[1].FontFamily != nil || mivs[1].Signature != "sig" {
+		t.Errorf("Expected optional fields to round-trip")
+	}
+
+	// The recipient finds the conversation even though To was stored formatted
+	for _, deskID := range []string{"5551111111", "5552222222"} {
+		convs, _ := store.ListConversationsByDesk(deskID)
+		if len(convs) != 1 || convs[0].ID != conv.ID {
+			t.Errorf("Expected conversation for desk %s, got %+v", deskID, convs)
+		}
+	}
+	if convs, _ := store.ListConversationsByDesk("5553333333"); len(convs) != 0 {
+		t.Errorf("Expected no conversations for outsider, got %+v", convs)
+	}
+
+	// Only the addressee can mark a miv as read
+	if err := store.MarkConversationMivAsRead(first.ID, "5551111111"); err == nil {
+		t.Errorf("Expected sender to be unable to mark own miv as read")
+	}
+	if err := store.MarkConversationMivAsRead(first.ID, "5552222222"); err != nil {
+		t.Fatalf("MarkConversationMivAsRead failed: %v", err)
+	}
+	got, _ := store.GetConversationMiv(first.ID)
+	if got.ReadAt == nil || got.State != models.StatePENDING {
+		t.Errorf("Expected read miv in PENDING, got %+v", got)
+	}
+
+	if err := store.MarkConversationMivsAsRead(conv.ID, "5551111111"); err != nil {
+		t.Fatalf("MarkConversationMivsAsRead failed: %v", err)
+	}
+	got, _ = store.GetConversationMiv(reply.ID)
+	if got.ReadAt == nil {
+		t.Errorf("Expected reply to be marked read")
+	}
+
+	got.IsForgotten = true
+	if err := store.UpdateConversationMiv(got); err != nil {
+		t.Fatalf("UpdateConversationMiv failed: %v", err)
+	}
+	got, _ = store.GetConversationMiv(reply.ID)
+	if !got.IsForgotten {
+		t.Errorf("Expected miv update to persist")
+	}
+
+	stored.IsArchived = true
+	if err := store.UpdateConversation(stored); err != nil {
+		t.Fatalf("UpdateConversation failed: %v", err)
+	}
+	stored, _ = store.GetConversation(conv.ID)
+	if !stored.IsArchived {
+		t.Errorf("Expected conversation update to persist")
+	}
+
+	if _, err := store.GetConversationMivs("missing"); err == nil {
+		t.Errorf("Expected error listing mivs of missing conversation")
+	}
+	if _, err := store.GetConversationMiv("missing"); err == nil {
+		t.Errorf("Expected error for missing miv")
+	}
+}
+
+func testStartConversation(t *testing.T, store Store) {
+	conv := &models.Conversation{Subject: "Hello", DeskID: "5551111111"}
+	miv := &models.ConversationMiv{SeqNo: 1, From: "5551111111", To: "555-222-2222",
+		Subject: "Hello", Body: "b1", State: models.StateSENT}
+	notif := &models.Notification{DeskID: "5552222222", Type: models.NotificationTypeNewMiv, Message: "New"}
+	if err := store.StartConversation(conv, miv, []*models.Notification{notif}); err != nil {
+		t.Fatalf("StartConversation failed: %v", err)
+	}
+	if miv.ConversationID != conv.ID || notif.ConversationID != conv.ID || notif.MivID != miv.ID {
+		t.Errorf("Expected linked IDs, got conv %+v miv %+v notif %+v", conv, miv, notif)
+	}
+	if conv.MivCount != 1 {
+		t.Errorf("Expected miv count 1, got %d", conv.MivCount)
+	}
+
+	// A failing notification must roll back the conversation and miv too
+	before, _ := store.ListConversationsByDesk("5553333333")
+	err := store.StartConversation(
+		&models.Conversation{Subject: "Orphan", DeskID: "5553333333"},
+		&models.ConversationMiv{From: "5553333333", To: "5554444444", Subject: "Orphan", State: models.StateSENT},
+		[]*models.Notification{{ID: notif.ID, DeskID: "5554444444", Type: models.NotificationTypeNewMiv}})
+	if err == nil {
+		t.Fatalf("Expected duplicate notification ID to fail")
+	}
+	after, _ := store.ListConversationsByDesk("5553333333")
+	if len(after) != len(before) {
+		t.Errorf("Expected no orphaned conversation, got %+v", after)
+	}
+	if notifs, _ := store.ListNotificationsByDesk("5554444444", false); len(notifs) != 0 {
+		t.Errorf("Expected no notification for failed conversation, got %+v", notifs)
+	}
+
+	// An explicit sequence number that is already taken is rejected
+	dup := &models.ConversationMiv{ConversationID: conv.ID, SeqNo: 1, From: "5552222222", To: "5551111111", State: models.StateSENT}
+	if err := store.CreateConversationMiv(dup); !errors.Is(err, ErrDuplicateSeqNo) {
+		t.Errorf("Expected ErrDuplicateSeqNo for a taken sequence number, got %v", err)
+	}
+	if dup.ID != "" {
+		t.Errorf("Expected no ID assigned to a rejected miv, got %q", dup.ID)
+	}
+}
+
+func testConversationRecipients(t *testing.T, store Store) {
+	conv := &models.Conversation{Subject: "Team", DeskID: "5551111111"}
+	miv := &models.ConversationMiv{SeqNo: 1, From: "5551111111", To: "555-222-2222", Subject: "Team", Body: "to-2", State: models.StateSENT,
+		Recipients: []*models.MivRecipient{
+			{DeskID: "555-222-2222", Role: models.ParticipantRoleTo},
+			{DeskID: "5553333333", Role: models.ParticipantRoleTo, Body: "to-3", KeyVersion: 2},
+			{DeskID: "5554444444", Role: models.ParticipantRoleCc, Body: "cc-4", KeyVersion: 1},
+		}}
+	notifs := []*models.Notification{
+		{DeskID: "5552222222", Type: models.NotificationTypeNewMiv, Message: "New"},
+		{DeskID: "5553333333", Type: models.NotificationTypeNewMiv, Message: "New"},
+		{DeskID: "5554444444", Type: models.NotificationTypeNewMiv, Message: "New"},
+	}
+	if err := store.StartConversation(conv, miv, notifs); err != nil {
+		t.Fatalf("StartConversation failed: %v", err)
+	}
+	for _, n := range notifs {
+		if n.ID == "" || n.MivID != miv.ID {
+			t.Errorf("Expected every notification to be linked, got %+v", n)
+		}
+	}
+
+	stored, _ := store.GetConversation(conv.ID)
+	if len(stored.Participants) != 4 || stored.Participants[0].DeskID != "5551111111" {
+		t.Fatalf("Expected creator and three recipients as participants, got %+v", stored.Participants)
+	}
+	roles := map[string]models.ParticipantRole{}
+	for _, p := range stored.Participants {
+		roles[p.DeskID] = p.Role
+	}
+	if roles["5552222222"] != models.ParticipantRoleTo || roles["5554444444"] != models.ParticipantRoleCc {
+		t.Errorf("Expected participant roles to follow the first miv, got %+v", roles)
+	}
+	for _, deskID := range []string{"5551111111", "5553333333", "5554444444"} {
+		if convs, _ := store.ListConversationsByDesk(deskID); len(convs) != 1 {
+			t.Errorf("Expected desk %s to find the conversation, got %d", deskID, len(convs))
+		}
+	}
+
+	got, _ := store.GetConversationMiv(miv.ID)
+	if len(got.Recipients) != 3 || got.Recipients[0].DeskID != "5552222222" || got.Recipients[2].Body != "cc-4" || got.Recipients[1].KeyVersion != 2 {
+		t.Fatalf("Expected recipients in order with their copies, got %+v", got.Recipients)
+	}
+
+	// Read state is tracked per recipient; only the To desk's shows on the miv.
+	// The CC desk reads with receipts off, which stays recorded on its read.
+	ccDesk := &models.Desk{ID: "5554444444", AccountID: "acc-4", PublicKey: "pk", Name: "CC", DisableReadReceipts: true}
+	if err := store.CreateDesk(ccDesk, nil); err != nil {
+		t.Fatalf("CreateDesk failed: %v", err)
+	}
+	if err := store.MarkConversationMivAsRead(miv.ID, "5554444444"); err != nil {
+		t.Fatalf("MarkConversationMivAsRead failed for a CC recipient: %v", err)
+	}
+	if err := store.MarkConversationMivAsRead(miv.ID, "5555555555"); err == nil {
+		t.Errorf("Expected a non-recipient to be unable to mark the miv read")
+	}
+	got, _ = store.GetConversationMiv(miv.ID)
+	if got.ReadAt != nil || got.Recipients[2].ReadAt == nil || got.Recipients[1].ReadAt != nil {
+		t.Errorf("Expected only the CC recipient to have read the miv, got %+v", got.Recipients)
+	}
+
+	ccDesk.DisableReadReceipts = false
+	store.UpdateDesk(ccDesk)
+	store.MarkConversationMivsAsRead(conv.ID, "5552222222")
+	mivs, _ := store.GetConversationMivs(conv.ID)
+	if mivs[0].ReadAt == nil || mivs[0].Recipients[0].ReadAt == nil || mivs[0].Recipients[1].ReadAt != nil {
+		t.Errorf("Expected the To desk's read to show on the miv and its recipient entry, got %+v", mivs[0].Recipients)
+	}
+	if mivs[0].Recipients[0].ReceiptWithheld || !mivs[0].Recipients[2].ReceiptWithheld {
+		t.Errorf("Expected only the CC desk's read to withhold its receipt, got %+v", mivs[0].Recipients)
+	}
+}
+
+func testConversationStates(t *testing.T, store Store) {
+	conv := &models.Conversation{Subject: "Hello", DeskID: "5551111111"}
+	miv := &models.ConversationMiv{SeqNo: 1, From: "5551111111", To: "5552222222", Subject: "Hello", Body: "aGk=", State: models.StateSENT}
+	if err := store.StartConversation(conv, miv, nil); err != nil {
+		t.Fatalf("StartConversation failed: %v", err)
+	}
+
+	// Participants start with no flags set, and the basket and last-read seq
+	// their mivs put them in
+	state, err := store.GetConversationState(conv.ID, "555-222-2222")
+	if err != nil {
+		t.Fatalf("GetConversationState failed: %v", err)
+	}
+	if state.DeskID != "5552222222" || state.IsArchived || state.IsMuted || state.IsPinned || state.LastReadSeq != 0 || state.Basket != models.StateIN {
+		t.Errorf("Expected an unread state, got %+v", state)
+	}
+
+	// Changes set only the flags they name; the rest follows the mivs
+	yes, no := true, false
+	state, changed, err := store.UpdateConversationState(conv.ID, "555-222-2222", ConversationStateChange{IsArchived: &yes, IsMuted: &yes})
+	if err != nil {
+		t.Fatalf("UpdateConversationState failed: %v", err)
+	}
+	if !changed || !state.IsArchived || !state.IsMuted || state.IsPinned || state.Basket != models.StateIN || state.UpdatedAt.IsZero() {
+		t.Errorf("Expected the changed state, got %+v (changed %v)", state, changed)
+	}
+	if _, changed, _ := store.UpdateConversationState(conv.ID, "5552222222", ConversationStateChange{IsMuted: &yes}); changed {
+		t.Errorf("Expected setting a flag it already has to change nothing")
+	}
+
+	// A muted desk's archive can be kept through a change that would lift it
+	state, _, _ = store.UpdateConversationState(conv.ID, "5552222222", ConversationStateChange{IsArchived: &no, KeepArchivedIfMuted: true})
+	if state == nil || !state.IsArchived {
+		t.Errorf("Expected the muted desk to stay archived, got %+v", state)
+	}
+
+	// Concurrent changes to one state all take effect
+	var wg sync.WaitGroup
+	for _, change := range []ConversationStateChange{{IsPinned: &yes}, {IsArchived: &yes}, {IsMuted: &yes}} {
+		wg.Add(1)
+		go func(change ConversationStateChange) {
+			defer wg.Done()
+			if _, _, err := store.UpdateConversationState(conv.ID, "5552222222", change); err != nil {
+				t.Errorf("UpdateConversationState failed: %v", err)
+			}
+		}(change)
+	}
+	wg.Wait()
+	if err := store.MarkConversationMivAsRead(miv.ID, "5552222222"); err != nil {
+		t.Fatalf("MarkConversationMivAsRead failed: %v", err)
+	}
+	got, _ := store.GetConversationState(conv.ID, "5552222222")
+	if !got.IsArchived || !got.IsMuted || !got.IsPinned || got.LastReadSeq != 1 || got.Basket != models.StatePENDING || got.UpdatedAt.IsZero() {
+		t.Errorf("Expected updated state, got %+v", got)
+	}
+
+	// Each participant's state is its own
+	sender, _ := store.GetConversationState(conv.ID, "5551111111")
+	if sender == nil || sender.IsArchived || sender.IsPinned || sender.LastReadSeq != 1 || sender.Basket != models.StateSENT {
+		t.Errorf("Expected the sender's state to be untouched, got %+v", sender)
+	}
+	page, _ := store.ListConversationPage("5551111111", ConversationQuery{})
+	if len(page) != 1 || *page[0].State != *sender {
+		t.Errorf("Expected the page to carry the sender's state, got %+v", page)
+	}
+
+	// A reply answers the read miv and waits in the replier's SENT
+	reply := &models.ConversationMiv{ConversationID: conv.ID, From: "5552222222", To: "5551111111", Subject: "Hello", Body: "aGk=", State: models.StateSENT}
+	if err := store.CreateConversationMiv(reply); err != nil {
+		t.Fatalf("CreateConversationMiv failed: %v", err)
+	}
+	for _, want := range []models.ConversationState{
+		{DeskID: "5551111111", LastReadSeq: 1, Basket: models.StateIN},
+		{DeskID: "5552222222", LastReadSeq: 2, Basket: models.StateSENT},
+	} {
+		if got, _ := store.GetConversationState(conv.ID, want.DeskID); got.Basket != want.Basket || got.LastReadSeq != want.LastReadSeq {
+			t.Errorf("Expected %s in %s having read up to %d, got %+v", want.DeskID, want.Basket, want.LastReadSeq, got)
+		}
+	}
+
+	if _, err := store.GetConversationState(conv.ID, "5559999999"); err == nil {
+		t.Errorf("Expected error for a desk outside the conversation")
+	}
+	if _, _, err := store.UpdateConversationState(conv.ID, "5559999999", ConversationStateChange{IsPinned: &yes}); err == nil {
+		t.Errorf("Expected error updating a desk outside the conversation")
+	}
+}
+
+func testBaskets(t *testing.T, store Store) {
+	expectBasket := func(deskID string, basket models.MivState, want ...*models.ConversationMiv) {
+		t.Helper()
+		got, err := store.ListBasket(deskID, basket)
+		if err != nil {
+			t.Fatalf("ListBasket failed: %v", err)
+		}
+		var gotIDs, wantIDs []string
+		for _, miv := range got {
+			gotIDs = append(gotIDs, miv.ID)
+		}
+		for _, miv := range want {
+			wantIDs = append(wantIDs, miv.ID)
+		}
+		if fmt.Sprint(gotIDs) != fmt.Sprint(wantIDs) {
+			t.Errorf("Expected %s of %s to hold %v, got %v", basket, deskID, wantIDs, gotIDs)
+		}
+	}
+
+	conv := &models.Conversation{Subject: "Plans", DeskID: "5551111111"}
+	first := &models.ConversationMiv{SeqNo: 1, From: "5551111111", To: "5552222222", Subject: "Plans", Body: "b25l", State: models.StateSENT,
+		CreatedAt: time.Now().Add(-time.Minute),
+		Recipients: []*models.MivRecipient{
+			{DeskID: "5552222222", Role: models.ParticipantRoleTo},
+			{DeskID: "5553333333", Role: models.ParticipantRoleCc, Body: "Y2M="},
+		}}
+	if err := store.StartConversation(conv, first, nil); err != nil {
+		t.Fatalf("StartConversation failed: %v", err)
+	}
+	expectBasket("5551111111", models.StateSENT, first)
+	expectBasket("555-222-2222", models.StateIN, first)
+	expectBasket("5553333333", models.StateIN, first)
+	expectBasket("5552222222", models.StatePENDING)
+
+	// Reading moves a miv from IN to PENDING for that recipient only
+	if err := store.MarkConversationMivAsRead(first.ID, "5552222222"); err != nil {
+		t.Fatalf("MarkConversationMivAsRead failed: %v", err)
+	}
+	expectBasket("5552222222", models.StateIN)
+	expectBasket("5552222222", models.StatePENDING, first)
+	expectBasket("5553333333", models.StateIN, first)
+
+	// A reply answers the miv for both its sender and its reader
+	reply := &models.ConversationMiv{ConversationID: conv.ID, From: "5552222222", To: "5551111111", Subject: "Plans", Body: "dHdv", State: models.StateSENT,
+		Recipients: []*models.MivRecipient{
+			{DeskID: "5551111111", Role: models.ParticipantRoleTo},
+			{DeskID: "5553333333", Role: models.ParticipantRoleCc, Body: "Y2M="},
+		}}
+	if err := store.CreateConversationMiv(reply); err != nil {
+		t.Fatalf("CreateConversationMiv failed: %v", err)
+	}
+	expectBasket("5551111111", models.StateSENT)
+	expectBasket("5551111111", models.StateIN, reply)
+	expectBasket("5552222222", models.StatePENDING)
+	expectBasket("5552222222", models.StateSENT, reply)
+	expectBasket("5553333333", models.StateIN, reply, first)
+
+	// A CC recipient that has not answered keeps the miv in PENDING
+	if err := store.MarkConversationMivsAsRead(conv.ID, "5553333333"); err != nil {
+		t.Fatalf("MarkConversationMivsAsRead failed: %v", err)
+	}
+	expectBasket("5553333333", models.StatePENDING, reply, first)
+
+	// Forgetting takes a miv out of SENT
+	stored, _ := store.GetConversationMiv(reply.ID)
+	stored.IsForgotten = true
+	if err := store.UpdateConversationMiv(stored); err != nil {
+		t.Fatalf("UpdateConversationMiv failed: %v", err)
+	}
+	expectBasket("5552222222", models.StateSENT)
+
+	// Archived conversations leave the other baskets for that desk only
+	archived := true
+	if _, _, err := store.UpdateConversationState(conv.ID, "5551111111", ConversationStateChange{IsArchived: &archived}); err != nil {
+		t.Fatalf("UpdateConversationState failed: %v", err)
+	}
+	expectBasket("5551111111", models.StateIN)
+	expectBasket("5551111111", models.StateARCHIVED, reply)
+	expectBasket("5553333333", models.StateARCHIVED)
+}
+
+func testFollowUps(t *testing.T, store Store) {
+	now := time.Now()
+	expectDue := func(want ...*models.ConversationMiv) {
+		t.Helper()
+		got, err := store.ListDueFollowUps(now)
+		if err != nil {
+			t.Fatalf("ListDueFollowUps failed: %v", err)
+		}
+		var gotIDs, wantIDs []string
+		for _, miv := range got {
+			gotIDs = append(gotIDs, miv.ID)
+		}
+		for _, miv := range want {
+			wantIDs = append(wantIDs, miv.ID)
+		}
+		if fmt.Sprint(gotIDs) != fmt.Sprint(wantIDs) {
+			t.Errorf("Expected follow-ups %v, got %v", wantIDs, gotIDs)
+		}
+	}
+	start := func(subject string, replyBy time.Time) (*models.Conversation, *models.ConversationMiv) {
+		t.Helper()
+		conv := &models.Conversation{Subject: subject, DeskID: "5551111111"}
+		miv := &models.ConversationMiv{SeqNo: 1, From: "5551111111", To: "5552222222", Subject: subject, Body: "Ym9keQ==",
+			State: models.StateSENT, ReplyBy: &replyBy}
+		if err := store.StartConversation(conv, miv, nil); err != nil {
+			t.Fatalf("StartConversation failed: %v", err)
+		}
+		return conv, miv
+	}
+
+	_, overdue := start("Overdue", now.Add(-time.Hour))
+	answeredConv, answered := start("Answered", now.Add(-2*time.Hour))
+	_, forgotten := start("Forgotten", now.Add(-3*time.Hour))
+	_, upcoming := start("Upcoming", now.Add(time.Hour))
+	expectDue(forgotten, answered, overdue)
+
+	got, err := store.GetConversationMiv(upcoming.ID)
+	if err != nil || got.ReplyBy == nil || !got.ReplyBy.Equal(*upcoming.ReplyBy) {
+		t.Errorf("Expected the reply deadline to be stored, got %+v (err %v)", got, err)
+	}
+
+	// A reply or forgetting the miv takes it out of SENT, and so off the list
+	reply := &models.ConversationMiv{ConversationID: answeredConv.ID, From: "5552222222", To: "5551111111",
+		Subject: "Answered", Body: "cmU=", State: models.StateSENT}
+	if err := store.CreateConversationMiv(reply); err != nil {
+		t.Fatalf("CreateConversationMiv failed: %v", err)
+	}
+	forgotten.IsForgotten = true
+	if err := store.UpdateConversationMiv(forgotten); err != nil {
+		t.Fatalf("UpdateConversationMiv failed: %v", err)
+	}
+	expectDue(overdue)
+
+	// A miv is followed up once, until its deadline is set again
+	if claimed, err := store.ClaimFollowUp(overdue.ID, now); err != nil || !claimed {
+		t.Fatalf("ClaimFollowUp failed: %v (claimed %v)", err, claimed)
+	}
+	if claimed, err := store.ClaimFollowUp(overdue.ID, now); err != nil || claimed {
+		t.Errorf("Expected a follow-up to be claimed once, got %v (err %v)", claimed, err)
+	}
+	if _, err := store.ClaimFollowUp("missing", now); err == nil {
+		t.Errorf("Expected error claiming the follow-up of a missing miv")
+	}
+	expectDue()
+	if got, _ := store.GetConversationMiv(overdue.ID); got.FollowUpAt == nil {
+		t.Errorf("Expected the follow-up time to be stored")
+	}
+	earlier := now.Add(-time.Minute)
+	if err := store.SetMivReplyBy(overdue.ID, &earlier); err != nil {
+		t.Fatalf("SetMivReplyBy failed: %v", err)
+	}
+	expectDue(overdue)
+	if err := store.SetMivReplyBy(overdue.ID, nil); err != nil {
+		t.Fatalf("Clearing the reply deadline failed: %v", err)
+	}
+	expectDue()
+	if err := store.SetMivReplyBy("missing", nil); err == nil {
+		t.Errorf("Expected error setting the deadline of a missing miv")
+	}
+}
+
+func testPagination(t *testing.T, store Store) {
+	expectConversations := func(deskID string, q ConversationQuery, want ...*models.Conversation) []*models.ConversationWithLatest {
+		t.Helper()
+		got, err := store.ListConversationPage(deskID, q)
+		if err != nil {
+			t.Fatalf("ListConversationPage failed: %v", err)
+		}
+		var gotIDs, wantIDs []string
+		for _, item := range got {
+			gotIDs = append(gotIDs, item.Conversation.ID)
+		}
+		for _, conv := range want {
+			wantIDs = append(wantIDs, conv.ID)
+		}
+		if fmt.Sprint(gotIDs) != fmt.Sprint(wantIDs) {
+			t.Errorf("Expected conversations %v for %s, got %v", wantIDs, deskID, gotIDs)
+		}
+		return got
+	}
+
+	var convs []*models.Conversation
+	for _, to := range []string{"5552222222", "5553333333", "5552222222"} {
+		conv := &models.Conversation{Subject: "Hello", DeskID: "5551111111"}
+		miv := &models.ConversationMiv{SeqNo: 1, From: "5551111111", To: to, Subject: "Hello", Body: "aGk=", State: models.StateSENT}
+		if err := store.StartConversation(conv, miv, nil); err != nil {
+			t.Fatalf("StartConversation failed: %v", err)
+		}
+		convs = append(convs, conv)
+	}
+	first, second, third := convs[0], convs[1], convs[2]
+
+	// Pinned conversations come first, then the most recently started
+	pinned := true
+	store.UpdateConversationState(first.ID, "5551111111", ConversationStateChange{IsPinned: &pinned})
+
+	page := expectConversations("5551111111", ConversationQuery{Limit: 2}, first, third)
+	if page[0].LatestMiv == nil || page[0].LatestMiv.ConversationID != first.ID || len(page[0].Conversation.Participants) != 2 || !page[0].State.IsPinned {
+		t.Errorf("Expected the latest miv, participants and state with each conversation, got %+v", page[0])
+	}
+	after := ConversationCursor(page[1])
+	expectConversations("5551111111", ConversationQuery{After: &after, Limit: 2}, second)
+	after = ConversationCursor(page[0])
+	expectConversations("5551111111", ConversationQuery{After: &after}, third, second)
+
+	expectConversations("5551111111", ConversationQuery{Counterpart: "555-333-3333"}, second)
+	expectConversations("5551111111", ConversationQuery{Since: page[1].Conversation.UpdatedAt}, third)
+	expectConversations("5551111111", ConversationQuery{Until: page[1].Conversation.UpdatedAt}, first, second)
+
+	// Unread counts and the unread-only filter are per desk
+	if err := store.MarkConversationMivsAsRead(third.ID, "5552222222"); err != nil {
+		t.Fatalf("MarkConversationMivsAsRead failed: %v", err)
+	}
+	if page := expectConversations("5552222222", ConversationQuery{UnreadOnly: true}, first); len(page) == 1 && page[0].UnreadCount != 1 {
+		t.Errorf("Expected one unread miv, got %d", page[0].UnreadCount)
+	}
+	expectConversations("5551111111", ConversationQuery{UnreadOnly: true})
+
+	archived, open := true, false
+	store.UpdateConversationState(second.ID, "5551111111", ConversationStateChange{IsArchived: &archived})
+	expectConversations("5551111111", ConversationQuery{Archived: &archived}, second)
+	expectConversations("5551111111", ConversationQuery{Archived: &open}, first, third)
+	expectConversations("5553333333", ConversationQuery{Archived: &open}, second)
+
+	// A reply arriving while the desk pages does not move its conversation
+	// onto a page already fetched
+	page = expectConversations("5551111111", ConversationQuery{Limit: 2}, first, third)
+	if err := store.CreateConversationMiv(&models.ConversationMiv{ConversationID: second.ID, From: "5553333333", To: "5551111111",
+		Subject: "Hello", Body: "aGk=", State: models.StateSENT}); err != nil {
+		t.Fatalf("CreateConversationMiv failed: %v", err)
+	}
+	after = ConversationCursor(page[1])
+	expectConversations("5551111111", ConversationQuery{After: &after}, second)
+
+	// Notifications page newest first
+	var notifs []*models.Notification
+	for i := 0; i < 3; i++ {
+		notif := &models.Notification{DeskID: "5551111111", Type: models.NotificationTypeNewMiv, MivID: "cmiv-1", Message: "m",
+			CreatedAt: time.Now().Add(time.Duration(i-3) * time.Minute)}
+		if err := store.CreateNotification(notif); err != nil {
+			t.Fatalf("CreateNotification failed: %v", err)
+		}
+		notifs = append(notifs, notif)
+	}
+	store.MarkNotificationAsRead(notifs[2].ID)
+
+	gotNotifs, _ := store.ListNotificationPage("5551111111", NotificationQuery{Limit: 2})
+	if len(gotNotifs) != 2 || gotNotifs[0].ID != notifs[2].ID || gotNotifs[1].ID != notifs[1].ID {
+		t.Fatalf("Expected the two newest notifications, got %+v", gotNotifs)
+	}
+	after = NotificationCursor(gotNotifs[1])
+	if gotNotifs, _ = store.ListNotificationPage("5551111111", NotificationQuery{After: &after, Limit: 2}); len(gotNotifs) != 1 || gotNotifs[0].ID != notifs[0].ID {
+		t.Errorf("Expected the oldest notification on the next page, got %+v", gotNotifs)
+	}
+	if gotNotifs, _ = store.ListNotificationPage("5551111111", NotificationQuery{UnreadOnly: true, Since: notifs[1].CreatedAt}); len(gotNotifs) != 1 || gotNotifs[0].ID != notifs[1].ID {
+		t.Errorf("Expected the unread notification since the second, got %+v", gotNotifs)
+	}
+	if count, _ := store.CountUnreadNotifications("5551111111"); count != 2 {
+		t.Errorf("Expected 2 unread notifications, got %d", count)
+	}
+
+	// Contacts page oldest first
+	var contacts []*models.Contact
+	for _, name := range []string{"Bob", "Carol", "Dave"} {
+		contact := &models.Contact{DeskID: "5551111111", Name: name, DeskIDRef: "5552222222"}
+		if err := store.CreateContact(contact); err != nil {
+			t.Fatalf("CreateContact failed: %v", err)
+		}
+		contacts = append(contacts, contact)
+	}
+	gotContacts, _ := store.ListContactPage("5551111111", ContactQuery{Limit: 2})
+	if len(gotContacts) != 2 || gotContacts[0].ID != contacts[0].ID || gotContacts[1].ID != contacts[1].ID {
+		t.Fatalf("Expected the two oldest contacts, got %+v", gotContacts)
+	}
+	after = ContactCursor(gotContacts[1])
+	if gotContacts, _ = store.ListContactPage("5551111111", ContactQuery{After: &after, Limit: 2}); len(gotContacts) != 1 || gotContacts[0].ID != contacts[2].ID {
+		t.Errorf("Expected the last contact on the next page, got %+v", gotContacts)
+	}
+}
+
+func testConcurrentReplies(t *testing.T, store Store) {
+	conv := &models.Conversation{Subject: "Busy", DeskID: "5551111111"}
+	if err := store.StartConversation(conv, &models.ConversationMiv{From: "5551111111", To: "5552222222",
+		Subject: "Busy", Body: "b", State: models.StateSENT}, nil); err != nil {
+		t.Fatalf("StartConversation failed: %v", err)
+	}
+
+	const replies = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, replies)
+	for i := 0; i < replies; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- store.CreateConversationMiv(&models.ConversationMiv{ConversationID: conv.ID,
+				From: "5551111111", To: "5552222222", Subject: "Busy", Body: "b", State: models.StateSENT})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Concurrent CreateConversationMiv failed: %v", err)
+		}
+	}
+
+	mivs, _ := store.GetConversationMivs(conv.ID)
+	if len(mivs) != replies+1 {
+		t.Fatalf("Expected %d mivs, got %d", replies+1, len(mivs))
+	}
+	for i, miv := range mivs {
+		if miv.SeqNo != i+1 {
+			t.Errorf("Expected sequence numbers 1..%d without gaps, got %d at position %d", replies+1, miv.SeqNo, i)
+		}
+	}
+	if stored, _ := store.GetConversation(conv.ID); stored.MivCount != replies+1 {
+		t.Errorf("Expected miv count %d, got %d", replies+1, stored.MivCount)
+	}
+}
+
+func testNotifications(t *testing.T, store Store) {
+	for i := 0; i < 3; i++ {
+		notif := &models.Notification{DeskID: "5551111111", Type: models.NotificationTypeNewMiv, MivID: "cmiv-1", Message: "m"}
+		if err := store.CreateNotification(notif); err != nil {
+			t.Fatalf("CreateNotification failed: %v", err)
+		}
+	}
+
+	all, _ := store.ListNotificationsByDesk("5551111111", false)
+	if len(all) != 3 {
+		t.Fatalf("Expected 3 notifications, got %d", len(all))
+	}
+
+	if err := store.MarkNotificationAsRead(all[0].ID); err != nil {
+		t.Fatalf("MarkNotificationAsRead failed: %v", err)
+	}
+	got, _ := store.GetNotification(all[0].ID)
+	if !got.Read || got.ReadAt == nil {
+		t.Errorf("Expected notification to be read, got %+v", got)
+	}
+
+	unread, _ := store.ListNotificationsByDesk("5551111111", true)
+	if len(unread) != 2 {
+		t.Errorf("Expected 2 unread notifications, got %d", len(unread))
+	}
+
+	if none, _ := store.ListNotificationsByDesk("5559999999", false); len(none) != 0 {
+		t.Errorf("Expected no notifications for other desk, got %d", len(none))
+	}
+	if err := store.MarkNotificationAsRead("missing"); err == nil {
+		t.Errorf("Expected error for missing notification")
+	}
+
+	readAt := time.Now().Add(-time.Minute)
+	receipt := &models.Notification{DeskID: "5551111111", Type: models.NotificationTypeReadReceipt, MivID: "cmiv-1", Message: "r", MivReadAt: &readAt}
+	store.CreateNotification(receipt)
+	got, _ = store.GetNotification(receipt.ID)
+	if got.MivReadAt == nil || !got.MivReadAt.Equal(readAt) {
+		t.Errorf("Expected read receipt to keep the miv read time, got %+v", got)
+	}
+}
+
+func testEvents(t *testing.T, store Store) {
+	if oldest, latest, err := store.EventSeqRange(); err != nil || oldest != 0 || latest != 0 {
+		t.Fatalf("Expected an empty log, got %d-%d (err %v)", oldest, latest, err)
+	}
+
+	first := []*models.Event{
+		{Type: models.EventTypeNotification, DeskID: "5551111111", Data: map[string]string{"id": "notif-1"}},
+		{Type: models.EventTypeNotification, DeskID: "5552222222", Data: map[string]string{"id": "notif-2"}},
+	}
+	if err := store.AppendEvents(first); err != nil {
+		t.Fatalf("AppendEvents failed: %v", err)
+	}
+	second := []*models.Event{{Type: models.EventTypeMivRead, DeskID: "5551111111", Data: map[string]string{"id": "miv-1"}}}
+	if err := store.AppendEvents(second); err != nil {
+		t.Fatalf("AppendEvents failed: %v", err)
+	}
+	if first[0].Seq == 0 || first[1].Seq != first[0].Seq+1 || second[0].Seq != first[1].Seq+1 {
+		t.Fatalf("Expected consecutive sequence numbers, got %d %d %d", first[0].Seq, first[1].Seq, second[0].Seq)
+	}
+
+	events, err := store.ListEvents(first[0].Seq, 10)
+	if err != nil {
+		t.Fatalf("ListEvents failed: %v", err)
+	}
+	if len(events) != 2 || events[0].Seq != first[1].Seq || events[1].Seq != second[0].Seq {
+		t.Fatalf("Expected the events after the first, oldest first, got %+v", events)
+	}
+	if data, ok := events[1].Data.(json.RawMessage); !ok || string(data) != `{"id":"miv-1"}` || events[1].Type != models.EventTypeMivRead {
+		t.Errorf("Expected the event's data as JSON, got %+v", events[1])
+	}
+	if events, _ := store.ListEvents(0, 1); len(events) != 1 || events[0].Seq != first[0].Seq {
+		t.Errorf("Expected the limit to apply, got %+v", events)
+	}
+
+	desk, err := store.ListDeskEvents("5551111111", 0, first[1].Seq)
+	if err != nil {
+		t.Fatalf("ListDeskEvents failed: %v", err)
+	}
+	if len(desk) != 1 || desk[0].Seq != first[0].Seq {
+		t.Errorf("Expected the desk's events up to the limit, got %+v", desk)
+	}
+
+	if oldest, latest, _ := store.EventSeqRange(); oldest != first[0].Seq || latest != second[0].Seq {
+		t.Errorf("Expected the range %d-%d, got %d-%d", first[0].Seq, second[0].Seq, oldest, latest)
+	}
+	if err := store.DeleteEventsBefore(time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("DeleteEventsBefore failed: %v", err)
+	}
+	if oldest, latest, _ := store.EventSeqRange(); oldest != 0 || latest != 0 {
+		t.Errorf("Expected the log to be emptied, got %d-%d", oldest, latest)
+	}
+
+	// Numbers keep counting after the log is emptied
+	third := []*models.Event{{Type: models.EventTypeNotification, DeskID: "5551111111", Data: nil}}
+	store.AppendEvents(third)
+	if third[0].Seq <= second[0].Seq {
+		t.Errorf("Expected sequence numbers never to be reused, got %d", third[0].Seq)
+	}
+}
+
+func testContacts(t *testing.T, store Store) {
+	contact := &models.Contact{DeskID: "5551111111", Name: "Bob", FirstName: "Bob", DeskIDRef: "5552222222"}
+	if err := store.CreateContact(contact); err != nil {
+		t.Fatalf("CreateContact failed: %v", err)
+	}
+
+	update := &models.Contact{ID: contact.ID, FirstName: "Robert", GreetingName: "Rob", Notes: "n"}
+	if err := store.UpdateContact(update); err != nil {
+		t.Fatalf("UpdateContact failed: %v", err)
+	}
+
+	got, err := store.GetContact(contact.ID)
+	if err != nil {
+		t.Fatalf("GetContact failed: %v", err)
+	}
+	// Empty Name and DeskIDRef keep their previous values; other fields are replaced
+	if got.Name != "Bob" || got.DeskIDRef != "5552222222" || got.FirstName != "Robert" || got.GreetingName != "Rob" || got.Notes != "n" {
+		t.Errorf("Unexpected contact after update: %+v", got)
+	}
+
+	pinnedAt := time.Now()
+	got.PinnedFingerprint = "12345 67890"
+	got.PinnedAt = &pinnedAt
+	if err := store.UpdateContact(got); err != nil {
+		t.Fatalf("UpdateContact with pin failed: %v", err)
+	}
+	got, _ = store.GetContact(contact.ID)
+	if got.PinnedFingerprint != "12345 67890" || got.PinnedAt == nil || !got.PinnedAt.Equal(pinnedAt) {
+		t.Errorf("Expected pinned fingerprint to round-trip, got %+v", got)
+	}
+
+	byRef, err := store.GetContactByDeskIDRef("5551111111", "5552222222")
+	if err != nil || byRef.ID != contact.ID {
+		t.Errorf("Expected contact by desk ref, got %+v (err %v)", byRef, err)
+	}
+
+	contacts, _ := store.ListContactsForDesk("5551111111")
+	if len(contacts) != 1 {
+		t.Errorf("Expected 1 contact, got %d", len(contacts))
+	}
+
+	if err := store.DeleteContact(contact.ID); err != nil {
+		t.Fatalf("DeleteContact failed: %v", err)
+	}
+	if contacts, _ := store.ListContactsForDesk("5551111111"); len(contacts) != 0 {
+		t.Errorf("Expected no contacts after delete, got %d", len(contacts))
+	}
+	if err := store.DeleteContact(contact.ID); err == nil {
+		t.Errorf("Expected error deleting missing contact")
+	}
+}
+
+func testKeyBackups(t *testing.T, store Store) {
+	if _, err := store.GetKeyBackup("5551234567"); err == nil {
+		t.Errorf("Expected error before a backup exists")
+	}
+
+	backup := &models.KeyBackup{DeskID: "5551234567", Blob: "blob-1"}
+	if err := store.SaveKeyBackup(backup, 1); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected conflict rotating a missing backup, got %v", err)
+	}
+	if err := store.SaveKeyBackup(backup, 0); err != nil {
+		t.Fatalf("SaveKeyBackup failed: %v", err)
+	}
+	if backup.Version != 1 || backup.CreatedAt.IsZero() {
+		t.Errorf("Expected version 1 with timestamps, got %+v", backup)
+	}
+	if err := store.SaveKeyBackup(&models.KeyBackup{DeskID: "5551234567", Blob: "again"}, 0); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected conflict uploading over an existing backup, got %v", err)
+	}
+
+	rotated := &models.KeyBackup{DeskID: "5551234567", Blob: "blob-2"}
+	if err := store.SaveKeyBackup(rotated, 1); err != nil {
+		t.Fatalf("Rotating backup failed: %v", err)
+	}
+	if err := store.SaveKeyBackup(&models.KeyBackup{DeskID: "5551234567", Blob: "stale"}, 1); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected conflict rotating from a stale version, got %v", err)
+	}
+
+	got, err := store.GetKeyBackup("5551234567")
+	if err != nil || got.Version != 2 || got.Blob != "blob-2" {
+		t.Fatalf("Expected rotated backup, got %+v (err %v)", got, err)
+	}
+
+	if err := store.DeleteKeyBackup("5551234567"); err != nil {
+		t.Fatalf("DeleteKeyBackup failed: %v", err)
+	}
+	if _, err := store.GetKeyBackup("5551234567"); err == nil {
+		t.Errorf("Expected deleted backup to be gone")
+	}
+	if err := store.DeleteKeyBackup("5551234567"); err == nil {
+		t.Errorf("Expected error deleting a missing backup")
+	}
+}
+
+func testScheduledMivs(t *testing.T, store Store) {
+	now := time.Now()
+	font := "serif"
+	later := &models.ScheduledMiv{DeskID: "5551111111", To: "5552222222", Subject: "Later", Body: "sealed-1",
+		FontFamily: &font, SendAt: now.Add(time.Hour), KeyVersion: 1, AttachmentIDs: []string{"att-1", "att-2"}}
+	soon := &models.ScheduledMiv{DeskID: "5551111111", ConversationID: "conv-1", Body: "sealed-2", IsAck: true,
+		SendAt: now.Add(-time.Minute), KeyVersion: 1}
+	other := &models.ScheduledMiv{DeskID: "5553333333", To: "5551111111", Subject: "Other", Body: "sealed-3",
+		SendAt: now.Add(-time.Hour), KeyVersion: 2}
+	for _, sched := range []*models.ScheduledMiv{later, soon, other} {
+		if err := store.CreateScheduledMiv(sched); err != nil {
+			t.Fatalf("CreateScheduledMiv failed: %v", err)
+		}
+	}
+	if later.ID == "" || later.State != models.StateSCHEDULED || later.CreatedAt.IsZero() {
+		t.Errorf("Expected ID, SCHEDULED state and timestamps, got %+v", later)
+	}
+
+	got, err := store.GetScheduledMiv(later.ID)
+	if err != nil {
+		t.Fatalf("GetScheduledMiv failed: %v", err)
+	}
+	if got.To != "5552222222" || got.Body != "sealed-1" || got.FontFamily == nil || *got.FontFamily != "serif" ||
+		!got.SendAt.Equal(later.SendAt) || got.KeyVersion != 1 || got.State != models.StateSCHEDULED ||
+		fmt.Sprint(got.AttachmentIDs) != "[att-1 att-2]" {
+		t.Errorf("Expected stored scheduled miv, got %+v", got)
+	}
+
+	desk, err := store.ListScheduledMivs("5551111111")
+	if err != nil {
+		t.Fatalf("ListScheduledMivs failed: %v", err)
+	}
+	if len(desk) != 2 || desk[0].ID != soon.ID || desk[1].ID != later.ID {
+		t.Errorf("Expected the desk's scheduled mivs soonest first, got %+v", desk)
+	}
+
+	due, err := store.ListDueScheduledMivs(now)
+	if err != nil {
+		t.Fatalf("ListDueScheduledMivs failed: %v", err)
+	}
+	if len(due) != 2 || due[0].ID != other.ID || due[1].ID != soon.ID {
+		t.Errorf("Expected every desk's due mivs soonest first, got %+v", due)
+	}
+
+	// A failed delivery leaves the dispatcher alone until the miv is edited
+	other.Error = "Recipient desk '5551111111' does not exist"
+	other.DeskID = "ignored"
+	if err := store.UpdateScheduledMiv(other); err != nil {
+		t.Fatalf("UpdateScheduledMiv failed: %v", err)
+	}
+	if other.DeskID != "5553333333" {
+		t.Errorf("Expected update to keep the desk, got %s", other.DeskID)
+	}
+	due, err = store.ListDueScheduledMivs(now)
+	if err != nil || len(due) != 1 || due[0].ID != soon.ID {
+		t.Errorf("Expected failed miv to be left out of due mivs, got %+v (err %v)", due, err)
+	}
+
+	if err := store.DeleteScheduledMiv(soon.ID); err != nil {
+		t.Fatalf("DeleteScheduledMiv failed: %v", err)
+	}
+	if _, err := store.GetScheduledMiv(soon.ID); err == nil {
+		t.Errorf("Expected deleted scheduled miv to be gone")
+	}
+	if err := store.DeleteScheduledMiv(soon.ID); err == nil {
+		t.Errorf("Expected error deleting a missing scheduled miv")
+	}
+	if err := store.UpdateScheduledMiv(&models.ScheduledMiv{ID: "missing"}); err == nil {
+		t.Errorf("Expected error updating a missing scheduled miv")
+	}
+}
+
+func testScheduledMivClaims(t *testing.T, store Store) {
+	now := time.Now()
+	sealed := &models.ScheduledMiv{DeskID: "5551111111", NewConversationID: "conv-chosen-by-client", To: "5552222222,5553333333",
+		Subject: "Sealed", Body: "sealed-to-bob", IsEncrypted: true, RecipientKeyVersion: 2,
+		Bodies: map[string]string{"5553333333": "sealed-to-carol"}, KeyVersions: map[string]int{"5553333333": 1},
+		Signature: "signed", SendAt: now.Add(-time.Minute)}
+	if err := store.CreateScheduledMiv(sealed); err != nil {
+		t.Fatalf("CreateScheduledMiv failed: %v", err)
+	}
+	got, err := store.GetScheduledMiv(sealed.ID)
+	if err != nil || !got.IsEncrypted || got.NewConversationID != "conv-chosen-by-client" || got.RecipientKeyVersion != 2 ||
+		got.Bodies["5553333333"] != "sealed-to-carol" || got.KeyVersions["5553333333"] != 1 || got.Signature != "signed" || got.ClaimedAt != nil {
+		t.Fatalf("Expected the client-sealed fields to be stored, got %+v (err %v)", got, err)
+	}
+
+	// Only one dispatcher claims a due miv, and only once it is due
+	if claimed, err := store.ClaimScheduledMiv(sealed.ID, now.Add(-time.Hour), now.Add(-2*time.Hour)); err != nil || claimed {
+		t.Errorf("Expected a miv not yet due to stay unclaimed, got %v (err %v)", claimed, err)
+	}
+	if claimed, err := store.ClaimScheduledMiv(sealed.ID, now, now.Add(-time.Minute)); err != nil || !claimed {
+		t.Fatalf("ClaimScheduledMiv failed: %v (claimed %v)", err, claimed)
+	}
+	if claimed, err := store.ClaimScheduledMiv(sealed.ID, now, now.Add(-time.Minute)); err != nil || claimed {
+		t.Errorf("Expected a claimed miv not to be claimed again, got %v (err %v)", claimed, err)
+	}
+
+	// The sender cannot edit or cancel it meanwhile
+	got.Subject = "Edited"
+	if err := store.UpdateScheduledMiv(got); !errors.Is(err, ErrScheduledMivClaimed) {
+		t.Errorf("Expected editing a claimed miv to fail with ErrScheduledMivClaimed, got %v", err)
+	}
+	if err := store.DeleteScheduledMiv(sealed.ID); !errors.Is(err, ErrScheduledMivClaimed) {
+		t.Errorf("Expected cancelling a claimed miv to fail with ErrScheduledMivClaimed, got %v", err)
+	}
+
+	// A failed delivery is released with its reason and waits for an edit
+	if err := store.ReleaseScheduledMiv(sealed.ID, "Key of desk '5553333333' has been rotated"); err != nil {
+		t.Fatalf("ReleaseScheduledMiv failed: %v", err)
+	}
+	if claimed, _ := store.ClaimScheduledMiv(sealed.ID, now, now.Add(-time.Minute)); claimed {
+		t.Errorf("Expected a failed miv not to be claimed")
+	}
+	got, _ = store.GetScheduledMiv(sealed.ID)
+	got.Error = ""
+	if err := store.UpdateScheduledMiv(got); err != nil {
+		t.Fatalf("UpdateScheduledMiv failed: %v", err)
+	}
+
+	// A claim left by a dispatcher that stopped is taken over once stale
+	if claimed, _ := store.ClaimScheduledMiv(sealed.ID, now, now.Add(-time.Minute)); !claimed {
+		t.Fatalf("Expected the edited miv to be claimed")
+	}
+	later := now.Add(10 * time.Minute)
+	if claimed, err := store.ClaimScheduledMiv(sealed.ID, later, later.Add(-5*time.Minute)); err != nil || !claimed {
+		t.Errorf("Expected a stale claim to be taken over, got %v (err %v)", claimed, err)
+	}
+
+	if err := store.FinishScheduledMiv(sealed.ID); err != nil {
+		t.Fatalf("FinishScheduledMiv failed: %v", err)
+	}
+	if _, err := store.GetScheduledMiv(sealed.ID); err == nil {
+		t.Errorf("Expected a delivered miv to be gone")
+	}
+	if claimed, err := store.ClaimScheduledMiv(sealed.ID, later, later); err != nil || claimed {
+		t.Errorf("Expected a missing miv not to be claimed, got %v (err %v)", claimed, err)
+	}
+	if err := store.ReleaseScheduledMiv(sealed.ID, ""); err == nil {
+		t.Errorf("Expected error releasing a missing scheduled miv")
+	}
+}
+
+func testDrafts(t *testing.T, store Store) {
+	first := &models.Draft{DeskID: "5551111111", To: "5552222222", Subject: "Plans", Body: "Half written"}
+	reply := &models.Draft{DeskID: "5551111111", ConversationID: "conv-1", Body: "Thanks", IsAck: true}
+	other := &models.Draft{DeskID: "5553333333", Body: "Not yours"}
+	for _, draft := range []*models.Draft{first, reply, other} {
+		if err := store.CreateDraft(draft); err != nil {
+			t.Fatalf("CreateDraft failed: %v", err)
+		}
+	}
+	if first.ID == "" || first.Version != 1 || first.CreatedAt.IsZero() {
+		t.Errorf("Expected an ID, version 1 and timestamps, got %+v", first)
+	}
+
+	// Saving bumps the version and moves the draft to the top of the list
+	font := "serif"
+	saved := &models.Draft{ID: first.ID, DeskID: "ignored", ConversationID: "ignored", To: "5552222222",
+		Subject: "Plans", Body: "Fully written", IsEncrypted: true, KeyVersion: 3, FontFamily: &font}
+	if err := store.UpdateDraft(saved, 1); err != nil {
+		t.Fatalf("UpdateDraft failed: %v", err)
+	}
+	if saved.Version != 2 || saved.DeskID != "5551111111" || saved.ConversationID != "" {
+		t.Errorf("Expected version 2 keeping the desk and conversation, got %+v", saved)
+	}
+	if err := store.UpdateDraft(&models.Draft{ID: first.ID, Body: "Stale"}, 1); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected conflict saving from a stale version, got %v", err)
+	}
+	if err := store.UpdateDraft(&models.Draft{ID: "missing"}, 1); err == nil || errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected not found updating a missing draft, got %v", err)
+	}
+
+	got, err := store.GetDraft(first.ID)
+	if err != nil {
+		t.Fatalf("GetDraft failed: %v", err)
+	}
+	if got.Version != 2 || got.Body != "Fully written" || !got.IsEncrypted || got.KeyVersion != 3 ||
+		got.FontFamily == nil || *got.FontFamily != "serif" {
+		t.Errorf("Expected the saved draft, got %+v", got)
+	}
+
+	drafts, err := store.ListDrafts("5551111111")
+	if err != nil {
+		t.Fatalf("ListDrafts failed: %v", err)
+	}
+	if len(drafts) != 2 || drafts[0].ID != first.ID || drafts[1].ID != reply.ID || !drafts[1].IsAck {
+		t.Errorf("Expected the desk's drafts most recently saved first, got %+v", drafts)
+	}
+
+	// Deleting at a version leaves a draft saved since alone
+	if err := store.DeleteDraft(first.ID, 1); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected conflict deleting from a stale version, got %v", err)
+	}
+	if err := store.DeleteDraft(first.ID, 2); err != nil {
+		t.Fatalf("DeleteDraft failed: %v", err)
+	}
+	if err := store.DeleteDraft(reply.ID, 0); err != nil {
+		t.Fatalf("DeleteDraft failed: %v", err)
+	}
+	for _, id := range []string{first.ID, reply.ID} {
+		if _, err := store.GetDraft(id); err == nil {
+			t.Errorf("Expected deleted draft %s to be gone", id)
+		}
+	}
+	if err := store.DeleteDraft(reply.ID, 0); err == nil || errors.Is(err, ErrVersionConflict) {
+		t.Errorf("Expected not found deleting a missing draft, got %v", err)
+	}
+}
+
+func testAttachments(t *testing.T, store Store) {
+	upload := func(deskID, filename string, size int64) *models.Attachment {
+		t.Helper()
+		att := &models.Attachment{DeskID: deskID, Filename: filename, ContentType: "application/pdf", Size: size,
+			Checksum: "c0ffee", StorageKey: filename + "-key"}
+		if err := store.CreateAttachment(att, 0); err != nil {
+			t.Fatalf("CreateAttachment failed: %v", err)
+		}
+		return att
+	}
+	report := upload("5551111111", "report.pdf", 300)
+	notes := upload("5551111111", "notes.pdf", 200)
+	foreign := upload("5552222222", "theirs.pdf", 1000)
+
+	got, err := store.GetAttachment(report.ID)
+	if err != nil {
+		t.Fatalf("GetAttachment failed: %v", err)
+	}
+	if got.Filename != "report.pdf" || got.Size != 300 || got.StorageKey != "report.pdf-key" || got.MivID != "" || got.CreatedAt.IsZero() {
+		t.Errorf("Expected a stored pending attachment, got %+v", got)
+	}
+	if used, err := store.DeskAttachmentUsage("5551111111"); err != nil || used != 500 {
+		t.Errorf("Expected 500 bytes used, got %d (err %v)", used, err)
+	}
+
+	// Re-encoded images keep their dimensions and thumbnails
+	photo := &models.Attachment{DeskID: "5553333333", Filename: "photo.jpg", ContentType: "image/jpeg", Size: 900,
+		Checksum: "c0ffee", StorageKey: "photo-key", Width: 2000, Height: 1000,
+		Thumbnails: []models.Thumbnail{{Name: "small", ContentType: "image/jpeg", Width: 160, Height: 80, Size: 90, StorageKey: "photo-small"}}}
+	if err := store.CreateAttachment(photo, 0); err != nil {
+		t.Fatalf("CreateAttachment failed: %v", err)
+	}
+	got, err = store.GetAttachment(photo.ID)
+	if err != nil {
+		t.Fatalf("GetAttachment failed: %v", err)
+	}
+	if got.Width != 2000 || got.Height != 1000 || len(got.Thumbnails) != 1 || got.Thumbnails[0] != photo.Thumbnails[0] {
+		t.Errorf("Expected the image's dimensions and thumbnails, got %+v", got)
+	}
+	if got, _ := store.GetAttachment(report.ID); len(got.Thumbnails) != 0 {
+		t.Errorf("Expected no thumbnails for a PDF, got %+v", got.Thumbnails)
+	}
+
+	// Only the sender's pending attachments can go with a miv, all or none
+	conv := &models.Conversation{Subject: "Files", DeskID: "5551111111"}
+	miv := &models.ConversationMiv{SeqNo: 1, From: "5551111111", To: "5552222222", Subject: "Files", Body: "Ym9keQ==",
+		State: models.StateSENT, Attachments: []*models.Attachment{report, foreign}}
+	if err := store.StartConversation(conv, miv, nil); !errors.Is(err, ErrAttachmentUnavailable) {
+		t.Fatalf("Expected another desk's attachment to be unavailable, got %v", err)
+	}
+	if convs, _ := store.ListConversationsByDesk("5551111111"); len(convs) != 0 {
+		t.Fatalf("Expected no conversation left behind, got %d", len(convs))
+	}
+
+	conv = &models.Conversation{Subject: "Files", DeskID: "5551111111"}
+	miv = &models.ConversationMiv{SeqNo: 1, From: "5551111111", To: "5552222222", Subject: "Files", Body: "Ym9keQ==",
+		State: models.StateSENT, Attachments: []*models.Attachment{notes, report}}
+	if err := store.StartConversation(conv, miv, nil); err != nil {
+		t.Fatalf("StartConversation failed: %v", err)
+	}
+	mivs, err := store.GetConversationMivs(conv.ID)
+	if err != nil {
+		t.Fatalf("GetConversationMivs failed: %v", err)
+	}
+	if len(mivs[0].Attachments) != 2 || mivs[0].Attachments[0].ID != notes.ID || mivs[0].Attachments[1].ID != report.ID {
+		t.Fatalf("Expected the miv's attachments in order, got %+v", mivs[0].Attachments)
+	}
+	if got, _ := store.GetAttachment(report.ID); got.MivID != miv.ID || got.ConversationID != conv.ID {
+		t.Errorf("Expected the attachment linked to its miv, got %+v", got)
+	}
+
+	// A sent attachment is linked by later mivs, which reference its blob,
+	// and cannot be deleted
+	if links, err := store.ListAttachmentLinks(report.ID); err != nil || len(links) != 0 {
+		t.Errorf("Expected no links yet, got %v (err %v)", links, err)
+	}
+	reply := &models.ConversationMiv{ConversationID: conv.ID, From: "5552222222", To: "5551111111", Subject: "Files",
+		Body: "YWdhaW4=", State: models.StateSENT, Attachments: []*models.Attachment{report}}
+	if err := store.CreateConversationMiv(reply); err != nil {
+		t.Fatalf("Expected a sent attachment to be linked, got %v", err)
+	}
+	mivs, _ = store.GetConversationMivs(conv.ID)
+	if len(mivs) != 2 || len(mivs[1].Attachments) != 1 || mivs[1].Attachments[0].ID != report.ID || mivs[1].Attachments[0].MivID != miv.ID {
+		t.Fatalf("Expected the reply to link the attachment, got %+v", mivs[1].Attachments)
+	}
+	if links, err := store.ListAttachmentLinks(report.ID); err != nil || len(links) != 1 || links[0] != conv.ID {
+		t.Errorf("Expected the reply's conversation to link the attachment, got %v (err %v)", links, err)
+	}
+	if blob, err := store.GetBlob(report.StorageKey); err != nil || blob.Refs != 2 {
+		t.Errorf("Expected the attachment and the link to reference the blob, got %+v (err %v)", blob, err)
+	}
+	if err := store.DeleteAttachment(report.ID); err == nil {
+		t.Errorf("Expected deleting a sent attachment to fail")
+	}
+	if used, err := store.DeskAttachmentUsage("5553333333"); err != nil || used != 990 {
+		t.Errorf("Expected thumbnails to count towards usage, got %d (err %v)", used, err)
+	}
+
+	list, err := store.ListAttachments("5551111111")
+	if err != nil {
+		t.Fatalf("ListAttachments failed: %v", err)
+	}
+	if len(list) != 2 || list[0].ID != notes.ID || list[1].ID != report.ID {
+		t.Errorf("Expected the desk's attachments newest first, got %+v", list)
+	}
+
+	if err := store.DeleteAttachment(foreign.ID); err != nil {
+		t.Fatalf("DeleteAttachment failed: %v", err)
+	}
+	if _, err := store.GetAttachment(foreign.ID); err == nil {
+		t.Errorf("Expected the deleted attachment to be gone")
+	}
+}
+
+func testAttachmentQuota(t *testing.T, store Store) {
+	// Uploads racing for the last of a quota cannot all get in
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			att := &models.Attachment{DeskID: "5551111111", Filename: "part.pdf", ContentType: "application/pdf", Size: 100,
+				Checksum: "c0ffee", StorageKey: fmt.Sprintf("part-%d", i)}
+			errs[i] = store.CreateAttachment(att, 500)
+		}(i)
+	}
+	wg.Wait()
+
+	var created int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case !errors.Is(err, ErrQuotaExceeded):
+			t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+		}
+	}
+	if used, _ := store.DeskAttachmentUsage("5551111111"); created != 5 || used != 500 {
+		t.Errorf("Expected 5 uploads filling the quota, got %d using %d bytes", created, used)
+	}
+
+	// Thumbnails count, and other desks have quotas of their own
+	photo := &models.Attachment{DeskID: "5552222222", Filename: "photo.jpg", ContentType: "image/jpeg", Size: 450,
+		Checksum: "c0ffee", StorageKey: "photo-key", Thumbnails: []models.Thumbnail{{Name: "small", Size: 90, StorageKey: "photo-small"}}}
+	if err := store.CreateAttachment(photo, 500); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected the thumbnail to take the photo over quota, got %v", err)
+	}
+	photo.Thumbnails[0].Size = 50
+	if err := store.CreateAttachment(photo, 500); err != nil {
+		t.Errorf("Expected the photo to fit another desk's quota, got %v", err)
+	}
+}
+
+func testBlobs(t *testing.T, store Store) {
+	// An upload holds a blob, stores it and then creates its attachment
+	if stored, err := store.HoldBlob("logo", 100); err != nil || stored {
+		t.Fatalf("Expected a new blob to need storing, got %v %v", stored, err)
+	}
+	if err := store.MarkBlobStored("logo"); err != nil {
+		t.Fatalf("MarkBlobStored failed: %v", err)
+	}
+	if stored, err := store.HoldBlob("logo", 100); err != nil || !stored {
+		t.Fatalf("Expected a stored blob to be reused, got %v %v", stored, err)
+	}
+	if err := store.MarkBlobStored("missing"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Expected marking an unknown blob to fail, got %v", err)
+	}
+
+	attach := func(key string) *models.Attachment {
+		t.Helper()
+		att := &models.Attachment{DeskID: "5551111111", Filename: "logo.png", ContentType: "image/png", Size: 100,
+			Checksum: key, StorageKey: key,
+			Thumbnails: []models.Thumbnail{{Name: "small", ContentType: "image/png", Size: 10, StorageKey: key + "-small"}}}
+		if err := store.CreateAttachment(att, 0); err != nil {
+			t.Fatalf("CreateAttachment failed: %v", err)
+		}
+		return att
+	}
+	first := attach("logo")
+	second := attach("logo")
+	if blob, err := store.GetBlob("logo"); err != nil || blob.Refs != 2 || !blob.Stored {
+		t.Fatalf("Expected two references to the blob, got %+v (err %v)", blob, err)
+	}
+	if blob, err := store.GetBlob("logo-small"); err != nil || blob.Refs != 2 || blob.Size != 10 {
+		t.Fatalf("Expected two references to the thumbnail, got %+v (err %v)", blob, err)
+	}
+
+	later := time.Now().Add(time.Hour)
+	if released, _ := store.ListReleasedBlobs(later); len(released) != 0 {
+		t.Errorf("Expected referenced blobs to be kept, got %+v", released)
+	}
+	if claimed, err := store.ClaimBlob("logo", 100, later); err != nil || claimed {
+		t.Errorf("Expected a referenced blob not to be claimed, got %v %v", claimed, err)
+	}
+
+	store.DeleteAttachment(first.ID)
+	if blob, _ := store.GetBlob("logo"); blob.Refs != 1 {
+		t.Errorf("Expected one reference left, got %+v", blob)
+	}
+	store.DeleteAttachment(second.ID)
+
+	// Released blobs wait out the grace period
+	earlier := time.Now().Add(-time.Hour)
+	if released, _ := store.ListReleasedBlobs(earlier); len(released) != 0 {
+		t.Errorf("Expected released blobs to wait for the grace period, got %+v", released)
+	}
+	if claimed, _ := store.ClaimBlob("logo", 100, earlier); claimed {
+		t.Errorf("Expected a recently released blob not to be claimed")
+	}
+	released, err := store.ListReleasedBlobs(later)
+	if err != nil || len(released) != 2 || released[0].Key != "logo" || released[1].Key != "logo-small" {
+		t.Fatalf("Expected both released blobs, got %+v (err %v)", released, err)
+	}
+
+	if claimed, err := store.ClaimBlob("logo", 100, later); err != nil || !claimed {
+		t.Fatalf("Expected the released blob to be claimed, got %v %v", claimed, err)
+	}
+	if _, err := store.HoldBlob("logo", 100); !errors.Is(err, ErrBlobBusy) {
+		t.Errorf("Expected a claimed blob to be busy, got %v", err)
+	}
+	if err := store.CreateAttachment(&models.Attachment{DeskID: "5551111111", Filename: "logo.png", StorageKey: "logo", Size: 100}, 0); !errors.Is(err, ErrBlobBusy) {
+		t.Errorf("Expected an attachment of a claimed blob to fail, got %v", err)
+	}
+	if list, _ := store.ListAttachments("5551111111"); len(list) != 0 {
+		t.Errorf("Expected no attachment left behind, got %+v", list)
+	}
+
+	// Blobs without a record can be claimed too
+	if claimed, err := store.ClaimBlob("orphan", 5, earlier); err != nil || !claimed {
+		t.Errorf("Expected an unknown blob to be claimed, got %v %v", claimed, err)
+	}
+	if released, _ := store.ListReleasedBlobs(earlier); len(released) != 2 || released[0].Key != "logo" || released[1].Key != "orphan" {
+		t.Errorf("Expected claimed blobs to be listed, got %+v", released)
+	}
+
+	if err := store.DeleteBlobRecord("logo-small"); err == nil {
+		t.Errorf("Expected deleting an unclaimed blob record to fail")
+	}
+	if err := store.DeleteBlobRecord("logo"); err != nil {
+		t.Fatalf("DeleteBlobRecord failed: %v", err)
+	}
+	if _, err := store.GetBlob("logo"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("Expected the record to be gone, got %v", err)
+	}
+}
+
+func testServerSecrets(t *testing.T, store Store) {
+	first, err := store.ServerSecret("file-key", 32)
+	if err != nil || len(first) != 32 {
+		t.Fatalf("Expected a 32-byte secret, got %d bytes (err %v)", len(first), err)
+	}
+	again, err := store.ServerSecret("file-key", 32)
+	if err != nil || !bytes.Equal(again, first) {
+		t.Errorf("Expected the secret to be kept, got %x (err %v)", again, err)
+	}
+	if other, _ := store.ServerSecret("other", 32); bytes.Equal(other, first) {
+		t.Errorf("Expected each name to get its own secret")
+	}
+}
@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -9,31 +12,44 @@ import (
 	"github.com/jadefox10200/missiv/backend/internal/models"
 )
 
-// MemoryStorage provides in-memory storage for mivs and identities
-// This is a simple implementation for initial setup. In production, use a database.
+// MemoryStorage provides in-memory storage for accounts, desks and their
+// conversations. This is a simple implementation for initial setup. In
+// production, use a database.
 type MemoryStorage struct {
-	// Legacy single-user fields (kept for backward compatibility)
-	mivs       map[string]*models.Miv
-	identity   *models.Identity
-	mivCounter int
+	// Legacy single-user identity (kept for backward compatibility)
+	identity *models.Identity
 
 	// Multi-user account fields
 	accounts            map[string]*models.Account           // accountID -> Account
 	accountsByUsername  map[string]*models.Account           // username -> Account
 	desks               map[string]*models.Desk              // deskID -> Desk
-	deskPrivateKeys     map[string][32]byte                  // deskID -> PrivateKey
+	deskKeys            map[string][]*deskKeyRecord          // deskID -> keys by version (index = version-1)
 	conversations       map[string]*models.Conversation      // conversationID -> Conversation
 	conversationMivs    map[string][]*models.ConversationMiv // conversationID -> []Miv
+	conversationStates  map[string]*models.ConversationState // conversationID/deskID -> participant's own state
 	notifications       map[string]*models.Notification      // notificationID -> Notification
 	notificationsByDesk map[string][]*models.Notification    // deskID -> []Notification
 	contacts            map[string]*models.Contact           // contactID -> Contact
 	contactsByDesk      map[string][]*models.Contact         // deskID -> []Contact
+	sessions            map[string]*models.Session           // token hash -> Session
+	keyBackups          map[string]*models.KeyBackup         // deskID -> KeyBackup
+	scheduledMivs       map[string]*models.ScheduledMiv      // scheduledID -> ScheduledMiv
+	drafts              map[string]*models.Draft             // draftID -> Draft
+	attachments         map[string]*models.Attachment        // attachmentID -> Attachment
+	blobs               map[string]*models.Blob              // storage key -> Blob
+	attachmentLinks     map[string][]string                  // attachmentID -> conversations with a miv that links it
+	secrets             map[string][]byte                    // name -> server secret
+	events              []*models.Event                      // event log, oldest first
 
 	accountCounter         int
 	conversationCounter    int
 	conversationMivCounter int
 	notificationCounter    int
 	contactCounter         int
+	scheduledCounter       int
+	draftCounter           int
+	attachmentCounter      int
+	eventSeq               int64
 
 	mu sync.RWMutex
 }
@@ -41,25 +57,39 @@ type MemoryStorage struct {
 // NewMemoryStorage creates a new memory storage instance
 func NewMemoryStorage() *MemoryStorage {
 	return &MemoryStorage{
-		mivs:                make(map[string]*models.Miv),
 		accounts:            make(map[string]*models.Account),
 		accountsByUsername:  make(map[string]*models.Account),
 		desks:               make(map[string]*models.Desk),
-		deskPrivateKeys:     make(map[string][32]byte),
+		deskKeys:            make(map[string][]*deskKeyRecord),
 		conversations:       make(map[string]*models.Conversation),
 		conversationMivs:    make(map[string][]*models.ConversationMiv),
+		conversationStates:  make(map[string]*models.ConversationState),
 		notifications:       make(map[string]*models.Notification),
 		notificationsByDesk: make(map[string][]*models.Notification),
 		contacts:            make(map[string]*models.Contact),
 		contactsByDesk:      make(map[string][]*models.Contact),
+		sessions:            make(map[string]*models.Session),
+		keyBackups:          make(map[string]*models.KeyBackup),
+		scheduledMivs:       make(map[string]*models.ScheduledMiv),
+		drafts:              make(map[string]*models.Draft),
+		attachments:         make(map[string]*models.Attachment),
+		blobs:               make(map[string]*models.Blob),
+		attachmentLinks:     make(map[string][]string),
+		secrets:             make(map[string][]byte),
 	}
 }
 
+// Close is a no-op for in-memory storage
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
 // SetIdentity sets the current user identity
-func (s *MemoryStorage) SetIdentity(identity *models.Identity) {
+func (s *MemoryStorage) SetIdentity(identity *models.Identity) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.identity = identity
+	return nil
 }
 
 // GetIdentity returns the current user identity
@@ -74,92 +104,6 @@ func (s *MemoryStorage) GetIdentity() (*models.Identity, error) {
 	return s.identity, nil
 }
 
-// CreateMiv creates a new miv
-func (s *MemoryStorage) CreateMiv(miv *models.Miv) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if miv.ID == "" {
-		s.mivCounter++
-		miv.ID = fmt.Sprintf("miv-%d", s.mivCounter)
-	}
-
-	if miv.CreatedAt.IsZero() {
-		miv.CreatedAt = time.Now()
-	}
-
-	s.mivs[miv.ID] = miv
-	return nil
-}
-
-// GetMiv retrieves a miv by ID
-func (s *MemoryStorage) GetMiv(id string) (*models.Miv, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	miv, exists := s.mivs[id]
-	if !exists {
-		return nil, fmt.Errorf("miv not found: %s", id)
-	}
-
-	return miv, nil
-}
-
-// ListMivs returns all mivs, optionally filtered by state
-func (s *MemoryStorage) ListMivs(state models.MivState) ([]*models.Miv, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	var result []*models.Miv
-
-	for _, miv := range s.mivs {
-		if state == "" || miv.State == state {
-			result = append(result, miv)
-		}
-	}
-
-	return result, nil
-}
-
-// UpdateMivState updates the state of a miv
-func (s *MemoryStorage) UpdateMivState(id string, state models.MivState) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	miv, exists := s.mivs[id]
-	if !exists {
-		return fmt.Errorf("miv not found: %s", id)
-	}
-
-	miv.State = state
-
-	// Update timestamps based on state
-	now := time.Now()
-	switch state {
-	case models.StateOUT:
-		miv.SentAt = &now
-	case models.StateIN:
-		if miv.ReceivedAt == nil {
-			miv.ReceivedAt = &now
-		}
-	}
-
-	return nil
-}
-
-// DeleteMiv deletes a miv (for cleanup, though mivs are meant to be immutable)
-func (s *MemoryStorage) DeleteMiv(id string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if _, exists := s.mivs[id]; !exists {
-		return fmt.Errorf("miv not found: %s", id)
-	}
-
-	delete(s.mivs, id)
-	return nil
-}
-
 // Account methods
 
 // CreateAccount creates a new account
@@ -227,22 +171,172 @@ func (s *MemoryStorage) UpdateAccount(account *models.Account) error {
 	return nil
 }
 
+// Session methods
+
+// CreateSession stores a new session keyed by its token hash
+func (s *MemoryStorage) CreateSession(session *models.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session.TokenHash == "" {
+		return fmt.Errorf("session token hash is required")
+	}
+
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = time.Now()
+	}
+
+	s.sessions[session.TokenHash] = session
+	return nil
+}
+
+// GetSession retrieves a session by token hash
+func (s *MemoryStorage) GetSession(tokenHash string) (*models.Session, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, exists := s.sessions[tokenHash]
+	if !exists {
+		return nil, fmt.Errorf("session not found")
+	}
+
+	return session, nil
+}
+
+// DeleteSession removes a session
+func (s *MemoryStorage) DeleteSession(tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.sessions[tokenHash]; !exists {
+		return fmt.Errorf("session not found")
+	}
+
+	delete(s.sessions, tokenHash)
+	return nil
+}
+
+// DeleteAccountSessions removes every session and ticket of an account
+func (s *MemoryStorage) DeleteAccountSessions(accountID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for tokenHash, session := range s.sessions {
+		if session.AccountID == accountID {
+			delete(s.sessions, tokenHash)
+		}
+	}
+
+	return nil
+}
+
+// DeleteExpiredSessions removes all sessions that expired before the given time
+func (s *MemoryStorage) DeleteExpiredSessions(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for tokenHash, session := range s.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(s.sessions, tokenHash)
+		}
+	}
+
+	return nil
+}
+
 // Desk methods
 
-// CreateDesk creates a new desk
-func (s *MemoryStorage) CreateDesk(desk *models.Desk, privateKey [32]byte) error {
+// deskKeyRecord is one version of a desk's keys; private is nil when the
+// client holds the private halves
+type deskKeyRecord struct {
+	key     *models.DeskKey
+	private *DeskPrivateKeys
+}
+
+// CreateDesk creates a new desk with key version 1. Nil privateKeys means
+// the keys were generated by the client and the server never holds the
+// private halves.
+func (s *MemoryStorage) CreateDesk(desk *models.Desk, privateKeys *DeskPrivateKeys) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if desk.CreatedAt.IsZero() {
 		desk.CreatedAt = time.Now()
 	}
+	desk.KeyVersion = 1
 
 	s.desks[desk.ID] = desk
-	s.deskPrivateKeys[desk.ID] = privateKey
+	s.deskKeys[desk.ID] = []*deskKeyRecord{{
+		key:     &models.DeskKey{DeskID: desk.ID, Version: 1, PublicKey: desk.PublicKey, SigningKey: desk.SigningKey, CreatedAt: desk.CreatedAt},
+		private: privateKeys,
+	}}
 	return nil
 }
 
+// RotateDeskKey retires the desk's current keys and makes the given ones
+// current under the next version. Retired keys stay available so older mivs
+// can still be opened and verified.
+func (s *MemoryStorage) RotateDeskKey(deskID string, publicKey, signingKey string, privateKeys *DeskPrivateKeys) (*models.Desk, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	desk, exists := s.desks[crypto.NormalizeDeskID(deskID)]
+	if !exists {
+		return nil, fmt.Errorf("desk not found: %s", deskID)
+	}
+
+	now := time.Now()
+	keys := s.deskKeys[desk.ID]
+	if len(keys) > 0 {
+		keys[len(keys)-1].key.RetiredAt = &now
+	}
+
+	desk.KeyVersion = len(keys) + 1
+	desk.PublicKey = publicKey
+	desk.SigningKey = signingKey
+	s.deskKeys[desk.ID] = append(keys, &deskKeyRecord{
+		key:     &models.DeskKey{DeskID: desk.ID, Version: desk.KeyVersion, PublicKey: publicKey, SigningKey: signingKey, CreatedAt: now},
+		private: privateKeys,
+	})
+	return desk, nil
+}
+
+// GetDeskKey retrieves one version of a desk's public key; version 0 means current
+func (s *MemoryStorage) GetDeskKey(deskID string, version int) (*models.DeskKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, err := s.deskKeyLocked(deskID, version)
+	if err != nil {
+		return nil, err
+	}
+	return record.key, nil
+}
+
+// ListDeskKeys returns every version of a desk's public key, oldest first
+func (s *MemoryStorage) ListDeskKeys(deskID string) ([]*models.DeskKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var result []*models.DeskKey
+	for _, record := range s.deskKeys[crypto.NormalizeDeskID(deskID)] {
+		result = append(result, record.key)
+	}
+	return result, nil
+}
+
+// deskKeyLocked looks up a key version; the caller must hold s.mu
+func (s *MemoryStorage) deskKeyLocked(deskID string, version int) (*deskKeyRecord, error) {
+	keys := s.deskKeys[crypto.NormalizeDeskID(deskID)]
+	if version == 0 {
+		version = len(keys)
+	}
+	if version < 1 || version > len(keys) {
+		return nil, fmt.Errorf("desk key not found: %s v%d", deskID, version)
+	}
+	return keys[version-1], nil
+}
+
 // GetDesk retrieves a desk by ID
 func (s *MemoryStorage) GetDesk(id string) (*models.Desk, error) {
 	s.mu.RLock()
@@ -259,17 +353,32 @@ func (s *MemoryStorage) GetDesk(id string) (*models.Desk, error) {
 	return desk, nil
 }
 
-// GetDeskPrivateKey retrieves a desk's private key
-func (s *MemoryStorage) GetDeskPrivateKey(id string) ([32]byte, error) {
+// GetDeskPrivateKey retrieves one version of a desk's private key; version 0
+// means current
+func (s *MemoryStorage) GetDeskPrivateKey(id string, version int) ([32]byte, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	key, exists := s.deskPrivateKeys[id]
-	if !exists {
+	record, err := s.deskKeyLocked(id, version)
+	if err != nil || record.private == nil {
 		return [32]byte{}, fmt.Errorf("desk private key not found: %s", id)
 	}
 
-	return key, nil
+	return record.private.BoxKey, nil
+}
+
+// GetDeskSigningPrivateKey retrieves one version of a desk's signing key;
+// version 0 means current
+func (s *MemoryStorage) GetDeskSigningPrivateKey(id string, version int) (ed25519.PrivateKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, err := s.deskKeyLocked(id, version)
+	if err != nil || record.private == nil || record.private.SigningKey == nil {
+		return nil, fmt.Errorf("desk signing key not found: %s", id)
+	}
+
+	return record.private.SigningKey, nil
 }
 
 // ListDesksByAccount retrieves all desks for an account
@@ -296,17 +405,62 @@ func (s *MemoryStorage) UpdateDesk(desk *models.Desk) error {
 		return fmt.Errorf("desk not found: %s", desk.ID)
 	}
 
+	// Keys only change through RotateDeskKey
+	if keys := s.deskKeys[desk.ID]; len(keys) > 0 {
+		desk.PublicKey = keys[len(keys)-1].key.PublicKey
+		desk.SigningKey = keys[len(keys)-1].key.SigningKey
+		desk.KeyVersion = len(keys)
+	}
 	s.desks[desk.ID] = desk
 	return nil
 }
 
 // Conversation methods
 
-// CreateConversation creates a new conversation
-func (s *MemoryStorage) CreateConversation(conv *models.Conversation) error {
+// StartConversation writes a new conversation, its first miv and the
+// recipients' notifications atomically
+func (s *MemoryStorage) StartConversation(conv *models.Conversation, miv *models.ConversationMiv, notifs []*models.Notification) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// Validate everything up front so a failure leaves nothing behind
+	if conv.ID != "" {
+		if _, exists := s.conversations[conv.ID]; exists {
+			return fmt.Errorf("conversation already exists: %s", conv.ID)
+		}
+	}
+	for _, notif := range notifs {
+		if notif.ID != "" {
+			if _, exists := s.notifications[notif.ID]; exists {
+				return fmt.Errorf("notification already exists: %s", notif.ID)
+			}
+		}
+	}
+	if err := s.checkAttachmentsLocked(miv); err != nil {
+		return err
+	}
+
+	if err := s.createConversationLocked(conv); err != nil {
+		return err
+	}
+
+	miv.ConversationID = conv.ID
+	if err := s.createConversationMivLocked(miv); err != nil {
+		return err
+	}
+
+	for _, notif := range notifs {
+		notif.ConversationID = conv.ID
+		notif.MivID = miv.ID
+		if err := s.createNotificationLocked(notif); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createConversationLocked stores a conversation; the caller must hold s.mu
+func (s *MemoryStorage) createConversationLocked(conv *models.Conversation) error {
 	if conv.ID == "" {
 		s.conversationCounter++
 		conv.ID = fmt.Sprintf("conv-%d", s.conversationCounter)
@@ -317,11 +471,32 @@ func (s *MemoryStorage) CreateConversation(conv *models.Conversation) error {
 	}
 	conv.UpdatedAt = conv.CreatedAt
 
+	given := conv.Participants
+	conv.Participants = nil
+	addParticipant(conv, conv.DeskID, models.ParticipantRoleTo, conv.CreatedAt)
+	for _, p := range given {
+		addParticipant(conv, p.DeskID, p.Role, conv.CreatedAt)
+	}
+
 	s.conversations[conv.ID] = conv
 	s.conversationMivs[conv.ID] = []*models.ConversationMiv{}
 	return nil
 }
 
+// addParticipant adds a desk to a conversation unless it already takes part
+func addParticipant(conv *models.Conversation, deskID string, role models.ParticipantRole, joinedAt time.Time) {
+	deskID = crypto.NormalizeDeskID(deskID)
+	if deskID == "" {
+		return
+	}
+	for _, p := range conv.Participants {
+		if p.DeskID == deskID {
+			return
+		}
+	}
+	conv.Participants = append(conv.Participants, &models.ConversationParticipant{DeskID: deskID, Role: role, JoinedAt: joinedAt})
+}
+
 // GetConversation retrieves a conversation by ID
 func (s *MemoryStorage) GetConversation(id string) (*models.Conversation, error) {
 	s.mu.RLock()
@@ -340,37 +515,63 @@ func (s *MemoryStorage) ListConversationsByDesk(deskID string) ([]*models.Conver
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	// Use a map to track unique conversations (avoid duplicates)
-	conversationMap := make(map[string]*models.Conversation)
-
-	// First, add conversations created by this desk
+	normalizedDeskID := crypto.NormalizeDeskID(deskID)
+	var result []*models.Conversation
 	for _, conv := range s.conversations {
-		if conv.DeskID == deskID {
-			conversationMap[conv.ID] = conv
+		for _, p := range conv.Participants {
+			if p.DeskID == normalizedDeskID {
+				result = append(result, conv)
+				break
+			}
 		}
 	}
 
-	// Then, add conversations where this desk is a participant (sent to or received from)
-	for convID, mivs := range s.conversationMivs {
+	return result, nil
+}
+
+// ListConversationPage returns one page of a desk's conversations
+func (s *MemoryStorage) ListConversationPage(deskID string, q ConversationQuery) ([]*models.ConversationWithLatest, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	deskID = crypto.NormalizeDeskID(deskID)
+	result := []*models.ConversationWithLatest{}
+	for id, conv := range s.conversations {
+		if !s.isParticipantLocked(id, deskID) || !inRange(conv.UpdatedAt, q.Since, q.Until) {
+			continue
+		}
+		if q.Counterpart != "" && !s.isParticipantLocked(id, crypto.NormalizeDeskID(q.Counterpart)) {
+			continue
+		}
+
+		state := s.conversationStateLocked(id, deskID)
+		if q.Archived != nil && state.IsArchived != *q.Archived {
+			continue
+		}
+
+		item := &models.ConversationWithLatest{Conversation: conv, State: &state}
+		mivs := s.conversationMivs[id]
 		for _, miv := range mivs {
-			normalizedMivTo := crypto.NormalizeDeskID(miv.To)
-			normalizedDeskID := crypto.NormalizeDeskID(deskID)
-			if normalizedMivTo == normalizedDeskID || miv.From == deskID {
-				if conv, exists := s.conversations[convID]; exists {
-					conversationMap[convID] = conv
-				}
-				break // Only need to find one miv to include the conversation
+			if r := findRecipient(miv, deskID); r != nil && r.ReadAt == nil {
+				item.UnreadCount++
 			}
 		}
+		if q.UnreadOnly && item.UnreadCount == 0 {
+			continue
+		}
+		if q.After != nil && !newestFirst(*q.After, ConversationCursor(item)) {
+			continue
+		}
+		if len(mivs) > 0 {
+			item.LatestMiv = mivs[len(mivs)-1]
+		}
+		result = append(result, item)
 	}
 
-	// Convert map to slice
-	var result []*models.Conversation
-	for _, conv := range conversationMap {
-		result = append(result, conv)
-	}
-
-	return result, nil
+	sort.Slice(result, func(i, j int) bool {
+		return newestFirst(ConversationCursor(result[i]), ConversationCursor(result[j]))
+	})
+	return limitPage(result, q.Limit), nil
 }
 
 // UpdateConversation updates a conversation
@@ -392,30 +593,86 @@ func (s *MemoryStorage) CreateConversationMiv(miv *models.ConversationMiv) error
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if miv.ID == "" {
-		s.conversationMivCounter++
-		miv.ID = fmt.Sprintf("cmiv-%d", s.conversationMivCounter)
-	}
-
-	if miv.CreatedAt.IsZero() {
-		miv.CreatedAt = time.Now()
-	}
+	return s.createConversationMivLocked(miv)
+}
 
+// createConversationMivLocked stores a conversation miv; the caller must hold s.mu
+func (s *MemoryStorage) createConversationMivLocked(miv *models.ConversationMiv) error {
 	// Get current mivs for this conversation
 	mivs, exists := s.conversationMivs[miv.ConversationID]
 	if !exists {
 		return fmt.Errorf("conversation not found: %s", miv.ConversationID)
 	}
 
-	// Set sequence number
+	// Set sequence number, rejecting an explicit one that is already taken
 	if miv.SeqNo == 0 {
 		miv.SeqNo = len(mivs) + 1
+	} else {
+		for _, m := range mivs {
+			if m.SeqNo == miv.SeqNo {
+				return fmt.Errorf("%w: %d in conversation %s", ErrDuplicateSeqNo, miv.SeqNo, miv.ConversationID)
+			}
+		}
+	}
+
+	if err := s.checkAttachmentsLocked(miv); err != nil {
+		return err
+	}
+
+	if miv.ID == "" {
+		s.conversationMivCounter++
+		miv.ID = fmt.Sprintf("cmiv-%d", s.conversationMivCounter)
+	}
+
+	if miv.CreatedAt.IsZero() {
+		miv.CreatedAt = time.Now()
+	}
+	defaultRecipients(miv)
+
+	// File the new miv, and take the earlier ones it answers out of their baskets
+	sender := crypto.NormalizeDeskID(miv.From)
+	miv.SenderBasket = sentBasket(miv)
+	for _, r := range miv.Recipients {
+		r.Basket = models.StateIN
+		if r.ReadAt != nil {
+			r.Basket = readBasket(miv, false)
+		}
+	}
+	for _, m := range mivs {
+		if m.SenderBasket == models.StateSENT && crypto.NormalizeDeskID(m.From) != sender {
+			m.SenderBasket = ""
+		}
+		if r := findRecipient(m, sender); r != nil && r.Basket == models.StatePENDING {
+			r.Basket = ""
+		}
 	}
 
 	s.conversationMivs[miv.ConversationID] = append(mivs, miv)
 
+	// Send the pending attachments with the miv and link the sent ones
+	for i, att := range miv.Attachments {
+		stored := s.attachments[att.ID]
+		if stored.MivID == "" {
+			stored.ConversationID = miv.ConversationID
+			stored.MivID = miv.ID
+		} else {
+			s.attachmentLinks[att.ID] = append(s.attachmentLinks[att.ID], miv.ConversationID)
+			for _, ref := range attachmentBlobs(stored) {
+				if blob, exists := s.blobs[ref.key]; exists {
+					blob.Refs++
+				}
+			}
+		}
+		copied := *stored
+		miv.Attachments[i] = &copied
+	}
+
 	// Update conversation
 	if conv, exists := s.conversations[miv.ConversationID]; exists {
+		addParticipant(conv, miv.From, models.ParticipantRoleTo, miv.CreatedAt)
+		for _, r := range miv.Recipients {
+			addParticipant(conv, r.DeskID, r.Role, miv.CreatedAt)
+		}
 		conv.MivCount = len(s.conversationMivs[miv.ConversationID])
 		conv.UpdatedAt = time.Now()
 	}
@@ -448,6 +705,14 @@ func (s *MemoryStorage) UpdateConversationMiv(miv *models.ConversationMiv) error
 
 	for i, m := range mivs {
 		if m.ID == miv.ID {
+			if miv.Recipients == nil {
+				miv.Recipients = m.Recipients
+			}
+			// Forgetting a miv is the only update that moves it between baskets
+			miv.SenderBasket = m.SenderBasket
+			if miv.IsForgotten {
+				miv.SenderBasket = ""
+			}
 			mivs[i] = miv
 			return nil
 		}
@@ -466,14 +731,21 @@ func (s *MemoryStorage) MarkConversationMivAsRead(mivID string, deskID string) e
 		for i, miv := range mivs {
 			if miv.ID == mivID {
 				// Only mark as read if the miv is addressed to this desk
-				if miv.To != deskID {
+				recipient := findRecipient(miv, deskID)
+				if recipient == nil {
 					return fmt.Errorf("miv not found or not addressed to this desk")
 				}
 
-				// Mark as read and update state to PENDING
 				now := time.Now()
-				mivs[i].ReadAt = &now
-				mivs[i].State = models.StatePENDING
+				recipient.ReadAt = &now
+				recipient.ReceiptWithheld = s.withholdsReceipts(recipient.DeskID)
+				recipient.Basket = readBasket(miv, hasLaterMivFrom(mivs, miv.SeqNo, recipient.DeskID))
+
+				// The To desk's read state is also kept on the miv itself
+				if crypto.NormalizeDeskID(miv.To) == recipient.DeskID {
+					mivs[i].ReadAt = &now
+					mivs[i].State = models.StatePENDING
+				}
 				return nil
 			}
 		}
@@ -495,7 +767,14 @@ func (s *MemoryStorage) MarkConversationMivsAsRead(conversationID string, deskID
 	now := time.Now()
 	for i, miv := range mivs {
 		// Mark as read only if it's addressed to this desk and not already read
-		if miv.To == deskID && miv.ReadAt == nil {
+		recipient := findRecipient(miv, deskID)
+		if recipient == nil || recipient.ReadAt != nil {
+			continue
+		}
+		recipient.ReadAt = &now
+		recipient.ReceiptWithheld = s.withholdsReceipts(recipient.DeskID)
+		recipient.Basket = readBasket(miv, hasLaterMivFrom(mivs, miv.SeqNo, recipient.DeskID))
+		if crypto.NormalizeDeskID(miv.To) == recipient.DeskID {
 			mivs[i].ReadAt = &now
 		}
 	}
@@ -503,6 +782,34 @@ func (s *MemoryStorage) MarkConversationMivsAsRead(conversationID string, deskID
 	return nil
 }
 
+// withholdsReceipts reports whether the desk has read receipts turned off;
+// the caller holds the lock
+func (s *MemoryStorage) withholdsReceipts(deskID string) bool {
+	desk, ok := s.desks[crypto.NormalizeDeskID(deskID)]
+	return ok && desk.DisableReadReceipts
+}
+
+// findRecipient returns the desk's entry in a miv's recipients, if any
+func findRecipient(miv *models.ConversationMiv, deskID string) *models.MivRecipient {
+	normalizedDeskID := crypto.NormalizeDeskID(deskID)
+	for _, r := range miv.Recipients {
+		if r.DeskID == normalizedDeskID {
+			return r
+		}
+	}
+	return nil
+}
+
+// hasLaterMivFrom reports whether a normalized desk sent any miv after seqNo
+func hasLaterMivFrom(mivs []*models.ConversationMiv, seqNo int, deskID string) bool {
+	for _, m := range mivs {
+		if m.SeqNo > seqNo && crypto.NormalizeDeskID(m.From) == deskID {
+			return true
+		}
+	}
+	return false
+}
+
 // GetConversationMiv retrieves a specific miv by ID
 func (s *MemoryStorage) GetConversationMiv(mivID string) (*models.ConversationMiv, error) {
 	s.mu.RLock()
@@ -520,35 +827,259 @@ func (s *MemoryStorage) GetConversationMiv(mivID string) (*models.ConversationMi
 	return nil, fmt.Errorf("miv not found: %s", mivID)
 }
 
-// Notification methods
-
-// CreateNotification creates a new notification
-func (s *MemoryStorage) CreateNotification(notif *models.Notification) error {
+// SetMivReplyBy sets or clears the time a miv's sender expects a reply by,
+// clearing any follow-up already raised for it
+func (s *MemoryStorage) SetMivReplyBy(mivID string, replyBy *time.Time) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if notif.ID == "" {
-		s.notificationCounter++
-		notif.ID = fmt.Sprintf("notif-%d", s.notificationCounter)
-	}
-
-	if notif.CreatedAt.IsZero() {
-		notif.CreatedAt = time.Now()
+	miv := s.findConversationMivLocked(mivID)
+	if miv == nil {
+		return fmt.Errorf("miv not found: %s", mivID)
 	}
-
-	s.notifications[notif.ID] = notif
-	s.notificationsByDesk[notif.DeskID] = append(s.notificationsByDesk[notif.DeskID], notif)
+	miv.ReplyBy = replyBy
+	miv.FollowUpAt = nil
 	return nil
 }
 
-// GetNotification retrieves a notification by ID
-func (s *MemoryStorage) GetNotification(id string) (*models.Notification, error) {
+// ListDueFollowUps returns the mivs whose reply deadline has passed by now
+// while they are still in their sender's SENT basket and have not been
+// followed up, earliest deadline first
+func (s *MemoryStorage) ListDueFollowUps(now time.Time) ([]*models.ConversationMiv, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	notif, exists := s.notifications[id]
-	if !exists {
-		return nil, fmt.Errorf("notification not found: %s", id)
+	result := []*models.ConversationMiv{}
+	for _, mivs := range s.conversationMivs {
+		for _, miv := range mivs {
+			if miv.ReplyBy != nil && !miv.ReplyBy.After(now) && miv.FollowUpAt == nil && miv.SenderBasket == models.StateSENT {
+				result = append(result, miv)
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return oldestFirst(Cursor{Time: *result[i].ReplyBy, ID: result[i].ID}, Cursor{Time: *result[j].ReplyBy, ID: result[j].ID})
+	})
+	return result, nil
+}
+
+// ClaimFollowUp records when a miv's sender was reminded of its overdue
+// reply, unless a reminder is already recorded
+func (s *MemoryStorage) ClaimFollowUp(mivID string, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	miv := s.findConversationMivLocked(mivID)
+	if miv == nil {
+		return false, fmt.Errorf("miv not found: %s", mivID)
+	}
+	if miv.FollowUpAt != nil {
+		return false, nil
+	}
+	miv.FollowUpAt = &at
+	return true, nil
+}
+
+// findConversationMivLocked finds a miv in any conversation; the caller must
+// hold s.mu
+func (s *MemoryStorage) findConversationMivLocked(mivID string) *models.ConversationMiv {
+	for _, mivs := range s.conversationMivs {
+		for _, miv := range mivs {
+			if miv.ID == mivID {
+				return miv
+			}
+		}
+	}
+	return nil
+}
+
+// GetConversationState returns a participant's own view of a conversation
+func (s *MemoryStorage) GetConversationState(conversationID, deskID string) (*models.ConversationState, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	deskID = crypto.NormalizeDeskID(deskID)
+	if !s.isParticipantLocked(conversationID, deskID) {
+		return nil, fmt.Errorf("desk %s is not a participant in conversation %s", deskID, conversationID)
+	}
+
+	state := s.conversationStateLocked(conversationID, deskID)
+	return &state, nil
+}
+
+// conversationStateLocked returns a participant's own state. Its basket and
+// last-read seq are read from the per-miv baskets and reads: the conversation
+// sits in the first of IN, PENDING and SENT that holds one of its mivs. The
+// caller must hold s.mu.
+func (s *MemoryStorage) conversationStateLocked(conversationID, deskID string) models.ConversationState {
+	state := models.ConversationState{ConversationID: conversationID, DeskID: deskID}
+	if stored, exists := s.conversationStates[conversationID+"/"+deskID]; exists {
+		state = *stored
+	}
+
+	baskets := make(map[models.MivState]bool)
+	for _, miv := range s.conversationMivs[conversationID] {
+		sent := crypto.NormalizeDeskID(miv.From) == deskID
+		r := findRecipient(miv, deskID)
+		if sent {
+			baskets[miv.SenderBasket] = true
+		}
+		if r != nil {
+			baskets[r.Basket] = true
+		}
+		if (sent || r != nil && r.ReadAt != nil) && miv.SeqNo > state.LastReadSeq {
+			state.LastReadSeq = miv.SeqNo
+		}
+	}
+	for _, basket := range []models.MivState{models.StateIN, models.StatePENDING, models.StateSENT} {
+		if baskets[basket] {
+			state.Basket = basket
+			break
+		}
+	}
+	return state
+}
+
+// UpdateConversationState applies a change to a participant's own view of a
+// conversation
+func (s *MemoryStorage) UpdateConversationState(conversationID, deskID string, change ConversationStateChange) (*models.ConversationState, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deskID = crypto.NormalizeDeskID(deskID)
+	if !s.isParticipantLocked(conversationID, deskID) {
+		return nil, false, fmt.Errorf("desk %s is not a participant in conversation %s", deskID, conversationID)
+	}
+
+	state := s.conversationStateLocked(conversationID, deskID)
+	before := state
+	change.apply(&state)
+	if state == before {
+		return &state, false, nil
+	}
+
+	state.UpdatedAt = time.Now()
+	s.conversationStates[conversationID+"/"+deskID] = &models.ConversationState{
+		ConversationID: conversationID,
+		DeskID:         deskID,
+		IsArchived:     state.IsArchived,
+		IsMuted:        state.IsMuted,
+		IsPinned:       state.IsPinned,
+		UpdatedAt:      state.UpdatedAt,
+	}
+	return &state, true, nil
+}
+
+// ListBasket returns the mivs in one of a desk's baskets, newest first
+func (s *MemoryStorage) ListBasket(deskID string, basket models.MivState) ([]*models.ConversationMiv, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	deskID = crypto.NormalizeDeskID(deskID)
+	result := []*models.ConversationMiv{}
+	for id, conv := range s.conversations {
+		if !s.isParticipantLocked(id, deskID) {
+			continue
+		}
+		archived := false
+		if state, exists := s.conversationStates[id+"/"+deskID]; exists {
+			archived = state.IsArchived
+		}
+		if archived != (basket == models.StateARCHIVED) {
+			continue
+		}
+
+		mivs := s.conversationMivs[conv.ID]
+		if basket == models.StateARCHIVED {
+			if len(mivs) > 0 {
+				result = append(result, mivs[len(mivs)-1])
+			}
+			continue
+		}
+		for _, miv := range mivs {
+			inBasket := crypto.NormalizeDeskID(miv.From) == deskID && miv.SenderBasket == basket
+			if r := findRecipient(miv, deskID); r != nil && r.Basket == basket {
+				inBasket = true
+			}
+			if inBasket {
+				result = append(result, miv)
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].CreatedAt.Equal(result[j].CreatedAt) {
+			return result[i].CreatedAt.After(result[j].CreatedAt)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+// inRange reports whether t falls within since and until, either of which
+// may be zero to leave that end open
+func inRange(t, since, until time.Time) bool {
+	return (since.IsZero() || !t.Before(since)) && (until.IsZero() || t.Before(until))
+}
+
+// limitPage cuts a sorted list down to its first limit items; 0 keeps them all
+func limitPage[T any](items []T, limit int) []T {
+	if limit > 0 && len(items) > limit {
+		return items[:limit]
+	}
+	return items
+}
+
+// isParticipantLocked reports whether a normalized desk takes part in a
+// conversation; the caller must hold s.mu
+func (s *MemoryStorage) isParticipantLocked(conversationID, deskID string) bool {
+	conv, exists := s.conversations[conversationID]
+	if !exists {
+		return false
+	}
+	for _, p := range conv.Participants {
+		if p.DeskID == deskID {
+			return true
+		}
+	}
+	return false
+}
+
+// Notification methods
+
+// CreateNotification creates a new notification
+func (s *MemoryStorage) CreateNotification(notif *models.Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.createNotificationLocked(notif)
+}
+
+// createNotificationLocked stores a notification; the caller must hold s.mu
+func (s *MemoryStorage) createNotificationLocked(notif *models.Notification) error {
+	if notif.ID == "" {
+		s.notificationCounter++
+		notif.ID = fmt.Sprintf("notif-%d", s.notificationCounter)
+	}
+
+	if notif.CreatedAt.IsZero() {
+		notif.CreatedAt = time.Now()
+	}
+
+	s.notifications[notif.ID] = notif
+	s.notificationsByDesk[notif.DeskID] = append(s.notificationsByDesk[notif.DeskID], notif)
+	return nil
+}
+
+// GetNotification retrieves a notification by ID
+func (s *MemoryStorage) GetNotification(id string) (*models.Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	notif, exists := s.notifications[id]
+	if !exists {
+		return nil, fmt.Errorf("notification not found: %s", id)
 	}
 
 	return notif, nil
@@ -578,6 +1109,42 @@ func (s *MemoryStorage) ListNotificationsByDesk(deskID string, unreadOnly bool)
 	return result, nil
 }
 
+// ListNotificationPage returns one page of a desk's notifications, newest first
+func (s *MemoryStorage) ListNotificationPage(deskID string, q NotificationQuery) ([]*models.Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.Notification{}
+	for _, notif := range s.notificationsByDesk[deskID] {
+		if q.UnreadOnly && notif.Read || !inRange(notif.CreatedAt, q.Since, q.Until) {
+			continue
+		}
+		if q.After != nil && !newestFirst(*q.After, NotificationCursor(notif)) {
+			continue
+		}
+		result = append(result, notif)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return newestFirst(NotificationCursor(result[i]), NotificationCursor(result[j]))
+	})
+	return limitPage(result, q.Limit), nil
+}
+
+// CountUnreadNotifications counts a desk's unread notifications
+func (s *MemoryStorage) CountUnreadNotifications(deskID string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := 0
+	for _, notif := range s.notificationsByDesk[deskID] {
+		if !notif.Read {
+			count++
+		}
+	}
+	return count, nil
+}
+
 // MarkNotificationAsRead marks a notification as read
 func (s *MemoryStorage) MarkNotificationAsRead(id string) error {
 	s.mu.Lock()
@@ -644,6 +1211,24 @@ func (s *MemoryStorage) ListContactsForDesk(deskID string) ([]*models.Contact, e
 	return contacts, nil
 }
 
+// ListContactPage returns one page of a desk's contacts, oldest first
+func (s *MemoryStorage) ListContactPage(deskID string, q ContactQuery) ([]*models.Contact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.Contact{}
+	for _, contact := range s.contactsByDesk[deskID] {
+		if q.After == nil || oldestFirst(*q.After, ContactCursor(contact)) {
+			result = append(result, contact)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return oldestFirst(ContactCursor(result[i]), ContactCursor(result[j]))
+	})
+	return limitPage(result, q.Limit), nil
+}
+
 // UpdateContact updates an existing contact
 func (s *MemoryStorage) UpdateContact(contact *models.Contact) error {
 	s.mu.Lock()
@@ -661,7 +1246,12 @@ func (s *MemoryStorage) UpdateContact(contact *models.Contact) error {
 	if contact.DeskIDRef != "" {
 		existing.DeskIDRef = contact.DeskIDRef
 	}
+	existing.FirstName = contact.FirstName
+	existing.LastName = contact.LastName
+	existing.GreetingName = contact.GreetingName
 	existing.Notes = contact.Notes
+	existing.PinnedFingerprint = contact.PinnedFingerprint
+	existing.PinnedAt = contact.PinnedAt
 	existing.UpdatedAt = time.Now()
 
 	return nil
@@ -710,3 +1300,663 @@ func (s *MemoryStorage) GetContactByDeskIDRef(deskID, deskIDRef string) (*models
 
 	return nil, fmt.Errorf("contact not found for desk ID: %s", deskIDRef)
 }
+
+// Scheduled miv methods
+
+// CreateScheduledMiv stores a miv to be sent later
+func (s *MemoryStorage) CreateScheduledMiv(sched *models.ScheduledMiv) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sched.ID == "" {
+		s.scheduledCounter++
+		sched.ID = fmt.Sprintf("sched-%d", s.scheduledCounter)
+	}
+
+	now := time.Now()
+	sched.State = models.StateSCHEDULED
+	sched.CreatedAt = now
+	sched.UpdatedAt = now
+
+	stored := *sched
+	s.scheduledMivs[sched.ID] = &stored
+	return nil
+}
+
+// GetScheduledMiv retrieves a scheduled miv by ID
+func (s *MemoryStorage) GetScheduledMiv(id string) (*models.ScheduledMiv, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sched, exists := s.scheduledMivs[id]
+	if !exists {
+		return nil, fmt.Errorf("scheduled miv not found: %s", id)
+	}
+
+	copied := *sched
+	return &copied, nil
+}
+
+// ListScheduledMivs returns a desk's scheduled mivs, soonest first
+func (s *MemoryStorage) ListScheduledMivs(deskID string) ([]*models.ScheduledMiv, error) {
+	return s.listScheduledMivs(func(sched *models.ScheduledMiv) bool {
+		return sched.DeskID == deskID
+	}), nil
+}
+
+// ListDueScheduledMivs returns the scheduled mivs due by now, soonest first,
+// leaving out those whose delivery failed
+func (s *MemoryStorage) ListDueScheduledMivs(now time.Time) ([]*models.ScheduledMiv, error) {
+	return s.listScheduledMivs(func(sched *models.ScheduledMiv) bool {
+		return sched.Error == "" && !sched.SendAt.After(now)
+	}), nil
+}
+
+// listScheduledMivs returns copies of the scheduled mivs that match, soonest
+// first
+func (s *MemoryStorage) listScheduledMivs(match func(*models.ScheduledMiv) bool) []*models.ScheduledMiv {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.ScheduledMiv{}
+	for _, sched := range s.scheduledMivs {
+		if match(sched) {
+			copied := *sched
+			result = append(result, &copied)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return oldestFirst(Cursor{Time: result[i].SendAt, ID: result[i].ID}, Cursor{Time: result[j].SendAt, ID: result[j].ID})
+	})
+	return result
+}
+
+// UpdateScheduledMiv replaces a scheduled miv's contents, keeping its desk,
+// conversation, claim and creation time
+func (s *MemoryStorage) UpdateScheduledMiv(sched *models.ScheduledMiv) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, exists := s.scheduledMivs[sched.ID]
+	if !exists {
+		return fmt.Errorf("scheduled miv not found: %s", sched.ID)
+	}
+	if existing.ClaimedAt != nil {
+		return ErrScheduledMivClaimed
+	}
+
+	sched.DeskID = existing.DeskID
+	sched.ConversationID = existing.ConversationID
+	sched.ClaimedAt = nil
+	sched.State = models.StateSCHEDULED
+	sched.CreatedAt = existing.CreatedAt
+	sched.UpdatedAt = time.Now()
+
+	stored := *sched
+	s.scheduledMivs[sched.ID] = &stored
+	return nil
+}
+
+// DeleteScheduledMiv removes a scheduled miv no dispatcher has claimed
+func (s *MemoryStorage) DeleteScheduledMiv(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sched, exists := s.scheduledMivs[id]
+	if !exists {
+		return fmt.Errorf("scheduled miv not found: %s", id)
+	}
+	if sched.ClaimedAt != nil {
+		return ErrScheduledMivClaimed
+	}
+
+	delete(s.scheduledMivs, id)
+	return nil
+}
+
+// ClaimScheduledMiv claims a due scheduled miv for delivery
+func (s *MemoryStorage) ClaimScheduledMiv(id string, now, staleBefore time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sched, exists := s.scheduledMivs[id]
+	if !exists || sched.Error != "" || sched.SendAt.After(now) {
+		return false, nil
+	}
+	if sched.ClaimedAt != nil && !sched.ClaimedAt.Before(staleBefore) {
+		return false, nil
+	}
+
+	claimed := *sched
+	claimed.ClaimedAt = &now
+	s.scheduledMivs[id] = &claimed
+	return true, nil
+}
+
+// FinishScheduledMiv removes a claimed scheduled miv once it is delivered
+func (s *MemoryStorage) FinishScheduledMiv(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.scheduledMivs[id]; !exists {
+		return fmt.Errorf("scheduled miv not found: %s", id)
+	}
+
+	delete(s.scheduledMivs, id)
+	return nil
+}
+
+// ReleaseScheduledMiv drops the claim on a scheduled miv whose delivery did
+// not go through, recording failure as its error
+func (s *MemoryStorage) ReleaseScheduledMiv(id string, failure string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sched, exists := s.scheduledMivs[id]
+	if !exists {
+		return fmt.Errorf("scheduled miv not found: %s", id)
+	}
+
+	released := *sched
+	released.ClaimedAt = nil
+	released.Error = failure
+	released.UpdatedAt = time.Now()
+	s.scheduledMivs[id] = &released
+	return nil
+}
+
+// checkAttachmentsLocked fails unless every attachment of a miv about to be
+// created is a pending attachment of its sender or a sent one it links; the
+// caller must hold s.mu
+func (s *MemoryStorage) checkAttachmentsLocked(miv *models.ConversationMiv) error {
+	sender := crypto.NormalizeDeskID(miv.From)
+	for _, att := range miv.Attachments {
+		stored, exists := s.attachments[att.ID]
+		if !exists || (stored.MivID == "" && crypto.NormalizeDeskID(stored.DeskID) != sender) {
+			return fmt.Errorf("%w: %s", ErrAttachmentUnavailable, att.ID)
+		}
+	}
+	return nil
+}
+
+// Attachment methods
+
+// CreateAttachment stores a pending attachment
+func (s *MemoryStorage) CreateAttachment(att *models.Attachment, quota int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if quota > 0 && s.deskAttachmentUsage(att.DeskID)+attachmentSize(att) > quota {
+		return ErrQuotaExceeded
+	}
+	refs := attachmentBlobs(att)
+	for _, ref := range refs {
+		if blob, exists := s.blobs[ref.key]; exists && blob.Collecting {
+			return fmt.Errorf("%w: %s", ErrBlobBusy, ref.key)
+		}
+	}
+
+	if att.ID == "" {
+		s.attachmentCounter++
+		att.ID = fmt.Sprintf("att-%d", s.attachmentCounter)
+	}
+	att.ConversationID = ""
+	att.MivID = ""
+	att.CreatedAt = time.Now()
+
+	for _, ref := range refs {
+		blob, exists := s.blobs[ref.key]
+		if !exists {
+			blob = &models.Blob{Key: ref.key, Size: ref.size, Stored: true, ReleasedAt: att.CreatedAt, CreatedAt: att.CreatedAt}
+			s.blobs[ref.key] = blob
+		}
+		blob.Refs++
+	}
+
+	stored := *att
+	stored.Thumbnails = append([]models.Thumbnail(nil), att.Thumbnails...)
+	s.attachments[att.ID] = &stored
+	return nil
+}
+
+// GetAttachment retrieves an attachment by ID
+func (s *MemoryStorage) GetAttachment(id string) (*models.Attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	att, exists := s.attachments[id]
+	if !exists {
+		return nil, fmt.Errorf("attachment not found: %s", id)
+	}
+
+	copied := *att
+	return &copied, nil
+}
+
+// ListAttachments returns the attachments a desk uploaded, newest first
+func (s *MemoryStorage) ListAttachments(deskID string) ([]*models.Attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.Attachment{}
+	for _, att := range s.attachments {
+		if att.DeskID == deskID {
+			copied := *att
+			result = append(result, &copied)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return newestFirst(Cursor{Time: result[i].CreatedAt, ID: result[i].ID}, Cursor{Time: result[j].CreatedAt, ID: result[j].ID})
+	})
+	return result, nil
+}
+
+// DeskAttachmentUsage returns the bytes of every attachment a desk uploaded
+func (s *MemoryStorage) DeskAttachmentUsage(deskID string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.deskAttachmentUsage(deskID), nil
+}
+
+// deskAttachmentUsage sums a desk's attachments; the caller holds s.mu
+func (s *MemoryStorage) deskAttachmentUsage(deskID string) int64 {
+	var used int64
+	for _, att := range s.attachments {
+		if att.DeskID == deskID {
+			used += attachmentSize(att)
+		}
+	}
+	return used
+}
+
+// ListAttachmentLinks returns the conversations with a miv that links a
+// sent attachment
+func (s *MemoryStorage) ListAttachmentLinks(attachmentID string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]string{}, s.attachmentLinks[attachmentID]...), nil
+}
+
+// DeleteAttachment removes a pending attachment
+func (s *MemoryStorage) DeleteAttachment(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	att, exists := s.attachments[id]
+	if !exists || att.MivID != "" {
+		return fmt.Errorf("pending attachment not found: %s", id)
+	}
+
+	delete(s.attachments, id)
+	now := time.Now()
+	for _, ref := range attachmentBlobs(att) {
+		if blob, exists := s.blobs[ref.key]; exists && blob.Refs > 0 {
+			blob.Refs--
+			if blob.Refs == 0 {
+				blob.ReleasedAt = now
+			}
+		}
+	}
+	return nil
+}
+
+// Blob methods
+
+// HoldBlob records a blob an upload is about to use and restarts its grace
+// period
+func (s *MemoryStorage) HoldBlob(key string, size int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	blob, exists := s.blobs[key]
+	if !exists {
+		s.blobs[key] = &models.Blob{Key: key, Size: size, ReleasedAt: now, CreatedAt: now}
+		return false, nil
+	}
+	if blob.Collecting {
+		return false, fmt.Errorf("%w: %s", ErrBlobBusy, key)
+	}
+	blob.ReleasedAt = now
+	return blob.Stored, nil
+}
+
+// MarkBlobStored records that a blob's bytes have been written
+func (s *MemoryStorage) MarkBlobStored(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blob, exists := s.blobs[key]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrBlobNotFound, key)
+	}
+	blob.Stored = true
+	return nil
+}
+
+// GetBlob retrieves the record of a blob
+func (s *MemoryStorage) GetBlob(key string) (*models.Blob, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blob, exists := s.blobs[key]
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, key)
+	}
+	copied := *blob
+	return &copied, nil
+}
+
+// ListReleasedBlobs returns the blobs unreferenced since before, and those
+// already claimed, by key
+func (s *MemoryStorage) ListReleasedBlobs(before time.Time) ([]*models.Blob, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.Blob{}
+	for _, blob := range s.blobs {
+		if blob.Refs == 0 && (blob.Collecting || blob.ReleasedAt.Before(before)) {
+			copied := *blob
+			result = append(result, &copied)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result, nil
+}
+
+// ClaimBlob marks a blob for collection if it has been unreferenced since
+// before or has no record
+func (s *MemoryStorage) ClaimBlob(key string, size int64, before time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blob, exists := s.blobs[key]
+	if !exists {
+		now := time.Now()
+		s.blobs[key] = &models.Blob{Key: key, Size: size, Stored: true, Collecting: true, ReleasedAt: now, CreatedAt: now}
+		return true, nil
+	}
+	if blob.Refs == 0 && (blob.Collecting || blob.ReleasedAt.Before(before)) {
+		blob.Collecting = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// DeleteBlobRecord removes the record of a claimed blob
+func (s *MemoryStorage) DeleteBlobRecord(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blob, exists := s.blobs[key]
+	if !exists || !blob.Collecting {
+		return fmt.Errorf("claimed blob not found: %s", key)
+	}
+	delete(s.blobs, key)
+	return nil
+}
+
+// Draft methods
+
+// CreateDraft stores a new draft at version 1
+func (s *MemoryStorage) CreateDraft(draft *models.Draft) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if draft.ID == "" {
+		s.draftCounter++
+		draft.ID = fmt.Sprintf("draft-%d", s.draftCounter)
+	}
+
+	now := time.Now()
+	draft.Version = 1
+	draft.CreatedAt = now
+	draft.UpdatedAt = now
+
+	stored := *draft
+	s.drafts[draft.ID] = &stored
+	return nil
+}
+
+// GetDraft retrieves a draft by ID
+func (s *MemoryStorage) GetDraft(id string) (*models.Draft, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	draft, exists := s.drafts[id]
+	if !exists {
+		return nil, fmt.Errorf("draft not found: %s", id)
+	}
+
+	copied := *draft
+	return &copied, nil
+}
+
+// ListDrafts returns a desk's drafts, most recently saved first
+func (s *MemoryStorage) ListDrafts(deskID string) ([]*models.Draft, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.Draft{}
+	for _, draft := range s.drafts {
+		if draft.DeskID == deskID {
+			copied := *draft
+			result = append(result, &copied)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return newestFirst(Cursor{Time: result[i].UpdatedAt, ID: result[i].ID}, Cursor{Time: result[j].UpdatedAt, ID: result[j].ID})
+	})
+	return result, nil
+}
+
+// UpdateDraft replaces a draft's contents if the stored version still equals
+// expectedVersion, bumping the version
+func (s *MemoryStorage) UpdateDraft(draft *models.Draft, expectedVersion int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, exists := s.drafts[draft.ID]
+	if !exists {
+		return fmt.Errorf("draft not found: %s", draft.ID)
+	}
+	if existing.Version != expectedVersion {
+		return ErrVersionConflict
+	}
+
+	draft.DeskID = existing.DeskID
+	draft.ConversationID = existing.ConversationID
+	draft.Version = existing.Version + 1
+	draft.CreatedAt = existing.CreatedAt
+	draft.UpdatedAt = time.Now()
+
+	stored := *draft
+	s.drafts[draft.ID] = &stored
+	return nil
+}
+
+// DeleteDraft removes a draft if the stored version still equals
+// expectedVersion (0 for any version)
+func (s *MemoryStorage) DeleteDraft(id string, expectedVersion int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, exists := s.drafts[id]
+	if !exists {
+		return fmt.Errorf("draft not found: %s", id)
+	}
+	if expectedVersion != 0 && existing.Version != expectedVersion {
+		return ErrVersionConflict
+	}
+
+	delete(s.drafts, id)
+	return nil
+}
+
+// Key backup methods
+
+// SaveKeyBackup stores a desk's key backup if the stored version still equals
+// expectedVersion (0 when no backup may exist yet), bumping the version
+func (s *MemoryStorage) SaveKeyBackup(backup *models.KeyBackup, expectedVersion int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := 0
+	existing, exists := s.keyBackups[backup.DeskID]
+	if exists {
+		current = existing.Version
+	}
+	if current != expectedVersion {
+		return ErrVersionConflict
+	}
+
+	now := time.Now()
+	backup.Version = current + 1
+	backup.CreatedAt = now
+	if exists {
+		backup.CreatedAt = existing.CreatedAt
+	}
+	backup.UpdatedAt = now
+
+	stored := *backup
+	s.keyBackups[backup.DeskID] = &stored
+	return nil
+}
+
+// GetKeyBackup retrieves a desk's key backup
+func (s *MemoryStorage) GetKeyBackup(deskID string) (*models.KeyBackup, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	backup, exists := s.keyBackups[deskID]
+	if !exists {
+		return nil, fmt.Errorf("key backup not found: %s", deskID)
+	}
+
+	copied := *backup
+	return &copied, nil
+}
+
+// DeleteKeyBackup removes a desk's key backup
+func (s *MemoryStorage) DeleteKeyBackup(deskID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.keyBackups[deskID]; !exists {
+		return fmt.Errorf("key backup not found: %s", deskID)
+	}
+
+	delete(s.keyBackups, deskID)
+	return nil
+}
+
+// Event methods
+
+// AppendEvents adds events to the log, each with the next sequence number
+// and its data encoded as JSON
+func (s *MemoryStorage) AppendEvents(events []*models.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	encoded := make([]json.RawMessage, len(events))
+	for i, event := range events {
+		data, err := json.Marshal(event.Data)
+		if err != nil {
+			return err
+		}
+		encoded[i] = data
+	}
+
+	now := time.Now()
+	for i, event := range events {
+		s.eventSeq++
+		event.Seq = s.eventSeq
+		event.Data = encoded[i]
+		event.CreatedAt = now
+		stored := *event
+		s.events = append(s.events, &stored)
+	}
+	return nil
+}
+
+// ListEvents returns up to limit events logged after afterSeq, oldest first
+func (s *MemoryStorage) ListEvents(afterSeq int64, limit int) ([]*models.Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.Event{}
+	for _, event := range s.events {
+		if event.Seq > afterSeq && len(result) < limit {
+			copied := *event
+			result = append(result, &copied)
+		}
+	}
+	return result, nil
+}
+
+// ListDeskEvents returns a desk's events logged after afterSeq up to and
+// including throughSeq, oldest first
+func (s *MemoryStorage) ListDeskEvents(deskID string, afterSeq, throughSeq int64) ([]*models.Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := []*models.Event{}
+	for _, event := range s.events {
+		if event.DeskID == deskID && event.Seq > afterSeq && event.Seq <= throughSeq {
+			copied := *event
+			result = append(result, &copied)
+		}
+	}
+	return result, nil
+}
+
+// EventSeqRange returns the lowest and highest sequence numbers of the
+// events kept, or zeros when there are none
+func (s *MemoryStorage) EventSeqRange() (int64, int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.events) == 0 {
+		return 0, 0, nil
+	}
+	return s.events[0].Seq, s.events[len(s.events)-1].Seq, nil
+}
+
+// DeleteEventsBefore drops the events logged before a time
+func (s *MemoryStorage) DeleteEventsBefore(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := s.events[:0]
+	for _, event := range s.events {
+		if !event.CreatedAt.Before(before) {
+			kept = append(kept, event)
+		}
+	}
+	s.events = kept
+	return nil
+}
+
+// Server secret methods
+
+// ServerSecret returns the secret kept under name, generating it the first
+// time
+func (s *MemoryStorage) ServerSecret(name string, size int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secret, exists := s.secrets[name]
+	if !exists {
+		var err error
+		if secret, err = crypto.GenerateSecret(size); err != nil {
+			return nil, err
+		}
+		s.secrets[name] = secret
+	}
+	return append([]byte(nil), secret...), nil
+}
@@ -0,0 +1,2748 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// SQLStorage is a Store backed by a database/sql connection.
+// Queries are written once with "?" placeholders and rewritten for the
+// dialect; timestamps are stored as Unix nanoseconds so the same queries work
+// on every supported driver. See sqlite.go and postgres.go for the
+// driver-specific setup and schema.
+type SQLStorage struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+// dialect captures the differences between SQL drivers
+type dialect struct {
+	name              string
+	numberedParams    bool             // Use $1, $2, ... instead of ?
+	isUniqueViolation func(error) bool // Reports unique constraint failures
+}
+
+// maxSeqNoRetries bounds how often a conversation miv insert is retried after
+// losing a sequence number race to a concurrent writer
+const maxSeqNoRetries = 5
+
+// queryer is the subset of *sql.DB and *sql.Tx used by the helpers below
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// conn wraps a *sql.DB or *sql.Tx and rewrites placeholders for the dialect
+type conn struct {
+	q queryer
+	d dialect
+}
+
+func (c conn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return c.q.Exec(c.d.rebind(query), args...)
+}
+
+func (c conn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return c.q.Query(c.d.rebind(query), args...)
+}
+
+func (c conn) QueryRow(query string, args ...interface{}) *sql.Row {
+	return c.q.QueryRow(c.d.rebind(query), args...)
+}
+
+// placeholders returns n comma-separated "?" placeholders for an IN list
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// rebind converts "?" placeholders into the dialect's parameter syntax
+func (d dialect) rebind(query string) string {
+	if !d.numberedParams {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// conn returns the store's connection pool wrapped for its dialect
+func (s *SQLStorage) conn() conn {
+	return conn{q: s.db, d: s.dialect}
+}
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// ownedRow scans a row's first column into owner and the rest as row would
+type ownedRow struct {
+	row   rowScanner
+	owner *string
+}
+
+func (r ownedRow) Scan(dest ...interface{}) error {
+	return r.row.Scan(append([]interface{}{r.owner}, dest...)...)
+}
+
+// migration is a numbered schema change applied exactly once
+type migration struct {
+	version    int
+	statements []string
+}
+
+// Close closes the underlying database
+func (s *SQLStorage) Close() error {
+	return s.db.Close()
+}
+
+// migrate applies every migration newer than the recorded schema version
+func migrate(db *sql.DB, d dialect, migrations []migration) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range m.statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d failed: %w", m.version, err)
+			}
+		}
+		if _, err := tx.Exec(d.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`), m.version, time.Now().UnixNano()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", m.version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d failed: %w", m.version, err)
+		}
+	}
+
+	return nil
+}
+
+// withTx runs fn inside a transaction, committing only if it returns nil
+func (s *SQLStorage) withTx(fn func(tx conn) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(conn{q: tx, d: s.dialect}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// nextID allocates the next value of a named counter, producing IDs in the
+// same "prefix-N" form MemoryStorage uses
+func nextID(q queryer, prefix string) (string, error) {
+	var value int64
+	err := q.QueryRow(`UPDATE id_sequences SET value = value + 1 WHERE name = ? RETURNING value`, prefix).Scan(&value)
+	if err != nil {
+		return "", fmt.Errorf("failed to allocate %s id: %w", prefix, err)
+	}
+	return fmt.Sprintf("%s-%d", prefix, value), nil
+}
+
+// Value conversion helpers
+
+func toNanos(t time.Time) int64 {
+	return t.UnixNano()
+}
+
+func fromNanos(n int64) time.Time {
+	return time.Unix(0, n)
+}
+
+func nullableNanos(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: true}
+}
+
+func timePtr(n sql.NullInt64) *time.Time {
+	if !n.Valid {
+		return nil
+	}
+	t := fromNanos(n.Int64)
+	return &t
+}
+
+func nullableString(s *string) sql.NullString {
+	if s == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: *s, Valid: true}
+}
+
+func stringPtr(s sql.NullString) *string {
+	if !s.Valid {
+		return nil
+	}
+	v := s.String
+	return &v
+}
+
+// notFound converts sql.ErrNoRows into the store's "not found" error
+func notFound(err error, format string, args ...interface{}) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf(format, args...)
+	}
+	return err
+}
+
+// Identity methods
+
+// SetIdentity sets the current user identity
+func (s *SQLStorage) SetIdentity(identity *models.Identity) error {
+	_, err := s.conn().Exec(`INSERT INTO identity (slot, id, public_key, name) VALUES (1, ?, ?, ?)
+		ON CONFLICT (slot) DO UPDATE SET id = excluded.id, public_key = excluded.public_key, name = excluded.name`,
+		identity.ID, identity.PublicKey, identity.Name)
+	return err
+}
+
+// GetIdentity returns the current user identity
+func (s *SQLStorage) GetIdentity() (*models.Identity, error) {
+	identity := &models.Identity{}
+	err := s.conn().QueryRow(`SELECT id, public_key, name FROM identity WHERE slot = 1`).
+		Scan(&identity.ID, &identity.PublicKey, &identity.Name)
+	if err != nil {
+		return nil, notFound(err, "identity not set")
+	}
+	return identity, nil
+}
+
+// requireAffected returns a "not found" error when a statement touched no rows
+func requireAffected(result sql.Result, format string, args ...interface{}) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf(format, args...)
+	}
+	return nil
+}
+
+// Account methods
+
+const accountColumns = `id, username, password_hash, display_name, created_at, updated_at, desks, active_desk, birthday_hash, first_pet_name_hash, mother_maiden_hash`
+
+func scanAccount(row rowScanner) (*models.Account, error) {
+	account := &models.Account{}
+	var createdAt, updatedAt int64
+	var desks string
+	err := row.Scan(&account.ID, &account.Username, &account.PasswordHash, &account.DisplayName,
+		&createdAt, &updatedAt, &desks, &account.ActiveDesk,
+		&account.BirthdayHash, &account.FirstPetNameHash, &account.MotherMaidenHash)
+	if err != nil {
+		return nil, err
+	}
+	account.CreatedAt = fromNanos(createdAt)
+	account.UpdatedAt = fromNanos(updatedAt)
+	if err := json.Unmarshal([]byte(desks), &account.Desks); err != nil {
+		return nil, fmt.Errorf("failed to decode account desks: %w", err)
+	}
+	return account, nil
+}
+
+func encodeDeskList(desks []string) (string, error) {
+	if desks == nil {
+		desks = []string{}
+	}
+	encoded, err := json.Marshal(desks)
+	return string(encoded), err
+}
+
+// encodeIDList stores a list of IDs as a JSON array
+func encodeIDList(ids []string) (string, error) {
+	if ids == nil {
+		ids = []string{}
+	}
+	encoded, err := json.Marshal(ids)
+	return string(encoded), err
+}
+
+// CreateAccount creates a new account
+func (s *SQLStorage) CreateAccount(account *models.Account) error {
+	return s.withTx(func(tx conn) error {
+		var exists int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM accounts WHERE username = ?`, account.Username).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists > 0 {
+			return fmt.Errorf("username already exists")
+		}
+
+		if account.ID == "" {
+			id, err := nextID(tx, "acc")
+			if err != nil {
+				return err
+			}
+			account.ID = id
+		}
+
+		if account.CreatedAt.IsZero() {
+			account.CreatedAt = time.Now()
+		}
+		account.UpdatedAt = account.CreatedAt
+
+		desks, err := encodeDeskList(account.Desks)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO accounts (`+accountColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			account.ID, account.Username, account.PasswordHash, account.DisplayName,
+			toNanos(account.CreatedAt), toNanos(account.UpdatedAt), desks, account.ActiveDesk,
+			account.BirthdayHash, account.FirstPetNameHash, account.MotherMaidenHash)
+		return err
+	})
+}
+
+// GetAccountByID retrieves an account by ID
+func (s *SQLStorage) GetAccountByID(id string) (*models.Account, error) {
+	account, err := scanAccount(s.conn().QueryRow(`SELECT `+accountColumns+` FROM accounts WHERE id = ?`, id))
+	if err != nil {
+		return nil, notFound(err, "account not found: %s", id)
+	}
+	return account, nil
+}
+
+// GetAccountByUsername retrieves an account by username
+func (s *SQLStorage) GetAccountByUsername(username string) (*models.Account, error) {
+	account, err := scanAccount(s.conn().QueryRow(`SELECT `+accountColumns+` FROM accounts WHERE username = ?`, username))
+	if err != nil {
+		return nil, notFound(err, "account not found: %s", username)
+	}
+	return account, nil
+}
+
+// UpdateAccount updates an account
+func (s *SQLStorage) UpdateAccount(account *models.Account) error {
+	desks, err := encodeDeskList(account.Desks)
+	if err != nil {
+		return err
+	}
+
+	updatedAt := time.Now()
+	result, err := s.conn().Exec(`UPDATE accounts SET username = ?, password_hash = ?, display_name = ?, updated_at = ?,
+		desks = ?, active_desk = ?, birthday_hash = ?, first_pet_name_hash = ?, mother_maiden_hash = ?
+		WHERE id = ?`,
+		account.Username, account.PasswordHash, account.DisplayName, toNanos(updatedAt),
+		desks, account.ActiveDesk, account.BirthdayHash, account.FirstPetNameHash, account.MotherMaidenHash,
+		account.ID)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result, "account not found: %s", account.ID); err != nil {
+		return err
+	}
+
+	account.UpdatedAt = updatedAt
+	return nil
+}
+
+// Session methods
+
+// CreateSession stores a new session keyed by its token hash
+func (s *SQLStorage) CreateSession(session *models.Session) error {
+	if session.TokenHash == "" {
+		return fmt.Errorf("session token hash is required")
+	}
+
+	if session.CreatedAt.IsZero() {
+		session.CreatedAt = time.Now()
+	}
+
+	_, err := s.conn().Exec(`INSERT INTO sessions (token_hash, account_id, created_at, expires_at, scope) VALUES (?, ?, ?, ?, ?)`,
+		session.TokenHash, session.AccountID, toNanos(session.CreatedAt), toNanos(session.ExpiresAt), session.Scope)
+	return err
+}
+
+// GetSession retrieves a session by token hash
+func (s *SQLStorage) GetSession(tokenHash string) (*models.Session, error) {
+	session := &models.Session{}
+	var createdAt, expiresAt int64
+	err := s.conn().QueryRow(`SELECT token_hash, account_id, created_at, expires_at, scope FROM sessions WHERE token_hash = ?`, tokenHash).
+		Scan(&session.TokenHash, &session.AccountID, &createdAt, &expiresAt, &session.Scope)
+	if err != nil {
+		return nil, notFound(err, "session not found")
+	}
+	session.CreatedAt = fromNanos(createdAt)
+	session.ExpiresAt = fromNanos(expiresAt)
+	return session, nil
+}
+
+// DeleteSession removes a session
+func (s *SQLStorage) DeleteSession(tokenHash string) error {
+	result, err := s.conn().Exec(`DELETE FROM sessions WHERE token_hash = ?`, tokenHash)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, "session not found")
+}
+
+// DeleteAccountSessions removes every session and ticket of an account
+func (s *SQLStorage) DeleteAccountSessions(accountID string) error {
+	_, err := s.conn().Exec(`DELETE FROM sessions WHERE account_id = ?`, accountID)
+	return err
+}
+
+// DeleteExpiredSessions removes all sessions that expired before the given time
+func (s *SQLStorage) DeleteExpiredSessions(now time.Time) error {
+	_, err := s.conn().Exec(`DELETE FROM sessions WHERE expires_at < ?`, toNanos(now))
+	return err
+}
+
+// Desk methods
+
+const deskColumns = `id, account_id, public_key, signing_key, key_version, name, created_at, auto_indent, font_family, font_size, default_salutation, default_closure, disable_read_receipts`
+
+func scanDesk(row rowScanner) (*models.Desk, error) {
+	desk := &models.Desk{}
+	var createdAt int64
+	err := row.Scan(&desk.ID, &desk.AccountID, &desk.PublicKey, &desk.SigningKey, &desk.KeyVersion, &desk.Name, &createdAt,
+		&desk.AutoIndent, &desk.FontFamily, &desk.FontSize, &desk.DefaultSalutation, &desk.DefaultClosure, &desk.DisableReadReceipts)
+	if err != nil {
+		return nil, err
+	}
+	desk.CreatedAt = fromNanos(createdAt)
+	return desk, nil
+}
+
+// CreateDesk creates a new desk with key version 1. Nil privateKeys are
+// stored as NULL for desks whose keys are held by the client.
+func (s *SQLStorage) CreateDesk(desk *models.Desk, privateKeys *DeskPrivateKeys) error {
+	if desk.CreatedAt.IsZero() {
+		desk.CreatedAt = time.Now()
+	}
+	desk.KeyVersion = 1
+
+	return s.withTx(func(tx conn) error {
+		_, err := tx.Exec(`INSERT INTO desks (`+deskColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			desk.ID, desk.AccountID, desk.PublicKey, desk.SigningKey, desk.KeyVersion, desk.Name, toNanos(desk.CreatedAt),
+			desk.AutoIndent, desk.FontFamily, desk.FontSize, desk.DefaultSalutation, desk.DefaultClosure, desk.DisableReadReceipts)
+		if err != nil {
+			return err
+		}
+		key := &models.DeskKey{DeskID: desk.ID, Version: desk.KeyVersion, PublicKey: desk.PublicKey, SigningKey: desk.SigningKey, CreatedAt: desk.CreatedAt}
+		return insertDeskKey(tx, key, privateKeys)
+	})
+}
+
+// insertDeskKey records one version of a desk's keys
+func insertDeskKey(q queryer, key *models.DeskKey, privateKeys *DeskPrivateKeys) error {
+	var rawKey, rawSigningKey []byte
+	if privateKeys != nil {
+		rawKey = privateKeys.BoxKey[:]
+		rawSigningKey = privateKeys.SigningKey
+	}
+	_, err := q.Exec(`INSERT INTO desk_keys (desk_id, version, public_key, private_key, signing_key, signing_private_key, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		key.DeskID, key.Version, key.PublicKey, rawKey, key.SigningKey, rawSigningKey, toNanos(key.CreatedAt))
+	return err
+}
+
+// RotateDeskKey retires the desk's current keys and makes the given ones
+// current under the next version. Retired keys stay available so older mivs
+// can still be opened and verified.
+func (s *SQLStorage) RotateDeskKey(deskID string, publicKey, signingKey string, privateKeys *DeskPrivateKeys) (*models.Desk, error) {
+	normalizedID := crypto.NormalizeDeskID(deskID)
+	err := s.withTx(func(tx conn) error {
+		var current int
+		if err := tx.QueryRow(`SELECT key_version FROM desks WHERE id = ?`, normalizedID).Scan(&current); err != nil {
+			return notFound(err, "desk not found: %s", deskID)
+		}
+
+		now := time.Now()
+		if _, err := tx.Exec(`UPDATE desk_keys SET retired_at = ? WHERE desk_id = ? AND version = ?`,
+			toNanos(now), normalizedID, current); err != nil {
+			return err
+		}
+		key := &models.DeskKey{DeskID: normalizedID, Version: current + 1, PublicKey: publicKey, SigningKey: signingKey, CreatedAt: now}
+		if err := insertDeskKey(tx, key, privateKeys); err != nil {
+			return err
+		}
+
+		// Guarding on the old version makes a concurrent rotation fail instead
+		// of silently skipping a version
+		result, err := tx.Exec(`UPDATE desks SET public_key = ?, signing_key = ?, key_version = ? WHERE id = ? AND key_version = ?`,
+			publicKey, signingKey, current+1, normalizedID, current)
+		if err != nil {
+			return err
+		}
+		return requireAffected(result, "desk key changed concurrently: %s", deskID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetDesk(normalizedID)
+}
+
+const deskKeyColumns = `desk_id, version, public_key, signing_key, created_at, retired_at`
+
+func scanDeskKey(row rowScanner) (*models.DeskKey, error) {
+	key := &models.DeskKey{}
+	var createdAt int64
+	var retiredAt sql.NullInt64
+	if err := row.Scan(&key.DeskID, &key.Version, &key.PublicKey, &key.SigningKey, &createdAt, &retiredAt); err != nil {
+		return nil, err
+	}
+	key.CreatedAt = fromNanos(createdAt)
+	key.RetiredAt = timePtr(retiredAt)
+	return key, nil
+}
+
+// GetDeskKey retrieves one version of a desk's public key; version 0 means current
+func (s *SQLStorage) GetDeskKey(deskID string, version int) (*models.DeskKey, error) {
+	normalizedID := crypto.NormalizeDeskID(deskID)
+	version, err := s.resolveKeyVersion(normalizedID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := scanDeskKey(s.conn().QueryRow(`SELECT `+deskKeyColumns+` FROM desk_keys WHERE desk_id = ? AND version = ?`,
+		normalizedID, version))
+	if err != nil {
+		return nil, notFound(err, "desk key not found: %s v%d", deskID, version)
+	}
+	return key, nil
+}
+
+// resolveKeyVersion maps version 0 to the desk's current key version
+func (s *SQLStorage) resolveKeyVersion(deskID string, version int) (int, error) {
+	if version != 0 {
+		return version, nil
+	}
+	if err := s.conn().QueryRow(`SELECT key_version FROM desks WHERE id = ?`, deskID).Scan(&version); err != nil {
+		return 0, notFound(err, "desk not found: %s", deskID)
+	}
+	return version, nil
+}
+
+// ListDeskKeys returns every version of a desk's public key, oldest first
+func (s *SQLStorage) ListDeskKeys(deskID string) ([]*models.DeskKey, error) {
+	rows, err := s.conn().Query(`SELECT `+deskKeyColumns+` FROM desk_keys WHERE desk_id = ? ORDER BY version`,
+		crypto.NormalizeDeskID(deskID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*models.DeskKey
+	for rows.Next() {
+		key, err := scanDeskKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, key)
+	}
+	return result, rows.Err()
+}
+
+// GetDesk retrieves a desk by ID
+func (s *SQLStorage) GetDesk(id string) (*models.Desk, error) {
+	// Normalize the ID to handle formatted inputs like "555-123-4567"
+	normalizedID := crypto.NormalizeDeskID(id)
+
+	desk, err := scanDesk(s.conn().QueryRow(`SELECT `+deskColumns+` FROM desks WHERE id = ?`, normalizedID))
+	if err != nil {
+		return nil, notFound(err, "desk not found: %s", id)
+	}
+	return desk, nil
+}
+
+// GetDeskPrivateKey retrieves one version of a desk's private key; version 0
+// means current
+func (s *SQLStorage) GetDeskPrivateKey(id string, version int) ([32]byte, error) {
+	var key [32]byte
+	normalizedID := crypto.NormalizeDeskID(id)
+	version, err := s.resolveKeyVersion(normalizedID, version)
+	if err != nil {
+		return key, err
+	}
+
+	var raw []byte
+	if err := s.conn().QueryRow(`SELECT private_key FROM desk_keys WHERE desk_id = ? AND version = ?`,
+		normalizedID, version).Scan(&raw); err != nil {
+		return key, notFound(err, "desk private key not found: %s", id)
+	}
+	if len(raw) != len(key) {
+		return key, fmt.Errorf("desk private key not found: %s", id)
+	}
+	copy(key[:], raw)
+	return key, nil
+}
+
+// GetDeskSigningPrivateKey retrieves one version of a desk's signing key;
+// version 0 means current
+func (s *SQLStorage) GetDeskSigningPrivateKey(id string, version int) (ed25519.PrivateKey, error) {
+	normalizedID := crypto.NormalizeDeskID(id)
+	version, err := s.resolveKeyVersion(normalizedID, version)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	if err := s.conn().QueryRow(`SELECT signing_private_key FROM desk_keys WHERE desk_id = ? AND version = ?`,
+		normalizedID, version).Scan(&raw); err != nil {
+		return nil, notFound(err, "desk signing key not found: %s", id)
+	}
+	if len(raw) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("desk signing key not found: %s", id)
+	}
+	return ed25519.PrivateKey(raw), nil
+}
+
+// ListDesksByAccount retrieves all desks for an account
+func (s *SQLStorage) ListDesksByAccount(accountID string) ([]*models.Desk, error) {
+	rows, err := s.conn().Query(`SELECT `+deskColumns+` FROM desks WHERE account_id = ? ORDER BY created_at, id`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*models.Desk
+	for rows.Next() {
+		desk, err := scanDesk(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, desk)
+	}
+	return result, rows.Err()
+}
+
+// UpdateDesk updates an existing desk
+func (s *SQLStorage) UpdateDesk(desk *models.Desk) error {
+	// Keys only change through RotateDeskKey
+	result, err := s.conn().Exec(`UPDATE desks SET account_id = ?, name = ?, auto_indent = ?, font_family = ?,
+		font_size = ?, default_salutation = ?, default_closure = ?, disable_read_receipts = ? WHERE id = ?`,
+		desk.AccountID, desk.Name, desk.AutoIndent, desk.FontFamily,
+		desk.FontSize, desk.DefaultSalutation, desk.DefaultClosure, desk.DisableReadReceipts, desk.ID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, "desk not found: %s", desk.ID)
+}
+
+// Conversation methods
+
+const conversationColumns = `id, subject, desk_id, created_at, updated_at, miv_count, is_archived`
+
+func scanConversation(row rowScanner) (*models.Conversation, error) {
+	conv := &models.Conversation{}
+	var createdAt, updatedAt int64
+	err := row.Scan(&conv.ID, &conv.Subject, &conv.DeskID, &createdAt, &updatedAt, &conv.MivCount, &conv.IsArchived)
+	if err != nil {
+		return nil, err
+	}
+	conv.CreatedAt = fromNanos(createdAt)
+	conv.UpdatedAt = fromNanos(updatedAt)
+	return conv, nil
+}
+
+// StartConversation writes a new conversation, its first miv and the
+// recipients' notifications in a single transaction
+func (s *SQLStorage) StartConversation(conv *models.Conversation, miv *models.ConversationMiv, notifs []*models.Notification) error {
+	err := s.withTx(func(tx conn) error {
+		if err := insertConversation(tx, conv); err != nil {
+			return err
+		}
+
+		miv.ConversationID = conv.ID
+		if err := insertConversationMiv(tx, miv); err != nil {
+			return err
+		}
+
+		for _, notif := range notifs {
+			notif.ConversationID = conv.ID
+			notif.MivID = miv.ID
+			if err := insertNotification(tx, notif); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	conv.MivCount = 1
+	conv.UpdatedAt = miv.CreatedAt
+	return s.loadParticipants(conv)
+}
+
+// insertConversation writes a conversation using the given connection or transaction
+func insertConversation(q queryer, conv *models.Conversation) error {
+	if conv.ID == "" {
+		id, err := nextID(q, "conv")
+		if err != nil {
+			return err
+		}
+		conv.ID = id
+	}
+
+	if conv.CreatedAt.IsZero() {
+		conv.CreatedAt = time.Now()
+	}
+	conv.UpdatedAt = conv.CreatedAt
+
+	_, err := q.Exec(`INSERT INTO conversations (`+conversationColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		conv.ID, conv.Subject, conv.DeskID, toNanos(conv.CreatedAt), toNanos(conv.UpdatedAt),
+		conv.MivCount, conv.IsArchived)
+	if err != nil {
+		return err
+	}
+
+	if err := insertParticipant(q, conv.ID, conv.DeskID, models.ParticipantRoleTo, conv.CreatedAt); err != nil {
+		return err
+	}
+	for _, p := range conv.Participants {
+		if err := insertParticipant(q, conv.ID, p.DeskID, p.Role, conv.CreatedAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertParticipant adds a desk to a conversation unless it already takes part
+func insertParticipant(q queryer, conversationID, deskID string, role models.ParticipantRole, joinedAt time.Time) error {
+	deskID = crypto.NormalizeDeskID(deskID)
+	if deskID == "" {
+		return nil
+	}
+	_, err := q.Exec(`INSERT INTO conversation_participants (conversation_id, desk_id, role, joined_at)
+		VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		conversationID, deskID, role, toNanos(joinedAt))
+	return err
+}
+
+// loadParticipants fills in the participants of each conversation
+func (s *SQLStorage) loadParticipants(convs ...*models.Conversation) error {
+	if len(convs) == 0 {
+		return nil
+	}
+	byID := make(map[string]*models.Conversation, len(convs))
+	ids := make([]interface{}, 0, len(convs))
+	for _, conv := range convs {
+		conv.Participants = nil
+		byID[conv.ID] = conv
+		ids = append(ids, conv.ID)
+	}
+
+	rows, err := s.conn().Query(`SELECT conversation_id, desk_id, role, joined_at FROM conversation_participants
+		WHERE conversation_id IN (`+placeholders(len(ids))+`) ORDER BY conversation_id, joined_at, desk_id`, ids...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var conversationID string
+		var joinedAt int64
+		p := &models.ConversationParticipant{}
+		if err := rows.Scan(&conversationID, &p.DeskID, &p.Role, &joinedAt); err != nil {
+			return err
+		}
+		p.JoinedAt = fromNanos(joinedAt)
+		if conv, ok := byID[conversationID]; ok {
+			conv.Participants = append(conv.Participants, p)
+		}
+	}
+	return rows.Err()
+}
+
+// GetConversation retrieves a conversation by ID
+func (s *SQLStorage) GetConversation(id string) (*models.Conversation, error) {
+	conv, err := scanConversation(s.conn().QueryRow(`SELECT `+conversationColumns+` FROM conversations WHERE id = ?`, id))
+	if err != nil {
+		return nil, notFound(err, "conversation not found: %s", id)
+	}
+	if err := s.loadParticipants(conv); err != nil {
+		return nil, err
+	}
+	return conv, nil
+}
+
+// ListConversationsByDesk retrieves all conversations the desk participates in
+func (s *SQLStorage) ListConversationsByDesk(deskID string) ([]*models.Conversation, error) {
+	rows, err := s.conn().Query(`SELECT `+conversationColumns+` FROM conversations
+		WHERE id IN (SELECT conversation_id FROM conversation_participants WHERE desk_id = ?)
+		ORDER BY updated_at DESC, id`,
+		crypto.NormalizeDeskID(deskID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*models.Conversation
+	for rows.Next() {
+		conv, err := scanConversation(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, conv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := s.loadParticipants(result...); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// unreadMivs selects a participant p's unread mivs in conversation c
+const unreadMivs = `conversation_miv_recipients r JOIN conversation_mivs m ON m.id = r.miv_id
+	WHERE m.conversation_id = c.id AND r.desk_id = p.desk_id AND r.read_at IS NULL`
+
+// ListConversationPage returns one page of a desk's conversations
+func (s *SQLStorage) ListConversationPage(deskID string, q ConversationQuery) ([]*models.ConversationWithLatest, error) {
+	query := `SELECT c.id, c.subject, c.desk_id, c.created_at, c.updated_at, c.miv_count, c.is_archived,
+			` + conversationStateColumns + `,
+			(SELECT COUNT(*) FROM ` + unreadMivs + `)
+		FROM conversations c JOIN conversation_participants p ON p.conversation_id = c.id
+		WHERE p.desk_id = ?`
+	args := []interface{}{crypto.NormalizeDeskID(deskID)}
+
+	if q.UnreadOnly {
+		query += ` AND EXISTS (SELECT 1 FROM ` + unreadMivs + `)`
+	}
+	if q.Archived != nil {
+		query += ` AND p.is_archived = ?`
+		args = append(args, *q.Archived)
+	}
+	if q.Counterpart != "" {
+		query += ` AND EXISTS (SELECT 1 FROM conversation_participants o WHERE o.conversation_id = c.id AND o.desk_id = ?)`
+		args = append(args, crypto.NormalizeDeskID(q.Counterpart))
+	}
+	if !q.Since.IsZero() {
+		query += ` AND c.updated_at >= ?`
+		args = append(args, toNanos(q.Since))
+	}
+	if !q.Until.IsZero() {
+		query += ` AND c.updated_at < ?`
+		args = append(args, toNanos(q.Until))
+	}
+	if q.After != nil {
+		// Pinned conversations come first, so a page ending among them
+		// continues into the unpinned ones
+		if q.After.Pinned {
+			query += ` AND (NOT p.is_pinned OR c.created_at < ? OR (c.created_at = ? AND c.id < ?))`
+		} else {
+			query += ` AND NOT p.is_pinned AND (c.created_at < ? OR (c.created_at = ? AND c.id < ?))`
+		}
+		args = append(args, toNanos(q.After.Time), toNanos(q.After.Time), q.After.ID)
+	}
+	query += ` ORDER BY p.is_pinned DESC, c.created_at DESC, c.id DESC`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.conn().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*models.ConversationWithLatest{}
+	var convs []*models.Conversation
+	for rows.Next() {
+		conv := &models.Conversation{}
+		state := &models.ConversationState{}
+		item := &models.ConversationWithLatest{Conversation: conv, State: state}
+		var createdAt, updatedAt int64
+		var stateUpdatedAt sql.NullInt64
+		err := rows.Scan(&conv.ID, &conv.Subject, &conv.DeskID, &createdAt, &updatedAt, &conv.MivCount, &conv.IsArchived,
+			&state.ConversationID, &state.DeskID, &state.IsArchived, &state.IsMuted, &state.IsPinned,
+			&state.LastReadSeq, &state.Basket, &stateUpdatedAt, &item.UnreadCount)
+		if err != nil {
+			return nil, err
+		}
+		conv.CreatedAt = fromNanos(createdAt)
+		conv.UpdatedAt = fromNanos(updatedAt)
+		if stateUpdatedAt.Valid {
+			state.UpdatedAt = fromNanos(stateUpdatedAt.Int64)
+		}
+		result = append(result, item)
+		convs = append(convs, conv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(result) == 0 {
+		return result, nil
+	}
+	if err := s.loadParticipants(convs...); err != nil {
+		return nil, err
+	}
+
+	// Load every conversation's latest miv in one go
+	ids := make([]interface{}, 0, len(convs))
+	for _, conv := range convs {
+		ids = append(ids, conv.ID)
+	}
+	latest, err := s.listMivsByID(`SELECT m.id FROM conversation_mivs m
+		WHERE m.conversation_id IN (`+placeholders(len(ids))+`)
+		  AND m.seq_no = (SELECT MAX(seq_no) FROM conversation_mivs WHERE conversation_id = m.conversation_id)`, ids...)
+	if err != nil {
+		return nil, err
+	}
+	byConversation := make(map[string]*models.ConversationMiv, len(latest))
+	for _, miv := range latest {
+		byConversation[miv.ConversationID] = miv
+	}
+	for _, item := range result {
+		item.LatestMiv = byConversation[item.Conversation.ID]
+	}
+	return result, nil
+}
+
+// UpdateConversation updates a conversation
+func (s *SQLStorage) UpdateConversation(conv *models.Conversation) error {
+	updatedAt := time.Now()
+	result, err := s.conn().Exec(`UPDATE conversations SET subject = ?, desk_id = ?, updated_at = ?, miv_count = ?, is_archived = ?
+		WHERE id = ?`,
+		conv.Subject, conv.DeskID, toNanos(updatedAt), conv.MivCount, conv.IsArchived, conv.ID)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result, "conversation not found: %s", conv.ID); err != nil {
+		return err
+	}
+
+	conv.UpdatedAt = updatedAt
+	return nil
+}
+
+const conversationMivColumns = `id, conversation_id, seq_no, from_desk, to_desk, subject, body, state, created_at,
+	sent_at, received_at, read_at, is_encrypted, sender_key_version, recipient_key_version, signature, is_ack, is_forgotten,
+	font_family, font_size, sender_basket, reply_by, follow_up_at`
+
+func scanConversationMiv(row rowScanner) (*models.ConversationMiv, error) {
+	miv := &models.ConversationMiv{}
+	var createdAt int64
+	var sentAt, receivedAt, readAt, replyBy, followUpAt sql.NullInt64
+	var fontFamily, fontSize sql.NullString
+	err := row.Scan(&miv.ID, &miv.ConversationID, &miv.SeqNo, &miv.From, &miv.To, &miv.Subject, &miv.Body,
+		&miv.State, &createdAt, &sentAt, &receivedAt, &readAt,
+		&miv.IsEncrypted, &miv.SenderKeyVersion, &miv.RecipientKeyVersion, &miv.Signature, &miv.IsAck, &miv.IsForgotten, &fontFamily, &fontSize,
+		&miv.SenderBasket, &replyBy, &followUpAt)
+	if err != nil {
+		return nil, err
+	}
+	miv.CreatedAt = fromNanos(createdAt)
+	miv.SentAt = timePtr(sentAt)
+	miv.ReceivedAt = timePtr(receivedAt)
+	miv.ReadAt = timePtr(readAt)
+	miv.ReplyBy = timePtr(replyBy)
+	miv.FollowUpAt = timePtr(followUpAt)
+	miv.FontFamily = stringPtr(fontFamily)
+	miv.FontSize = stringPtr(fontSize)
+	return miv, nil
+}
+
+// CreateConversationMiv creates a new miv in a conversation.
+// When the sequence number is assigned here, a concurrent reply may claim the
+// same one first; the unique (conversation_id, seq_no) constraint rejects the
+// loser, which then retries with a fresh number. A caller-chosen sequence
+// number that is already taken fails with ErrDuplicateSeqNo instead.
+func (s *SQLStorage) CreateConversationMiv(miv *models.ConversationMiv) error {
+	autoID := miv.ID == ""
+	autoSeqNo := miv.SeqNo == 0
+
+	for attempt := 0; ; attempt++ {
+		err := s.withTx(func(tx conn) error {
+			return insertConversationMiv(tx, miv)
+		})
+		if err == nil {
+			return nil
+		}
+
+		// The transaction rolled back, so anything assigned inside it is void
+		if autoID {
+			miv.ID = ""
+		}
+		if !s.dialect.isUniqueViolation(err) {
+			return err
+		}
+		if !autoSeqNo {
+			return fmt.Errorf("%w: %d in conversation %s", ErrDuplicateSeqNo, miv.SeqNo, miv.ConversationID)
+		}
+		if attempt >= maxSeqNoRetries {
+			return err
+		}
+		miv.SeqNo = 0
+	}
+}
+
+// insertConversationMiv writes a conversation miv and bumps the parent
+// conversation's miv count using the given connection or transaction
+func insertConversationMiv(q queryer, miv *models.ConversationMiv) error {
+	var exists int
+	if err := q.QueryRow(`SELECT COUNT(*) FROM conversations WHERE id = ?`, miv.ConversationID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return fmt.Errorf("conversation not found: %s", miv.ConversationID)
+	}
+
+	if miv.ID == "" {
+		id, err := nextID(q, "cmiv")
+		if err != nil {
+			return err
+		}
+		miv.ID = id
+	}
+
+	if miv.CreatedAt.IsZero() {
+		miv.CreatedAt = time.Now()
+	}
+
+	// Set sequence number
+	if miv.SeqNo == 0 {
+		err := q.QueryRow(`SELECT COALESCE(MAX(seq_no), 0) + 1 FROM conversation_mivs WHERE conversation_id = ?`,
+			miv.ConversationID).Scan(&miv.SeqNo)
+		if err != nil {
+			return err
+		}
+	}
+
+	miv.SenderBasket = sentBasket(miv)
+	_, err := q.Exec(`INSERT INTO conversation_mivs (`+conversationMivColumns+`, to_desk_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		miv.ID, miv.ConversationID, miv.SeqNo, miv.From, miv.To, miv.Subject, miv.Body, miv.State,
+		toNanos(miv.CreatedAt), nullableNanos(miv.SentAt), nullableNanos(miv.ReceivedAt), nullableNanos(miv.ReadAt),
+		miv.IsEncrypted, miv.SenderKeyVersion, miv.RecipientKeyVersion, miv.Signature, miv.IsAck, miv.IsForgotten, nullableString(miv.FontFamily), nullableString(miv.FontSize),
+		miv.SenderBasket, nullableNanos(miv.ReplyBy), nullableNanos(miv.FollowUpAt), crypto.NormalizeDeskID(miv.To))
+	if err != nil {
+		return err
+	}
+
+	defaultRecipients(miv)
+	if err := insertParticipant(q, miv.ConversationID, miv.From, models.ParticipantRoleTo, miv.CreatedAt); err != nil {
+		return err
+	}
+	for i, r := range miv.Recipients {
+		r.Basket = models.StateIN
+		if r.ReadAt != nil {
+			r.Basket = readBasket(miv, false)
+		}
+		_, err := q.Exec(`INSERT INTO conversation_miv_recipients (`+mivRecipientColumns+`, position)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			miv.ID, r.DeskID, r.Role, r.Body, r.KeyVersion, nullableNanos(r.ReadAt), r.Basket, r.ReceiptWithheld, i)
+		if err != nil {
+			return err
+		}
+		if err := insertParticipant(q, miv.ConversationID, r.DeskID, r.Role, miv.CreatedAt); err != nil {
+			return err
+		}
+	}
+
+	// Send the pending attachments with the miv and link the sent ones
+	for i, att := range miv.Attachments {
+		result, err := q.Exec(`UPDATE attachments SET conversation_id = ?, miv_id = ?, position = ?
+			WHERE id = ? AND desk_id = ? AND miv_id = ''`,
+			miv.ConversationID, miv.ID, i, att.ID, miv.From)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 1 {
+			att.ConversationID = miv.ConversationID
+			att.MivID = miv.ID
+			continue
+		}
+
+		sent, err := scanAttachment(q.QueryRow(`SELECT `+attachmentColumns+` FROM attachments WHERE id = ? AND miv_id <> ''`, att.ID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %s", ErrAttachmentUnavailable, att.ID)
+		} else if err != nil {
+			return err
+		}
+		_, err = q.Exec(`INSERT INTO attachment_links (miv_id, attachment_id, conversation_id, position) VALUES (?, ?, ?, ?)`,
+			miv.ID, att.ID, miv.ConversationID, i)
+		if err != nil {
+			return err
+		}
+		for _, ref := range attachmentBlobs(sent) {
+			if _, err := q.Exec(`UPDATE blobs SET refs = refs + 1 WHERE storage_key = ?`, ref.key); err != nil {
+				return err
+			}
+		}
+		*att = *sent
+	}
+
+	// Take the earlier mivs this one answers out of their baskets
+	sender := crypto.NormalizeDeskID(miv.From)
+	_, err = q.Exec(`UPDATE conversation_mivs SET sender_basket = ''
+		WHERE conversation_id = ? AND seq_no < ? AND from_desk <> ? AND sender_basket = ?`,
+		miv.ConversationID, miv.SeqNo, sender, models.StateSENT)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`UPDATE conversation_miv_recipients SET basket = ''
+		WHERE desk_id = ? AND basket = ?
+		  AND miv_id IN (SELECT id FROM conversation_mivs WHERE conversation_id = ? AND seq_no < ?)`,
+		sender, models.StatePENDING, miv.ConversationID, miv.SeqNo)
+	if err != nil {
+		return err
+	}
+
+	// Update conversation
+	_, err = q.Exec(`UPDATE conversations SET miv_count = miv_count + 1, updated_at = ? WHERE id = ?`,
+		toNanos(time.Now()), miv.ConversationID)
+	return err
+}
+
+const mivRecipientColumns = `miv_id, desk_id, role, body, key_version, read_at, basket, receipt_withheld`
+
+// receiptWithheldExpr is the read receipt setting of the desk of the
+// conversation_miv_recipients row being updated
+const receiptWithheldExpr = `COALESCE((SELECT d.disable_read_receipts FROM desks d WHERE d.id = conversation_miv_recipients.desk_id), FALSE)`
+
+// readBasketExpr is readBasket for the conversation_miv_recipients row being updated
+const readBasketExpr = `CASE WHEN EXISTS (SELECT 1 FROM conversation_mivs m WHERE m.id = conversation_miv_recipients.miv_id AND m.is_ack)
+	OR EXISTS (SELECT 1 FROM conversation_mivs m JOIN conversation_mivs later
+		ON later.conversation_id = m.conversation_id AND later.seq_no > m.seq_no AND later.from_desk = conversation_miv_recipients.desk_id
+		WHERE m.id = conversation_miv_recipients.miv_id)
+	THEN '' ELSE 'PENDING' END`
+
+// loadRecipients fills in the recipients of the mivs selected by the
+// condition on conversation_mivs (aliased m)
+func (s *SQLStorage) loadRecipients(mivs []*models.ConversationMiv, condition string, args ...interface{}) error {
+	byID := make(map[string]*models.ConversationMiv, len(mivs))
+	for _, miv := range mivs {
+		byID[miv.ID] = miv
+	}
+
+	rows, err := s.conn().Query(`SELECT r.miv_id, r.desk_id, r.role, r.body, r.key_version, r.read_at, r.basket, r.receipt_withheld
+		FROM conversation_miv_recipients r JOIN conversation_mivs m ON m.id = r.miv_id
+		WHERE `+condition+` ORDER BY r.miv_id, r.position`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var mivID string
+		var readAt sql.NullInt64
+		r := &models.MivRecipient{}
+		if err := rows.Scan(&mivID, &r.DeskID, &r.Role, &r.Body, &r.KeyVersion, &readAt, &r.Basket, &r.ReceiptWithheld); err != nil {
+			return err
+		}
+		r.ReadAt = timePtr(readAt)
+		if miv, ok := byID[mivID]; ok {
+			miv.Recipients = append(miv.Recipients, r)
+		}
+	}
+	return rows.Err()
+}
+
+// loadAttachments fills in the attachments of the mivs selected by the
+// condition on conversation_mivs (aliased m)
+func (s *SQLStorage) loadAttachments(mivs []*models.ConversationMiv, condition string, args ...interface{}) error {
+	byID := make(map[string]*models.ConversationMiv, len(mivs))
+	for _, miv := range mivs {
+		byID[miv.ID] = miv
+	}
+
+	// The miv's own attachments and the ones it links, in the order sent
+	rows, err := s.conn().Query(`SELECT owner, id, desk_id, conversation_id, miv_id, filename, content_type,
+		size, checksum, storage_key, width, height, thumbnails, created_at FROM (
+			SELECT m.id AS owner, a.position AS position, a.id, a.desk_id, a.conversation_id, a.miv_id, a.filename, a.content_type,
+				a.size, a.checksum, a.storage_key, a.width, a.height, a.thumbnails, a.created_at
+				FROM attachments a JOIN conversation_mivs m ON m.id = a.miv_id
+				WHERE `+condition+`
+			UNION ALL
+			SELECT m.id, l.position, a.id, a.desk_id, a.conversation_id, a.miv_id, a.filename, a.content_type,
+				a.size, a.checksum, a.storage_key, a.width, a.height, a.thumbnails, a.created_at
+				FROM attachment_links l JOIN attachments a ON a.id = l.attachment_id JOIN conversation_mivs m ON m.id = l.miv_id
+				WHERE `+condition+`
+		) sent ORDER BY owner, position`, append(append([]interface{}{}, args...), args...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var owner string
+		att, err := scanAttachment(ownedRow{rows, &owner})
+		if err != nil {
+			return err
+		}
+		if miv, ok := byID[owner]; ok {
+			miv.Attachments = append(miv.Attachments, att)
+		}
+	}
+	return rows.Err()
+}
+
+// GetConversationMivs retrieves all mivs for a conversation
+func (s *SQLStorage) GetConversationMivs(conversationID string) ([]*models.ConversationMiv, error) {
+	var exists int
+	if err := s.conn().QueryRow(`SELECT COUNT(*) FROM conversations WHERE id = ?`, conversationID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		return nil, fmt.Errorf("conversation not found: %s", conversationID)
+	}
+
+	rows, err := s.conn().Query(`SELECT `+conversationMivColumns+` FROM conversation_mivs
+		WHERE conversation_id = ? ORDER BY seq_no`, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*models.ConversationMiv{}
+	for rows.Next() {
+		miv, err := scanConversationMiv(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, miv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := s.loadRecipients(result, `m.conversation_id = ?`, conversationID); err != nil {
+		return nil, err
+	}
+	if err := s.loadAttachments(result, `m.conversation_id = ?`, conversationID); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// UpdateConversationMiv updates a miv in a conversation. Forgetting a miv is
+// the only update that moves it between baskets.
+func (s *SQLStorage) UpdateConversationMiv(miv *models.ConversationMiv) error {
+	result, err := s.conn().Exec(`UPDATE conversation_mivs SET seq_no = ?, from_desk = ?, to_desk = ?, to_desk_id = ?,
+		subject = ?, body = ?, state = ?, sent_at = ?, received_at = ?, read_at = ?, is_encrypted = ?,
+		sender_key_version = ?, recipient_key_version = ?, signature = ?, is_ack = ?, is_forgotten = ?, font_family = ?, font_size = ?,
+		sender_basket = CASE WHEN ? THEN '' ELSE sender_basket END
+		WHERE id = ? AND conversation_id = ?`,
+		miv.SeqNo, miv.From, miv.To, crypto.NormalizeDeskID(miv.To),
+		miv.Subject, miv.Body, miv.State, nullableNanos(miv.SentAt), nullableNanos(miv.ReceivedAt), nullableNanos(miv.ReadAt),
+		miv.IsEncrypted, miv.SenderKeyVersion, miv.RecipientKeyVersion, miv.Signature, miv.IsAck, miv.IsForgotten, nullableString(miv.FontFamily), nullableString(miv.FontSize),
+		miv.IsForgotten, miv.ID, miv.ConversationID)
+	if err != nil {
+		return err
+	}
+	if err := requireAffected(result, "miv not found: %s", miv.ID); err != nil {
+		return err
+	}
+	if miv.IsForgotten {
+		miv.SenderBasket = ""
+	}
+	return nil
+}
+
+// SetMivReplyBy sets or clears the time a miv's sender expects a reply by,
+// clearing any follow-up already raised for it
+func (s *SQLStorage) SetMivReplyBy(mivID string, replyBy *time.Time) error {
+	result, err := s.conn().Exec(`UPDATE conversation_mivs SET reply_by = ?, follow_up_at = NULL WHERE id = ?`,
+		nullableNanos(replyBy), mivID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, "miv not found: %s", mivID)
+}
+
+// ListDueFollowUps returns the mivs whose reply deadline has passed by now
+// while they are still in their sender's SENT basket and have not been
+// followed up, earliest deadline first
+func (s *SQLStorage) ListDueFollowUps(now time.Time) ([]*models.ConversationMiv, error) {
+	const due = `m.reply_by <= ? AND m.follow_up_at IS NULL AND m.sender_basket = ?`
+	rows, err := s.conn().Query(`SELECT `+conversationMivColumns+` FROM conversation_mivs m
+		WHERE `+due+` ORDER BY m.reply_by, m.id`, toNanos(now), models.StateSENT)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*models.ConversationMiv{}
+	for rows.Next() {
+		miv, err := scanConversationMiv(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, miv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(result) == 0 {
+		return result, nil
+	}
+	if err := s.loadRecipients(result, due, toNanos(now), models.StateSENT); err != nil {
+		return nil, err
+	}
+	if err := s.loadAttachments(result, due, toNanos(now), models.StateSENT); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ClaimFollowUp records when a miv's sender was reminded of its overdue
+// reply, unless a reminder is already recorded
+func (s *SQLStorage) ClaimFollowUp(mivID string, at time.Time) (bool, error) {
+	var claimed bool
+	err := s.withTx(func(tx conn) error {
+		result, err := tx.Exec(`UPDATE conversation_mivs SET follow_up_at = ? WHERE id = ? AND follow_up_at IS NULL`, toNanos(at), mivID)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			claimed = true
+			return nil
+		}
+		var exists int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM conversation_mivs WHERE id = ?`, mivID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return fmt.Errorf("miv not found: %s", mivID)
+		}
+		return nil
+	})
+	return claimed, err
+}
+
+// MarkConversationMivAsRead marks a specific miv as read
+func (s *SQLStorage) MarkConversationMivAsRead(mivID string, deskID string) error {
+	return s.withTx(func(tx conn) error {
+		var toDeskID string
+		if err := tx.QueryRow(`SELECT to_desk_id FROM conversation_mivs WHERE id = ?`, mivID).Scan(&toDeskID); err != nil {
+			return notFound(err, "miv not found: %s", mivID)
+		}
+
+		// Only mark as read if the miv is addressed to this desk
+		normalizedDeskID := crypto.NormalizeDeskID(deskID)
+		now := toNanos(time.Now())
+		result, err := tx.Exec(`UPDATE conversation_miv_recipients SET read_at = ?, receipt_withheld = `+receiptWithheldExpr+`, basket = `+readBasketExpr+`
+			WHERE miv_id = ? AND desk_id = ?`,
+			now, mivID, normalizedDeskID)
+		if err != nil {
+			return err
+		}
+		if err := requireAffected(result, "miv not found or not addressed to this desk"); err != nil {
+			return err
+		}
+
+		// The To desk's read state is also kept on the miv itself
+		if toDeskID != normalizedDeskID {
+			return nil
+		}
+		_, err = tx.Exec(`UPDATE conversation_mivs SET read_at = ?, state = ? WHERE id = ?`,
+			now, models.StatePENDING, mivID)
+		return err
+	})
+}
+
+// MarkConversationMivsAsRead marks all incoming unread mivs in a conversation as read for a specific desk
+func (s *SQLStorage) MarkConversationMivsAsRead(conversationID string, deskID string) error {
+	if _, err := s.GetConversation(conversationID); err != nil {
+		return err
+	}
+
+	now := toNanos(time.Now())
+	normalizedDeskID := crypto.NormalizeDeskID(deskID)
+	return s.withTx(func(tx conn) error {
+		_, err := tx.Exec(`UPDATE conversation_miv_recipients SET read_at = ?, receipt_withheld = `+receiptWithheldExpr+`, basket = `+readBasketExpr+`
+			WHERE desk_id = ? AND read_at IS NULL
+			  AND miv_id IN (SELECT id FROM conversation_mivs WHERE conversation_id = ?)`,
+			now, normalizedDeskID, conversationID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`UPDATE conversation_mivs SET read_at = ?
+			WHERE conversation_id = ? AND to_desk_id = ? AND read_at IS NULL`,
+			now, conversationID, normalizedDeskID)
+		return err
+	})
+}
+
+// GetConversationMiv retrieves a specific miv by ID
+func (s *SQLStorage) GetConversationMiv(mivID string) (*models.ConversationMiv, error) {
+	miv, err := scanConversationMiv(s.conn().QueryRow(`SELECT `+conversationMivColumns+` FROM conversation_mivs WHERE id = ?`, mivID))
+	if err != nil {
+		return nil, notFound(err, "miv not found: %s", mivID)
+	}
+	if err := s.loadRecipients([]*models.ConversationMiv{miv}, `m.id = ?`, mivID); err != nil {
+		return nil, err
+	}
+	if err := s.loadAttachments([]*models.ConversationMiv{miv}, `m.id = ?`, mivID); err != nil {
+		return nil, err
+	}
+	return miv, nil
+}
+
+// ListBasket returns the mivs in one of a desk's baskets, newest first. Each
+// basket is read through the (desk, basket) indexes on the miv and recipient
+// tables rather than by scanning the desk's conversations.
+func (s *SQLStorage) ListBasket(deskID string, basket models.MivState) ([]*models.ConversationMiv, error) {
+	deskID = crypto.NormalizeDeskID(deskID)
+	switch basket {
+	case models.StateSENT:
+		return s.listMivsByID(`SELECT id FROM conversation_mivs
+			WHERE from_desk = ? AND sender_basket = ?
+			  AND conversation_id IN (SELECT conversation_id FROM conversation_participants WHERE desk_id = ? AND NOT is_archived)`,
+			deskID, basket, deskID)
+	case models.StateARCHIVED:
+		return s.listMivsByID(`SELECT m.id FROM conversation_participants p
+			JOIN conversation_mivs m ON m.conversation_id = p.conversation_id
+			WHERE p.desk_id = ? AND p.is_archived
+			  AND m.seq_no = (SELECT MAX(seq_no) FROM conversation_mivs WHERE conversation_id = p.conversation_id)`,
+			deskID)
+	default:
+		return s.listMivsByID(`SELECT r.miv_id FROM conversation_miv_recipients r
+			JOIN conversation_mivs m ON m.id = r.miv_id
+			JOIN conversation_participants p ON p.conversation_id = m.conversation_id AND p.desk_id = r.desk_id
+			WHERE r.desk_id = ? AND r.basket = ? AND NOT p.is_archived`,
+			deskID, basket)
+	}
+}
+
+// listMivsByID loads the conversation mivs whose IDs idQuery selects, with
+// their recipients, newest first
+func (s *SQLStorage) listMivsByID(idQuery string, args ...interface{}) ([]*models.ConversationMiv, error) {
+	rows, err := s.conn().Query(`SELECT `+conversationMivColumns+` FROM conversation_mivs
+		WHERE id IN (`+idQuery+`) ORDER BY created_at DESC, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*models.ConversationMiv{}
+	for rows.Next() {
+		miv, err := scanConversationMiv(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, miv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if len(result) == 0 {
+		return result, nil
+	}
+	if err := s.loadRecipients(result, `m.id IN (`+idQuery+`)`, args...); err != nil {
+		return nil, err
+	}
+	if err := s.loadAttachments(result, `m.id IN (`+idQuery+`)`, args...); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// conversationStateColumns select participant p's own state. Its basket and
+// last-read seq are read from the per-miv baskets and reads: the conversation
+// sits in the first of IN, PENDING and SENT that holds one of its mivs.
+const conversationStateColumns = `p.conversation_id, p.desk_id, p.is_archived, p.is_muted, p.is_pinned,
+	COALESCE((SELECT MAX(m.seq_no) FROM conversation_mivs m WHERE m.conversation_id = p.conversation_id
+		AND (m.from_desk = p.desk_id OR EXISTS (SELECT 1 FROM conversation_miv_recipients r
+			WHERE r.miv_id = m.id AND r.desk_id = p.desk_id AND r.read_at IS NOT NULL))), 0),
+	CASE
+		WHEN EXISTS (SELECT 1 FROM conversation_miv_recipients r JOIN conversation_mivs m ON m.id = r.miv_id
+			WHERE m.conversation_id = p.conversation_id AND r.desk_id = p.desk_id AND r.basket = 'IN') THEN 'IN'
+		WHEN EXISTS (SELECT 1 FROM conversation_miv_recipients r JOIN conversation_mivs m ON m.id = r.miv_id
+			WHERE m.conversation_id = p.conversation_id AND r.desk_id = p.desk_id AND r.basket = 'PENDING') THEN 'PENDING'
+		WHEN EXISTS (SELECT 1 FROM conversation_mivs m
+			WHERE m.conversation_id = p.conversation_id AND m.from_desk = p.desk_id AND m.sender_basket = 'SENT') THEN 'SENT'
+		ELSE ''
+	END,
+	p.state_updated_at`
+
+// GetConversationState returns a participant's own view of a conversation
+func (s *SQLStorage) GetConversationState(conversationID, deskID string) (*models.ConversationState, error) {
+	return getConversationState(s.conn(), conversationID, crypto.NormalizeDeskID(deskID))
+}
+
+func getConversationState(q queryer, conversationID, deskID string) (*models.ConversationState, error) {
+	state := &models.ConversationState{}
+	var updatedAt sql.NullInt64
+	err := q.QueryRow(`SELECT `+conversationStateColumns+` FROM conversation_participants p
+		WHERE p.conversation_id = ? AND p.desk_id = ?`, conversationID, deskID).
+		Scan(&state.ConversationID, &state.DeskID, &state.IsArchived, &state.IsMuted, &state.IsPinned,
+			&state.LastReadSeq, &state.Basket, &updatedAt)
+	if err != nil {
+		return nil, notFound(err, "desk %s is not a participant in conversation %s", deskID, conversationID)
+	}
+	if updatedAt.Valid {
+		state.UpdatedAt = fromNanos(updatedAt.Int64)
+	}
+	return state, nil
+}
+
+// UpdateConversationState applies a change to a participant's own view of a
+// conversation
+func (s *SQLStorage) UpdateConversationState(conversationID, deskID string, change ConversationStateChange) (*models.ConversationState, bool, error) {
+	deskID = crypto.NormalizeDeskID(deskID)
+	var state *models.ConversationState
+	var changed bool
+	err := s.withTx(func(tx conn) error {
+		// Take the participant's row before reading it, so concurrent
+		// changes to the same state apply one after the other
+		result, err := tx.Exec(`UPDATE conversation_participants SET is_archived = is_archived
+			WHERE conversation_id = ? AND desk_id = ?`, conversationID, deskID)
+		if err != nil {
+			return err
+		}
+		if err := requireAffected(result, "desk %s is not a participant in conversation %s", deskID, conversationID); err != nil {
+			return err
+		}
+
+		state, err = getConversationState(tx, conversationID, deskID)
+		if err != nil {
+			return err
+		}
+		before := *state
+		change.apply(state)
+		if *state == before {
+			return nil
+		}
+
+		changed = true
+		state.UpdatedAt = time.Now()
+		_, err = tx.Exec(`UPDATE conversation_participants SET is_archived = ?, is_muted = ?, is_pinned = ?, state_updated_at = ?
+			WHERE conversation_id = ? AND desk_id = ?`,
+			state.IsArchived, state.IsMuted, state.IsPinned, toNanos(state.UpdatedAt), conversationID, deskID)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return state, changed, nil
+}
+
+// Notification methods
+
+const notificationColumns = `id, desk_id, type, miv_id, conversation_id, message, is_read, created_at, read_at, miv_read_at`
+
+func scanNotification(row rowScanner) (*models.Notification, error) {
+	notif := &models.Notification{}
+	var createdAt int64
+	var readAt, mivReadAt sql.NullInt64
+	err := row.Scan(&notif.ID, &notif.DeskID, &notif.Type, &notif.MivID, &notif.ConversationID,
+		&notif.Message, &notif.Read, &createdAt, &readAt, &mivReadAt)
+	if err != nil {
+		return nil, err
+	}
+	notif.CreatedAt = fromNanos(createdAt)
+	notif.ReadAt = timePtr(readAt)
+	notif.MivReadAt = timePtr(mivReadAt)
+	return notif, nil
+}
+
+// CreateNotification creates a new notification
+func (s *SQLStorage) CreateNotification(notif *models.Notification) error {
+	return s.withTx(func(tx conn) error {
+		return insertNotification(tx, notif)
+	})
+}
+
+// insertNotification writes a notification using the given connection or transaction
+func insertNotification(q queryer, notif *models.Notification) error {
+	if notif.ID == "" {
+		id, err := nextID(q, "notif")
+		if err != nil {
+			return err
+		}
+		notif.ID = id
+	}
+
+	if notif.CreatedAt.IsZero() {
+		notif.CreatedAt = time.Now()
+	}
+
+	_, err := q.Exec(`INSERT INTO notifications (`+notificationColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		notif.ID, notif.DeskID, notif.Type, notif.MivID, notif.ConversationID, notif.Message,
+		notif.Read, toNanos(notif.CreatedAt), nullableNanos(notif.ReadAt), nullableNanos(notif.MivReadAt))
+	return err
+}
+
+// GetNotification retrieves a notification by ID
+func (s *SQLStorage) GetNotification(id string) (*models.Notification, error) {
+	notif, err := scanNotification(s.conn().QueryRow(`SELECT `+notificationColumns+` FROM notifications WHERE id = ?`, id))
+	if err != nil {
+		return nil, notFound(err, "notification not found: %s", id)
+	}
+	return notif, nil
+}
+
+// ListNotificationsByDesk retrieves all notifications for a desk
+func (s *SQLStorage) ListNotificationsByDesk(deskID string, unreadOnly bool) ([]*models.Notification, error) {
+	query := `SELECT ` + notificationColumns + ` FROM notifications WHERE desk_id = ?`
+	if unreadOnly {
+		query += ` AND is_read = ?`
+	}
+	query += ` ORDER BY created_at, id`
+
+	args := []interface{}{deskID}
+	if unreadOnly {
+		args = append(args, false)
+	}
+
+	rows, err := s.conn().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*models.Notification{}
+	for rows.Next() {
+		notif, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, notif)
+	}
+	return result, rows.Err()
+}
+
+// ListNotificationPage returns one page of a desk's notifications, newest first
+func (s *SQLStorage) ListNotificationPage(deskID string, q NotificationQuery) ([]*models.Notification, error) {
+	query := `SELECT ` + notificationColumns + ` FROM notifications WHERE desk_id = ?`
+	args := []interface{}{deskID}
+	if q.UnreadOnly {
+		query += ` AND is_read = ?`
+		args = append(args, false)
+	}
+	if !q.Since.IsZero() {
+		query += ` AND created_at >= ?`
+		args = append(args, toNanos(q.Since))
+	}
+	if !q.Until.IsZero() {
+		query += ` AND created_at < ?`
+		args = append(args, toNanos(q.Until))
+	}
+	if q.After != nil {
+		query += ` AND (created_at < ? OR (created_at = ? AND id < ?))`
+		args = append(args, toNanos(q.After.Time), toNanos(q.After.Time), q.After.ID)
+	}
+	query += ` ORDER BY created_at DESC, id DESC`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.conn().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*models.Notification{}
+	for rows.Next() {
+		notif, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, notif)
+	}
+	return result, rows.Err()
+}
+
+// CountUnreadNotifications counts a desk's unread notifications
+func (s *SQLStorage) CountUnreadNotifications(deskID string) (int, error) {
+	var count int
+	err := s.conn().QueryRow(`SELECT COUNT(*) FROM notifications WHERE desk_id = ? AND is_read = ?`, deskID, false).Scan(&count)
+	return count, err
+}
+
+// MarkNotificationAsRead marks a notification as read
+func (s *SQLStorage) MarkNotificationAsRead(id string) error {
+	result, err := s.conn().Exec(`UPDATE notifications SET is_read = ?, read_at = ? WHERE id = ?`,
+		true, toNanos(time.Now()), id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, "notification not found: %s", id)
+}
+
+// Contact methods
+
+const contactColumns = `id, desk_id, name, first_name, last_name, greeting_name, desk_id_ref, notes, created_at, updated_at,
+	pinned_fingerprint, pinned_at`
+
+func scanContact(row rowScanner) (*models.Contact, error) {
+	contact := &models.Contact{}
+	var createdAt, updatedAt int64
+	var pinnedAt sql.NullInt64
+	err := row.Scan(&contact.ID, &contact.DeskID, &contact.Name, &contact.FirstName, &contact.LastName,
+		&contact.GreetingName, &contact.DeskIDRef, &contact.Notes, &createdAt, &updatedAt,
+		&contact.PinnedFingerprint, &pinnedAt)
+	if err != nil {
+		return nil, err
+	}
+	contact.CreatedAt = fromNanos(createdAt)
+	contact.UpdatedAt = fromNanos(updatedAt)
+	contact.PinnedAt = timePtr(pinnedAt)
+	return contact, nil
+}
+
+// CreateContact creates a new contact for a desk
+func (s *SQLStorage) CreateContact(contact *models.Contact) error {
+	return s.withTx(func(tx conn) error {
+		if contact.ID == "" {
+			id, err := nextID(tx, "contact")
+			if err != nil {
+				return err
+			}
+			contact.ID = id
+		}
+
+		now := time.Now()
+		if contact.CreatedAt.IsZero() {
+			contact.CreatedAt = now
+		}
+		contact.UpdatedAt = now
+
+		_, err := tx.Exec(`INSERT INTO contacts (`+contactColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			contact.ID, contact.DeskID, contact.Name, contact.FirstName, contact.LastName, contact.GreetingName,
+			contact.DeskIDRef, contact.Notes, toNanos(contact.CreatedAt), toNanos(contact.UpdatedAt),
+			contact.PinnedFingerprint, nullableNanos(contact.PinnedAt))
+		return err
+	})
+}
+
+// GetContact retrieves a contact by ID
+func (s *SQLStorage) GetContact(id string) (*models.Contact, error) {
+	contact, err := scanContact(s.conn().QueryRow(`SELECT `+contactColumns+` FROM contacts WHERE id = ?`, id))
+	if err != nil {
+		return nil, notFound(err, "contact not found: %s", id)
+	}
+	return contact, nil
+}
+
+// ListContactsForDesk retrieves all contacts for a desk
+func (s *SQLStorage) ListContactsForDesk(deskID string) ([]*models.Contact, error) {
+	rows, err := s.conn().Query(`SELECT `+contactColumns+` FROM contacts WHERE desk_id = ? ORDER BY created_at, id`, deskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*models.Contact{}
+	for rows.Next() {
+		contact, err := scanContact(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, contact)
+	}
+	return result, rows.Err()
+}
+
+// ListContactPage returns one page of a desk's contacts, oldest first
+func (s *SQLStorage) ListContactPage(deskID string, q ContactQuery) ([]*models.Contact, error) {
+	query := `SELECT ` + contactColumns + ` FROM contacts WHERE desk_id = ?`
+	args := []interface{}{deskID}
+	if q.After != nil {
+		query += ` AND (created_at > ? OR (created_at = ? AND id > ?))`
+		args = append(args, toNanos(q.After.Time), toNanos(q.After.Time), q.After.ID)
+	}
+	query += ` ORDER BY created_at, id`
+	if q.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+
+	rows, err := s.conn().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*models.Contact{}
+	for rows.Next() {
+		contact, err := scanContact(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, contact)
+	}
+	return result, rows.Err()
+}
+
+// UpdateContact updates an existing contact
+func (s *SQLStorage) UpdateContact(contact *models.Contact) error {
+	return s.withTx(func(tx conn) error {
+		existing, err := scanContact(tx.QueryRow(`SELECT `+contactColumns+` FROM contacts WHERE id = ?`, contact.ID))
+		if err != nil {
+			return notFound(err, "contact not found: %s", contact.ID)
+		}
+
+		// Update fields
+		if contact.Name != "" {
+			existing.Name = contact.Name
+		}
+		if contact.DeskIDRef != "" {
+			existing.DeskIDRef = contact.DeskIDRef
+		}
+		existing.FirstName = contact.FirstName
+		existing.LastName = contact.LastName
+		existing.GreetingName = contact.GreetingName
+		existing.Notes = contact.Notes
+		existing.PinnedFingerprint = contact.PinnedFingerprint
+		existing.PinnedAt = contact.PinnedAt
+		existing.UpdatedAt = time.Now()
+
+		_, err = tx.Exec(`UPDATE contacts SET name = ?, first_name = ?, last_name = ?, greeting_name = ?,
+			desk_id_ref = ?, notes = ?, pinned_fingerprint = ?, pinned_at = ?, updated_at = ? WHERE id = ?`,
+			existing.Name, existing.FirstName, existing.LastName, existing.GreetingName,
+			existing.DeskIDRef, existing.Notes, existing.PinnedFingerprint, nullableNanos(existing.PinnedAt),
+			toNanos(existing.UpdatedAt), existing.ID)
+		if err != nil {
+			return err
+		}
+
+		*contact = *existing
+		return nil
+	})
+}
+
+// DeleteContact deletes a contact
+func (s *SQLStorage) DeleteContact(id string) error {
+	result, err := s.conn().Exec(`DELETE FROM contacts WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, "contact not found: %s", id)
+}
+
+// GetContactByDeskIDRef finds a contact by desk ID reference
+func (s *SQLStorage) GetContactByDeskIDRef(deskID, deskIDRef string) (*models.Contact, error) {
+	contact, err := scanContact(s.conn().QueryRow(`SELECT `+contactColumns+` FROM contacts
+		WHERE desk_id = ? AND desk_id_ref = ? ORDER BY created_at, id LIMIT 1`, deskID, deskIDRef))
+	if err != nil {
+		return nil, notFound(err, "contact not found for desk ID: %s", deskIDRef)
+	}
+	return contact, nil
+}
+
+// Scheduled miv methods
+
+const scheduledMivColumns = `id, desk_id, conversation_id, to_desks, cc_desks, subject, body, is_ack, font_family, font_size,
+	send_at, key_version, error, created_at, updated_at, reply_by, attachment_ids,
+	new_conversation_id, bodies, is_encrypted, recipient_key_version, key_versions, seq_no, signature, claimed_at`
+
+func scanScheduledMiv(row rowScanner) (*models.ScheduledMiv, error) {
+	sched := &models.ScheduledMiv{State: models.StateSCHEDULED}
+	var fontFamily, fontSize sql.NullString
+	var sendAt, createdAt, updatedAt int64
+	var replyBy, claimedAt sql.NullInt64
+	var attachmentIDs, bodies, keyVersions string
+	err := row.Scan(&sched.ID, &sched.DeskID, &sched.ConversationID, &sched.To, &sched.Cc, &sched.Subject, &sched.Body,
+		&sched.IsAck, &fontFamily, &fontSize, &sendAt, &sched.KeyVersion, &sched.Error, &createdAt, &updatedAt, &replyBy, &attachmentIDs,
+		&sched.NewConversationID, &bodies, &sched.IsEncrypted, &sched.RecipientKeyVersion, &keyVersions, &sched.SeqNo, &sched.Signature, &claimedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(attachmentIDs), &sched.AttachmentIDs); err != nil {
+		return nil, fmt.Errorf("failed to decode scheduled miv attachments: %w", err)
+	}
+	if err := json.Unmarshal([]byte(bodies), &sched.Bodies); err != nil {
+		return nil, fmt.Errorf("failed to decode scheduled miv bodies: %w", err)
+	}
+	if err := json.Unmarshal([]byte(keyVersions), &sched.KeyVersions); err != nil {
+		return nil, fmt.Errorf("failed to decode scheduled miv key versions: %w", err)
+	}
+	sched.FontFamily = stringPtr(fontFamily)
+	sched.FontSize = stringPtr(fontSize)
+	sched.SendAt = fromNanos(sendAt)
+	sched.CreatedAt = fromNanos(createdAt)
+	sched.UpdatedAt = fromNanos(updatedAt)
+	sched.ReplyBy = timePtr(replyBy)
+	sched.ClaimedAt = timePtr(claimedAt)
+	return sched, nil
+}
+
+// scheduledSealing returns the JSON columns a scheduled miv's client-sealed
+// copies and their key versions are kept in
+func scheduledSealing(sched *models.ScheduledMiv) (bodies, keyVersions string, err error) {
+	encodedBodies, err := json.Marshal(sched.Bodies)
+	if err != nil {
+		return "", "", err
+	}
+	encodedVersions, err := json.Marshal(sched.KeyVersions)
+	if err != nil {
+		return "", "", err
+	}
+	return string(encodedBodies), string(encodedVersions), nil
+}
+
+// CreateScheduledMiv stores a miv to be sent later
+func (s *SQLStorage) CreateScheduledMiv(sched *models.ScheduledMiv) error {
+	return s.withTx(func(tx conn) error {
+		if sched.ID == "" {
+			id, err := nextID(tx, "sched")
+			if err != nil {
+				return err
+			}
+			sched.ID = id
+		}
+
+		now := time.Now()
+		sched.State = models.StateSCHEDULED
+		sched.CreatedAt = now
+		sched.UpdatedAt = now
+
+		attachmentIDs, err := encodeIDList(sched.AttachmentIDs)
+		if err != nil {
+			return err
+		}
+		bodies, keyVersions, err := scheduledSealing(sched)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO scheduled_mivs (`+scheduledMivColumns+`)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			sched.ID, sched.DeskID, sched.ConversationID, sched.To, sched.Cc, sched.Subject, sched.Body, sched.IsAck,
+			nullableString(sched.FontFamily), nullableString(sched.FontSize), toNanos(sched.SendAt), sched.KeyVersion,
+			sched.Error, toNanos(sched.CreatedAt), toNanos(sched.UpdatedAt), nullableNanos(sched.ReplyBy), attachmentIDs,
+			sched.NewConversationID, bodies, sched.IsEncrypted, sched.RecipientKeyVersion, keyVersions, sched.SeqNo, sched.Signature, nil)
+		return err
+	})
+}
+
+// GetScheduledMiv retrieves a scheduled miv by ID
+func (s *SQLStorage) GetScheduledMiv(id string) (*models.ScheduledMiv, error) {
+	sched, err := scanScheduledMiv(s.conn().QueryRow(`SELECT `+scheduledMivColumns+` FROM scheduled_mivs WHERE id = ?`, id))
+	if err != nil {
+		return nil, notFound(err, "scheduled miv not found: %s", id)
+	}
+	return sched, nil
+}
+
+// ListScheduledMivs returns a desk's scheduled mivs, soonest first
+func (s *SQLStorage) ListScheduledMivs(deskID string) ([]*models.ScheduledMiv, error) {
+	return s.listScheduledMivs(`WHERE desk_id = ?`, deskID)
+}
+
+// ListDueScheduledMivs returns the scheduled mivs due by now, soonest first,
+// leaving out those whose delivery failed
+func (s *SQLStorage) ListDueScheduledMivs(now time.Time) ([]*models.ScheduledMiv, error) {
+	return s.listScheduledMivs(`WHERE send_at <= ? AND error = ''`, toNanos(now))
+}
+
+// listScheduledMivs returns the scheduled mivs matching a WHERE clause,
+// soonest first
+func (s *SQLStorage) listScheduledMivs(where string, args ...interface{}) ([]*models.ScheduledMiv, error) {
+	rows, err := s.conn().Query(`SELECT `+scheduledMivColumns+` FROM scheduled_mivs `+where+` ORDER BY send_at, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*models.ScheduledMiv{}
+	for rows.Next() {
+		sched, err := scanScheduledMiv(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, sched)
+	}
+	return result, rows.Err()
+}
+
+// UpdateScheduledMiv replaces a scheduled miv's contents, keeping its desk,
+// conversation, claim and creation time
+func (s *SQLStorage) UpdateScheduledMiv(sched *models.ScheduledMiv) error {
+	return s.withTx(func(tx conn) error {
+		existing, err := scanScheduledMiv(tx.QueryRow(`SELECT `+scheduledMivColumns+` FROM scheduled_mivs WHERE id = ?`, sched.ID))
+		if err != nil {
+			return notFound(err, "scheduled miv not found: %s", sched.ID)
+		}
+
+		sched.DeskID = existing.DeskID
+		sched.ConversationID = existing.ConversationID
+		sched.ClaimedAt = nil
+		sched.State = models.StateSCHEDULED
+		sched.CreatedAt = existing.CreatedAt
+		sched.UpdatedAt = time.Now()
+
+		attachmentIDs, err := encodeIDList(sched.AttachmentIDs)
+		if err != nil {
+			return err
+		}
+		bodies, keyVersions, err := scheduledSealing(sched)
+		if err != nil {
+			return err
+		}
+		// A dispatcher may have claimed the miv since it was read
+		result, err := tx.Exec(`UPDATE scheduled_mivs SET to_desks = ?, cc_desks = ?, subject = ?, body = ?, is_ack = ?,
+			font_family = ?, font_size = ?, send_at = ?, reply_by = ?, attachment_ids = ?, key_version = ?, error = ?, updated_at = ?,
+			new_conversation_id = ?, bodies = ?, is_encrypted = ?, recipient_key_version = ?, key_versions = ?, seq_no = ?, signature = ?
+			WHERE id = ? AND claimed_at IS NULL`,
+			sched.To, sched.Cc, sched.Subject, sched.Body, sched.IsAck,
+			nullableString(sched.FontFamily), nullableString(sched.FontSize), toNanos(sched.SendAt), nullableNanos(sched.ReplyBy),
+			attachmentIDs, sched.KeyVersion, sched.Error, toNanos(sched.UpdatedAt),
+			sched.NewConversationID, bodies, sched.IsEncrypted, sched.RecipientKeyVersion, keyVersions, sched.SeqNo, sched.Signature, sched.ID)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			if err != nil {
+				return err
+			}
+			return ErrScheduledMivClaimed
+		}
+		return nil
+	})
+}
+
+// DeleteScheduledMiv removes a scheduled miv no dispatcher has claimed
+func (s *SQLStorage) DeleteScheduledMiv(id string) error {
+	return s.withTx(func(tx conn) error {
+		result, err := tx.Exec(`DELETE FROM scheduled_mivs WHERE id = ? AND claimed_at IS NULL`, id)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+		var exists int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM scheduled_mivs WHERE id = ?`, id).Scan(&exists); err != nil {
+			return err
+		}
+		if exists > 0 {
+			return ErrScheduledMivClaimed
+		}
+		return fmt.Errorf("scheduled miv not found: %s", id)
+	})
+}
+
+// ClaimScheduledMiv claims a due scheduled miv for delivery. The claim is a
+// single conditional update, so of several dispatchers sharing the database
+// only one sees it take effect.
+func (s *SQLStorage) ClaimScheduledMiv(id string, now, staleBefore time.Time) (bool, error) {
+	result, err := s.conn().Exec(`UPDATE scheduled_mivs SET claimed_at = ?
+		WHERE id = ? AND send_at <= ? AND error = '' AND (claimed_at IS NULL OR claimed_at < ?)`,
+		toNanos(now), id, toNanos(now), toNanos(staleBefore))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// FinishScheduledMiv removes a claimed scheduled miv once it is delivered
+func (s *SQLStorage) FinishScheduledMiv(id string) error {
+	result, err := s.conn().Exec(`DELETE FROM scheduled_mivs WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, "scheduled miv not found: %s", id)
+}
+
+// ReleaseScheduledMiv drops the claim on a scheduled miv whose delivery did
+// not go through, recording failure as its error
+func (s *SQLStorage) ReleaseScheduledMiv(id string, failure string) error {
+	result, err := s.conn().Exec(`UPDATE scheduled_mivs SET claimed_at = NULL, error = ?, updated_at = ? WHERE id = ?`,
+		failure, toNanos(time.Now()), id)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, "scheduled miv not found: %s", id)
+}
+
+// Attachment methods
+
+const attachmentColumns = `id, desk_id, conversation_id, miv_id, filename, content_type, size, checksum, storage_key,
+	width, height, thumbnails, created_at`
+
+// storedThumbnail is how a thumbnail is kept in the thumbnails column,
+// storage key included
+type storedThumbnail struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Size        int64  `json:"size"`
+	StorageKey  string `json:"storage_key"`
+}
+
+func encodeThumbnails(thumbnails []models.Thumbnail) (string, error) {
+	stored := make([]storedThumbnail, len(thumbnails))
+	for i, thumb := range thumbnails {
+		stored[i] = storedThumbnail{thumb.Name, thumb.ContentType, thumb.Width, thumb.Height, thumb.Size, thumb.StorageKey}
+	}
+	encoded, err := json.Marshal(stored)
+	return string(encoded), err
+}
+
+func decodeThumbnails(encoded string) ([]models.Thumbnail, error) {
+	var stored []storedThumbnail
+	if err := json.Unmarshal([]byte(encoded), &stored); err != nil {
+		return nil, fmt.Errorf("failed to decode attachment thumbnails: %w", err)
+	}
+	var thumbnails []models.Thumbnail
+	for _, thumb := range stored {
+		thumbnails = append(thumbnails, models.Thumbnail{
+			Name: thumb.Name, ContentType: thumb.ContentType, Width: thumb.Width, Height: thumb.Height,
+			Size: thumb.Size, StorageKey: thumb.StorageKey,
+		})
+	}
+	return thumbnails, nil
+}
+
+func scanAttachment(row rowScanner) (*models.Attachment, error) {
+	att := &models.Attachment{}
+	var thumbnails string
+	var createdAt int64
+	err := row.Scan(&att.ID, &att.DeskID, &att.ConversationID, &att.MivID, &att.Filename, &att.ContentType,
+		&att.Size, &att.Checksum, &att.StorageKey, &att.Width, &att.Height, &thumbnails, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	if att.Thumbnails, err = decodeThumbnails(thumbnails); err != nil {
+		return nil, err
+	}
+	att.CreatedAt = fromNanos(createdAt)
+	return att, nil
+}
+
+// CreateAttachment stores a pending attachment
+func (s *SQLStorage) CreateAttachment(att *models.Attachment, quota int64) error {
+	return s.withTx(func(tx conn) error {
+		if quota > 0 {
+			// Uploads to one desk queue on its row here until this one
+			// commits, so each sums the usage of those before it
+			_, err := tx.Exec(`INSERT INTO attachment_quota_locks (desk_id) VALUES (?)
+				ON CONFLICT (desk_id) DO UPDATE SET desk_id = excluded.desk_id`, att.DeskID)
+			if err != nil {
+				return err
+			}
+			used, err := deskAttachmentUsage(tx, att.DeskID)
+			if err != nil {
+				return err
+			}
+			if used+attachmentSize(att) > quota {
+				return ErrQuotaExceeded
+			}
+		}
+
+		if att.ID == "" {
+			id, err := nextID(tx, "att")
+			if err != nil {
+				return err
+			}
+			att.ID = id
+		}
+		att.ConversationID = ""
+		att.MivID = ""
+		att.CreatedAt = time.Now()
+
+		thumbnails, err := encodeThumbnails(att.Thumbnails)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO attachments (`+attachmentColumns+`, position) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0)`,
+			att.ID, att.DeskID, att.ConversationID, att.MivID, att.Filename, att.ContentType,
+			att.Size, att.Checksum, att.StorageKey, att.Width, att.Height, thumbnails, toNanos(att.CreatedAt))
+		if err != nil {
+			return err
+		}
+
+		for _, ref := range attachmentBlobs(att) {
+			result, err := tx.Exec(`INSERT INTO blobs (`+blobColumns+`) VALUES (?, ?, 1, ?, ?, ?, ?)
+				ON CONFLICT (storage_key) DO UPDATE SET refs = blobs.refs + 1 WHERE NOT blobs.collecting`,
+				ref.key, ref.size, true, false, toNanos(att.CreatedAt), toNanos(att.CreatedAt))
+			if err != nil {
+				return err
+			}
+			if n, err := result.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				return fmt.Errorf("%w: %s", ErrBlobBusy, ref.key)
+			}
+		}
+		return nil
+	})
+}
+
+// GetAttachment retrieves an attachment by ID
+func (s *SQLStorage) GetAttachment(id string) (*models.Attachment, error) {
+	att, err := scanAttachment(s.conn().QueryRow(`SELECT `+attachmentColumns+` FROM attachments WHERE id = ?`, id))
+	if err != nil {
+		return nil, notFound(err, "attachment not found: %s", id)
+	}
+	return att, nil
+}
+
+// ListAttachments returns the attachments a desk uploaded, newest first
+func (s *SQLStorage) ListAttachments(deskID string) ([]*models.Attachment, error) {
+	return listAttachments(s.conn(), deskID)
+}
+
+func listAttachments(q queryer, deskID string) ([]*models.Attachment, error) {
+	rows, err := q.Query(`SELECT `+attachmentColumns+` FROM attachments WHERE desk_id = ? ORDER BY created_at DESC, id DESC`, deskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*models.Attachment{}
+	for rows.Next() {
+		att, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, att)
+	}
+	return result, rows.Err()
+}
+
+// DeskAttachmentUsage returns the bytes of every attachment a desk
+// uploaded, thumbnails included
+func (s *SQLStorage) DeskAttachmentUsage(deskID string) (int64, error) {
+	return deskAttachmentUsage(s.conn(), deskID)
+}
+
+func deskAttachmentUsage(q queryer, deskID string) (int64, error) {
+	attachments, err := listAttachments(q, deskID)
+	if err != nil {
+		return 0, err
+	}
+	var used int64
+	for _, att := range attachments {
+		used += attachmentSize(att)
+	}
+	return used, nil
+}
+
+// ListAttachmentLinks returns the conversations with a miv that links a
+// sent attachment
+func (s *SQLStorage) ListAttachmentLinks(attachmentID string) ([]string, error) {
+	rows, err := s.conn().Query(`SELECT conversation_id FROM attachment_links WHERE attachment_id = ?`, attachmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []string{}
+	for rows.Next() {
+		var conversationID string
+		if err := rows.Scan(&conversationID); err != nil {
+			return nil, err
+		}
+		result = append(result, conversationID)
+	}
+	return result, rows.Err()
+}
+
+// DeleteAttachment removes a pending attachment
+func (s *SQLStorage) DeleteAttachment(id string) error {
+	return s.withTx(func(tx conn) error {
+		att, err := scanAttachment(tx.QueryRow(`SELECT `+attachmentColumns+` FROM attachments WHERE id = ? AND miv_id = ''`, id))
+		if err != nil {
+			return notFound(err, "pending attachment not found: %s", id)
+		}
+		if _, err := tx.Exec(`DELETE FROM attachments WHERE id = ?`, id); err != nil {
+			return err
+		}
+
+		now := toNanos(time.Now())
+		for _, ref := range attachmentBlobs(att) {
+			_, err := tx.Exec(`UPDATE blobs SET refs = refs - 1, released_at = CASE WHEN refs = 1 THEN ? ELSE released_at END
+				WHERE storage_key = ? AND refs > 0`, now, ref.key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Blob methods
+
+const blobColumns = `storage_key, size, refs, stored, collecting, released_at, created_at`
+
+func scanBlob(row rowScanner) (*models.Blob, error) {
+	blob := &models.Blob{}
+	var releasedAt, createdAt int64
+	if err := row.Scan(&blob.Key, &blob.Size, &blob.Refs, &blob.Stored, &blob.Collecting, &releasedAt, &createdAt); err != nil {
+		return nil, err
+	}
+	blob.ReleasedAt = fromNanos(releasedAt)
+	blob.CreatedAt = fromNanos(createdAt)
+	return blob, nil
+}
+
+// HoldBlob records a blob an upload is about to use and restarts its grace
+// period
+func (s *SQLStorage) HoldBlob(key string, size int64) (bool, error) {
+	var blob *models.Blob
+	err := s.withTx(func(tx conn) error {
+		now := toNanos(time.Now())
+		_, err := tx.Exec(`INSERT INTO blobs (`+blobColumns+`) VALUES (?, ?, 0, ?, ?, ?, ?)
+			ON CONFLICT (storage_key) DO UPDATE SET released_at = excluded.released_at`,
+			key, size, false, false, now, now)
+		if err != nil {
+			return err
+		}
+		blob, err = scanBlob(tx.QueryRow(`SELECT `+blobColumns+` FROM blobs WHERE storage_key = ?`, key))
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if blob.Collecting {
+		return false, fmt.Errorf("%w: %s", ErrBlobBusy, key)
+	}
+	return blob.Stored, nil
+}
+
+// MarkBlobStored records that a blob's bytes have been written
+func (s *SQLStorage) MarkBlobStored(key string) error {
+	result, err := s.conn().Exec(`UPDATE blobs SET stored = ? WHERE storage_key = ?`, true, key)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, "%w: %s", ErrBlobNotFound, key)
+}
+
+// GetBlob retrieves the record of a blob
+func (s *SQLStorage) GetBlob(key string) (*models.Blob, error) {
+	blob, err := scanBlob(s.conn().QueryRow(`SELECT `+blobColumns+` FROM blobs WHERE storage_key = ?`, key))
+	if err != nil {
+		return nil, notFound(err, "%w: %s", ErrBlobNotFound, key)
+	}
+	return blob, nil
+}
+
+// ListReleasedBlobs returns the blobs unreferenced since before, and those
+// already claimed, by key
+func (s *SQLStorage) ListReleasedBlobs(before time.Time) ([]*models.Blob, error) {
+	rows, err := s.conn().Query(`SELECT `+blobColumns+` FROM blobs
+		WHERE refs = 0 AND (collecting OR released_at < ?) ORDER BY storage_key`, toNanos(before))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*models.Blob{}
+	for rows.Next() {
+		blob, err := scanBlob(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, blob)
+	}
+	return result, rows.Err()
+}
+
+// ClaimBlob marks a blob for collection if it has been unreferenced since
+// before or has no record
+func (s *SQLStorage) ClaimBlob(key string, size int64, before time.Time) (bool, error) {
+	now := toNanos(time.Now())
+	result, err := s.conn().Exec(`INSERT INTO blobs (`+blobColumns+`) VALUES (?, ?, 0, ?, ?, ?, ?)
+		ON CONFLICT (storage_key) DO NOTHING`, key, size, true, true, now, now)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 1 {
+		return err == nil, err
+	}
+
+	result, err = s.conn().Exec(`UPDATE blobs SET collecting = ?
+		WHERE storage_key = ? AND refs = 0 AND (collecting OR released_at < ?)`, true, key, toNanos(before))
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// DeleteBlobRecord removes the record of a claimed blob
+func (s *SQLStorage) DeleteBlobRecord(key string) error {
+	result, err := s.conn().Exec(`DELETE FROM blobs WHERE storage_key = ? AND collecting`, key)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, "claimed blob not found: %s", key)
+}
+
+// Draft methods
+
+const draftColumns = `id, desk_id, conversation_id, to_desks, cc_desks, subject, body, is_encrypted, is_ack, font_family,
+	font_size, version, key_version, created_at, updated_at`
+
+func scanDraft(row rowScanner) (*models.Draft, error) {
+	draft := &models.Draft{}
+	var fontFamily, fontSize sql.NullString
+	var createdAt, updatedAt int64
+	err := row.Scan(&draft.ID, &draft.DeskID, &draft.ConversationID, &draft.To, &draft.Cc, &draft.Subject, &draft.Body,
+		&draft.IsEncrypted, &draft.IsAck, &fontFamily, &fontSize, &draft.Version, &draft.KeyVersion, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	draft.FontFamily = stringPtr(fontFamily)
+	draft.FontSize = stringPtr(fontSize)
+	draft.CreatedAt = fromNanos(createdAt)
+	draft.UpdatedAt = fromNanos(updatedAt)
+	return draft, nil
+}
+
+// CreateDraft stores a new draft at version 1
+func (s *SQLStorage) CreateDraft(draft *models.Draft) error {
+	return s.withTx(func(tx conn) error {
+		if draft.ID == "" {
+			id, err := nextID(tx, "draft")
+			if err != nil {
+				return err
+			}
+			draft.ID = id
+		}
+
+		now := time.Now()
+		draft.Version = 1
+		draft.CreatedAt = now
+		draft.UpdatedAt = now
+
+		_, err := tx.Exec(`INSERT INTO drafts (`+draftColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			draft.ID, draft.DeskID, draft.ConversationID, draft.To, draft.Cc, draft.Subject, draft.Body, draft.IsEncrypted, draft.IsAck,
+			nullableString(draft.FontFamily), nullableString(draft.FontSize), draft.Version, draft.KeyVersion,
+			toNanos(draft.CreatedAt), toNanos(draft.UpdatedAt))
+		return err
+	})
+}
+
+// GetDraft retrieves a draft by ID
+func (s *SQLStorage) GetDraft(id string) (*models.Draft, error) {
+	draft, err := scanDraft(s.conn().QueryRow(`SELECT `+draftColumns+` FROM drafts WHERE id = ?`, id))
+	if err != nil {
+		return nil, notFound(err, "draft not found: %s", id)
+	}
+	return draft, nil
+}
+
+// ListDrafts returns a desk's drafts, most recently saved first
+func (s *SQLStorage) ListDrafts(deskID string) ([]*models.Draft, error) {
+	rows, err := s.conn().Query(`SELECT `+draftColumns+` FROM drafts WHERE desk_id = ? ORDER BY updated_at DESC, id DESC`, deskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*models.Draft{}
+	for rows.Next() {
+		draft, err := scanDraft(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, draft)
+	}
+	return result, rows.Err()
+}
+
+// UpdateDraft replaces a draft's contents if the stored version still equals
+// expectedVersion, bumping the version
+func (s *SQLStorage) UpdateDraft(draft *models.Draft, expectedVersion int) error {
+	return s.withTx(func(tx conn) error {
+		existing, err := scanDraft(tx.QueryRow(`SELECT `+draftColumns+` FROM drafts WHERE id = ?`, draft.ID))
+		if err != nil {
+			return notFound(err, "draft not found: %s", draft.ID)
+		}
+
+		draft.DeskID = existing.DeskID
+		draft.ConversationID = existing.ConversationID
+		draft.Version = expectedVersion + 1
+		draft.CreatedAt = existing.CreatedAt
+		draft.UpdatedAt = time.Now()
+
+		result, err := tx.Exec(`UPDATE drafts SET to_desks = ?, cc_desks = ?, subject = ?, body = ?, is_encrypted = ?,
+			is_ack = ?, font_family = ?, font_size = ?, version = ?, key_version = ?, updated_at = ? WHERE id = ? AND version = ?`,
+			draft.To, draft.Cc, draft.Subject, draft.Body, draft.IsEncrypted, draft.IsAck,
+			nullableString(draft.FontFamily), nullableString(draft.FontSize), draft.Version, draft.KeyVersion,
+			toNanos(draft.UpdatedAt), draft.ID, expectedVersion)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrVersionConflict
+		}
+		return nil
+	})
+}
+
+// DeleteDraft removes a draft if the stored version still equals
+// expectedVersion (0 for any version)
+func (s *SQLStorage) DeleteDraft(id string, expectedVersion int) error {
+	return s.withTx(func(tx conn) error {
+		var version int
+		if err := tx.QueryRow(`SELECT version FROM drafts WHERE id = ?`, id).Scan(&version); err != nil {
+			return notFound(err, "draft not found: %s", id)
+		}
+		if expectedVersion != 0 && version != expectedVersion {
+			return ErrVersionConflict
+		}
+
+		result, err := tx.Exec(`DELETE FROM drafts WHERE id = ? AND version = ?`, id, version)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrVersionConflict
+		}
+		return nil
+	})
+}
+
+// Key backup methods
+
+// SaveKeyBackup stores a desk's key backup if the stored version still equals
+// expectedVersion (0 when no backup may exist yet), bumping the version
+func (s *SQLStorage) SaveKeyBackup(backup *models.KeyBackup, expectedVersion int) error {
+	now := time.Now()
+	err := s.withTx(func(tx conn) error {
+		if expectedVersion == 0 {
+			_, err := tx.Exec(`INSERT INTO key_backups (desk_id, version, blob, created_at, updated_at) VALUES (?, 1, ?, ?, ?)`,
+				backup.DeskID, backup.Blob, toNanos(now), toNanos(now))
+			if err != nil && s.dialect.isUniqueViolation(err) {
+				return ErrVersionConflict
+			}
+			return err
+		}
+
+		result, err := tx.Exec(`UPDATE key_backups SET version = version + 1, blob = ?, updated_at = ?
+			WHERE desk_id = ? AND version = ?`,
+			backup.Blob, toNanos(now), backup.DeskID, expectedVersion)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrVersionConflict
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	stored, err := s.GetKeyBackup(backup.DeskID)
+	if err != nil {
+		return err
+	}
+	*backup = *stored
+	return nil
+}
+
+// GetKeyBackup retrieves a desk's key backup
+func (s *SQLStorage) GetKeyBackup(deskID string) (*models.KeyBackup, error) {
+	backup := &models.KeyBackup{}
+	var createdAt, updatedAt int64
+	err := s.conn().QueryRow(`SELECT desk_id, version, blob, created_at, updated_at FROM key_backups WHERE desk_id = ?`, deskID).
+		Scan(&backup.DeskID, &backup.Version, &backup.Blob, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, notFound(err, "key backup not found: %s", deskID)
+	}
+	backup.CreatedAt = fromNanos(createdAt)
+	backup.UpdatedAt = fromNanos(updatedAt)
+	return backup, nil
+}
+
+// DeleteKeyBackup removes a desk's key backup
+func (s *SQLStorage) DeleteKeyBackup(deskID string) error {
+	result, err := s.conn().Exec(`DELETE FROM key_backups WHERE desk_id = ?`, deskID)
+	if err != nil {
+		return err
+	}
+	return requireAffected(result, "key backup not found: %s", deskID)
+}
+
+// Event methods
+
+const eventColumns = `seq, desk_id, type, data, created_at`
+
+func scanEvent(row rowScanner) (*models.Event, error) {
+	event := &models.Event{}
+	var data string
+	var createdAt int64
+	if err := row.Scan(&event.Seq, &event.DeskID, &event.Type, &data, &createdAt); err != nil {
+		return nil, err
+	}
+	event.Data = json.RawMessage(data)
+	event.CreatedAt = fromNanos(createdAt)
+	return event, nil
+}
+
+// AppendEvents adds events to the log, each with the next sequence number
+// and its data encoded as JSON. The numbers are taken from a counter row
+// that stays locked until the events are committed, so the log grows in
+// commit order and a reader never sees a later event before an earlier one.
+func (s *SQLStorage) AppendEvents(events []*models.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	encoded := make([]string, len(events))
+	for i, event := range events {
+		data, err := json.Marshal(event.Data)
+		if err != nil {
+			return err
+		}
+		encoded[i] = string(data)
+	}
+
+	return s.withTx(func(tx conn) error {
+		var last int64
+		err := tx.QueryRow(`UPDATE id_sequences SET value = value + ? WHERE name = 'event' RETURNING value`, len(events)).Scan(&last)
+		if err != nil {
+			return fmt.Errorf("failed to allocate event sequence numbers: %w", err)
+		}
+
+		now := time.Now()
+		for i, event := range events {
+			seq := last - int64(len(events)-1-i)
+			_, err := tx.Exec(`INSERT INTO events (`+eventColumns+`) VALUES (?, ?, ?, ?, ?)`,
+				seq, event.DeskID, event.Type, encoded[i], toNanos(now))
+			if err != nil {
+				return err
+			}
+		}
+		for i, event := range events {
+			event.Seq = last - int64(len(events)-1-i)
+			event.Data = json.RawMessage(encoded[i])
+			event.CreatedAt = now
+		}
+		return nil
+	})
+}
+
+// ListEvents returns up to limit events logged after afterSeq, oldest first
+func (s *SQLStorage) ListEvents(afterSeq int64, limit int) ([]*models.Event, error) {
+	return s.queryEvents(`SELECT `+eventColumns+` FROM events WHERE seq > ? ORDER BY seq LIMIT ?`, afterSeq, limit)
+}
+
+// ListDeskEvents returns a desk's events logged after afterSeq up to and
+// including throughSeq, oldest first
+func (s *SQLStorage) ListDeskEvents(deskID string, afterSeq, throughSeq int64) ([]*models.Event, error) {
+	return s.queryEvents(`SELECT `+eventColumns+` FROM events WHERE desk_id = ? AND seq > ? AND seq <= ? ORDER BY seq`,
+		deskID, afterSeq, throughSeq)
+}
+
+func (s *SQLStorage) queryEvents(query string, args ...interface{}) ([]*models.Event, error) {
+	rows, err := s.conn().Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*models.Event{}
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, event)
+	}
+	return result, rows.Err()
+}
+
+// EventSeqRange returns the lowest and highest sequence numbers of the
+// events kept, or zeros when there are none
+func (s *SQLStorage) EventSeqRange() (int64, int64, error) {
+	var oldest, latest int64
+	err := s.conn().QueryRow(`SELECT COALESCE(MIN(seq), 0), COALESCE(MAX(seq), 0) FROM events`).Scan(&oldest, &latest)
+	return oldest, latest, err
+}
+
+// DeleteEventsBefore drops the events logged before a time
+func (s *SQLStorage) DeleteEventsBefore(before time.Time) error {
+	_, err := s.conn().Exec(`DELETE FROM events WHERE created_at < ?`, toNanos(before))
+	return err
+}
+
+// Server secret methods
+
+// ServerSecret returns the secret kept under name, generating it the first
+// time. Concurrent first calls race to insert, and all read back the winner.
+func (s *SQLStorage) ServerSecret(name string, size int) ([]byte, error) {
+	secret, err := crypto.GenerateSecret(size)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.conn().Exec(`INSERT INTO server_secrets (name, secret) VALUES (?, ?) ON CONFLICT (name) DO NOTHING`,
+		name, base64.StdEncoding.EncodeToString(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded string
+	if err := s.conn().QueryRow(`SELECT secret FROM server_secrets WHERE name = ?`, name).Scan(&encoded); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
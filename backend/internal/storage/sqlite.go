@@ -0,0 +1,555 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"modernc.org/sqlite" // Pure-Go SQLite driver, keeps CGO_ENABLED=0 builds working
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var sqliteDialect = dialect{
+	name: DriverSQLite,
+	isUniqueViolation: func(err error) bool {
+		var sqliteErr *sqlite.Error
+		if errors.As(err, &sqliteErr) {
+			code := sqliteErr.Code()
+			return code == sqlite3.SQLITE_CONSTRAINT_UNIQUE || code == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+		}
+		return false
+	},
+}
+
+// NewSQLiteStorage opens (creating if needed) the SQLite database at path and
+// brings its schema up to date
+func NewSQLiteStorage(path string) (*SQLStorage, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create database directory: %w", err)
+		}
+	}
+
+	dsn := fmt.Sprintf("file:%s?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
+	}
+
+	// SQLite allows a single writer; serializing through one connection avoids
+	// SQLITE_BUSY errors when transactions overlap
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(db, sqliteDialect, sqliteMigrations); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLStorage{db: db, dialect: sqliteDialect}, nil
+}
+
+// sqliteMigrations is the ordered SQLite schema history. Never edit an entry
+// that has shipped; append a new one instead.
+var sqliteMigrations = []migration{
+	{
+		version: 1,
+		statements: []string{
+			`CREATE TABLE id_sequences (
+				name  TEXT PRIMARY KEY,
+				value INTEGER NOT NULL
+			)`,
+			`INSERT INTO id_sequences (name, value) VALUES
+				('miv', 0), ('acc', 0), ('conv', 0), ('cmiv', 0), ('notif', 0), ('contact', 0)`,
+
+			`CREATE TABLE identity (
+				slot       INTEGER PRIMARY KEY CHECK (slot = 1),
+				id         TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				name       TEXT NOT NULL
+			)`,
+
+			`CREATE TABLE mivs (
+				id           TEXT PRIMARY KEY,
+				from_desk    TEXT NOT NULL,
+				to_desk      TEXT NOT NULL,
+				subject      TEXT NOT NULL,
+				body         TEXT NOT NULL,
+				state        TEXT NOT NULL,
+				created_at   INTEGER NOT NULL,
+				sent_at      INTEGER,
+				received_at  INTEGER,
+				is_encrypted INTEGER NOT NULL,
+				font_family  TEXT,
+				font_size    TEXT
+			)`,
+			`CREATE INDEX idx_mivs_state ON mivs (state)`,
+
+			`CREATE TABLE accounts (
+				id                  TEXT PRIMARY KEY,
+				username            TEXT NOT NULL UNIQUE,
+				password_hash       TEXT NOT NULL,
+				display_name        TEXT NOT NULL,
+				created_at          INTEGER NOT NULL,
+				updated_at          INTEGER NOT NULL,
+				desks               TEXT NOT NULL,
+				active_desk         TEXT NOT NULL,
+				birthday_hash       TEXT NOT NULL,
+				first_pet_name_hash TEXT NOT NULL,
+				mother_maiden_hash  TEXT NOT NULL
+			)`,
+
+			`CREATE TABLE sessions (
+				token      TEXT PRIMARY KEY,
+				account_id TEXT NOT NULL REFERENCES accounts (id) ON DELETE CASCADE,
+				created_at INTEGER NOT NULL,
+				expires_at INTEGER NOT NULL
+			)`,
+			`CREATE INDEX idx_sessions_expires_at ON sessions (expires_at)`,
+
+			`CREATE TABLE desks (
+				id                 TEXT PRIMARY KEY,
+				account_id         TEXT NOT NULL,
+				public_key         TEXT NOT NULL,
+				private_key        BLOB,
+				name               TEXT NOT NULL,
+				created_at         INTEGER NOT NULL,
+				auto_indent        INTEGER NOT NULL,
+				font_family        TEXT NOT NULL,
+				font_size          TEXT NOT NULL,
+				default_salutation TEXT NOT NULL,
+				default_closure    TEXT NOT NULL
+			)`,
+			`CREATE INDEX idx_desks_account_id ON desks (account_id)`,
+
+			`CREATE TABLE conversations (
+				id          TEXT PRIMARY KEY,
+				subject     TEXT NOT NULL,
+				desk_id     TEXT NOT NULL,
+				created_at  INTEGER NOT NULL,
+				updated_at  INTEGER NOT NULL,
+				miv_count   INTEGER NOT NULL,
+				is_archived INTEGER NOT NULL
+			)`,
+			`CREATE INDEX idx_conversations_desk_id ON conversations (desk_id)`,
+
+			`CREATE TABLE conversation_mivs (
+				id              TEXT PRIMARY KEY,
+				conversation_id TEXT NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+				seq_no          INTEGER NOT NULL,
+				from_desk       TEXT NOT NULL,
+				to_desk         TEXT NOT NULL,
+				to_desk_id      TEXT NOT NULL,
+				subject         TEXT NOT NULL,
+				body            TEXT NOT NULL,
+				state           TEXT NOT NULL,
+				created_at      INTEGER NOT NULL,
+				sent_at         INTEGER,
+				received_at     INTEGER,
+				read_at         INTEGER,
+				is_encrypted    INTEGER NOT NULL,
+				is_ack          INTEGER NOT NULL,
+				is_forgotten    INTEGER NOT NULL,
+				font_family     TEXT,
+				font_size       TEXT,
+				UNIQUE (conversation_id, seq_no)
+			)`,
+			`CREATE INDEX idx_conversation_mivs_to_desk_id ON conversation_mivs (to_desk_id)`,
+			`CREATE INDEX idx_conversation_mivs_from_desk ON conversation_mivs (from_desk)`,
+
+			`CREATE TABLE notifications (
+				id              TEXT PRIMARY KEY,
+				desk_id         TEXT NOT NULL,
+				type            TEXT NOT NULL,
+				miv_id          TEXT NOT NULL,
+				conversation_id TEXT NOT NULL,
+				message         TEXT NOT NULL,
+				is_read         INTEGER NOT NULL,
+				created_at      INTEGER NOT NULL,
+				read_at         INTEGER
+			)`,
+			`CREATE INDEX idx_notifications_desk_id ON notifications (desk_id, created_at)`,
+
+			`CREATE TABLE contacts (
+				id            TEXT PRIMARY KEY,
+				desk_id       TEXT NOT NULL,
+				name          TEXT NOT NULL,
+				first_name    TEXT NOT NULL,
+				last_name     TEXT NOT NULL,
+				greeting_name TEXT NOT NULL,
+				desk_id_ref   TEXT NOT NULL,
+				notes         TEXT NOT NULL,
+				created_at    INTEGER NOT NULL,
+				updated_at    INTEGER NOT NULL
+			)`,
+			`CREATE INDEX idx_contacts_desk_id ON contacts (desk_id)`,
+		},
+	},
+	{
+		version: 2,
+		statements: []string{
+			`CREATE TABLE key_backups (
+				desk_id    TEXT PRIMARY KEY,
+				version    INTEGER NOT NULL,
+				blob       TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				updated_at INTEGER NOT NULL
+			)`,
+		},
+	},
+	{
+		version: 3,
+		statements: []string{
+			`CREATE TABLE desk_keys (
+				desk_id     TEXT NOT NULL REFERENCES desks (id) ON DELETE CASCADE,
+				version     INTEGER NOT NULL,
+				public_key  TEXT NOT NULL,
+				private_key BLOB,
+				created_at  INTEGER NOT NULL,
+				retired_at  INTEGER,
+				PRIMARY KEY (desk_id, version)
+			)`,
+			`INSERT INTO desk_keys (desk_id, version, public_key, private_key, created_at)
+				SELECT id, 1, public_key, private_key, created_at FROM desks`,
+			`ALTER TABLE desks ADD COLUMN key_version INTEGER NOT NULL DEFAULT 1`,
+			`ALTER TABLE desks DROP COLUMN private_key`,
+
+			`ALTER TABLE conversation_mivs ADD COLUMN sender_key_version INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE conversation_mivs ADD COLUMN recipient_key_version INTEGER NOT NULL DEFAULT 0`,
+			`UPDATE conversation_mivs SET sender_key_version = 1, recipient_key_version = 1 WHERE is_encrypted = 1`,
+		},
+	},
+	{
+		version: 4,
+		statements: []string{
+			`ALTER TABLE desk_keys ADD COLUMN signing_key TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE desk_keys ADD COLUMN signing_private_key BLOB`,
+			`ALTER TABLE desks ADD COLUMN signing_key TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE conversation_mivs ADD COLUMN signature TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 5,
+		statements: []string{
+			`ALTER TABLE contacts ADD COLUMN pinned_fingerprint TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE contacts ADD COLUMN pinned_at INTEGER`,
+		},
+	},
+	{
+		version: 6,
+		statements: []string{
+			`ALTER TABLE desks ADD COLUMN disable_read_receipts INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE notifications ADD COLUMN miv_read_at INTEGER`,
+		},
+	},
+	{
+		version: 7,
+		statements: []string{
+			`CREATE TABLE conversation_participants (
+				conversation_id TEXT NOT NULL REFERENCES conversations (id) ON DELETE CASCADE,
+				desk_id         TEXT NOT NULL,
+				role            TEXT NOT NULL,
+				joined_at       INTEGER NOT NULL,
+				PRIMARY KEY (conversation_id, desk_id)
+			)`,
+			`CREATE INDEX idx_conversation_participants_desk_id ON conversation_participants (desk_id)`,
+			`INSERT INTO conversation_participants (conversation_id, desk_id, role, joined_at)
+				SELECT id, desk_id, 'to', created_at FROM conversations WHERE desk_id <> ''
+				ON CONFLICT DO NOTHING`,
+			`INSERT INTO conversation_participants (conversation_id, desk_id, role, joined_at)
+				SELECT conversation_id, from_desk, 'to', MIN(created_at) FROM conversation_mivs
+				WHERE true GROUP BY conversation_id, from_desk
+				ON CONFLICT DO NOTHING`,
+			`INSERT INTO conversation_participants (conversation_id, desk_id, role, joined_at)
+				SELECT conversation_id, to_desk_id, 'to', MIN(created_at) FROM conversation_mivs
+				WHERE true GROUP BY conversation_id, to_desk_id
+				ON CONFLICT DO NOTHING`,
+
+			`CREATE TABLE conversation_miv_recipients (
+				miv_id      TEXT NOT NULL REFERENCES conversation_mivs (id) ON DELETE CASCADE,
+				desk_id     TEXT NOT NULL,
+				position    INTEGER NOT NULL,
+				role        TEXT NOT NULL,
+				body        TEXT NOT NULL,
+				key_version INTEGER NOT NULL,
+				read_at     INTEGER,
+				PRIMARY KEY (miv_id, desk_id)
+			)`,
+			`CREATE INDEX idx_conversation_miv_recipients_desk_id ON conversation_miv_recipients (desk_id)`,
+			`INSERT INTO conversation_miv_recipients (miv_id, desk_id, position, role, body, key_version, read_at)
+				SELECT id, to_desk_id, 0, 'to', '', recipient_key_version, read_at FROM conversation_mivs`,
+		},
+	},
+	{
+		version: 8,
+		statements: []string{
+			`ALTER TABLE conversation_participants ADD COLUMN is_archived INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE conversation_participants ADD COLUMN is_muted INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE conversation_participants ADD COLUMN is_pinned INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE conversation_participants ADD COLUMN last_read_seq INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE conversation_participants ADD COLUMN basket TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE conversation_participants ADD COLUMN state_updated_at INTEGER`,
+			`UPDATE conversation_participants SET is_archived = (SELECT c.is_archived FROM conversations c
+				WHERE c.id = conversation_participants.conversation_id)`,
+			`UPDATE conversation_participants SET last_read_seq = COALESCE((SELECT MAX(m.seq_no) FROM conversation_mivs m
+				WHERE m.conversation_id = conversation_participants.conversation_id
+				AND (m.from_desk = conversation_participants.desk_id OR EXISTS (SELECT 1 FROM conversation_miv_recipients r
+					WHERE r.miv_id = m.id AND r.desk_id = conversation_participants.desk_id AND r.read_at IS NOT NULL))), 0)`,
+			`UPDATE conversation_participants SET basket = CASE
+				WHEN EXISTS (SELECT 1 FROM conversation_miv_recipients r JOIN conversation_mivs m ON m.id = r.miv_id
+					WHERE m.conversation_id = conversation_participants.conversation_id
+					AND r.desk_id = conversation_participants.desk_id AND r.read_at IS NULL) THEN 'IN'
+				WHEN EXISTS (SELECT 1 FROM conversation_mivs m
+					WHERE m.conversation_id = conversation_participants.conversation_id
+					AND m.seq_no = (SELECT MAX(seq_no) FROM conversation_mivs WHERE conversation_id = m.conversation_id)
+					AND m.from_desk = conversation_participants.desk_id AND NOT m.is_ack AND NOT m.is_forgotten) THEN 'SENT'
+				WHEN EXISTS (SELECT 1 FROM conversation_mivs m JOIN conversation_miv_recipients r ON r.miv_id = m.id
+					WHERE m.conversation_id = conversation_participants.conversation_id
+					AND m.seq_no = (SELECT MAX(seq_no) FROM conversation_mivs WHERE conversation_id = m.conversation_id)
+					AND r.desk_id = conversation_participants.desk_id AND m.from_desk <> r.desk_id AND NOT m.is_ack) THEN 'PENDING'
+				ELSE '' END`,
+		},
+	},
+	{
+		version: 9,
+		statements: []string{
+			`ALTER TABLE conversation_mivs ADD COLUMN sender_basket TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE conversation_miv_recipients ADD COLUMN basket TEXT NOT NULL DEFAULT ''`,
+			`UPDATE conversation_mivs SET sender_basket = CASE
+				WHEN is_ack OR is_forgotten OR EXISTS (SELECT 1 FROM conversation_mivs later
+					WHERE later.conversation_id = conversation_mivs.conversation_id
+					AND later.seq_no > conversation_mivs.seq_no AND later.from_desk <> conversation_mivs.from_desk) THEN ''
+				ELSE 'SENT' END`,
+			`UPDATE conversation_miv_recipients SET basket = CASE
+				WHEN read_at IS NULL THEN 'IN'
+				WHEN EXISTS (SELECT 1 FROM conversation_mivs m WHERE m.id = conversation_miv_recipients.miv_id AND m.is_ack)
+					OR EXISTS (SELECT 1 FROM conversation_mivs m JOIN conversation_mivs later
+						ON later.conversation_id = m.conversation_id AND later.seq_no > m.seq_no
+						AND later.from_desk = conversation_miv_recipients.desk_id
+						WHERE m.id = conversation_miv_recipients.miv_id) THEN ''
+				ELSE 'PENDING' END`,
+			`DROP INDEX idx_conversation_mivs_from_desk`,
+			`CREATE INDEX idx_conversation_mivs_sender_basket ON conversation_mivs (from_desk, sender_basket)`,
+			`DROP INDEX idx_conversation_miv_recipients_desk_id`,
+			`CREATE INDEX idx_conversation_miv_recipients_basket ON conversation_miv_recipients (desk_id, basket)`,
+		},
+	},
+	{
+		version: 10,
+		statements: []string{
+			`CREATE TABLE scheduled_mivs (
+				id              TEXT PRIMARY KEY,
+				desk_id         TEXT NOT NULL,
+				conversation_id TEXT NOT NULL,
+				to_desks        TEXT NOT NULL,
+				cc_desks        TEXT NOT NULL,
+				subject         TEXT NOT NULL,
+				body            TEXT NOT NULL,
+				is_ack          INTEGER NOT NULL,
+				font_family     TEXT,
+				font_size       TEXT,
+				send_at         INTEGER NOT NULL,
+				key_version     INTEGER NOT NULL,
+				error           TEXT NOT NULL,
+				created_at      INTEGER NOT NULL,
+				updated_at      INTEGER NOT NULL
+			)`,
+			`CREATE INDEX idx_scheduled_mivs_send_at ON scheduled_mivs (send_at)`,
+			`CREATE INDEX idx_scheduled_mivs_desk_id ON scheduled_mivs (desk_id, send_at)`,
+			`INSERT INTO id_sequences (name, value) VALUES ('sched', 0)`,
+		},
+	},
+	{
+		version: 11,
+		statements: []string{
+			`CREATE TABLE drafts (
+				id              TEXT PRIMARY KEY,
+				desk_id         TEXT NOT NULL,
+				conversation_id TEXT NOT NULL,
+				to_desks        TEXT NOT NULL,
+				cc_desks        TEXT NOT NULL,
+				subject         TEXT NOT NULL,
+				body            TEXT NOT NULL,
+				is_ack          INTEGER NOT NULL,
+				font_family     TEXT,
+				font_size       TEXT,
+				version         INTEGER NOT NULL,
+				key_version     INTEGER NOT NULL,
+				created_at      INTEGER NOT NULL,
+				updated_at      INTEGER NOT NULL
+			)`,
+			`CREATE INDEX idx_drafts_desk_id ON drafts (desk_id, updated_at)`,
+			`INSERT INTO id_sequences (name, value) VALUES ('draft', 0)`,
+		},
+	},
+	{
+		version: 12,
+		statements: []string{
+			`ALTER TABLE conversation_mivs ADD COLUMN reply_by INTEGER`,
+			`ALTER TABLE conversation_mivs ADD COLUMN follow_up_at INTEGER`,
+			`CREATE INDEX idx_conversation_mivs_reply_by ON conversation_mivs (reply_by)`,
+			`ALTER TABLE scheduled_mivs ADD COLUMN reply_by INTEGER`,
+		},
+	},
+	{
+		version: 13,
+		statements: []string{
+			`CREATE TABLE attachments (
+				id              TEXT PRIMARY KEY,
+				desk_id         TEXT NOT NULL,
+				conversation_id TEXT NOT NULL,
+				miv_id          TEXT NOT NULL,
+				position        INTEGER NOT NULL,
+				filename        TEXT NOT NULL,
+				content_type    TEXT NOT NULL,
+				size            INTEGER NOT NULL,
+				checksum        TEXT NOT NULL,
+				storage_key     TEXT NOT NULL,
+				created_at      INTEGER NOT NULL
+			)`,
+			`CREATE INDEX idx_attachments_desk_id ON attachments (desk_id, created_at)`,
+			`CREATE INDEX idx_attachments_miv_id ON attachments (miv_id, position)`,
+			`INSERT INTO id_sequences (name, value) VALUES ('att', 0)`,
+			`ALTER TABLE scheduled_mivs ADD COLUMN attachment_ids TEXT NOT NULL DEFAULT '[]'`,
+		},
+	},
+	{
+		version: 14,
+		statements: []string{
+			`ALTER TABLE attachments ADD COLUMN width INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE attachments ADD COLUMN height INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE attachments ADD COLUMN thumbnails TEXT NOT NULL DEFAULT '[]'`,
+		},
+	},
+	{
+		version: 15,
+		statements: []string{
+			`CREATE TABLE blobs (
+				storage_key TEXT PRIMARY KEY,
+				size        INTEGER NOT NULL,
+				refs        INTEGER NOT NULL,
+				stored      INTEGER NOT NULL,
+				collecting  INTEGER NOT NULL,
+				released_at INTEGER NOT NULL,
+				created_at  INTEGER NOT NULL
+			)`,
+			`CREATE INDEX idx_blobs_refs ON blobs (refs, released_at)`,
+			// Count the references of the files and thumbnails stored so far
+			`INSERT INTO blobs (storage_key, size, refs, stored, collecting, released_at, created_at)
+				SELECT storage_key, MAX(size), COUNT(*), 1, 0, MAX(created_at), MIN(created_at) FROM (
+					SELECT storage_key, size, created_at FROM attachments
+					UNION ALL
+					SELECT json_extract(t.value, '$.storage_key'), json_extract(t.value, '$.size'), a.created_at
+						FROM attachments a, json_each(a.thumbnails) t
+				) GROUP BY storage_key`,
+		},
+	},
+	{
+		version: 16,
+		statements: []string{
+			`ALTER TABLE sessions ADD COLUMN scope TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 17,
+		statements: []string{
+			// Sessions are now looked up by token hash; tokens stored in the
+			// clear are dropped, which signs everyone out once
+			`DELETE FROM sessions`,
+			`ALTER TABLE sessions RENAME COLUMN token TO token_hash`,
+			`CREATE INDEX idx_sessions_account_id ON sessions (account_id)`,
+		},
+	},
+	{
+		version: 18,
+		statements: []string{
+			`ALTER TABLE conversation_miv_recipients ADD COLUMN receipt_withheld INTEGER NOT NULL DEFAULT 0`,
+			// Earlier reads only have the desks' current setting to go by
+			`UPDATE conversation_miv_recipients SET receipt_withheld = 1
+				WHERE read_at IS NOT NULL AND desk_id IN (SELECT id FROM desks WHERE disable_read_receipts = 1)`,
+		},
+	},
+	{
+		version: 19,
+		statements: []string{
+			// Client-sealed scheduled mivs keep what the client sealed and
+			// signed; claimed_at marks the miv a dispatcher is delivering
+			`ALTER TABLE scheduled_mivs ADD COLUMN new_conversation_id TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE scheduled_mivs ADD COLUMN bodies TEXT NOT NULL DEFAULT 'null'`,
+			`ALTER TABLE scheduled_mivs ADD COLUMN is_encrypted INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE scheduled_mivs ADD COLUMN recipient_key_version INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE scheduled_mivs ADD COLUMN key_versions TEXT NOT NULL DEFAULT 'null'`,
+			`ALTER TABLE scheduled_mivs ADD COLUMN seq_no INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE scheduled_mivs ADD COLUMN signature TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE scheduled_mivs ADD COLUMN claimed_at INTEGER`,
+		},
+	},
+	{
+		version: 20,
+		statements: []string{
+			// Mivs that link attachments sent with earlier mivs
+			`CREATE TABLE attachment_links (
+				miv_id          TEXT NOT NULL,
+				attachment_id   TEXT NOT NULL,
+				conversation_id TEXT NOT NULL,
+				position        INTEGER NOT NULL,
+				PRIMARY KEY (miv_id, attachment_id)
+			)`,
+			`CREATE INDEX idx_attachment_links_attachment_id ON attachment_links (attachment_id)`,
+			`CREATE TABLE server_secrets (
+				name   TEXT PRIMARY KEY,
+				secret TEXT NOT NULL
+			)`,
+		},
+	},
+	{
+		version: 21,
+		statements: []string{
+			// The event log every server fans out to its streams
+			`CREATE TABLE events (
+				seq        INTEGER PRIMARY KEY,
+				desk_id    TEXT NOT NULL,
+				type       TEXT NOT NULL,
+				data       TEXT NOT NULL,
+				created_at INTEGER NOT NULL
+			)`,
+			`CREATE INDEX idx_events_desk_id ON events (desk_id, seq)`,
+			`CREATE INDEX idx_events_created_at ON events (created_at)`,
+			`INSERT INTO id_sequences (name, value) VALUES ('event', 0)`,
+		},
+	},
+	{
+		version: 22,
+		statements: []string{
+			// Drafts sealed by clients that hold their desk's keys
+			`ALTER TABLE drafts ADD COLUMN is_encrypted INTEGER NOT NULL DEFAULT 0`,
+		},
+	},
+	{
+		version: 23,
+		statements: []string{
+			// A row per desk that concurrent uploads take in turn, so the
+			// quota check and the insert of one finish before the next
+			`CREATE TABLE attachment_quota_locks (
+				desk_id TEXT PRIMARY KEY
+			)`,
+		},
+	},
+	{
+		version: 24,
+		statements: []string{
+			// Participants' baskets and last-read seqs are read from the
+			// per-miv baskets and reads instead
+			`ALTER TABLE conversation_participants DROP COLUMN last_read_seq`,
+			`ALTER TABLE conversation_participants DROP COLUMN basket`,
+		},
+	},
+	{
+		version: 25,
+		statements: []string{
+			// The single-user mivs that conversations replaced
+			`DROP TABLE mivs`,
+		},
+	},
+}
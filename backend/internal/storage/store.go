@@ -0,0 +1,368 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"time"
+
+	"github.com/jadefox10200/missiv/backend/internal/crypto"
+	"github.com/jadefox10200/missiv/backend/internal/models"
+)
+
+// Store is the persistence contract the API server depends on.
+// MemoryStorage and SQLStorage (SQLite or PostgreSQL) all implement it and are
+// expected to behave identically; see conformance_test.go.
+type Store interface {
+	// Legacy single-user identity
+	SetIdentity(identity *models.Identity) error
+	GetIdentity() (*models.Identity, error)
+
+	// Accounts
+	CreateAccount(account *models.Account) error
+	GetAccountByID(id string) (*models.Account, error)
+	GetAccountByUsername(username string) (*models.Account, error)
+	UpdateAccount(account *models.Account) error
+
+	// Sessions are keyed by the SHA-256 of their token (crypto.HashToken),
+	// so the store never holds a working bearer token
+	CreateSession(session *models.Session) error
+	GetSession(tokenHash string) (*models.Session, error)
+	DeleteSession(tokenHash string) error
+	DeleteAccountSessions(accountID string) error // sessions and tickets alike
+	DeleteExpiredSessions(now time.Time) error
+
+	// Desks
+	// CreateDesk stores a desk; privateKeys is nil when the client holds the keys
+	CreateDesk(desk *models.Desk, privateKeys *DeskPrivateKeys) error
+	GetDesk(id string) (*models.Desk, error)
+	GetDeskPrivateKey(id string, version int) ([32]byte, error)                  // version 0 means current
+	GetDeskSigningPrivateKey(id string, version int) (ed25519.PrivateKey, error) // version 0 means current
+	RotateDeskKey(deskID string, publicKey, signingKey string, privateKeys *DeskPrivateKeys) (*models.Desk, error)
+	GetDeskKey(deskID string, version int) (*models.DeskKey, error) // version 0 means current
+	ListDeskKeys(deskID string) ([]*models.DeskKey, error)
+	ListDesksByAccount(accountID string) ([]*models.Desk, error)
+	UpdateDesk(desk *models.Desk) error
+
+	// Conversations
+	// StartConversation atomically writes a new conversation, its first miv and
+	// the recipient notifications, filling in the IDs that link them
+	StartConversation(conv *models.Conversation, miv *models.ConversationMiv, notifs []*models.Notification) error
+	GetConversation(id string) (*models.Conversation, error)
+	ListConversationsByDesk(deskID string) ([]*models.Conversation, error) // conversations the desk participates in
+	// ListConversationPage returns one page of the conversations a desk takes
+	// part in, pinned first and then most recently started, each with its
+	// latest miv, the desk's unread count and the desk's own state
+	ListConversationPage(deskID string, q ConversationQuery) ([]*models.ConversationWithLatest, error)
+	UpdateConversation(conv *models.Conversation) error
+	// CreateConversationMiv stores a miv with its recipients (just To when none
+	// are given) and adds the sender and recipients as participants. The
+	// miv's Attachments are sent with it if they are pending attachments of
+	// its sender, and linked to it if they were already sent with another
+	// miv; any other fails with ErrAttachmentUnavailable. A link references
+	// the attachment's blobs for as long as the miv exists.
+	CreateConversationMiv(miv *models.ConversationMiv) error
+	GetConversationMivs(conversationID string) ([]*models.ConversationMiv, error)
+	UpdateConversationMiv(miv *models.ConversationMiv) error // recipients are left as created
+	// MarkConversationMivAsRead and MarkConversationMivsAsRead record the
+	// reading desk's DisableReadReceipts at the time of the read as the
+	// recipient's ReceiptWithheld
+	MarkConversationMivAsRead(mivID string, deskID string) error // fails unless the desk is a recipient
+	MarkConversationMivsAsRead(conversationID string, deskID string) error
+	GetConversationMiv(mivID string) (*models.ConversationMiv, error)
+	// GetConversationState returns a participant's own view of a conversation;
+	// it fails unless the desk is a participant. Its flags are all false until
+	// they are first set, and its basket and last-read seq are read from the
+	// mivs' baskets and reads.
+	GetConversationState(conversationID, deskID string) (*models.ConversationState, error)
+	// UpdateConversationState applies change to a participant's own state
+	// in one step, so concurrent changes to it all take effect, and returns
+	// the state and whether it changed; it fails unless the desk is a
+	// participant
+	UpdateConversationState(conversationID, deskID string, change ConversationStateChange) (*models.ConversationState, bool, error)
+	// ListBasket returns the mivs in one of a desk's baskets, newest first,
+	// leaving out conversations the desk has archived. The ARCHIVED basket
+	// holds the latest miv of each conversation the desk has archived.
+	ListBasket(deskID string, basket models.MivState) ([]*models.ConversationMiv, error)
+	// SetMivReplyBy sets or clears the time a miv's sender expects a reply by,
+	// clearing any follow-up already raised for it
+	SetMivReplyBy(mivID string, replyBy *time.Time) error
+	// ListDueFollowUps returns the mivs whose reply deadline has passed by now
+	// while they are still in their sender's SENT basket and have not been
+	// followed up, earliest deadline first
+	ListDueFollowUps(now time.Time) ([]*models.ConversationMiv, error)
+	// ClaimFollowUp records that a miv's sender is being reminded of its
+	// overdue reply, and reports whether this call did so; when several
+	// servers share the store only one of them reminds the sender
+	ClaimFollowUp(mivID string, at time.Time) (bool, error)
+
+	// Notifications
+	CreateNotification(notif *models.Notification) error
+	GetNotification(id string) (*models.Notification, error)
+	ListNotificationsByDesk(deskID string, unreadOnly bool) ([]*models.Notification, error)
+	ListNotificationPage(deskID string, q NotificationQuery) ([]*models.Notification, error) // newest first
+	CountUnreadNotifications(deskID string) (int, error)
+	MarkNotificationAsRead(id string) error
+
+	// Events go into one log shared by every server on the store, so a
+	// desk's stream gets the events of every server and can resume on any
+	// of them. AppendEvents gives each event the next sequence number; the
+	// events of one call become visible together, after those of earlier
+	// calls.
+	AppendEvents(events []*models.Event) error
+	ListEvents(afterSeq int64, limit int) ([]*models.Event, error)                     // oldest first
+	ListDeskEvents(deskID string, afterSeq, throughSeq int64) ([]*models.Event, error) // oldest first
+	EventSeqRange() (oldest, latest int64, err error)                                  // of the events kept; zero when there are none
+	DeleteEventsBefore(before time.Time) error
+
+	// Contacts
+	CreateContact(contact *models.Contact) error
+	GetContact(id string) (*models.Contact, error)
+	ListContactsForDesk(deskID string) ([]*models.Contact, error)
+	ListContactPage(deskID string, q ContactQuery) ([]*models.Contact, error) // oldest first
+	UpdateContact(contact *models.Contact) error
+	DeleteContact(id string) error
+	GetContactByDeskIDRef(deskID, deskIDRef string) (*models.Contact, error)
+
+	// Scheduled mivs
+	CreateScheduledMiv(sched *models.ScheduledMiv) error
+	GetScheduledMiv(id string) (*models.ScheduledMiv, error)
+	ListScheduledMivs(deskID string) ([]*models.ScheduledMiv, error) // soonest first
+	// ListDueScheduledMivs returns the scheduled mivs due by now, soonest
+	// first, leaving out those whose delivery failed
+	ListDueScheduledMivs(now time.Time) ([]*models.ScheduledMiv, error)
+	// UpdateScheduledMiv and DeleteScheduledMiv fail with
+	// ErrScheduledMivClaimed while a dispatcher is delivering the miv
+	UpdateScheduledMiv(sched *models.ScheduledMiv) error
+	DeleteScheduledMiv(id string) error
+	// ClaimScheduledMiv claims a scheduled miv for delivery at now and
+	// reports whether it did: only a due miv whose delivery has not failed,
+	// and that no other dispatcher claimed after staleBefore, can be claimed.
+	// The claimer either finishes the miv once it is delivered or releases
+	// it, with the reason delivery failed if it should wait for an edit.
+	ClaimScheduledMiv(id string, now, staleBefore time.Time) (bool, error)
+	FinishScheduledMiv(id string) error
+	ReleaseScheduledMiv(id string, failure string) error
+
+	// Attachments
+	// CreateAttachment fails with ErrQuotaExceeded if the attachment would
+	// take its desk's uploads past quota bytes (0 for no limit); the check
+	// and the insert are one step, so concurrent uploads cannot overshoot
+	CreateAttachment(att *models.Attachment, quota int64) error
+	GetAttachment(id string) (*models.Attachment, error)
+	ListAttachments(deskID string) ([]*models.Attachment, error) // uploaded by the desk, newest first
+	DeskAttachmentUsage(deskID string) (int64, error)            // bytes of every attachment the desk uploaded, thumbnails included
+	DeleteAttachment(id string) error                            // fails unless the attachment is pending
+	ListAttachmentLinks(attachmentID string) ([]string, error)   // conversations with a miv that links the attachment
+
+	// Blobs are counted by the attachments, thumbnails and miv links stored
+	// in them: CreateAttachment adds a reference to each of its blobs,
+	// DeleteAttachment drops them and linking an attachment to a miv adds
+	// another. An upload holds a blob before storing it,
+	// so the garbage collector leaves it alone until the attachment exists.
+	HoldBlob(key string, size int64) (stored bool, err error) // records the blob and restarts its grace period; ErrBlobBusy while it is collected
+	MarkBlobStored(key string) error
+	GetBlob(key string) (*models.Blob, error)                   // ErrBlobNotFound without a record
+	ListReleasedBlobs(before time.Time) ([]*models.Blob, error) // unreferenced since before, or claimed
+	// ClaimBlob marks a blob for collection if it has been unreferenced
+	// since before, or if there is no record of it, and reports whether it
+	// did. Claimed blobs cannot be held until DeleteBlobRecord removes them.
+	ClaimBlob(key string, size int64, before time.Time) (bool, error)
+	DeleteBlobRecord(key string) error // removes the record of a claimed blob
+
+	// Drafts
+	CreateDraft(draft *models.Draft) error // starts at version 1
+	GetDraft(id string) (*models.Draft, error)
+	ListDrafts(deskID string) ([]*models.Draft, error) // most recently saved first
+	// UpdateDraft replaces a draft's contents if the stored version still
+	// equals expectedVersion, bumping the version; its desk and conversation
+	// never change
+	UpdateDraft(draft *models.Draft, expectedVersion int) error
+	// DeleteDraft removes a draft if its stored version still equals
+	// expectedVersion, or whatever its version when that is 0
+	DeleteDraft(id string, expectedVersion int) error
+
+	// Key backups
+	SaveKeyBackup(backup *models.KeyBackup, expectedVersion int) error
+	GetKeyBackup(deskID string) (*models.KeyBackup, error)
+	DeleteKeyBackup(deskID string) error
+
+	// Server secrets
+	// ServerSecret returns the secret kept under name, generating size
+	// random bytes the first time, so every server on the store shares it
+	ServerSecret(name string, size int) ([]byte, error)
+
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// DeskPrivateKeys are the private halves of one version of a desk's keys
+type DeskPrivateKeys struct {
+	BoxKey     [32]byte           // Curve25519 key mivs are sealed with
+	SigningKey ed25519.PrivateKey // Ed25519 key mivs are signed with
+}
+
+// Cursor is the sort key of the last item on a page; the next page starts
+// with the item after it
+type Cursor struct {
+	Pinned bool      `json:"p,omitempty"` // conversations only
+	Time   time.Time `json:"t"`
+	ID     string    `json:"i"`
+}
+
+// ConversationStateChange sets the flags of a participant's own state that
+// are not nil
+type ConversationStateChange struct {
+	IsArchived *bool
+	IsMuted    *bool
+	IsPinned   *bool
+	// KeepArchivedIfMuted leaves IsArchived alone when the desk had muted
+	// the conversation
+	KeepArchivedIfMuted bool
+}
+
+// apply sets the flags change names on state
+func (change ConversationStateChange) apply(state *models.ConversationState) {
+	if change.IsArchived != nil && !(change.KeepArchivedIfMuted && state.IsMuted) {
+		state.IsArchived = *change.IsArchived
+	}
+	if change.IsMuted != nil {
+		state.IsMuted = *change.IsMuted
+	}
+	if change.IsPinned != nil {
+		state.IsPinned = *change.IsPinned
+	}
+}
+
+// ConversationQuery filters and pages a desk's conversations. Since and
+// Until bound the time of the latest activity; zero leaves them open.
+type ConversationQuery struct {
+	UnreadOnly  bool   // only conversations with mivs the desk has not read
+	Archived    *bool  // archived or open for the desk; nil for both
+	Counterpart string // only conversations this desk also takes part in
+	Since       time.Time
+	Until       time.Time // exclusive
+	After       *Cursor   // nil for the first page
+	Limit       int       // 0 for no limit
+}
+
+// NotificationQuery filters and pages a desk's notifications by creation time
+type NotificationQuery struct {
+	UnreadOnly bool
+	Since      time.Time
+	Until      time.Time // exclusive
+	After      *Cursor
+	Limit      int
+}
+
+// ContactQuery pages a desk's contacts
+type ContactQuery struct {
+	After *Cursor
+	Limit int
+}
+
+// ConversationCursor returns the sort key of a conversation in a desk's
+// list. It uses the creation time, which never changes, so a conversation
+// that gets a reply while a client pages through the list keeps its place.
+func ConversationCursor(conv *models.ConversationWithLatest) Cursor {
+	return Cursor{Pinned: conv.State.IsPinned, Time: conv.Conversation.CreatedAt, ID: conv.Conversation.ID}
+}
+
+// NotificationCursor returns the sort key of a notification
+func NotificationCursor(notif *models.Notification) Cursor {
+	return Cursor{Time: notif.CreatedAt, ID: notif.ID}
+}
+
+// ContactCursor returns the sort key of a contact
+func ContactCursor(contact *models.Contact) Cursor {
+	return Cursor{Time: contact.CreatedAt, ID: contact.ID}
+}
+
+// newestFirst orders conversations and notifications: pinned first, then by
+// time and ID, both descending
+func newestFirst(a, b Cursor) bool {
+	if a.Pinned != b.Pinned {
+		return a.Pinned
+	}
+	if !a.Time.Equal(b.Time) {
+		return a.Time.After(b.Time)
+	}
+	return a.ID > b.ID
+}
+
+// oldestFirst orders contacts by time and ID, both ascending
+func oldestFirst(a, b Cursor) bool {
+	if !a.Time.Equal(b.Time) {
+		return a.Time.Before(b.Time)
+	}
+	return a.ID < b.ID
+}
+
+// defaultRecipients gives a miv without a recipient list its To desk as the
+// only recipient and normalizes the desk IDs of an explicit list
+func defaultRecipients(miv *models.ConversationMiv) {
+	if len(miv.Recipients) == 0 {
+		miv.Recipients = []*models.MivRecipient{{
+			DeskID:     miv.To,
+			Role:       models.ParticipantRoleTo,
+			KeyVersion: miv.RecipientKeyVersion,
+			ReadAt:     miv.ReadAt,
+		}}
+	}
+	for _, r := range miv.Recipients {
+		r.DeskID = crypto.NormalizeDeskID(r.DeskID)
+	}
+}
+
+// Every conversation miv sits in at most one basket for each desk, which the
+// store keeps up to date as mivs are sent, read and forgotten. A recipient has
+// it in IN until reading it, then in PENDING until the recipient sends a later
+// miv in the conversation. Its sender has it in SENT until another desk sends
+// a later miv or the sender forgets it. ACKs expect no answer, so they never
+// wait in PENDING or SENT.
+
+// sentBasket returns the basket a miv starts in for its sender
+func sentBasket(miv *models.ConversationMiv) models.MivState {
+	if miv.IsAck || miv.IsForgotten {
+		return ""
+	}
+	return models.StateSENT
+}
+
+// readBasket returns the basket a miv moves to once a recipient has read it;
+// answered says whether the recipient has since sent a later miv
+func readBasket(miv *models.ConversationMiv, answered bool) models.MivState {
+	if miv.IsAck || answered {
+		return ""
+	}
+	return models.StatePENDING
+}
+
+// ErrDuplicateSeqNo is returned when a conversation miv is created with an
+// explicit sequence number that is already taken
+var ErrDuplicateSeqNo = errors.New("sequence number already used")
+
+// ErrVersionConflict is returned when an optimistic update finds the stored
+// version no longer matches the one the caller read
+var ErrVersionConflict = errors.New("version conflict")
+
+// ErrAttachmentUnavailable is returned when a miv is sent with an attachment
+// that is not a pending attachment of its sender
+var ErrAttachmentUnavailable = errors.New("attachment not available")
+
+// ErrQuotaExceeded is returned when an attachment would take its desk past
+// its attachment quota
+var ErrQuotaExceeded = errors.New("attachment quota exceeded")
+
+// ErrScheduledMivClaimed is returned when a scheduled miv is edited or
+// cancelled while a dispatcher is delivering it
+var ErrScheduledMivClaimed = errors.New("scheduled miv is being delivered")
+
+// ErrBlobBusy is returned when a blob is held while the garbage collector
+// is deleting it
+var ErrBlobBusy = errors.New("blob is being collected")
+
+// Compile-time checks that the backends satisfy Store
+var (
+	_ Store = (*MemoryStorage)(nil)
+	_ Store = (*SQLStorage)(nil)
+)
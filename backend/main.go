@@ -2,14 +2,67 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/jadefox10200/missiv/backend/internal/api"
+	"github.com/jadefox10200/missiv/backend/internal/storage"
 )
 
 func main() {
-	server := api.NewServer()
+	cfg := storage.ConfigFromEnv()
+	store, err := storage.Open(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open %s storage: %v", cfg.Driver, err)
+	}
+	defer store.Close()
+
+	custody, err := api.ParseKeyCustody(os.Getenv("MISSIV_KEY_CUSTODY"))
+	if err != nil {
+		log.Fatalf("Invalid MISSIV_KEY_CUSTODY: %v", err)
+	}
+
+	blobCfg := storage.BlobConfigFromEnv()
+	blobs, err := storage.OpenBlobStore(blobCfg)
+	if err != nil {
+		log.Fatalf("Failed to open %s blob store: %v", blobCfg.Driver, err)
+	}
+
+	quota, err := api.ParseDeskQuota(os.Getenv("MISSIV_DESK_QUOTA_MB"))
+	if err != nil {
+		log.Fatalf("Invalid MISSIV_DESK_QUOTA_MB: %v", err)
+	}
+
+	gcMode, err := api.ParseBlobGCMode(os.Getenv("MISSIV_BLOB_GC"))
+	if err != nil {
+		log.Fatalf("Invalid MISSIV_BLOB_GC: %v", err)
+	}
+	gcGrace, err := api.ParseBlobGCGrace(os.Getenv("MISSIV_BLOB_GC_GRACE"))
+	if err != nil {
+		log.Fatalf("Invalid MISSIV_BLOB_GC_GRACE: %v", err)
+	}
+	// The memory backend forgets every blob on restart, leaving all of
+	// UPLOAD_DIR unrecorded
+	gcOrphans := os.Getenv("MISSIV_BLOB_GC_ORPHANS") == "true"
+	if gcOrphans && cfg.Driver == storage.DriverMemory {
+		log.Fatalf("MISSIV_BLOB_GC_ORPHANS needs sqlite or postgres storage")
+	}
+
+	fileKeySecret, err := api.ParseFileKeySecret(os.Getenv("MISSIV_FILE_KEY_SECRET"))
+	if err != nil {
+		log.Fatalf("Invalid MISSIV_FILE_KEY_SECRET: %v", err)
+	}
+	if fileKeySecret == nil {
+		log.Printf("MISSIV_FILE_KEY_SECRET is not set: file keys are derived from a secret generated and kept in the database")
+	}
+
+	server := api.NewServerWithStore(store)
+	server.SetKeyCustody(custody)
+	server.SetDeskQuota(quota)
+	server.SetBlobStore(blobs)
+	server.SetFileKeySecret(fileKeySecret)
+	server.SetBlobGC(gcMode, gcGrace, gcOrphans)
 
-	log.Println("Starting Missiv backend server on :8080")
+	log.Printf("Starting Missiv backend server on :8080 (storage: %s, blobs: %s, blob collector: %s, key custody: %s)", cfg.Driver, blobCfg.Driver, gcMode, custody)
 	if err := server.Run(":8080"); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
@@ -23,6 +23,8 @@ import {
   Contact,
 } from "./types";
 import * as api from "./api/client";
+import { embeddedAttachmentIDs } from "./utils/attachments";
+import { DeskKeyPairs, generateDeskKeys, saveDeskKeys } from "./utils/deskKeys";
 import "./App.css";
 
 type View =
@@ -160,16 +162,56 @@ function App() {
       }
     };
 
-    if (activeDesk) {
-      loadData();
+    if (!activeDesk) return;
+    loadData();
+
+    // Reload on the desk's events instead of polling. A dropped stream is
+    // reopened with a fresh ticket and resumes after the last event seen;
+    // a reset means the missed events are gone, so everything is reloaded.
+    let source: EventSource | null = null;
+    let retry: ReturnType<typeof setTimeout> | undefined;
+    let lastEventID: string | undefined;
+    let closed = false;
+
+    const connect = async () => {
+      let opened: EventSource;
+      try {
+        opened = await api.openEventStream(activeDesk.id, lastEventID);
+      } catch (err) {
+        console.error("Failed to open event stream:", err);
+        if (!closed) retry = setTimeout(connect, 5000);
+        return;
+      }
+      if (closed) {
+        opened.close();
+        return;
+      }
+      source = opened;
 
-      // Poll for updates every 10 seconds
-      const interval = setInterval(() => {
-        loadData();
-      }, 10000);
+      const handle = (reload: () => void) => (e: MessageEvent) => {
+        if (e.lastEventId) lastEventID = e.lastEventId;
+        reload();
+      };
+      opened.addEventListener("notification", handle(refreshNotifications));
+      opened.addEventListener("notification_read", handle(refreshNotifications));
+      opened.addEventListener("conversation", handle(loadData));
+      opened.addEventListener("miv_read", handle(loadData));
+      opened.addEventListener("reset", handle(loadData));
+      opened.onerror = () => {
+        // The ticket in the URL has expired, so EventSource cannot
+        // reconnect by itself
+        opened.close();
+        source = null;
+        if (!closed) retry = setTimeout(connect, 2000);
+      };
+    };
+    connect();
 
-      return () => clearInterval(interval);
-    }
+    return () => {
+      closed = true;
+      clearTimeout(retry);
+      source?.close();
+    };
   }, [activeDesk]);
 
   const calculateBasketCounts = async (
@@ -260,8 +302,11 @@ function App() {
     localStorage.setItem("token", response.token);
   };
 
-  const handleRegister = async (request: RegisterRequest) => {
+  const handleRegister = async (request: RegisterRequest, deskKeys?: DeskKeyPairs) => {
     const response = await api.register(request);
+    if (deskKeys) {
+      await saveDeskKeys(response.account.active_desk, 1, deskKeys);
+    }
     setAccount(response.account);
     setToken(response.token);
     localStorage.setItem("account", JSON.stringify(response.account));
@@ -269,6 +314,8 @@ function App() {
   };
 
   const handleLogout = () => {
+    // End the server-side session; the local state is cleared regardless
+    api.logout().catch(() => {});
     setAccount(null);
     setToken(null);
     setDesks([]);
@@ -279,14 +326,24 @@ function App() {
     localStorage.removeItem("token");
   };
 
-  const handleCreateDesk = async (name: string) => {
+  const handleCreateDesk = async (name: string, keepKeys: boolean) => {
     if (!account) return;
 
     try {
-      const newDesk = await api.createDesk(account.id, { name });
+      // Only the public keys of a desk that keeps its keys leave the browser
+      const deskKeys = keepKeys ? await generateDeskKeys() : undefined;
+      const newDesk = await api.createDesk(account.id, {
+        name,
+        public_key: deskKeys?.publicKey,
+        signing_key: deskKeys?.signingKey,
+      });
+      if (deskKeys) {
+        await saveDeskKeys(newDesk.id, newDesk.key_version, deskKeys.keys);
+      }
       setDesks([...desks, newDesk]);
-    } catch (err) {
+    } catch (err: any) {
       console.error("Failed to create desk:", err);
+      alert(err.message || "Failed to create desk");
     }
   };
 
@@ -379,6 +436,7 @@ function App() {
           is_ack: isAck,
           font_family: activeDesk.font_family,
           font_size: activeDesk.font_size,
+          attachment_ids: embeddedAttachmentIDs(body),
         }
       );
 
@@ -445,6 +503,7 @@ function App() {
         body: request.body,
         font_family: request.font_family,
         font_size: request.font_size,
+        attachment_ids: embeddedAttachmentIDs(request.body),
       };
 
       await api.createConversation(activeDesk.id, conversationRequest);
@@ -477,6 +536,7 @@ function App() {
         {
           body,
           is_ack: isAck,
+          attachment_ids: embeddedAttachmentIDs(body),
         }
       );
 
@@ -1,8 +1,5 @@
 import { 
-  Miv, 
   Identity, 
-  CreateMivRequest, 
-  UpdateStateRequest,
   Account,
   Desk,
   RegisterRequest,
@@ -15,18 +12,44 @@ import {
   GetConversationResponse,
   CreateConversationRequest,
   ReplyToConversationRequest,
+  ConversationMiv,
   ListNotificationsResponse,
   Contact,
   CreateContactRequest,
   UpdateContactRequest,
   ListContactsResponse,
+  MivState,
+  BasketResponse,
+  ListOptions,
+  SearchResponse,
+  ScheduledMiv,
+  UpdateScheduledMivRequest,
+  ListScheduledMivsResponse,
+  Draft,
+  CreateDraftRequest,
+  UpdateDraftRequest,
+  ListDraftsResponse,
+  Attachment,
+  ListAttachmentsResponse,
+  TicketResponse,
+  DeskPublicKeyResponse,
 } from '../types';
 
 const API_BASE_URL = process.env.REACT_APP_API_URL || 'http://localhost:8080/api';
 
+// apiFetch wraps fetch and attaches the session token saved at login
+const apiFetch = (input: string, init: RequestInit = {}): Promise<Response> => {
+  const token = localStorage.getItem('token');
+  const headers = new Headers(init.headers);
+  if (token) {
+    headers.set('Authorization', `Bearer ${token}`);
+  }
+  return fetch(input, { ...init, headers });
+};
+
 // Identity API
 export const getIdentity = async (): Promise<Identity> => {
-  const response = await fetch(`${API_BASE_URL}/identity`);
+  const response = await apiFetch(`${API_BASE_URL}/identity`);
   if (!response.ok) {
     throw new Error('Failed to fetch identity');
   }
@@ -34,7 +57,7 @@ export const getIdentity = async (): Promise<Identity> => {
 };
 
 export const createIdentity = async (name: string): Promise<Identity> => {
-  const response = await fetch(`${API_BASE_URL}/identity`, {
+  const response = await apiFetch(`${API_BASE_URL}/identity`, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
@@ -47,88 +70,11 @@ export const createIdentity = async (name: string): Promise<Identity> => {
   return response.json();
 };
 
-// Miv API
-export const listMivs = async (): Promise<Miv[]> => {
-  const response = await fetch(`${API_BASE_URL}/mivs`);
-  if (!response.ok) {
-    throw new Error('Failed to fetch mivs');
-  }
-  return response.json();
-};
-
-export const getMiv = async (id: string): Promise<Miv> => {
-  const response = await fetch(`${API_BASE_URL}/mivs/${id}`);
-  if (!response.ok) {
-    throw new Error('Failed to fetch miv');
-  }
-  return response.json();
-};
-
-export const createMiv = async (request: CreateMivRequest): Promise<Miv> => {
-  const response = await fetch(`${API_BASE_URL}/mivs`, {
-    method: 'POST',
-    headers: {
-      'Content-Type': 'application/json',
-    },
-    body: JSON.stringify(request),
-  });
-  if (!response.ok) {
-    throw new Error('Failed to create miv');
-  }
-  return response.json();
-};
-
-export const updateMivState = async (id: string, request: UpdateStateRequest): Promise<Miv> => {
-  const response = await fetch(`${API_BASE_URL}/mivs/${id}/state`, {
-    method: 'PUT',
-    headers: {
-      'Content-Type': 'application/json',
-    },
-    body: JSON.stringify(request),
-  });
-  if (!response.ok) {
-    throw new Error('Failed to update miv state');
-  }
-  return response.json();
-};
-
-// Filtered miv endpoints
-export const getInbox = async (): Promise<Miv[]> => {
-  const response = await fetch(`${API_BASE_URL}/mivs/inbox`);
+// getBasket lists the conversation mivs in one of a desk's baskets
+export const getBasket = async (deskId: string, basket: MivState): Promise<BasketResponse> => {
+  const response = await apiFetch(`${API_BASE_URL}/desks/${deskId}/baskets/${basket}`);
   if (!response.ok) {
-    throw new Error('Failed to fetch inbox');
-  }
-  return response.json();
-};
-
-export const getPending = async (): Promise<Miv[]> => {
-  const response = await fetch(`${API_BASE_URL}/mivs/pending`);
-  if (!response.ok) {
-    throw new Error('Failed to fetch pending mivs');
-  }
-  return response.json();
-};
-
-export const getSent = async (): Promise<Miv[]> => {
-  const response = await fetch(`${API_BASE_URL}/mivs/sent`);
-  if (!response.ok) {
-    throw new Error('Failed to fetch sent mivs');
-  }
-  return response.json();
-};
-
-export const getUnanswered = async (): Promise<Miv[]> => {
-  const response = await fetch(`${API_BASE_URL}/mivs/unanswered`);
-  if (!response.ok) {
-    throw new Error('Failed to fetch unanswered mivs');
-  }
-  return response.json();
-};
-
-export const getArchived = async (): Promise<Miv[]> => {
-  const response = await fetch(`${API_BASE_URL}/mivs/archived`);
-  if (!response.ok) {
-    throw new Error('Failed to fetch archived mivs');
+    throw new Error('Failed to fetch basket');
   }
   return response.json();
 };
@@ -136,7 +82,7 @@ export const getArchived = async (): Promise<Miv[]> => {
 // Account API
 
 export const register = async (request: RegisterRequest): Promise<LoginResponse> => {
-  const response = await fetch(`${API_BASE_URL}/accounts/register`, {
+  const response = await apiFetch(`${API_BASE_URL}/accounts/register`, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
@@ -151,7 +97,7 @@ export const register = async (request: RegisterRequest): Promise<LoginResponse>
 };
 
 export const login = async (request: LoginRequest): Promise<LoginResponse> => {
-  const response = await fetch(`${API_BASE_URL}/accounts/login`, {
+  const response = await apiFetch(`${API_BASE_URL}/accounts/login`, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
@@ -165,10 +111,19 @@ export const login = async (request: LoginRequest): Promise<LoginResponse> => {
   return response.json();
 };
 
+export const logout = async (): Promise<void> => {
+  const response = await apiFetch(`${API_BASE_URL}/accounts/logout`, {
+    method: 'POST',
+  });
+  if (!response.ok) {
+    throw new Error('Failed to logout');
+  }
+};
+
 // Desk API
 
 export const listDesks = async (accountId: string): Promise<Desk[]> => {
-  const response = await fetch(`${API_BASE_URL}/desks?account_id=${accountId}`);
+  const response = await apiFetch(`${API_BASE_URL}/desks?account_id=${accountId}`);
   if (!response.ok) {
     throw new Error('Failed to fetch desks');
   }
@@ -176,7 +131,7 @@ export const listDesks = async (accountId: string): Promise<Desk[]> => {
 };
 
 export const createDesk = async (accountId: string, request: CreateDeskRequest): Promise<Desk> => {
-  const response = await fetch(`${API_BASE_URL}/desks?account_id=${accountId}`, {
+  const response = await apiFetch(`${API_BASE_URL}/desks?account_id=${accountId}`, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
@@ -190,7 +145,7 @@ export const createDesk = async (accountId: string, request: CreateDeskRequest):
 };
 
 export const switchDesk = async (accountId: string, request: SwitchDeskRequest): Promise<Account> => {
-  const response = await fetch(`${API_BASE_URL}/desks/switch?account_id=${accountId}`, {
+  const response = await apiFetch(`${API_BASE_URL}/desks/switch?account_id=${accountId}`, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
@@ -204,7 +159,7 @@ export const switchDesk = async (accountId: string, request: SwitchDeskRequest):
 };
 
 export const updateDesk = async (deskId: string, request: UpdateDeskRequest): Promise<Desk> => {
-  const response = await fetch(`${API_BASE_URL}/desks/${deskId}`, {
+  const response = await apiFetch(`${API_BASE_URL}/desks/${deskId}`, {
     method: 'PUT',
     headers: {
       'Content-Type': 'application/json',
@@ -217,10 +172,22 @@ export const updateDesk = async (deskId: string, request: UpdateDeskRequest): Pr
   return response.json();
 };
 
+// listQuery turns list options into query parameters, leaving out unset ones
+const listQuery = (options: ListOptions = {}): string => {
+  const params = new URLSearchParams();
+  Object.entries(options).forEach(([key, value]) => {
+    if (value !== undefined && value !== '') {
+      params.set(key, String(value));
+    }
+  });
+  const query = params.toString();
+  return query ? `&${query}` : '';
+};
+
 // Conversation API
 
-export const listConversations = async (deskId: string): Promise<ListConversationsResponse> => {
-  const response = await fetch(`${API_BASE_URL}/conversations?desk_id=${deskId}`);
+export const listConversations = async (deskId: string, options?: ListOptions): Promise<ListConversationsResponse> => {
+  const response = await apiFetch(`${API_BASE_URL}/conversations?desk_id=${deskId}${listQuery(options)}`);
   if (!response.ok) {
     throw new Error('Failed to fetch conversations');
   }
@@ -231,7 +198,7 @@ export const getConversation = async (id: string, deskId?: string): Promise<GetC
   const url = deskId 
     ? `${API_BASE_URL}/conversations/${id}?desk_id=${deskId}`
     : `${API_BASE_URL}/conversations/${id}`;
-  const response = await fetch(url);
+  const response = await apiFetch(url);
   if (!response.ok) {
     throw new Error('Failed to fetch conversation');
   }
@@ -242,7 +209,7 @@ export const createConversation = async (
   deskId: string,
   request: CreateConversationRequest
 ): Promise<GetConversationResponse> => {
-  const response = await fetch(`${API_BASE_URL}/conversations?desk_id=${deskId}`, {
+  const response = await apiFetch(`${API_BASE_URL}/conversations?desk_id=${deskId}`, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
@@ -262,7 +229,7 @@ export const replyToConversation = async (
   deskId: string,
   request: ReplyToConversationRequest
 ): Promise<void> => {
-  const response = await fetch(`${API_BASE_URL}/conversations/${conversationId}/reply?desk_id=${deskId}`, {
+  const response = await apiFetch(`${API_BASE_URL}/conversations/${conversationId}/reply?desk_id=${deskId}`, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
@@ -276,7 +243,7 @@ export const replyToConversation = async (
 
 // Archive conversation
 export const archiveConversation = async (conversationId: string): Promise<void> => {
-  const response = await fetch(`${API_BASE_URL}/conversations/${conversationId}/archive`, {
+  const response = await apiFetch(`${API_BASE_URL}/conversations/${conversationId}/archive`, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
@@ -292,7 +259,7 @@ export const markMivAsRead = async (mivId: string, deskId?: string): Promise<voi
   const url = deskId 
     ? `${API_BASE_URL}/mivs/${mivId}/read?desk_id=${deskId}`
     : `${API_BASE_URL}/mivs/${mivId}/read`;
-  const response = await fetch(url, {
+  const response = await apiFetch(url, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
@@ -305,7 +272,7 @@ export const markMivAsRead = async (mivId: string, deskId?: string): Promise<voi
 
 // Forget miv (remove from SENT basket, stop tracking replies)
 export const forgetMiv = async (mivId: string): Promise<void> => {
-  const response = await fetch(`${API_BASE_URL}/mivs/${mivId}/forget`, {
+  const response = await apiFetch(`${API_BASE_URL}/mivs/${mivId}/forget`, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
@@ -316,11 +283,167 @@ export const forgetMiv = async (mivId: string): Promise<void> => {
   }
 };
 
+// setReplyBy sets when the sender expects a reply to a miv; null clears it
+export const setReplyBy = async (mivId: string, deskId: string, replyBy: string | null): Promise<ConversationMiv> => {
+  const response = await apiFetch(`${API_BASE_URL}/mivs/${mivId}/reply-by?desk_id=${deskId}`, {
+    method: 'PUT',
+    headers: {
+      'Content-Type': 'application/json',
+    },
+    body: JSON.stringify({ reply_by: replyBy }),
+  });
+  if (!response.ok) {
+    throw new Error('Failed to set reply deadline');
+  }
+  return response.json();
+};
+
+// listAttachments lists the desk's attachments, newest first, with its quota
+export const listAttachments = async (deskId: string): Promise<ListAttachmentsResponse> => {
+  const response = await apiFetch(`${API_BASE_URL}/desks/${deskId}/attachments`);
+  if (!response.ok) {
+    throw new Error('Failed to fetch attachments');
+  }
+  return response.json();
+};
+
+export const getAttachment = async (id: string, deskId: string): Promise<Attachment> => {
+  const response = await apiFetch(`${API_BASE_URL}/attachments/${id}?desk_id=${deskId}`);
+  if (!response.ok) {
+    throw new Error('Failed to fetch attachment');
+  }
+  return response.json();
+};
+
+// deleteAttachment discards an attachment that has not been sent
+export const deleteAttachment = async (id: string, deskId: string): Promise<void> => {
+  const response = await apiFetch(`${API_BASE_URL}/attachments/${id}?desk_id=${deskId}`, {
+    method: 'DELETE',
+  });
+  if (!response.ok) {
+    throw new Error('Failed to delete attachment');
+  }
+};
+
+// downloadAttachment fetches an attachment's encrypted file, or one of its
+// thumbnails, to be opened with decryptFile and the key from the miv body
+export const downloadAttachment = async (id: string, deskId: string, thumbnail?: string): Promise<ArrayBuffer> => {
+  const query = thumbnail ? `&thumbnail=${encodeURIComponent(thumbnail)}` : '';
+  const response = await apiFetch(`${API_BASE_URL}/attachments/${id}/download?desk_id=${deskId}${query}`);
+  if (!response.ok) {
+    throw new Error('Failed to download attachment');
+  }
+  return response.arrayBuffer();
+};
+
+// listScheduledMivs lists the desk's scheduled mivs, soonest first
+export const listScheduledMivs = async (deskId: string): Promise<ListScheduledMivsResponse> => {
+  const response = await apiFetch(`${API_BASE_URL}/desks/${deskId}/scheduled`);
+  if (!response.ok) {
+    throw new Error('Failed to list scheduled mivs');
+  }
+  return response.json();
+};
+
+// updateScheduledMiv edits a miv that has not been sent yet
+export const updateScheduledMiv = async (id: string, request: UpdateScheduledMivRequest): Promise<ScheduledMiv> => {
+  const response = await apiFetch(`${API_BASE_URL}/scheduled/${id}`, {
+    method: 'PUT',
+    headers: {
+      'Content-Type': 'application/json',
+    },
+    body: JSON.stringify(request),
+  });
+  if (!response.ok) {
+    const errorData = await response.json().catch(() => ({ error: 'Failed to update scheduled miv' }));
+    throw new Error(errorData.error || 'Failed to update scheduled miv');
+  }
+  return response.json();
+};
+
+// cancelScheduledMiv drops a miv before it is sent
+export const cancelScheduledMiv = async (id: string): Promise<void> => {
+  const response = await apiFetch(`${API_BASE_URL}/scheduled/${id}`, {
+    method: 'DELETE',
+  });
+  if (!response.ok) {
+    throw new Error('Failed to cancel scheduled miv');
+  }
+};
+
+// Draft API
+
+// listDrafts lists the desk's drafts, most recently saved first
+export const listDrafts = async (deskId: string): Promise<ListDraftsResponse> => {
+  const response = await apiFetch(`${API_BASE_URL}/desks/${deskId}/drafts`);
+  if (!response.ok) {
+    throw new Error('Failed to list drafts');
+  }
+  return response.json();
+};
+
+export const createDraft = async (deskId: string, request: CreateDraftRequest): Promise<Draft> => {
+  const response = await apiFetch(`${API_BASE_URL}/desks/${deskId}/drafts`, {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+    },
+    body: JSON.stringify(request),
+  });
+  if (!response.ok) {
+    throw new Error('Failed to save draft');
+  }
+  return response.json();
+};
+
+// updateDraft saves a draft over the version it was loaded at; it fails if
+// the draft has been saved elsewhere since
+export const updateDraft = async (id: string, request: UpdateDraftRequest): Promise<Draft> => {
+  const response = await apiFetch(`${API_BASE_URL}/drafts/${id}`, {
+    method: 'PUT',
+    headers: {
+      'Content-Type': 'application/json',
+    },
+    body: JSON.stringify(request),
+  });
+  if (!response.ok) {
+    const errorData = await response.json().catch(() => ({ error: 'Failed to save draft' }));
+    throw new Error(errorData.error || 'Failed to save draft');
+  }
+  return response.json();
+};
+
+export const deleteDraft = async (id: string): Promise<void> => {
+  const response = await apiFetch(`${API_BASE_URL}/drafts/${id}`, {
+    method: 'DELETE',
+  });
+  if (!response.ok) {
+    throw new Error('Failed to delete draft');
+  }
+};
+
+// searchDesk searches the desk's conversations, best match first
+export const searchDesk = async (deskId: string, query: string, limit?: number): Promise<SearchResponse> => {
+  const params = new URLSearchParams({ q: query });
+  if (limit) {
+    params.set('limit', String(limit));
+  }
+  const response = await apiFetch(`${API_BASE_URL}/desks/${deskId}/search?${params.toString()}`);
+  if (!response.ok) {
+    throw new Error('Failed to search');
+  }
+  return response.json();
+};
+
 // Notification API
 
-export const listNotifications = async (deskId: string, unreadOnly: boolean = false): Promise<ListNotificationsResponse> => {
-  const url = `${API_BASE_URL}/notifications?desk_id=${deskId}${unreadOnly ? '&unread_only=true' : ''}`;
-  const response = await fetch(url);
+export const listNotifications = async (
+  deskId: string,
+  unreadOnly: boolean = false,
+  options?: ListOptions
+): Promise<ListNotificationsResponse> => {
+  const url = `${API_BASE_URL}/notifications?desk_id=${deskId}${listQuery({ ...options, unread_only: unreadOnly || undefined })}`;
+  const response = await apiFetch(url);
   if (!response.ok) {
     throw new Error('Failed to fetch notifications');
   }
@@ -328,7 +451,7 @@ export const listNotifications = async (deskId: string, unreadOnly: boolean = fa
 };
 
 export const markNotificationAsRead = async (notificationId: string): Promise<void> => {
-  const response = await fetch(`${API_BASE_URL}/notifications/${notificationId}/read`, {
+  const response = await apiFetch(`${API_BASE_URL}/notifications/${notificationId}/read`, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
@@ -339,21 +462,63 @@ export const markNotificationAsRead = async (notificationId: string): Promise<vo
   }
 };
 
-// Contact API
+// Key directory API
 
-export const listContacts = async (deskId: string): Promise<ListContactsResponse> => {
-  const response = await fetch(`${API_BASE_URL}/desks/${deskId}/contacts`);
+export const getDeskPublicKey = async (deskId: string): Promise<DeskPublicKeyResponse> => {
+  const response = await apiFetch(`${API_BASE_URL}/desks/${deskId}/publickey`);
   if (!response.ok) {
-    throw new Error('Failed to fetch contacts');
+    throw new Error('Failed to fetch desk keys');
   }
   return response.json();
 };
 
+// Event API
+
+// openEventStream opens a desk's event stream. EventSource cannot send the
+// session token, so each connection asks for a one-minute ticket first;
+// lastEventID resumes after the last event seen.
+export const openEventStream = async (deskId: string, lastEventID?: string): Promise<EventSource> => {
+  const path = `/api/desks/${deskId}/events`;
+  const response = await apiFetch(`${API_BASE_URL}/tickets`, {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+    },
+    body: JSON.stringify({ path }),
+  });
+  if (!response.ok) {
+    throw new Error(`Failed to get an event stream ticket: ${response.status}`);
+  }
+  const ticket: TicketResponse = await response.json();
+  const resume = lastEventID ? `&last_event_id=${encodeURIComponent(lastEventID)}` : '';
+  return new EventSource(`${API_BASE_URL}/desks/${deskId}/events?ticket=${encodeURIComponent(ticket.ticket)}${resume}`);
+};
+
+// Contact API
+
+// listContacts follows next_cursor to return all of a desk's contacts, which
+// the app uses to put names to desk IDs
+export const listContacts = async (deskId: string): Promise<ListContactsResponse> => {
+  const contacts: Contact[] = [];
+  let cursor: string | undefined;
+  do {
+    const query = listQuery({ limit: 200, cursor }).slice(1);
+    const response = await apiFetch(`${API_BASE_URL}/desks/${deskId}/contacts?${query}`);
+    if (!response.ok) {
+      throw new Error('Failed to fetch contacts');
+    }
+    const page: ListContactsResponse = await response.json();
+    contacts.push(...(page.contacts || []));
+    cursor = page.next_cursor;
+  } while (cursor);
+  return { contacts, total: contacts.length };
+};
+
 export const createContact = async (
   deskId: string,
   request: CreateContactRequest
 ): Promise<Contact> => {
-  const response = await fetch(`${API_BASE_URL}/desks/${deskId}/contacts`, {
+  const response = await apiFetch(`${API_BASE_URL}/desks/${deskId}/contacts`, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
@@ -368,7 +533,7 @@ export const createContact = async (
 };
 
 export const getContact = async (contactId: string): Promise<Contact> => {
-  const response = await fetch(`${API_BASE_URL}/contacts/${contactId}`);
+  const response = await apiFetch(`${API_BASE_URL}/contacts/${contactId}`);
   if (!response.ok) {
     throw new Error('Failed to fetch contact');
   }
@@ -379,7 +544,7 @@ export const updateContact = async (
   contactId: string,
   request: UpdateContactRequest
 ): Promise<Contact> => {
-  const response = await fetch(`${API_BASE_URL}/contacts/${contactId}`, {
+  const response = await apiFetch(`${API_BASE_URL}/contacts/${contactId}`, {
     method: 'PUT',
     headers: {
       'Content-Type': 'application/json',
@@ -394,7 +559,7 @@ export const updateContact = async (
 };
 
 export const deleteContact = async (contactId: string): Promise<void> => {
-  const response = await fetch(`${API_BASE_URL}/contacts/${contactId}`, {
+  const response = await apiFetch(`${API_BASE_URL}/contacts/${contactId}`, {
     method: 'DELETE',
   });
   if (!response.ok) {
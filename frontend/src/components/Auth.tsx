@@ -1,10 +1,11 @@
 import React, { useState } from 'react';
 import { RegisterRequest } from '../types';
+import { DeskKeyPairs, generateDeskKeys } from '../utils/deskKeys';
 import './Auth.css';
 
 interface AuthProps {
   onLogin: (username: string, password: string) => Promise<void>;
-  onRegister: (request: RegisterRequest) => Promise<void>;
+  onRegister: (request: RegisterRequest, deskKeys?: DeskKeyPairs) => Promise<void>;
 }
 
 function Auth({ onLogin, onRegister }: AuthProps) {
@@ -17,6 +18,7 @@ function Auth({ onLogin, onRegister }: AuthProps) {
   const [firstPetName, setFirstPetName] = useState('');
   const [motherMaiden, setMotherMaiden] = useState('');
   const [newPassword, setNewPassword] = useState('');
+  const [keepKeys, setKeepKeys] = useState(false);
   const [error, setError] = useState<string | null>(null);
   const [loading, setLoading] = useState(false);
 
@@ -40,14 +42,21 @@ function Auth({ onLogin, onRegister }: AuthProps) {
     setLoading(true);
 
     try {
-      await onRegister({
-        username,
-        password,
-        display_name: displayName,
-        birthday,
-        first_pet_name: firstPetName,
-        mother_maiden: motherMaiden,
-      });
+      // Only the public keys of a desk that keeps its keys leave the browser
+      const deskKeys = keepKeys ? await generateDeskKeys() : undefined;
+      await onRegister(
+        {
+          username,
+          password,
+          display_name: displayName,
+          birthday,
+          first_pet_name: firstPetName,
+          mother_maiden: motherMaiden,
+          public_key: deskKeys?.publicKey,
+          signing_key: deskKeys?.signingKey,
+        },
+        deskKeys?.keys
+      );
     } catch (err: any) {
       setError(err.message || 'Registration failed');
     } finally {
@@ -305,6 +314,16 @@ function Auth({ onLogin, onRegister }: AuthProps) {
                 required
               />
             </div>
+            <div className="form-group checkbox-group">
+              <label>
+                <input
+                  type="checkbox"
+                  checked={keepKeys}
+                  onChange={(e) => setKeepKeys(e.target.checked)}
+                />
+                <span>Keep my desk's private keys on this device only</span>
+              </label>
+            </div>
             <button type="submit" className="btn btn-primary" disabled={loading}>
               {loading ? 'Creating account...' : 'Create Account'}
             </button>
@@ -59,15 +59,10 @@ function BasketView({
         const contactsResponse = await api.listContacts(deskId);
         setContacts(contactsResponse.contacts || []);
 
-        // Get all conversations and extract mivs matching the selected basket state
-        const response = await api.listConversations(deskId);
-        const allMivs: ConversationMiv[] = [];
-
-        // Handle case where conversations might be null or undefined
-        const conversations = response?.conversations || [];
-
         // Handle ARCHIVED view separately - show conversations instead of mivs
         if (selectedBasket === "ARCHIVED") {
+          const response = await api.listConversations(deskId);
+          const conversations = response?.conversations || [];
           const archived = conversations.filter(
             (conv) => conv.conversation.is_archived
           );
@@ -76,39 +71,9 @@ function BasketView({
         } else {
           setArchivedConversations([]);
 
-          for (const conv of conversations) {
-            // Skip archived conversations for non-archived baskets
-            if (conv.conversation.is_archived) {
-              continue;
-            }
-
-            // Get full conversation to access all mivs
-            // Pass deskId to get miv states from user's perspective
-            const fullConv = await api.getConversation(
-              conv.conversation.id,
-              deskId
-            );
-            const mivArray = fullConv.mivs || [];
-            const filteredMivs = mivArray.filter((miv) => {
-              // Filter based on miv state from backend
-              if (miv.state !== selectedBasket) return false;
-
-              // Exclude ACK mivs from SENT basket (they don't expect replies)
-              if (selectedBasket === "SENT" && miv.is_ack) return false;
-
-              return true;
-            });
-            allMivs.push(...filteredMivs);
-          }
-
-          // Sort by most recent first
-          allMivs.sort(
-            (a, b) =>
-              new Date(b.created_at).getTime() -
-              new Date(a.created_at).getTime()
-          );
-
-          setMivs(allMivs);
+          // The server returns the basket's mivs newest first
+          const response = await api.getBasket(deskId, selectedBasket);
+          setMivs(response?.mivs || []);
         }
       } catch (err) {
         console.error("Failed to load basket mivs:", err);
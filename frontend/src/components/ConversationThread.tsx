@@ -5,6 +5,8 @@ import { GetConversationResponse, Contact, ConversationMiv, Desk, Account } from
 import * as api from '../api/client';
 import { uploadPlugin } from '../utils/ckEditorUploadAdapter';
 import { buildMessageWithTemplate } from '../utils/messageTemplate';
+import MivBody from './MivBody';
+import SignatureBadge from './SignatureBadge';
 import './ConversationThread.css';
 
 interface ConversationThreadProps {
@@ -216,6 +218,7 @@ function ConversationThread({ conversation, currentDeskId, desk, account, onRepl
                 </span>
                 <span className="message-inbox-date">{formatDate(miv.created_at)}</span>
                 <span className="message-inbox-seq">#{miv.seq_no}</span>
+                <SignatureBadge miv={miv} />
               </div>
               
               <div className="message-inbox-body epistle-document">
@@ -228,9 +231,10 @@ function ConversationThread({ conversation, currentDeskId, desk, account, onRepl
                     fontSize: desk?.font_size || '14px'
                   }}
                 >
-                  <div 
+                  <MivBody
                     className={desk?.auto_indent ? 'auto-indent' : ''}
-                    dangerouslySetInnerHTML={{ __html: atob(miv.body) }} 
+                    html={atob(miv.body)}
+                    deskId={currentDeskId}
                   />
                 </div>
               </div>
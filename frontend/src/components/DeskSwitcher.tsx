@@ -6,21 +6,23 @@ interface DeskSwitcherProps {
   desks: Desk[];
   activeDeskId: string;
   onSwitchDesk: (deskId: string) => void;
-  onCreateDesk: (name: string) => void;
+  onCreateDesk: (name: string, keepKeys: boolean) => void; // keepKeys generates the desk's keys in this browser
 }
 
 function DeskSwitcher({ desks, activeDeskId, onSwitchDesk, onCreateDesk }: DeskSwitcherProps) {
   const [showDropdown, setShowDropdown] = useState(false);
   const [showCreateForm, setShowCreateForm] = useState(false);
   const [newDeskName, setNewDeskName] = useState('');
+  const [keepKeys, setKeepKeys] = useState(false);
 
   const activeDesk = desks.find(d => d.id === activeDeskId);
 
   const handleCreateDesk = (e: React.FormEvent) => {
     e.preventDefault();
     if (newDeskName.trim()) {
-      onCreateDesk(newDeskName.trim());
+      onCreateDesk(newDeskName.trim(), keepKeys);
       setNewDeskName('');
+      setKeepKeys(false);
       setShowCreateForm(false);
       setShowDropdown(false);
     }
@@ -73,6 +75,14 @@ function DeskSwitcher({ desks, activeDeskId, onSwitchDesk, onCreateDesk }: DeskS
                 placeholder="Desk name"
                 autoFocus
               />
+              <label className="create-desk-keys">
+                <input
+                  type="checkbox"
+                  checked={keepKeys}
+                  onChange={(e) => setKeepKeys(e.target.checked)}
+                />
+                Keep private keys on this device only
+              </label>
               <div className="form-buttons">
                 <button type="submit" className="btn btn-sm btn-primary">
                   Create
@@ -83,6 +93,7 @@ function DeskSwitcher({ desks, activeDeskId, onSwitchDesk, onCreateDesk }: DeskS
                   onClick={() => {
                     setShowCreateForm(false);
                     setNewDeskName('');
+                    setKeepKeys(false);
                   }}
                 >
                   Cancel
@@ -0,0 +1,25 @@
+import React, { useEffect, useRef } from 'react';
+import { openEmbeddedAttachments } from '../utils/attachments';
+
+interface MivBodyProps {
+  html: string;
+  deskId: string; // Desk viewing the miv, which downloads its attachments
+  className?: string;
+  style?: React.CSSProperties;
+}
+
+// MivBody renders an opened miv body and decrypts the attachments it embeds
+function MivBody({ html, deskId, className, style }: MivBodyProps) {
+  const ref = useRef<HTMLDivElement>(null);
+
+  useEffect(() => {
+    if (!ref.current) {
+      return;
+    }
+    return openEmbeddedAttachments(ref.current, deskId);
+  }, [html, deskId]);
+
+  return <div ref={ref} className={className} style={style} dangerouslySetInnerHTML={{ __html: html }} />;
+}
+
+export default MivBody;
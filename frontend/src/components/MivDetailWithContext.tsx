@@ -10,6 +10,8 @@ import {
 import * as api from "../api/client";
 import { uploadPlugin } from "../utils/ckEditorUploadAdapter";
 import { parseClosureAndSignature } from "../utils/messageTemplate";
+import MivBody from "./MivBody";
+import SignatureBadge from "./SignatureBadge";
 import "./MivDetailWithContext.css";
 
 interface MivDetailWithContextProps {
@@ -61,9 +63,7 @@ function MivDetailWithContext({
         // Mark message as read (move from IN to PENDING) if it's currently in IN state
         if (currentMiv.state === "IN") {
           try {
-            await api.updateMivState(currentMiv.id, {
-              state: "PENDING" as const,
-            });
+            await api.markMivAsRead(currentMiv.id, currentDeskId);
             // Update local state to reflect the change
             const updatedMiv = { ...currentMiv, state: "PENDING" as const };
             setSelectedMiv(updatedMiv);
@@ -155,6 +155,7 @@ function MivDetailWithContext({
       state: "SENT" as any,
       created_at: new Date().toISOString(),
       is_encrypted: false,
+      is_verified: false,
       is_ack: false,
       is_forgotten: false,
       font_family: currentDesk?.font_family,
@@ -210,6 +211,7 @@ function MivDetailWithContext({
       state: "SENT" as any,
       created_at: new Date().toISOString(),
       is_encrypted: false,
+      is_verified: false,
       is_ack: true,
       is_forgotten: false,
       font_family: currentDesk?.font_family,
@@ -442,6 +444,7 @@ function MivDetailWithContext({
                   <span className="epistle-field-value">
                     Message #{selectedMiv.seq_no}
                   </span>
+                  <SignatureBadge miv={selectedMiv} />
                 </div>
               </div>
             </div>
@@ -454,7 +457,7 @@ function MivDetailWithContext({
             {/* Body content */}
             <div className="epistle-body">
               {selectedMiv.is_ack && <span className="ack-badge">[ACK] </span>}
-              <div
+              <MivBody
                 className={`epistle-content ${
                   currentDesk?.auto_indent ? "auto-indent" : ""
                 }`}
@@ -462,7 +465,8 @@ function MivDetailWithContext({
                   fontFamily: selectedMiv.font_family || "Georgia, serif",
                   fontSize: selectedMiv.font_size || "14px",
                 }}
-                dangerouslySetInnerHTML={{ __html: atob(selectedMiv.body) }}
+                html={atob(selectedMiv.body)}
+                deskId={currentDeskId}
               />
             </div>
           </div>
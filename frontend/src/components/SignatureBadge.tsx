@@ -0,0 +1,46 @@
+import React, { useEffect, useState } from 'react';
+import { ConversationMiv } from '../types';
+import { checkMivSignature, SignatureStatus } from '../utils/mivSignature';
+import './SignatureBadge.css';
+
+interface SignatureBadgeProps {
+  miv: ConversationMiv;
+}
+
+const LABELS: Record<SignatureStatus, { text: string; title: string }> = {
+  verified: { text: 'Signed', title: "Signature checked in this browser against the sender's published key" },
+  invalid: { text: 'Signature invalid', title: 'This miv was not signed by the desk it claims to be from, or was changed since' },
+  unsigned: { text: 'Unsigned', title: 'The sender did not sign this miv' },
+  unknown: { text: 'Signature unchecked', title: "The sender's key could not be checked in this browser" },
+};
+
+// SignatureBadge checks a miv's signature in the browser rather than
+// trusting the server's is_verified flag
+function SignatureBadge({ miv }: SignatureBadgeProps) {
+  const [status, setStatus] = useState<SignatureStatus | null>(null);
+
+  useEffect(() => {
+    let cancelled = false;
+    setStatus(null);
+    checkMivSignature(miv).then((checked) => {
+      if (!cancelled) {
+        setStatus(checked);
+      }
+    });
+    return () => {
+      cancelled = true;
+    };
+  }, [miv]);
+
+  if (!status) {
+    return null;
+  }
+  const label = LABELS[status];
+  return (
+    <span className={`signature-badge signature-${status}`} title={label.title}>
+      {label.text}
+    </span>
+  );
+}
+
+export default SignatureBadge;
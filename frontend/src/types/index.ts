@@ -4,9 +4,10 @@ export type MivState =
   | "SENT"
   | "OUT"
   | "UNANSWERED"
-  | "ARCHIVED";
+  | "ARCHIVED"
+  | "SCHEDULED";
 
-export type NotificationType = "READ_RECEIPT" | "NEW_MIV" | "REPLY";
+export type NotificationType = "READ_RECEIPT" | "NEW_MIV" | "REPLY" | "FOLLOW_UP_DUE";
 
 export interface Miv {
   id: string;
@@ -57,6 +58,8 @@ export interface Desk {
   id: string;
   account_id: string;
   public_key: string;
+  signing_key: string;
+  key_version: number;
   name: string;
   created_at: string;
   auto_indent: boolean;
@@ -64,6 +67,7 @@ export interface Desk {
   font_size: string;
   default_salutation: string;
   default_closure: string;
+  disable_read_receipts: boolean;
 }
 
 export interface RegisterRequest {
@@ -73,6 +77,8 @@ export interface RegisterRequest {
   birthday: string;
   first_pet_name: string;
   mother_maiden: string;
+  public_key?: string; // Client-generated Curve25519 public key (base64)
+  signing_key?: string; // Client-generated Ed25519 public key (base64), required with public_key
 }
 
 export interface LoginRequest {
@@ -87,6 +93,8 @@ export interface LoginResponse {
 
 export interface CreateDeskRequest {
   name: string;
+  public_key?: string; // Client-generated Curve25519 public key (base64)
+  signing_key?: string; // Client-generated Ed25519 public key (base64), required with public_key
 }
 
 export interface SwitchDeskRequest {
@@ -100,6 +108,7 @@ export interface UpdateDeskRequest {
   font_size?: string;
   default_salutation?: string;
   default_closure?: string;
+  disable_read_receipts?: boolean;
 }
 
 export interface RecoverPasswordRequest {
@@ -119,7 +128,42 @@ export interface Conversation {
   created_at: string;
   updated_at: string;
   miv_count: number;
+  is_archived: boolean; // Whether the requesting desk has archived it
+  participants: ConversationParticipant[];
+}
+
+// The requesting desk's own view of a conversation
+export interface ConversationState {
+  conversation_id: string;
+  desk_id: string;
   is_archived: boolean;
+  is_muted: boolean;
+  is_pinned: boolean;
+  last_read_seq: number;
+  basket: MivState | "";
+  updated_at: string;
+}
+
+export interface UpdateConversationStateRequest {
+  is_archived?: boolean;
+  is_muted?: boolean;
+  is_pinned?: boolean;
+}
+
+export type ParticipantRole = "to" | "cc";
+
+export interface ConversationParticipant {
+  desk_id: string;
+  role: ParticipantRole;
+  joined_at: string;
+}
+
+export interface MivRecipient {
+  desk_id: string;
+  role: ParticipantRole;
+  body?: string; // Sealed copy for this recipient; empty for the miv's own to desk
+  key_version: number;
+  read_at?: string;
 }
 
 export interface ConversationMiv {
@@ -136,41 +180,245 @@ export interface ConversationMiv {
   received_at?: string;
   read_at?: string;
   is_encrypted: boolean;
+  sender_key_version?: number; // Sender key version the miv was signed with
+  signature?: string;
+  is_verified: boolean; // Signature checks out against the sender's signing key
+  signed_body?: string; // Stored body the signature covers, when body is this desk's copy or was opened
   is_ack: boolean;
   is_forgotten: boolean;
   font_family?: string;
   font_size?: string;
+  reply_by?: string; // When the sender expects a reply by
+  follow_up_at?: string; // When the sender was reminded; shown to the sender only
+  recipients?: MivRecipient[];
+  attachments?: Attachment[];
 }
 
 export interface CreateConversationRequest {
-  to: string;
+  conversation_id?: string; // Chosen by the client and covered by the first miv's signature
+  to: string; // Comma-separated desk IDs; the first is the miv's to desk
+  cc?: string; // Comma-separated desk IDs
   subject: string;
   body: string;
+  is_encrypted?: boolean; // Body is already sealed to the recipient (base64 NaCl box)
+  signature?: string; // Client signature over the sealed miv
+  bodies?: Record<string, string>; // Client-sealed copies for the other recipients, keyed by desk ID
   font_family?: string;
   font_size?: string;
+  send_at?: string; // RFC 3339; holds the miv back and the server answers with a ScheduledMiv
+  draft_id?: string; // Draft this miv is sent from; deleted once sent
+  draft_version?: number; // Version of the draft being sent; required with draft_id
+  reply_by?: string; // RFC 3339; the sender is reminded if no reply has come by then
+  attachment_ids?: string[]; // Attachments to send or link, every one the body links
 }
 
 export interface ReplyToConversationRequest {
   body: string;
   is_ack?: boolean;
+  is_encrypted?: boolean;
+  seq_no?: number; // Sequence number the client signed
+  signature?: string;
+  bodies?: Record<string, string>;
   font_family?: string;
   font_size?: string;
+  send_at?: string; // RFC 3339; holds the miv back and the server answers with a ScheduledMiv
+  draft_id?: string; // Draft this miv is sent from; deleted once sent
+  draft_version?: number; // Version of the draft being sent; required with draft_id
+  reply_by?: string; // RFC 3339; not for ACKs
+  attachment_ids?: string[]; // Attachments to send or link, every one the body links
 }
 
 export interface ConversationWithLatest {
   conversation: Conversation;
   latest_miv?: ConversationMiv;
   unread_count: number;
+  state: ConversationState;
 }
 
 export interface ListConversationsResponse {
   conversations: ConversationWithLatest[];
-  total: number;
+  total: number; // Conversations in this page
+  next_cursor?: string; // Set when more conversations follow
+}
+
+// Paging and filters for list endpoints; filters apply where the list supports them
+export interface ListOptions {
+  limit?: number;
+  cursor?: string;
+  unread_only?: boolean;
+  archived?: boolean;
+  counterpart?: string;
+  since?: string; // RFC 3339
+  until?: string; // RFC 3339, exclusive
 }
 
 export interface GetConversationResponse {
   conversation: Conversation;
   mivs: ConversationMiv[];
+  state: ConversationState;
+}
+
+export interface BasketResponse {
+  basket: MivState;
+  mivs: ConversationMiv[];
+  total: number;
+}
+
+// Attachment types
+
+export interface Attachment {
+  id: string;
+  desk_id: string; // Uploading desk
+  conversation_id?: string; // Set once sent
+  miv_id?: string; // Set once sent
+  filename: string;
+  content_type: string;
+  size: number; // Bytes as stored, encrypted
+  checksum: string; // Hex SHA-256 of the encrypted file
+  url?: string; // Download URL of the encrypted file; needs the session token
+  key?: string; // File key of an upload the server encrypted; only in the upload response
+  width?: number; // Pixels across, for images the server re-encoded
+  height?: number; // Pixels down, for images the server re-encoded
+  thumbnails?: Thumbnail[]; // Smallest first; only for images the server re-encoded
+  created_at: string;
+}
+
+export interface Thumbnail {
+  name: "small" | "medium" | "large";
+  content_type: string;
+  width: number;
+  height: number;
+  size: number; // Bytes as stored, encrypted under the attachment's file key
+  url?: string; // Download URL; carries the file key in the upload response
+}
+
+export interface ListAttachmentsResponse {
+  attachments: Attachment[];
+  total: number;
+  used: number; // Bytes counted against the quota
+  quota: number; // Bytes each desk may upload
+}
+
+// Scheduled send types
+
+export interface ScheduledMiv {
+  id: string; // Also the delivered miv's ID
+  desk_id: string;
+  conversation_id?: string; // Set for a reply
+  new_conversation_id?: string; // ID a client-signed miv starting a conversation is signed over
+  to?: string;
+  cc?: string;
+  subject?: string;
+  body: string; // Base64 encoded, or still sealed when is_encrypted
+  bodies?: Record<string, string>; // Client-sealed copies for the other recipients
+  is_encrypted: boolean; // Sealed by the client and delivered as stored
+  key_version?: number;
+  key_versions?: Record<string, number>;
+  seq_no?: number; // Sequence number a client-signed reply is signed over
+  signature?: string;
+  is_ack: boolean;
+  font_family?: string;
+  font_size?: string;
+  send_at: string;
+  reply_by?: string;
+  attachment_ids?: string[];
+  state: MivState; // Always SCHEDULED
+  error?: string; // Why delivery failed; cleared by an edit
+  created_at: string;
+  updated_at: string;
+}
+
+export interface UpdateScheduledMivRequest {
+  to?: string;
+  cc?: string;
+  subject?: string;
+  body?: string; // Replaces the body along with the sealing fields below
+  bodies?: Record<string, string>;
+  is_encrypted?: boolean;
+  key_version?: number;
+  key_versions?: Record<string, number>;
+  seq_no?: number;
+  signature?: string;
+  send_at?: string;
+  reply_by?: string;
+  attachment_ids?: string[]; // Replaces the pending attachments
+  font_family?: string;
+  font_size?: string;
+}
+
+export interface ListScheduledMivsResponse {
+  scheduled: ScheduledMiv[];
+  total: number;
+}
+
+// Draft types
+
+export interface Draft {
+  id: string;
+  desk_id: string;
+  conversation_id?: string; // Set for a reply draft
+  to?: string;
+  cc?: string;
+  subject?: string;
+  body: string; // Sealed to the desk's own key when is_encrypted
+  is_encrypted: boolean;
+  key_version?: number; // Desk key version a sealed body is sealed to
+  is_ack: boolean;
+  font_family?: string;
+  font_size?: string;
+  version: number; // Send back with the next save
+  created_at: string;
+  updated_at: string;
+}
+
+export interface CreateDraftRequest {
+  conversation_id?: string;
+  to?: string;
+  cc?: string;
+  subject?: string;
+  body: string;
+  is_encrypted?: boolean; // Required for desks that hold their own keys
+  key_version?: number; // Desk key version the sealed body is sealed to
+  is_ack?: boolean;
+  font_family?: string;
+  font_size?: string;
+}
+
+export interface UpdateDraftRequest {
+  version: number; // Version the editor loaded; a newer save gets 409
+  to?: string;
+  cc?: string;
+  subject?: string;
+  body: string;
+  is_encrypted?: boolean; // Required for desks that hold their own keys
+  key_version?: number; // Desk key version the sealed body is sealed to
+  is_ack?: boolean;
+  font_family?: string;
+  font_size?: string;
+}
+
+export interface ListDraftsResponse {
+  drafts: Draft[];
+  total: number;
+}
+
+// Search types
+
+export interface SearchResult {
+  conversation_id: string;
+  miv_id: string;
+  seq_no: number;
+  subject: string;
+  snippet: string; // HTML-escaped, with matches wrapped in <mark>
+  score: number;
+  created_at: string;
+}
+
+export interface SearchResponse {
+  query: string;
+  results: SearchResult[];
+  total: number;
+  sealed_bodies: number; // Mivs whose bodies the server could not search; search them on the client
 }
 
 // Notification types
@@ -185,12 +433,55 @@ export interface Notification {
   read: boolean;
   created_at: string;
   read_at?: string;
+  miv_read_at?: string;
+}
+
+export type EventType = "notification" | "notification_read" | "conversation" | "miv_read" | "reset";
+
+export interface DeskKey {
+  desk_id: string;
+  version: number;
+  public_key: string; // Curve25519 public key (base64)
+  signing_key?: string; // Ed25519 public key (base64)
+  fingerprint?: string;
+  created_at: string;
+  retired_at?: string;
+}
+
+export interface DeskPublicKeyResponse {
+  desk_id: string;
+  public_key: string;
+  signing_key: string;
+  key_version: number;
+  fingerprint: string;
+  keys: DeskKey[]; // Every key version, oldest first
+}
+
+export interface TicketResponse {
+  ticket: string;
+  path: string;
+  expires_at: string;
+}
+
+export interface ConversationEvent {
+  conversation_id: string;
+  action: "miv_created" | "miv_updated" | "updated" | "state";
+  miv_id?: string;
+  seq_no?: number;
+}
+
+export interface MivReadEvent {
+  conversation_id: string;
+  miv_id: string;
+  desk_id: string;
+  read_at: string;
 }
 
 export interface ListNotificationsResponse {
   notifications: Notification[];
-  unread_count: number;
-  total: number;
+  unread_count: number; // Across all of the desk's notifications
+  total: number; // Notifications in this page
+  next_cursor?: string;
 }
 
 // Contact types
@@ -206,6 +497,10 @@ export interface Contact {
   notes: string;
   created_at: string;
   updated_at: string;
+  pinned_fingerprint?: string; // Fingerprint the user verified out of band
+  pinned_at?: string;
+  current_fingerprint?: string;
+  key_changed: boolean; // Contact's keys no longer match the pinned fingerprint
 }
 
 export interface CreateContactRequest {
@@ -228,5 +523,6 @@ export interface UpdateContactRequest {
 
 export interface ListContactsResponse {
   contacts: Contact[];
-  total: number;
+  total: number; // Contacts in this page
+  next_cursor?: string;
 }
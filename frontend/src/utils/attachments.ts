@@ -0,0 +1,64 @@
+import { downloadAttachment } from '../api/client';
+import { decryptFile } from './fileCrypto';
+
+// Attachment download links look like .../api/attachments/<id>/download#key=<file key>,
+// with ?thumbnail=<name> for a thumbnail
+const DOWNLOAD_LINK = /\/api\/attachments\/([A-Za-z0-9-]+)\/download/g;
+const ENCRYPTED_LINK = /\/api\/attachments\/([A-Za-z0-9-]+)\/download(?:\?thumbnail=([a-z]+))?[^#]*#key=([A-Za-z0-9_-]+)/;
+
+/**
+ * Find the attachments a body embeds, such as images added in the editor,
+ * so they can be sent with the miv
+ * @param html - Miv body HTML
+ * @returns Attachment IDs, each listed once
+ */
+export function embeddedAttachmentIDs(html: string): string[] {
+  const ids: string[] = [];
+  html.replace(DOWNLOAD_LINK, (link, id: string) => {
+    if (!ids.includes(id)) {
+      ids.push(id);
+    }
+    return link;
+  });
+  return ids;
+}
+
+/**
+ * Download and decrypt the attachments embedded in a rendered miv body,
+ * pointing each image and link at the plaintext. The server only hands out
+ * ciphertext; the file key comes from the link's #key= fragment, which is
+ * part of the sealed body and never sent to the server.
+ * @param container - Element the body is rendered in
+ * @param deskId - Desk viewing the miv
+ * @returns Cleanup that releases the decrypted files
+ */
+export function openEmbeddedAttachments(container: HTMLElement, deskId: string): () => void {
+  let cancelled = false;
+  const objectURLs: string[] = [];
+
+  const open = async (element: Element, attribute: 'src' | 'href') => {
+    const match = ENCRYPTED_LINK.exec(element.getAttribute(attribute) || '');
+    if (!match) {
+      return;
+    }
+    try {
+      const plain = await decryptFile(await downloadAttachment(match[1], deskId, match[2]), match[3]);
+      if (cancelled) {
+        return;
+      }
+      const url = URL.createObjectURL(new Blob([plain]));
+      objectURLs.push(url);
+      element.setAttribute(attribute, url);
+    } catch (err) {
+      console.error('Failed to open attachment:', err);
+    }
+  };
+
+  container.querySelectorAll('img').forEach((img) => open(img, 'src'));
+  container.querySelectorAll('a').forEach((a) => open(a, 'href'));
+
+  return () => {
+    cancelled = true;
+    objectURLs.forEach((url) => URL.revokeObjectURL(url));
+  };
+}
@@ -1,6 +1,8 @@
 /**
  * Custom upload adapter for CKEditor 5
- * Handles image uploads to the server via /api/upload endpoint
+ * Handles image uploads to the server via /api/upload endpoint. The server
+ * stores the image encrypted and answers with a download URL whose #key=
+ * fragment carries the file key, so the key is sealed into the miv body.
  * 
  * Note: Uses 'any' types for CKEditor loader and editor as these are internal
  * CKEditor types that are not properly exported in the build-classic package.
@@ -10,6 +12,30 @@
 const API_BASE_URL = process.env.REACT_APP_API_URL || 'http://localhost:8080/api';
 const UPLOAD_URL = `${API_BASE_URL}/upload`;
 
+// Magic bytes of the image types the editor may upload. The server hands out
+// only ciphertext, so checking that a file is what it claims to be is up to
+// the clients on both ends.
+const IMAGE_SIGNATURES: Record<string, number[]> = {
+  "image/jpeg": [0xff, 0xd8, 0xff],
+  "image/png": [0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a],
+  "image/gif": [0x47, 0x49, 0x46, 0x38],
+  "image/webp": [0x52, 0x49, 0x46, 0x46],
+};
+
+/**
+ * Check that a file starts with the magic bytes of its declared image type
+ * @param file - File picked in the editor
+ * @returns Whether the file looks like the image it claims to be
+ */
+async function matchesImageSignature(file: File): Promise<boolean> {
+  const signature = IMAGE_SIGNATURES[file.type];
+  if (!signature) {
+    return false;
+  }
+  const header = new Uint8Array(await file.slice(0, signature.length).arrayBuffer());
+  return signature.every((byte, i) => header[i] === byte);
+}
+
 class UploadAdapter {
   private loader: any; // CKEditor FileLoader - type not exported
   private xhr: XMLHttpRequest | null = null;
@@ -22,9 +48,14 @@ class UploadAdapter {
     return this.loader.file.then(
       (file: File) =>
         new Promise((resolve, reject) => {
-          this._initRequest();
-          this._initListeners(resolve, reject, file);
-          this._sendRequest(file);
+          matchesImageSignature(file).then((ok) => {
+            if (!ok) {
+              return reject(`${file.name} is not a JPEG, PNG, GIF or WebP image.`);
+            }
+            this._initRequest();
+            this._initListeners(resolve, reject, file);
+            this._sendRequest(file);
+          }, reject);
         })
     );
   }
@@ -40,6 +71,12 @@ class UploadAdapter {
     // Upload to the configured backend URL
     xhr.open("POST", UPLOAD_URL, true);
     xhr.responseType = "json";
+
+    // Authenticate with the session token saved at login
+    const token = localStorage.getItem("token");
+    if (token) {
+      xhr.setRequestHeader("Authorization", `Bearer ${token}`);
+    }
   }
 
   private _initListeners(
@@ -62,7 +99,7 @@ class UploadAdapter {
         );
       }
 
-      // Expected response format: { url: "http://example.com/uploaded-image.jpg" }
+      // Expected response format: { url: "http://example.com/api/attachments/att-1/download#key=..." }
       resolve({
         default: response.url,
       });
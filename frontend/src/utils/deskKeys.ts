@@ -0,0 +1,98 @@
+/**
+ * Desk keys generated and kept in the browser, for desks whose private keys
+ * the server never holds (MISSIV_KEY_CUSTODY=client on the backend, or any
+ * desk created with its own public keys).
+ *
+ * A desk has a Curve25519 (X25519) key that bodies are sealed to and an
+ * Ed25519 key that its mivs are signed with. Only the raw 32-byte public
+ * keys, base64 encoded, are sent to the server; the key pairs stay in this
+ * browser's IndexedDB, by desk ID and key version.
+ */
+
+export interface DeskKeyPairs {
+  box: CryptoKeyPair; // X25519
+  signing: CryptoKeyPair; // Ed25519
+}
+
+export interface GeneratedDeskKeys {
+  publicKey: string; // Base64 X25519 public key, for public_key
+  signingKey: string; // Base64 Ed25519 public key, for signing_key
+  keys: DeskKeyPairs;
+}
+
+const DB_NAME = 'missiv-keys';
+const STORE = 'desk-keys';
+
+function encodeBase64(data: ArrayBuffer): string {
+  let binary = '';
+  new Uint8Array(data).forEach((b) => {
+    binary += String.fromCharCode(b);
+  });
+  return btoa(binary);
+}
+
+/**
+ * Generate a desk's key pairs. The private keys are extractable so they can
+ * be wrapped into a key backup.
+ * @returns The public keys to upload and the key pairs to keep
+ */
+export async function generateDeskKeys(): Promise<GeneratedDeskKeys> {
+  let box: CryptoKeyPair;
+  let signing: CryptoKeyPair;
+  try {
+    box = (await window.crypto.subtle.generateKey({ name: 'X25519' }, true, ['deriveBits'])) as CryptoKeyPair;
+    signing = (await window.crypto.subtle.generateKey({ name: 'Ed25519' }, true, ['sign', 'verify'])) as CryptoKeyPair;
+  } catch (err) {
+    throw new Error('This browser cannot generate desk keys; use a current version of Chrome, Firefox or Safari');
+  }
+  return {
+    publicKey: encodeBase64(await window.crypto.subtle.exportKey('raw', box.publicKey)),
+    signingKey: encodeBase64(await window.crypto.subtle.exportKey('raw', signing.publicKey)),
+    keys: { box, signing },
+  };
+}
+
+function openKeyStore(): Promise<IDBDatabase> {
+  return new Promise((resolve, reject) => {
+    const request = indexedDB.open(DB_NAME, 1);
+    request.onupgradeneeded = () => {
+      request.result.createObjectStore(STORE);
+    };
+    request.onsuccess = () => resolve(request.result);
+    request.onerror = () => reject(request.error);
+  });
+}
+
+async function withKeyStore<T>(mode: IDBTransactionMode, use: (store: IDBObjectStore) => IDBRequest): Promise<T> {
+  const db = await openKeyStore();
+  try {
+    return await new Promise<T>((resolve, reject) => {
+      const request = use(db.transaction(STORE, mode).objectStore(STORE));
+      request.onsuccess = () => resolve(request.result as T);
+      request.onerror = () => reject(request.error);
+    });
+  } finally {
+    db.close();
+  }
+}
+
+function storeKey(deskId: string, version: number): string {
+  return `${deskId.replace(/[^0-9]/g, '')}/${version}`;
+}
+
+/**
+ * Keep a desk's key pairs in this browser
+ * @param deskId - Desk the keys were uploaded for
+ * @param version - Key version the server assigned them
+ */
+export async function saveDeskKeys(deskId: string, version: number, keys: DeskKeyPairs): Promise<void> {
+  await withKeyStore<IDBValidKey>('readwrite', (store) => store.put(keys, storeKey(deskId, version)));
+}
+
+/**
+ * Look up a desk's key pairs kept in this browser
+ * @returns undefined when this browser does not hold them
+ */
+export async function loadDeskKeys(deskId: string, version: number): Promise<DeskKeyPairs | undefined> {
+  return withKeyStore<DeskKeyPairs | undefined>('readonly', (store) => store.get(storeKey(deskId, version)));
+}
@@ -0,0 +1,78 @@
+/**
+ * Decryption of attachments encrypted by the server or a client.
+ *
+ * Files are sealed with AES-256-GCM in 64 KiB chunks, in the layout of the
+ * backend's crypto.NewFileEncrypter:
+ *   "MVF1" | 7-byte nonce prefix | chunk | chunk | ...
+ * Each chunk's nonce is the prefix, the chunk index (4 bytes, big-endian)
+ * and a flag set only on the last chunk; the header is associated data.
+ */
+
+const MAGIC = 'MVF1';
+const NONCE_PREFIX = 7;
+const HEADER_SIZE = MAGIC.length + NONCE_PREFIX;
+const CHUNK_SIZE = 64 * 1024;
+const TAG_SIZE = 16;
+const SEALED_CHUNK = CHUNK_SIZE + TAG_SIZE;
+
+/**
+ * Decode a file key from the unpadded base64url form it travels in
+ * @param key - File key, as in the #key= fragment of a download URL
+ * @returns The raw 32-byte key
+ */
+export function decodeFileKey(key: string): Uint8Array {
+  const base64 = key.replace(/-/g, '+').replace(/_/g, '/');
+  const binary = atob(base64 + '='.repeat((4 - (base64.length % 4)) % 4));
+  const bytes = new Uint8Array(binary.length);
+  for (let i = 0; i < binary.length; i++) {
+    bytes[i] = binary.charCodeAt(i);
+  }
+  if (bytes.length !== 32) {
+    throw new Error('Invalid file key');
+  }
+  return bytes;
+}
+
+/**
+ * Decrypt an encrypted attachment
+ * @param data - Encrypted file as downloaded
+ * @param key - File key, unpadded base64url
+ * @returns The plaintext; rejects if the file was tampered with or the key is wrong
+ */
+export async function decryptFile(data: ArrayBuffer, key: string): Promise<ArrayBuffer> {
+  const bytes = new Uint8Array(data);
+  const header = bytes.subarray(0, HEADER_SIZE);
+  let magic = '';
+  for (let i = 0; i < MAGIC.length && i < bytes.length; i++) {
+    magic += String.fromCharCode(bytes[i]);
+  }
+  if (bytes.length < HEADER_SIZE + TAG_SIZE || magic !== MAGIC) {
+    throw new Error('Invalid encrypted file');
+  }
+
+  const cryptoKey = await window.crypto.subtle.importKey('raw', decodeFileKey(key), 'AES-GCM', false, ['decrypt']);
+  const plain = new Uint8Array(bytes.length - HEADER_SIZE);
+  let written = 0;
+  for (let offset = HEADER_SIZE, index = 0; ; offset += SEALED_CHUNK, index++) {
+    // A chunk that reaches the end of the file is the final one
+    const final = bytes.length - offset <= SEALED_CHUNK;
+    const chunk = bytes.subarray(offset, final ? bytes.length : offset + SEALED_CHUNK);
+
+    const nonce = new Uint8Array(12);
+    nonce.set(header.subarray(MAGIC.length));
+    new DataView(nonce.buffer).setUint32(NONCE_PREFIX, index);
+    nonce[11] = final ? 1 : 0;
+
+    const opened = await window.crypto.subtle.decrypt(
+      { name: 'AES-GCM', iv: nonce, additionalData: header, tagLength: TAG_SIZE * 8 },
+      cryptoKey,
+      chunk
+    );
+    plain.set(new Uint8Array(opened), written);
+    written += opened.byteLength;
+    if (final) {
+      break;
+    }
+  }
+  return plain.buffer.slice(0, written);
+}
@@ -0,0 +1,124 @@
+/**
+ * Verification of miv signatures in the browser, so a miv's sender is
+ * checked against the key directory rather than taken on the server's word.
+ *
+ * Signatures are Ed25519 over the payload built by the backend's
+ * crypto.SignedMivFields.Payload: the JSON array
+ *   ["missiv-miv-v1", conversation ID, seq no, from, to, subject, body hash]
+ * with desk IDs reduced to digits and the hex SHA-256 of the stored body,
+ * followed by [role, desk ID, body hash] entries sorted by desk ID when the
+ * miv has recipients past its to desk, and by "ack" for ACKs.
+ */
+
+import { getDeskPublicKey } from '../api/client';
+import { ConversationMiv, DeskPublicKeyResponse } from '../types';
+
+export type SignatureStatus = 'verified' | 'invalid' | 'unsigned' | 'unknown';
+
+// Key directory entries already fetched, by normalized desk ID
+const directory = new Map<string, Promise<DeskPublicKeyResponse>>();
+
+export function normalizeDeskID(id: string): string {
+  return id.replace(/[^0-9]/g, '');
+}
+
+// goJSON encodes like Go's encoding/json, which also escapes <, > and & and
+// the line and paragraph separators inside strings
+function goJSON(value: unknown): string {
+  return JSON.stringify(value).replace(
+    /[<>&\u2028\u2029]/g,
+    (c) => '\\u' + c.charCodeAt(0).toString(16).padStart(4, '0')
+  );
+}
+
+async function hashBody(body: string): Promise<string> {
+  const digest = await window.crypto.subtle.digest('SHA-256', new TextEncoder().encode(body));
+  return Array.from(new Uint8Array(digest), (b) => b.toString(16).padStart(2, '0')).join('');
+}
+
+function decodeBase64(value: string): Uint8Array {
+  const binary = atob(value);
+  const bytes = new Uint8Array(binary.length);
+  for (let i = 0; i < binary.length; i++) {
+    bytes[i] = binary.charCodeAt(i);
+  }
+  return bytes;
+}
+
+/**
+ * Build the canonical bytes a miv's signature covers
+ * @param miv - Miv as served; signed_body, when set, is the body that was signed
+ * @returns The UTF-8 payload
+ */
+export async function signedPayload(miv: ConversationMiv): Promise<Uint8Array> {
+  const fields: unknown[] = [
+    'missiv-miv-v1',
+    miv.conversation_id,
+    miv.seq_no,
+    normalizeDeskID(miv.from),
+    normalizeDeskID(miv.to),
+    miv.subject,
+    await hashBody(miv.signed_body || miv.body),
+  ];
+
+  const copies: string[][] = [];
+  for (const r of (miv.recipients || []).slice(1)) {
+    copies.push([r.role, normalizeDeskID(r.desk_id), await hashBody(r.body || '')]);
+  }
+  if (copies.length > 0) {
+    copies.sort((a, b) => (a[1] < b[1] ? -1 : a[1] > b[1] ? 1 : 0));
+    fields.push(copies);
+  }
+  if (miv.is_ack) {
+    fields.push('ack');
+  }
+  return new TextEncoder().encode(goJSON(fields));
+}
+
+/**
+ * Check a miv's signature against a signing key
+ * @param miv - Miv as served
+ * @param signingKey - Sender's Ed25519 public key (base64) for the miv's key version
+ * @returns Whether the signature is valid; rejects if the browser lacks Ed25519
+ */
+export async function verifyMivSignature(miv: ConversationMiv, signingKey: string): Promise<boolean> {
+  if (!miv.signature) {
+    return false;
+  }
+  const key = await window.crypto.subtle.importKey('raw', decodeBase64(signingKey), { name: 'Ed25519' }, false, ['verify']);
+  return window.crypto.subtle.verify({ name: 'Ed25519' }, key, decodeBase64(miv.signature), await signedPayload(miv));
+}
+
+/**
+ * Check a miv's signature against the sender's key for the version it was
+ * sent with, as published in the key directory
+ * @param miv - Miv as served
+ * @returns 'unknown' when the key or Ed25519 support is unavailable
+ */
+export async function checkMivSignature(miv: ConversationMiv): Promise<SignatureStatus> {
+  if (!miv.signature) {
+    return 'unsigned';
+  }
+
+  const deskID = normalizeDeskID(miv.from);
+  let entry = directory.get(deskID);
+  if (!entry) {
+    entry = getDeskPublicKey(miv.from);
+    directory.set(deskID, entry);
+  }
+  try {
+    const published = await entry;
+    const version = miv.sender_key_version || published.key_version;
+    const signingKey = published.keys.find((k) => k.version === version)?.signing_key;
+    if (!signingKey) {
+      // The desk may have rotated since it was fetched
+      directory.delete(deskID);
+      return 'unknown';
+    }
+    return (await verifyMivSignature(miv, signingKey)) ? 'verified' : 'invalid';
+  } catch (err) {
+    directory.delete(deskID);
+    console.error('Failed to check miv signature:', err);
+    return 'unknown';
+  }
+}